@@ -1,18 +1,26 @@
 package api_test
 
 import (
+	"bufio"
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
 
 	"hubproxy/internal/api"
+	"hubproxy/internal/security"
 	"hubproxy/internal/storage"
 	"hubproxy/internal/testutil"
+	"hubproxy/internal/webhook"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -36,6 +44,9 @@ func TestAPIHandler(t *testing.T) {
 			CreatedAt:  now.Add(-1 * time.Hour),
 			Repository: "test/repo-1",
 			Sender:     "user-1",
+
+			InstallationTargetType: "repository",
+			InstallationTargetID:   "1001",
 		},
 		{
 			ID:         "test-event-2",
@@ -44,6 +55,9 @@ func TestAPIHandler(t *testing.T) {
 			CreatedAt:  now.Add(-2 * time.Hour),
 			Repository: "test/repo-2",
 			Sender:     "user-2",
+
+			InstallationTargetType: "repository",
+			InstallationTargetID:   "1002",
 		},
 		{
 			ID:         "test-event-3",
@@ -52,6 +66,9 @@ func TestAPIHandler(t *testing.T) {
 			CreatedAt:  now,
 			Repository: "test/repo-1",
 			Sender:     "user-1",
+
+			InstallationTargetType: "repository",
+			InstallationTargetID:   "1001",
 		},
 	}
 
@@ -103,6 +120,48 @@ func TestAPIHandler(t *testing.T) {
 				expectedCount:  3,
 				expectedStatus: http.StatusOK,
 			},
+			{
+				name:           "Filter by ID prefix",
+				query:          "?id_prefix=test-event-",
+				expectedCount:  3,
+				expectedStatus: http.StatusOK,
+				validate: func(t *testing.T, events []*storage.Event) {
+					// Ordered by created_at
+					assert.Equal(t, "test-event-2", events[0].ID)
+					assert.Equal(t, "test-event-1", events[1].ID)
+					assert.Equal(t, "test-event-3", events[2].ID)
+				},
+			},
+			{
+				name:           "Filter by full ID as prefix",
+				query:          "?id_prefix=test-event-3",
+				expectedCount:  1,
+				expectedStatus: http.StatusOK,
+			},
+			{
+				name:           "ID prefix doesn't match mid-string",
+				query:          "?id_prefix=event-1",
+				expectedCount:  0,
+				expectedStatus: http.StatusOK,
+			},
+			{
+				name:           "ID prefix wildcards match literally",
+				query:          "?id_prefix=test_event",
+				expectedCount:  0,
+				expectedStatus: http.StatusOK,
+			},
+			{
+				name:           "Filter by installation target ID",
+				query:          "?installation_target_id=1001",
+				expectedCount:  2,
+				expectedStatus: http.StatusOK,
+				validate: func(t *testing.T, events []*storage.Event) {
+					for _, event := range events {
+						assert.Equal(t, "1001", event.InstallationTargetID)
+						assert.Equal(t, "repository", event.InstallationTargetType)
+					}
+				},
+			},
 			{
 				name:           "Pagination - first page",
 				query:          "?limit=2&offset=0",
@@ -312,6 +371,26 @@ func TestAPIHandler(t *testing.T) {
 					require.Len(t, result.Events, 1)
 				},
 			},
+			{
+				name:           "Replay by IDs",
+				handler:        handler.ReplayRange,
+				method:         http.MethodPost,
+				path:           "/api/replay?ids=test-event-2,non-existent,test-event-4",
+				expectedStatus: http.StatusOK,
+				validate: func(t *testing.T, resp *http.Response, store storage.Storage) {
+					var result struct {
+						ReplayedCount int              `json:"replayed_count"`
+						Events        []*storage.Event `json:"events"`
+					}
+					err := json.NewDecoder(resp.Body).Decode(&result)
+					require.NoError(t, err)
+
+					assert.Equal(t, 2, result.ReplayedCount)
+					require.Len(t, result.Events, 2)
+					assert.Equal(t, "test-event-2", result.Events[0].ReplayedFrom)
+					assert.Equal(t, "test-event-4", result.Events[1].ReplayedFrom)
+				},
+			},
 			{
 				name:           "Replay non-existent event",
 				handler:        handler.ReplayEvent,
@@ -357,3 +436,857 @@ func TestAPIHandler(t *testing.T) {
 		}
 	})
 }
+
+func TestForwardTargets(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	logger := slog.New(slog.NewJSONHandler(nil, nil))
+
+	attempts := webhook.NewAttemptTracker(webhook.DefaultAttemptWindow)
+	attempts.Record("http://target-a", nil)
+	attempts.Record("http://target-a", nil)
+	attempts.Record("http://target-a", errors.New("target returned 502 Bad Gateway"))
+	attempts.Record("http://target-a", nil)
+	attempts.Record("http://target-b", errors.New("connection refused"))
+
+	handler := api.NewHandler(store, logger, api.WithAttemptTracker(attempts))
+	server := httptest.NewServer(http.HandlerFunc(handler.ForwardTargets))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/forward/targets")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result struct {
+		Targets []webhook.TargetSummary `json:"targets"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	require.Len(t, result.Targets, 2)
+
+	assert.Equal(t, "http://target-a", result.Targets[0].Target)
+	assert.Equal(t, 4, result.Targets[0].Attempts)
+	assert.Equal(t, 3, result.Targets[0].Successes)
+	assert.Equal(t, 1, result.Targets[0].Failures)
+	assert.InDelta(t, 0.75, result.Targets[0].SuccessRate, 0.001)
+	assert.Equal(t, "target returned 502 Bad Gateway", result.Targets[0].LastError)
+
+	assert.Equal(t, "http://target-b", result.Targets[1].Target)
+	assert.Zero(t, result.Targets[1].SuccessRate)
+	assert.Equal(t, "connection refused", result.Targets[1].LastError)
+}
+
+func TestReplayLastFailed(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	logger := slog.New(slog.NewJSONHandler(nil, nil))
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	for _, event := range []*storage.Event{
+		{ID: "a-old-failed", Repository: "org/a", Status: storage.StatusFailed, CreatedAt: now.Add(-3 * time.Hour)},
+		{ID: "a-new-failed", Repository: "org/a", Status: storage.StatusFailed, CreatedAt: now.Add(-2 * time.Hour)},
+		{ID: "a-succeeded", Repository: "org/a", CreatedAt: now.Add(-time.Hour)},
+		{ID: "b-failed", Repository: "org/b", Status: storage.StatusFailed, CreatedAt: now.Add(-time.Hour)},
+		{ID: "c-succeeded", Repository: "org/c", CreatedAt: now},
+	} {
+		event.Type = "push"
+		event.Payload = []byte(`{"ref": "refs/heads/main"}`)
+		require.NoError(t, store.StoreEvent(ctx, event))
+	}
+
+	handler := api.NewHandler(store, logger)
+	server := httptest.NewServer(http.HandlerFunc(handler.ReplayLastFailed))
+	defer server.Close()
+
+	replayed := func(t *testing.T, query string) []string {
+		t.Helper()
+
+		resp, err := http.Post(server.URL+"/api/replay/last-failed"+query, "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var result struct {
+			ReplayedCount int              `json:"replayed_count"`
+			Events        []*storage.Event `json:"events"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Equal(t, len(result.Events), result.ReplayedCount)
+
+		var from []string
+		for _, event := range result.Events {
+			from = append(from, event.ReplayedFrom)
+		}
+		return from
+	}
+
+	t.Run("all repositories", func(t *testing.T) {
+		assert.Equal(t, []string{"a-new-failed", "b-failed"}, replayed(t, ""))
+	})
+
+	t.Run("single repository", func(t *testing.T) {
+		assert.Equal(t, []string{"b-failed"}, replayed(t, "?repository=org/b"))
+	})
+
+	t.Run("repository without failures", func(t *testing.T) {
+		resp, err := http.Post(server.URL+"/api/replay/last-failed?repository=org/c", "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestEventCurl(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	logger := slog.New(slog.NewJSONHandler(nil, nil))
+	ctx := context.Background()
+
+	payload := []byte(`{"ref":"refs/heads/main","head_commit":{"message":"it's fixed"}}`)
+	require.NoError(t, store.StoreEvent(ctx, &storage.Event{
+		ID:      "curl-event",
+		Type:    "push",
+		Payload: payload,
+		Headers: []byte(`{
+			"Content-Type": ["application/json"],
+			"Content-Length": ["64"],
+			"X-Github-Event": ["push"],
+			"X-Github-Delivery": ["curl-event"],
+			"X-Hub-Signature-256": ["sha256=original"]
+		}`),
+		CreatedAt: time.Now(),
+	}))
+
+	handler := api.NewHandler(store, logger)
+	get := func(t *testing.T, path string, secret string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if secret != "" {
+			req.Header.Set("X-Webhook-Secret", secret)
+		}
+		rec := httptest.NewRecorder()
+		handler.EventCurl(rec, req)
+		return rec
+	}
+
+	t.Run("curl script", func(t *testing.T) {
+		rec := get(t, "/api/events/curl-event/curl?target=http://localhost:3000/webhook", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		script := rec.Body.String()
+
+		assert.True(t, strings.HasPrefix(script, "#!/bin/sh\n"))
+		assert.Contains(t, script, "curl -sS -X POST 'http://localhost:3000/webhook'")
+		assert.Contains(t, script, "-H 'Content-Type: application/json'")
+		assert.Contains(t, script, "-H 'X-Github-Event: push'")
+		assert.Contains(t, script, "-H 'X-Github-Delivery: curl-event'")
+		assert.Contains(t, script, "-H 'X-Hub-Signature-256: sha256=original'")
+		assert.NotContains(t, script, "Content-Length")
+		assert.Contains(t, script, `--data-binary '{"ref":"refs/heads/main","head_commit":{"message":"it'\''s fixed"}}'`)
+	})
+
+	t.Run("defaults to TARGET_URL", func(t *testing.T) {
+		rec := get(t, "/api/events/curl-event/curl", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"${TARGET_URL:?`)
+	})
+
+	t.Run("secret re-signs the payload", func(t *testing.T) {
+		rec := get(t, "/api/events/curl-event/curl", "new-secret")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "-H 'X-Hub-Signature-256: "+security.GenerateSignature(payload, "new-secret")+"'")
+		assert.NotContains(t, rec.Body.String(), "sha256=original")
+	})
+
+	t.Run("raw HTTP request", func(t *testing.T) {
+		rec := get(t, "/api/events/curl-event/curl?format=http&target=http://example.com/hook", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "message/http", rec.Header().Get("Content-Type"))
+
+		req, err := http.ReadRequest(bufio.NewReader(rec.Body))
+		require.NoError(t, err)
+		assert.Equal(t, "/hook", req.URL.Path)
+		assert.Equal(t, "example.com", req.Host)
+		assert.Equal(t, "push", req.Header.Get("X-GitHub-Event"))
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, payload, body)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, get(t, "/api/events/missing/curl", "").Code)
+		assert.Equal(t, http.StatusBadRequest, get(t, "/api/events/curl-event/curl?format=xml", "").Code)
+		assert.Equal(t, http.StatusBadRequest, get(t, "/api/events/curl-event/curl?target=ftp://host", "").Code)
+	})
+}
+
+func TestRequeueEvent(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	logger := slog.New(slog.NewJSONHandler(nil, nil))
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	for _, event := range []*storage.Event{
+		{ID: "failed", Status: storage.StatusFailed, CreatedAt: now.Add(-time.Hour)},
+		{ID: "pending", CreatedAt: now},
+	} {
+		event.Type = "push"
+		event.Payload = []byte(`{"ref": "refs/heads/main"}`)
+		require.NoError(t, store.StoreEvent(ctx, event))
+	}
+
+	handler := api.NewHandler(store, logger)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/events", handler.ListEvents)
+	mux.HandleFunc("POST /api/events/{id}/requeue", handler.RequeueEvent)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	listFailed := func(t *testing.T) []string {
+		t.Helper()
+
+		resp, err := http.Get(server.URL + "/api/events?status=failed")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var result struct {
+			Events []*storage.Event `json:"events"`
+			Total  int              `json:"total"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Equal(t, len(result.Events), result.Total)
+
+		var ids []string
+		for _, event := range result.Events {
+			ids = append(ids, event.ID)
+		}
+		return ids
+	}
+
+	requeue := func(t *testing.T, id string) int {
+		t.Helper()
+
+		resp, err := http.Post(server.URL+"/api/events/"+id+"/requeue", "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, []string{"failed"}, listFailed(t))
+
+	t.Run("not failed", func(t *testing.T) {
+		assert.Equal(t, http.StatusConflict, requeue(t, "pending"))
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, requeue(t, "missing"))
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, requeue(t, "failed"))
+		assert.Empty(t, listFailed(t))
+
+		pending, _, err := store.ListEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true})
+		require.NoError(t, err)
+		assert.Len(t, pending, 2)
+	})
+}
+
+func TestDeleteEvent(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	logger := slog.New(slog.NewJSONHandler(nil, nil))
+	ctx := context.Background()
+
+	require.NoError(t, store.StoreEvent(ctx, &storage.Event{
+		ID:        "doomed",
+		Type:      "push",
+		Payload:   []byte(`{"ref": "refs/heads/main"}`),
+		CreatedAt: time.Now().UTC(),
+	}))
+
+	handler := api.NewHandler(store, logger)
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /api/events/{id}", handler.DeleteEvent)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	deleteEvent := func(t *testing.T, id string) int {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodDelete, server.URL+"/api/events/"+id, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusNoContent, deleteEvent(t, "doomed"))
+	event, err := store.GetEvent(ctx, "doomed")
+	require.NoError(t, err)
+	assert.Nil(t, event)
+
+	assert.Equal(t, http.StatusNotFound, deleteEvent(t, "doomed"))
+}
+
+func TestGetEvent(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	logger := slog.New(slog.NewJSONHandler(nil, nil))
+	ctx := context.Background()
+
+	require.NoError(t, store.StoreEvent(ctx, &storage.Event{
+		ID:         "wanted",
+		Type:       "push",
+		Payload:    []byte(`{"ref":"refs/heads/main"}`),
+		Headers:    []byte(`{"X-Github-Event":["push"]}`),
+		CreatedAt:  time.Now().UTC(),
+		Repository: "test/repo",
+	}))
+
+	handler := api.NewHandler(store, logger)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/events/{id}", handler.GetEvent)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	t.Run("found", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/api/events/wanted")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+		var event storage.Event
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&event))
+		assert.Equal(t, "wanted", event.ID)
+		assert.Equal(t, "push", event.Type)
+		assert.Equal(t, "test/repo", event.Repository)
+		assert.JSONEq(t, `{"ref":"refs/heads/main"}`, string(event.Payload))
+		assert.JSONEq(t, `{"X-Github-Event":["push"]}`, string(event.Headers))
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/api/events/missing")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("wrong method", func(t *testing.T) {
+		resp, err := http.Post(server.URL+"/api/events/wanted", "application/json", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
+
+func TestListEventsPagination(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	logger := slog.New(slog.NewJSONHandler(nil, nil))
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, store.StoreEvent(ctx, &storage.Event{
+			ID:        fmt.Sprintf("page-event-%d", i),
+			Type:      "push",
+			Payload:   []byte(`{}`),
+			CreatedAt: now.Add(time.Duration(i) * time.Minute),
+		}))
+	}
+
+	handler := api.NewHandler(store, logger)
+	server := httptest.NewServer(http.HandlerFunc(handler.ListEvents))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		offset  int
+		events  int
+		hasMore bool
+		link    string
+	}{
+		{
+			name:    "first page",
+			offset:  0,
+			events:  2,
+			hasMore: true,
+			link:    `</api/events?limit=2&offset=2&type=push>; rel="next"`,
+		},
+		{
+			name:    "middle page",
+			offset:  2,
+			events:  2,
+			hasMore: true,
+			link:    `</api/events?limit=2&offset=4&type=push>; rel="next", </api/events?limit=2&offset=0&type=push>; rel="prev"`,
+		},
+		{
+			name:    "last page",
+			offset:  4,
+			events:  1,
+			hasMore: false,
+			link:    `</api/events?limit=2&offset=2&type=push>; rel="prev"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(fmt.Sprintf("%s/api/events?type=push&limit=2&offset=%d", server.URL, tt.offset))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			var result struct {
+				Events  []*storage.Event `json:"events"`
+				Total   int              `json:"total"`
+				Limit   int              `json:"limit"`
+				Offset  int              `json:"offset"`
+				HasMore bool             `json:"has_more"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+			assert.Len(t, result.Events, tt.events)
+			assert.Equal(t, 5, result.Total)
+			assert.Equal(t, 2, result.Limit)
+			assert.Equal(t, tt.offset, result.Offset)
+			assert.Equal(t, tt.hasMore, result.HasMore)
+			assert.Equal(t, tt.link, resp.Header.Get("Link"))
+		})
+	}
+}
+
+func TestListEventsSort(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	logger := slog.New(slog.NewJSONHandler(nil, nil))
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	for i, repository := range []string{"org/b", "org/c", "org/a"} {
+		require.NoError(t, store.StoreEvent(ctx, &storage.Event{
+			ID:         fmt.Sprintf("sort-event-%d", i),
+			Type:       "push",
+			Payload:    []byte(`{}`),
+			CreatedAt:  now.Add(time.Duration(i) * time.Minute),
+			Repository: repository,
+		}))
+	}
+
+	handler := api.NewHandler(store, logger)
+	server := httptest.NewServer(http.HandlerFunc(handler.ListEvents))
+	defer server.Close()
+
+	listRepositories := func(t *testing.T, query string) []string {
+		t.Helper()
+
+		resp, err := http.Get(server.URL + "/api/events?" + query)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var result struct {
+			Events []*storage.Event `json:"events"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		var repositories []string
+		for _, event := range result.Events {
+			repositories = append(repositories, event.Repository)
+		}
+		return repositories
+	}
+
+	assert.Equal(t, []string{"org/a", "org/b", "org/c"}, listRepositories(t, "sort=repository"))
+	assert.Equal(t, []string{"org/a", "org/b", "org/c"}, listRepositories(t, "sort=repository&order=asc"))
+	assert.Equal(t, []string{"org/c", "org/b", "org/a"}, listRepositories(t, "sort=repository&order=desc"))
+	assert.Equal(t, []string{"org/a", "org/c", "org/b"}, listRepositories(t, "order=desc"))
+
+	for _, query := range []string{"sort=payload", "sort=created_at%3BDROP+TABLE+events", "order=sideways"} {
+		resp, err := http.Get(server.URL + "/api/events?" + query)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+}
+
+func TestListEventsMultipleTypes(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	logger := slog.New(slog.NewJSONHandler(nil, nil))
+	ctx := context.Background()
+
+	for _, eventType := range []string{"push", "pull_request", "issues"} {
+		require.NoError(t, store.StoreEvent(ctx, &storage.Event{
+			ID:        "types-" + eventType,
+			Type:      eventType,
+			Payload:   []byte(`{}`),
+			CreatedAt: time.Now().UTC(),
+		}))
+	}
+
+	handler := api.NewHandler(store, logger)
+	server := httptest.NewServer(http.HandlerFunc(handler.ListEvents))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/events?type=push&type=pull_request")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result struct {
+		Events []*storage.Event `json:"events"`
+		Total  int              `json:"total"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, 2, result.Total)
+	var types []string
+	for _, event := range result.Events {
+		types = append(types, event.Type)
+	}
+	assert.ElementsMatch(t, []string{"push", "pull_request"}, types)
+}
+
+func TestGetStatsBy(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	logger := slog.New(slog.NewJSONHandler(nil, nil))
+	ctx := context.Background()
+
+	for _, event := range []*storage.Event{
+		{ID: "stats-1", Type: "push", Repository: "org/a", Sender: "alice"},
+		{ID: "stats-2", Type: "push", Repository: "org/a", Sender: "bob", Status: storage.StatusFailed},
+		{ID: "stats-3", Type: "issues", Repository: "org/b", Sender: "alice"},
+	} {
+		event.Payload = []byte(`{}`)
+		event.CreatedAt = time.Now().UTC()
+		require.NoError(t, store.StoreEvent(ctx, event))
+	}
+
+	handler := api.NewHandler(store, logger)
+	server := httptest.NewServer(http.HandlerFunc(handler.GetStats))
+	defer server.Close()
+
+	tests := []struct {
+		query    string
+		expected map[string]int64
+	}{
+		{query: "", expected: map[string]int64{"push": 2, "issues": 1}},
+		{query: "?by=type", expected: map[string]int64{"push": 2, "issues": 1}},
+		{query: "?by=repository", expected: map[string]int64{"org/a": 2, "org/b": 1}},
+		{query: "?by=sender", expected: map[string]int64{"alice": 2, "bob": 1}},
+		{query: "?by=status", expected: map[string]int64{"": 2, "failed": 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run("by"+tt.query, func(t *testing.T) {
+			resp, err := http.Get(server.URL + "/api/stats" + tt.query)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			var stats map[string]int64
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+			assert.Equal(t, tt.expected, stats)
+		})
+	}
+
+	resp, err := http.Get(server.URL + "/api/stats?by=payload")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestStreamEvents(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	hub := api.NewEventHub()
+
+	webhookHandler := webhook.NewHandler(webhook.Options{
+		Secret:           "stream-secret",
+		Logger:           logger,
+		Store:            store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Publisher:        hub,
+	})
+	handler := api.NewHandler(store, logger, api.WithEventHub(hub))
+	server := httptest.NewServer(http.HandlerFunc(handler.StreamEvents))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/events/stream?type=push", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	postWebhook := func(eventType, deliveryID string) {
+		payload := []byte(`{"ref": "refs/heads/main"}`)
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(string(payload)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", eventType)
+		req.Header.Set("X-GitHub-Delivery", deliveryID)
+		req.Header.Set("X-Hub-Signature-256", security.GenerateSignature(payload, "stream-secret"))
+		rec := httptest.NewRecorder()
+		webhookHandler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	// Filtered out by the stream's type
+	postWebhook("issues", "streamed-issue")
+	postWebhook("push", "streamed-push")
+
+	frames := make(chan string)
+	go func() {
+		defer close(frames)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				frames <- data
+			}
+		}
+	}()
+
+	select {
+	case data := <-frames:
+		var event storage.Event
+		require.NoError(t, json.Unmarshal([]byte(data), &event))
+		assert.Equal(t, "streamed-push", event.ID)
+		assert.Equal(t, "push", event.Type)
+		assert.JSONEq(t, `{"ref": "refs/heads/main"}`, string(event.Payload))
+	case <-ctx.Done():
+		t.Fatal("event did not arrive on the stream")
+	}
+
+	// Closing the hub ends open streams
+	hub.Close()
+	select {
+	case data, ok := <-frames:
+		assert.False(t, ok, "unexpected frame %s", data)
+	case <-ctx.Done():
+		t.Fatal("stream was not closed")
+	}
+}
+
+func TestReplayEventToTarget(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	require.NoError(t, store.StoreEvent(ctx, &storage.Event{
+		ID:         "to-replay",
+		Type:       "push",
+		Payload:    []byte(`{"ref":"refs/heads/main"}`),
+		Headers:    []byte(`{"X-Github-Event":["push"]}`),
+		CreatedAt:  time.Now().UTC(),
+		Repository: "test/repo",
+	}))
+
+	var gotBody []byte
+	var gotEvent string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotBody, _ = io.ReadAll(r.Body)
+		gotEvent = r.Header.Get("X-Github-Event")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer target.Close()
+
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL: "http://forward.example.com",
+		Storage:   store,
+		Logger:    logger,
+	})
+	allowlist, err := security.NewHostAllowlist([]string{"127.0.0.1"})
+	require.NoError(t, err)
+
+	newServer := func(replayer *webhook.Replayer) *httptest.Server {
+		handler := api.NewHandler(store, logger, api.WithReplayer(replayer))
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api/events/{id}/replay", handler.ReplayEvent)
+		return httptest.NewServer(mux)
+	}
+	server := newServer(webhook.NewReplayer(forwarder, allowlist))
+	defer server.Close()
+
+	replay := func(t *testing.T, server *httptest.Server, target string) *http.Response {
+		t.Helper()
+		resp, err := http.Post(server.URL+"/api/events/to-replay/replay?target="+url.QueryEscape(target), "", nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("allowed target", func(t *testing.T) {
+		resp := replay(t, server, target.URL+"/hook")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var result struct {
+			Target     string `json:"target"`
+			StatusCode int    `json:"status_code"`
+			Error      string `json:"error"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		assert.Equal(t, target.URL+"/hook", result.Target)
+		assert.Equal(t, http.StatusAccepted, result.StatusCode)
+		assert.Empty(t, result.Error)
+		assert.JSONEq(t, `{"ref":"refs/heads/main"}`, string(gotBody))
+		assert.Equal(t, "push", gotEvent)
+
+		// Replaying to a target leaves no replay behind
+		count, err := store.CountEvents(ctx, storage.QueryOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("host not allowed", func(t *testing.T) {
+		resp := replay(t, server, "http://internal.example.com/hook")
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("invalid target", func(t *testing.T) {
+		resp := replay(t, server, "file:///etc/passwd")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("replays to a target disabled", func(t *testing.T) {
+		disabled := newServer(nil)
+		defer disabled.Close()
+
+		resp := replay(t, disabled, target.URL+"/hook")
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+}
+
+func TestReplayRangeDryRun(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, event := range []*storage.Event{
+		{ID: "in-range-1", Type: "push", CreatedAt: now.Add(-2 * time.Hour)},
+		{ID: "in-range-2", Type: "push", CreatedAt: now.Add(-time.Hour)},
+		{ID: "other-type", Type: "issues", CreatedAt: now.Add(-time.Hour)},
+		{ID: "too-old", Type: "push", CreatedAt: now.Add(-48 * time.Hour)},
+	} {
+		event.Payload = []byte(`{}`)
+		event.Repository = "test/repo"
+		require.NoError(t, store.StoreEvent(ctx, event))
+	}
+
+	handler := api.NewHandler(store, logger)
+	server := httptest.NewServer(http.HandlerFunc(handler.ReplayRange))
+	defer server.Close()
+
+	countBefore, err := store.CountEvents(ctx, storage.QueryOptions{})
+	require.NoError(t, err)
+
+	query := url.Values{
+		"since":   {now.Add(-3 * time.Hour).Format(time.RFC3339)},
+		"until":   {now.Format(time.RFC3339)},
+		"type":    {"push"},
+		"dry_run": {"true"},
+	}
+	resp, err := http.Post(server.URL+"/api/replay?"+query.Encode(), "", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result struct {
+		DryRun bool     `json:"dry_run"`
+		Count  int      `json:"count"`
+		IDs    []string `json:"ids"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.True(t, result.DryRun)
+	assert.Equal(t, 2, result.Count)
+	assert.ElementsMatch(t, []string{"in-range-1", "in-range-2"}, result.IDs)
+
+	countAfter, err := store.CountEvents(ctx, storage.QueryOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, countBefore, countAfter, "dry run should not store replays")
+
+	t.Run("invalid dry_run", func(t *testing.T) {
+		query.Set("dry_run", "maybe")
+		resp, err := http.Post(server.URL+"/api/replay?"+query.Encode(), "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestExportEvents(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	// More than two export pages
+	const total = 1234
+	start := time.Date(2025, 2, 6, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < total; i++ {
+		eventType := "push"
+		if i%2 == 1 {
+			eventType = "issues"
+		}
+		require.NoError(t, store.StoreEvent(ctx, &storage.Event{
+			ID:         fmt.Sprintf("event-%04d", i),
+			Type:       eventType,
+			Payload:    []byte(`{}`),
+			CreatedAt:  start.Add(time.Duration(i) * time.Second),
+			Repository: "test/repo",
+			Sender:     "user",
+		}))
+	}
+
+	handler := api.NewHandler(store, logger)
+	server := httptest.NewServer(http.HandlerFunc(handler.ExportEvents))
+	defer server.Close()
+
+	get := func(t *testing.T, query string) *http.Response {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/api/events/export" + query)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("ndjson", func(t *testing.T) {
+		resp := get(t, "?format=ndjson")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+		assert.Equal(t, `attachment; filename="events.ndjson"`, resp.Header.Get("Content-Disposition"))
+
+		scanner := bufio.NewScanner(resp.Body)
+		var ids []string
+		for scanner.Scan() {
+			var event storage.Event
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+			ids = append(ids, event.ID)
+		}
+		require.NoError(t, scanner.Err())
+		require.Len(t, ids, total)
+		assert.Equal(t, "event-0000", ids[0])
+		assert.Equal(t, fmt.Sprintf("event-%04d", total-1), ids[total-1])
+	})
+
+	t.Run("csv with filter", func(t *testing.T) {
+		resp := get(t, "?format=csv&type=push")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+
+		records, err := csv.NewReader(resp.Body).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, records, total/2+1)
+		assert.Equal(t, []string{"id", "type", "repository", "sender", "created_at", "forwarded_at", "status"}, records[0])
+		assert.Equal(t, []string{"event-0000", "push", "test/repo", "user", "2025-02-06T00:00:00Z", "", ""}, records[1])
+	})
+
+	t.Run("csv without events", func(t *testing.T) {
+		resp := get(t, "?format=csv&type=release")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		records, err := csv.NewReader(resp.Body).ReadAll()
+		require.NoError(t, err)
+		assert.Len(t, records, 1)
+	})
+
+	t.Run("invalid format", func(t *testing.T) {
+		resp := get(t, "?format=xml")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"hubproxy/internal/security"
+	"hubproxy/internal/storage"
+)
+
+// curlSkippedHeaders are stored headers that describe the original
+// connection rather than the event, and are left for the client to set
+var curlSkippedHeaders = map[string]bool{
+	"Accept-Encoding":   true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+}
+
+// EventCurl handles GET /api/events/:id/curl, returning a shell script that
+// replays the stored event with curl, or the raw HTTP request with
+// ?format=http. The target comes from ?target, defaulting to $TARGET_URL in
+// the script. When a secret is given in the X-Webhook-Secret header (or the
+// secret parameter), the signature headers are recomputed with it.
+func (h *Handler) EventCurl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract event ID from path
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 4 || parts[len(parts)-1] != "curl" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	eventID := parts[len(parts)-2]
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format != "" && format != "curl" && format != "http" {
+		http.Error(w, "Invalid format parameter", http.StatusBadRequest)
+		return
+	}
+
+	target := query.Get("target")
+	if target != "" {
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, "Invalid target parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	secret := r.Header.Get("X-Webhook-Secret")
+	if secret == "" {
+		secret = query.Get("secret")
+	}
+
+	event, err := h.store.GetEvent(r.Context(), eventID)
+	if err != nil {
+		h.logger.Error("Error getting event", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if event == nil {
+		http.Error(w, "Event not found", http.StatusNotFound)
+		return
+	}
+
+	headers, err := replayHeaders(event, secret)
+	if err != nil {
+		h.logger.Error("Error parsing event headers", "event", event.ID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if format == "http" {
+		if target == "" {
+			target = "http://localhost/webhook"
+		}
+		req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(event.Payload))
+		if err != nil {
+			http.Error(w, "Invalid target parameter", http.StatusBadRequest)
+			return
+		}
+		req.Header = headers
+
+		w.Header().Set("Content-Type", "message/http")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", event.ID+".http"))
+		if err := req.Write(w); err != nil {
+			h.logger.Error("Error writing response", "error", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/x-shellscript; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", event.ID+".sh"))
+	if _, err := w.Write([]byte(curlScript(event, headers, target))); err != nil {
+		h.logger.Error("Error writing response", "error", err)
+	}
+}
+
+// replayHeaders returns the stored headers to send with a replayed event,
+// re-signing the payload when a secret is given
+func replayHeaders(event *storage.Event, secret string) (http.Header, error) {
+	headers := make(http.Header)
+	if len(event.Headers) > 0 {
+		if err := json.Unmarshal(event.Headers, &headers); err != nil {
+			return nil, err
+		}
+	}
+
+	for name := range headers {
+		if curlSkippedHeaders[http.CanonicalHeaderKey(name)] {
+			delete(headers, name)
+		}
+	}
+
+	if secret != "" {
+		headers.Del("X-Hub-Signature")
+		headers.Set("X-Hub-Signature-256", security.GenerateSignature(event.Payload, secret))
+	}
+	return headers, nil
+}
+
+// curlScript renders a shell script posting the event with curl
+func curlScript(event *storage.Event, headers http.Header, target string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	fmt.Fprintf(&b, "# Replays %s event %s received %s\n", event.Type, event.ID, event.CreatedAt.UTC().Format("2006-01-02T15:04:05Z"))
+	if target == "" {
+		b.WriteString("curl -sS -X POST \"${TARGET_URL:?set TARGET_URL to the URL to deliver to}\"")
+	} else {
+		fmt.Fprintf(&b, "curl -sS -X POST %s", shellQuote(target))
+	}
+	for _, name := range names {
+		for _, value := range headers[name] {
+			fmt.Fprintf(&b, " \\\n  -H %s", shellQuote(name+": "+value))
+		}
+	}
+	fmt.Fprintf(&b, " \\\n  --data-binary %s\n", shellQuote(string(event.Payload)))
+	return b.String()
+}
+
+// shellQuote quotes s as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
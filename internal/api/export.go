@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"hubproxy/internal/storage"
+)
+
+// exportPageSize is how many events an export reads from storage at a time
+const exportPageSize = 500
+
+// Export formats
+const (
+	exportFormatNDJSON = "ndjson"
+	exportFormatCSV    = "csv"
+)
+
+var exportCSVHeader = []string{"id", "type", "repository", "sender", "created_at", "forwarded_at", "status"}
+
+// ExportEvents handles GET /api/events/export, streaming every event matching
+// the same filters as ListEvents as NDJSON or CSV
+func (h *Handler) ExportEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = exportFormatNDJSON
+	}
+
+	var contentType string
+	switch format {
+	case exportFormatNDJSON:
+		contentType = "application/x-ndjson"
+	case exportFormatCSV:
+		contentType = "text/csv"
+	default:
+		http.Error(w, "Invalid format parameter", http.StatusBadRequest)
+		return
+	}
+
+	var opts storage.QueryOptions
+	if !parseEventFilters(w, query, &opts) {
+		return
+	}
+
+	// Large exports outlive the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		h.logger.Warn("Error clearing export write deadline", "error", err)
+	}
+
+	// begin writes anything preceding the first event
+	var begin, flush func() error
+	var write func(*storage.Event) error
+	switch format {
+	case exportFormatNDJSON:
+		enc := json.NewEncoder(w)
+		begin = func() error { return nil }
+		write = func(event *storage.Event) error { return enc.Encode(event) }
+		flush = func() error { return nil }
+	case exportFormatCSV:
+		cw := csv.NewWriter(w)
+		begin = func() error { return cw.Write(exportCSVHeader) }
+		write = func(event *storage.Event) error { return cw.Write(exportCSVRecord(event)) }
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	}
+
+	// Read a page at a time rather than holding a cursor open while the client
+	// reads, so memory stays bounded and slow clients don't tie up the database
+	opts.Limit = exportPageSize
+	page := make([]*storage.Event, 0, exportPageSize)
+	for {
+		page = page[:0]
+		err := h.store.IterateEvents(r.Context(), opts, func(event *storage.Event) error {
+			page = append(page, event)
+			return nil
+		})
+		if err != nil {
+			h.logger.Error("Error exporting events", "error", err)
+			// Once streaming has started the status can't change, so the
+			// export just ends early
+			if opts.Offset == 0 {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if opts.Offset == 0 {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Disposition", `attachment; filename="events.`+format+`"`)
+			if err := begin(); err != nil {
+				return
+			}
+		}
+		for _, event := range page {
+			if err := write(event); err != nil {
+				return
+			}
+		}
+		if err := flush(); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		if len(page) < exportPageSize {
+			return
+		}
+		opts.Offset += len(page)
+	}
+}
+
+func exportCSVRecord(event *storage.Event) []string {
+	var forwardedAt string
+	if event.ForwardedAt != nil {
+		forwardedAt = event.ForwardedAt.UTC().Format(time.RFC3339)
+	}
+	return []string{
+		event.ID,
+		event.Type,
+		event.Repository,
+		event.Sender,
+		event.CreatedAt.UTC().Format(time.RFC3339),
+		forwardedAt,
+		event.Status,
+	}
+}
@@ -2,30 +2,64 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
 	"hubproxy/internal/storage"
+	"hubproxy/internal/webhook"
 
 	"github.com/google/uuid"
 )
 
 // Handler handles API requests
 type Handler struct {
-	store  storage.Storage
-	logger *slog.Logger
+	store    storage.Storage
+	attempts *webhook.AttemptTracker
+	hub      *EventHub
+	replayer *webhook.Replayer
+	logger   *slog.Logger
+}
+
+// Option configures optional Handler features
+type Option func(*Handler)
+
+// WithAttemptTracker enables GET /api/forward/targets using the forwarder's attempt tracker
+func WithAttemptTracker(attempts *webhook.AttemptTracker) Option {
+	return func(h *Handler) {
+		h.attempts = attempts
+	}
+}
+
+// WithEventHub enables GET /api/events/stream, streaming events published to hub
+func WithEventHub(hub *EventHub) Option {
+	return func(h *Handler) {
+		h.hub = hub
+	}
+}
+
+// WithReplayer enables replaying an event to a target given with ?target=
+func WithReplayer(replayer *webhook.Replayer) Option {
+	return func(h *Handler) {
+		h.replayer = replayer
+	}
 }
 
 // NewHandler creates a new API handler
-func NewHandler(store storage.Storage, logger *slog.Logger) *Handler {
-	return &Handler{
+func NewHandler(store storage.Storage, logger *slog.Logger, opts ...Option) *Handler {
+	h := &Handler{
 		store:  store,
 		logger: logger,
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 // ListEvents handles GET /api/events
@@ -42,32 +76,8 @@ func (h *Handler) ListEvents(w http.ResponseWriter, r *http.Request) {
 		Offset: 0,  // Default offset
 	}
 
-	// Parse type filter
-	if t := query.Get("type"); t != "" {
-		opts.Types = []string{t} // Single type for now
-	}
-
-	// Parse other filters
-	opts.Repository = query.Get("repository")
-	opts.Sender = query.Get("sender")
-
-	// Parse since/until
-	if since := query.Get("since"); since != "" {
-		t, err := time.Parse(time.RFC3339, since)
-		if err != nil {
-			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
-			return
-		}
-		opts.Since = t
-	}
-
-	if until := query.Get("until"); until != "" {
-		t, err := time.Parse(time.RFC3339, until)
-		if err != nil {
-			http.Error(w, "Invalid until parameter", http.StatusBadRequest)
-			return
-		}
-		opts.Until = t
+	if !parseEventFilters(w, query, &opts) {
+		return
 	}
 
 	// Parse limit/offset
@@ -89,24 +99,113 @@ func (h *Handler) ListEvents(w http.ResponseWriter, r *http.Request) {
 		opts.Offset = n
 	}
 
+	// Parse sort/order
+	opts.SortBy = query.Get("sort")
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.SortDesc = true
+	default:
+		http.Error(w, "Invalid order parameter", http.StatusBadRequest)
+		return
+	}
+
 	// Get events
 	events, total, err := h.store.ListEvents(r.Context(), opts)
+	if errors.Is(err, storage.ErrInvalidSort) {
+		http.Error(w, "Invalid sort parameter", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		h.logger.Error("Error listing events", "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	hasMore := opts.Offset+len(events) < total
+	if links := paginationLinks(r.URL, opts.Limit, opts.Offset, hasMore); len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
 	// Write response
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"events": events,
-		"total":  total,
+		"events":   events,
+		"total":    total,
+		"limit":    opts.Limit,
+		"offset":   opts.Offset,
+		"has_more": hasMore,
 	}); err != nil {
 		h.logger.Error("Error encoding response", "error", err)
 	}
 }
 
+// parseEventFilters sets the event filters shared by listing and exporting
+// events from query parameters. It responds 400 and returns false if one is
+// invalid.
+func parseEventFilters(w http.ResponseWriter, query url.Values, opts *storage.QueryOptions) bool {
+	// Parse type filter, repeated for events of any of several types
+	for _, t := range query["type"] {
+		if t != "" {
+			opts.Types = append(opts.Types, t)
+		}
+	}
+
+	// Parse other filters
+	opts.Repository = query.Get("repository")
+	opts.Sender = query.Get("sender")
+	opts.IDPrefix = query.Get("id_prefix")
+	opts.InstallationTargetID = query.Get("installation_target_id")
+	if status := query.Get("status"); status != "" {
+		opts.Statuses = []string{status}
+	}
+
+	// Parse since/until
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return false
+		}
+		opts.Since = t
+	}
+
+	if until := query.Get("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			http.Error(w, "Invalid until parameter", http.StatusBadRequest)
+			return false
+		}
+		opts.Until = t
+	}
+
+	return true
+}
+
+// paginationLinks returns RFC 5988 Link header values for the next and
+// previous pages of a list, keeping the request's other query parameters
+func paginationLinks(u *url.URL, limit, offset int, hasMore bool) []string {
+	if limit <= 0 {
+		return nil
+	}
+
+	link := func(offset int, rel string) string {
+		query := u.Query()
+		query.Set("limit", strconv.Itoa(limit))
+		query.Set("offset", strconv.Itoa(offset))
+		return fmt.Sprintf(`<%s?%s>; rel="%s"`, u.Path, query.Encode(), rel)
+	}
+
+	var links []string
+	if hasMore {
+		links = append(links, link(offset+limit, "next"))
+	}
+	if offset > 0 {
+		links = append(links, link(max(offset-limit, 0), "prev"))
+	}
+	return links
+}
+
 // GetStats handles GET /api/stats
 func (h *Handler) GetStats(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -126,7 +225,16 @@ func (h *Handler) GetStats(w http.ResponseWriter, r *http.Request) {
 		since = t
 	}
 
-	stats, err := h.store.GetStats(r.Context(), since)
+	by := r.URL.Query().Get("by")
+	if by == "" {
+		by = storage.StatsByType
+	}
+
+	stats, err := h.store.GetStatsBy(r.Context(), by, since)
+	if errors.Is(err, storage.ErrInvalidStats) {
+		http.Error(w, "Invalid by parameter", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		h.logger.Error("Error getting stats", "error", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -140,6 +248,27 @@ func (h *Handler) GetStats(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ForwardTargets handles GET /api/forward/targets
+func (h *Handler) ForwardTargets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	targets := []webhook.TargetSummary{}
+	if h.attempts != nil {
+		targets = h.attempts.Summaries()
+	}
+
+	// Write response
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"targets": targets,
+	}); err != nil {
+		h.logger.Error("Error encoding response", "error", err)
+	}
+}
+
 // ReplayEvent handles POST /api/events/:id/replay
 func (h *Handler) ReplayEvent(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -167,6 +296,11 @@ func (h *Handler) ReplayEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if target := r.URL.Query().Get("target"); target != "" {
+		h.replayToTarget(w, r, event, target)
+		return
+	}
+
 	// Create new event with same payload but new ID and timestamp
 	replayEvent := &storage.Event{
 		ID:           fmt.Sprintf("%s-replay-%s", event.ID, uuid.New().String()), // Format: original-id-replay-uuid
@@ -178,6 +312,9 @@ func (h *Handler) ReplayEvent(w http.ResponseWriter, r *http.Request) {
 		Sender:       event.Sender,
 		ReplayedFrom: event.ID,
 		OriginalTime: event.CreatedAt,
+
+		InstallationTargetType: event.InstallationTargetType,
+		InstallationTargetID:   event.InstallationTargetID,
 	}
 
 	// Store the replayed event
@@ -201,6 +338,151 @@ func (h *Handler) ReplayEvent(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GetEvent handles GET /api/events/:id, returning the event with its payload
+// and headers
+func (h *Handler) GetEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract event ID from path
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 4 || parts[len(parts)-2] != "events" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	eventID := parts[len(parts)-1]
+
+	event, err := h.store.GetEvent(r.Context(), eventID)
+	if err != nil {
+		h.logger.Error("Error getting event", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if event == nil {
+		http.Error(w, "Event not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(event); err != nil {
+		h.logger.Error("Error encoding response", "error", err)
+	}
+}
+
+// replayToTarget delivers a stored event to target rather than storing a
+// replay for the forwarder, and reports how the target responded
+func (h *Handler) replayToTarget(w http.ResponseWriter, r *http.Request, event *storage.Event, target string) {
+	statusCode, err := h.replayer.Replay(r.Context(), event, target)
+	switch {
+	case errors.Is(err, webhook.ErrInvalidReplayTarget):
+		http.Error(w, "Invalid target parameter", http.StatusBadRequest)
+		return
+	case errors.Is(err, webhook.ErrReplayTargetNotAllowed):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil && statusCode == 0:
+		h.logger.Warn("Error replaying event to target", "event", event.ID, "target", target, "error", err)
+		http.Error(w, "Error delivering to target: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	response := struct {
+		ReplayedCount int              `json:"replayed_count"`
+		Events        []*storage.Event `json:"events"`
+		Target        string           `json:"target"`
+		StatusCode    int              `json:"status_code"`
+		Error         string           `json:"error,omitempty"`
+	}{
+		ReplayedCount: 1,
+		Events:        []*storage.Event{event},
+		Target:        target,
+		StatusCode:    statusCode,
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		h.logger.Error("Error encoding response", "error", err)
+	}
+}
+
+// DeleteEvent handles DELETE /api/events/:id
+func (h *Handler) DeleteEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract event ID from path
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 4 || parts[len(parts)-2] != "events" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	eventID := parts[len(parts)-1]
+
+	err := h.store.DeleteEvent(r.Context(), eventID)
+	if errors.Is(err, storage.ErrEventNotFound) {
+		http.Error(w, "Event not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Error("Error deleting event", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequeueEvent handles POST /api/events/:id/requeue, clearing the status of
+// an event that exhausted its forward retries so the forwarder picks it up again
+func (h *Handler) RequeueEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Extract event ID from path
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 4 || parts[len(parts)-1] != "requeue" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	eventID := parts[len(parts)-2]
+
+	event, err := h.store.GetEvent(r.Context(), eventID)
+	if err != nil {
+		h.logger.Error("Error getting event", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if event == nil {
+		http.Error(w, "Event not found", http.StatusNotFound)
+		return
+	}
+	if event.Status != storage.StatusFailed {
+		http.Error(w, "Event has not failed", http.StatusConflict)
+		return
+	}
+
+	if err := h.store.UpdateEventStatus(r.Context(), event.ID, ""); err != nil {
+		h.logger.Error("Error requeueing event", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	event.Status = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(event); err != nil {
+		h.logger.Error("Error encoding response", "error", err)
+	}
+}
+
 // ReplayRange handles POST /api/replay with time range parameters
 func (h *Handler) ReplayRange(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -208,8 +490,26 @@ func (h *Handler) ReplayRange(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse query parameters for time range
 	query := r.URL.Query()
+
+	// A dry run reports the events that would be replayed without storing replays
+	var dryRun bool
+	if dryRunStr := query.Get("dry_run"); dryRunStr != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(dryRunStr)
+		if err != nil {
+			http.Error(w, "Invalid dry_run parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Replay an explicit set of events when IDs are given
+	if ids := query.Get("ids"); ids != "" {
+		h.replayEventsByID(w, r, strings.Split(ids, ","), dryRun)
+		return
+	}
+
+	// Parse query parameters for time range
 	opts := storage.QueryOptions{
 		Limit:  100, // Default limit for replay
 		Offset: 0,
@@ -264,6 +564,9 @@ func (h *Handler) ReplayRange(w http.ResponseWriter, r *http.Request) {
 	if sender := query.Get("sender"); sender != "" {
 		opts.Sender = sender
 	}
+	if targetID := query.Get("installation_target_id"); targetID != "" {
+		opts.InstallationTargetID = targetID
+	}
 
 	// Get events in range
 	events, _, err := h.store.ListEvents(r.Context(), opts)
@@ -278,6 +581,89 @@ func (h *Handler) ReplayRange(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if dryRun {
+		h.writeDryRun(w, events)
+		return
+	}
+	h.replayEvents(w, r, events)
+}
+
+// ReplayLastFailed handles POST /api/replay/last-failed, replaying the most
+// recent failed event of each repository, or of a single repository
+func (h *Handler) ReplayLastFailed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts := storage.QueryOptions{
+		Repository: r.URL.Query().Get("repository"),
+		Statuses:   []string{storage.StatusFailed},
+	}
+
+	events, err := h.store.LatestEventsPerRepository(r.Context(), opts)
+	if err != nil {
+		h.logger.Error("Error listing failed events", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if len(events) == 0 {
+		http.Error(w, "No failed events found", http.StatusNotFound)
+		return
+	}
+
+	h.replayEvents(w, r, events)
+}
+
+// replayEventsByID replays the events with the given IDs in the order given
+func (h *Handler) replayEventsByID(w http.ResponseWriter, r *http.Request, ids []string, dryRun bool) {
+	found, err := h.store.GetEvents(r.Context(), ids)
+	if err != nil {
+		h.logger.Error("Error getting events", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	events := make([]*storage.Event, 0, len(found))
+	for _, id := range ids {
+		// Unknown IDs are skipped rather than failing the whole batch
+		if event, ok := found[id]; ok {
+			events = append(events, event)
+		}
+	}
+
+	if len(events) == 0 {
+		http.Error(w, "No events found", http.StatusNotFound)
+		return
+	}
+
+	if dryRun {
+		h.writeDryRun(w, events)
+		return
+	}
+	h.replayEvents(w, r, events)
+}
+
+// writeDryRun writes the IDs of the events a replay would replay
+func (h *Handler) writeDryRun(w http.ResponseWriter, events []*storage.Event) {
+	ids := make([]string, 0, len(events))
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"dry_run": true,
+		"count":   len(ids),
+		"ids":     ids,
+	}); err != nil {
+		h.logger.Error("Error encoding response", "error", err)
+	}
+}
+
+// replayEvents stores a replay of each event and writes the replayed events
+func (h *Handler) replayEvents(w http.ResponseWriter, r *http.Request, events []*storage.Event) {
 	// Replay each event
 	replayedEvents := make([]*storage.Event, 0, len(events))
 	for _, event := range events {
@@ -291,6 +677,9 @@ func (h *Handler) ReplayRange(w http.ResponseWriter, r *http.Request) {
 			Sender:       event.Sender,
 			ReplayedFrom: event.ID,
 			OriginalTime: event.CreatedAt,
+
+			InstallationTargetType: event.InstallationTargetType,
+			InstallationTargetID:   event.InstallationTargetID,
 		}
 
 		if err := h.store.StoreEvent(r.Context(), replayEvent); err != nil {
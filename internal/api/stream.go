@@ -0,0 +1,177 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"hubproxy/internal/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// streamBufferSize is how many events a stream subscriber may fall behind
+// before events are dropped for it
+const streamBufferSize = 64
+
+// streamKeepAlive is how often an idle stream sends a comment, so proxies
+// don't close the connection
+const streamKeepAlive = 30 * time.Second
+
+var streamDroppedEvents = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "hubproxy_api_stream_dropped_events_total",
+		Help: "Total number of events not sent to an event stream client that fell too far behind",
+	},
+)
+
+// EventHub fans newly stored events out to event stream subscribers. It
+// implements webhook.EventPublisher.
+type EventHub struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	closed      bool
+}
+
+type subscriber struct {
+	types  []string
+	events chan *storage.Event
+}
+
+// NewEventHub creates an EventHub with no subscribers
+func NewEventHub() *EventHub {
+	return &EventHub{subscribers: make(map[*subscriber]struct{})}
+}
+
+// Publish sends an event to every subscriber interested in its type. It
+// never blocks: subscribers that fell behind miss the event.
+func (h *EventHub) Publish(event *storage.Event) {
+	// The publisher may go on to update its event while streams encode this one
+	snapshot := *event
+	event = &snapshot
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers {
+		if len(sub.types) > 0 && !slices.Contains(sub.types, event.Type) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			streamDroppedEvents.Inc()
+		}
+	}
+}
+
+// Subscribe returns a channel receiving events of the given types, or of
+// every type if none are given, and a function ending the subscription. The
+// channel is closed when the subscription ends or the hub is closed.
+func (h *EventHub) Subscribe(types []string) (<-chan *storage.Event, func()) {
+	sub := &subscriber{
+		types:  types,
+		events: make(chan *storage.Event, streamBufferSize),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(sub.events)
+		return sub.events, func() {}
+	}
+	h.subscribers[sub] = struct{}{}
+
+	return sub.events, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[sub]; ok {
+			delete(h.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// Close ends every subscription, so open streams finish and the server can
+// shut down
+func (h *EventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for sub := range h.subscribers {
+		delete(h.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// StreamEvents handles GET /api/events/stream, sending each newly stored
+// event as a Server-Sent Events data frame until the client disconnects
+func (h *Handler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.hub == nil {
+		http.Error(w, "Event streaming is not enabled", http.StatusNotFound)
+		return
+	}
+
+	var types []string
+	for _, t := range r.URL.Query()["type"] {
+		if t != "" {
+			types = append(types, t)
+		}
+	}
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		h.logger.Warn("Error clearing stream write deadline", "error", err)
+	}
+
+	events, unsubscribe := h.hub.Subscribe(types)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		h.logger.Error("Error flushing event stream", "error", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				h.logger.Error("Error encoding streamed event", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", event.ID, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
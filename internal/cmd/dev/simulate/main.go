@@ -11,6 +11,8 @@ import (
 	"log"
 	"net/http"
 	"time"
+
+	"hubproxy/internal/security"
 )
 
 var sampleEvents = []struct {
@@ -114,7 +116,7 @@ func generateSignature(payload []byte, secret string) string {
 	mac := hmac.New(sha256.New, []byte(secret))
 	mac.Write(payload)
 	sig := "sha256=" + hex.EncodeToString(mac.Sum(nil))
-	log.Printf("Generated signature with secret '%s': %s", secret, sig)
+	log.Printf("Generated signature: %s", sig)
 	return sig
 }
 
@@ -128,7 +130,7 @@ func main() {
 
 	log.Printf("Starting webhook simulation")
 	log.Printf("Target URL: %s/webhook", *targetURL)
-	log.Printf("Using secret: %q", *secret)
+	log.Printf("Using secret: %s", security.RedactSecret(*secret))
 	log.Printf("Delay between webhooks: %v", *delay)
 
 	client := &http.Client{}
@@ -0,0 +1,23 @@
+// Package dashboard serves a minimal, read-only HTML dashboard for HubProxy.
+// The page is embedded into the binary and talks to the existing REST API,
+// so it adds no endpoints of its own.
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+// Handler returns an http.Handler that serves the embedded dashboard
+func Handler() http.Handler {
+	root, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		// The embedded directory is fixed at build time, so this can't happen
+		panic(err)
+	}
+	return http.FileServer(http.FS(root))
+}
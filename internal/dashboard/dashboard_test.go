@@ -0,0 +1,34 @@
+package dashboard_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"hubproxy/internal/dashboard"
+)
+
+func TestDashboardHandler(t *testing.T) {
+	server := httptest.NewServer(dashboard.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	// The dashboard is a thin client over the REST API
+	assert.Contains(t, string(body), "/api/events")
+	assert.Contains(t, string(body), "/api/events?limit=50&order=desc", "the dashboard should list the newest events")
+	assert.Contains(t, string(body), "/api/stats")
+	assert.Contains(t, string(body), "/replay")
+}
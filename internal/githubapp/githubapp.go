@@ -0,0 +1,189 @@
+// Package githubapp mints GitHub App JWTs and installation access tokens so
+// forwarded requests can authenticate as a GitHub App installation.
+package githubapp
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAPIURL is the GitHub REST API used to mint installation tokens
+	DefaultAPIURL = "https://api.github.com"
+
+	// jwtLifetime stays under GitHub's 10 minute maximum
+	jwtLifetime = 9 * time.Minute
+	// jwtClockSkew backdates iat to tolerate clock drift between us and GitHub
+	jwtClockSkew = 60 * time.Second
+	// refreshBefore refreshes installation tokens this long before they expire
+	refreshBefore = 5 * time.Minute
+)
+
+// Options configures a TokenSource
+type Options struct {
+	AppID          int64
+	InstallationID int64
+	PrivateKey     *rsa.PrivateKey
+	APIURL         string // Defaults to DefaultAPIURL
+	HTTPClient     *http.Client
+}
+
+// TokenSource mints installation access tokens and caches them until shortly before they expire
+type TokenSource struct {
+	appID          int64
+	installationID int64
+	key            *rsa.PrivateKey
+	apiURL         string
+	httpClient     *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// NewTokenSource creates a TokenSource for a GitHub App installation
+func NewTokenSource(opts Options) (*TokenSource, error) {
+	if opts.AppID == 0 {
+		return nil, fmt.Errorf("app ID is required")
+	}
+	if opts.InstallationID == 0 {
+		return nil, fmt.Errorf("installation ID is required")
+	}
+	if opts.PrivateKey == nil {
+		return nil, fmt.Errorf("private key is required")
+	}
+	if opts.APIURL == "" {
+		opts.APIURL = DefaultAPIURL
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	return &TokenSource{
+		appID:          opts.AppID,
+		installationID: opts.InstallationID,
+		key:            opts.PrivateKey,
+		apiURL:         strings.TrimSuffix(opts.APIURL, "/"),
+		httpClient:     opts.HTTPClient,
+	}, nil
+}
+
+// ParsePrivateKey parses a PEM encoded RSA private key in PKCS#1 or PKCS#8 form,
+// as downloaded from the GitHub App settings page
+func ParsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in private key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// JWT returns a short-lived RS256 JWT identifying the app
+func (s *TokenSource) JWT() (string, error) {
+	now := time.Now()
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-jwtClockSkew).Unix(),
+		"exp": now.Add(jwtLifetime).Unix(),
+		"iss": fmt.Sprintf("%d", s.appID),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing JWT: %w", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Token returns a cached installation access token, minting a new one when
+// the cached token is missing or about to expire
+func (s *TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Until(s.expiresAt) > refreshBefore {
+		return s.token, nil
+	}
+
+	token, expiresAt, err := s.mint(ctx)
+	if err != nil {
+		return "", err
+	}
+	s.token = token
+	s.expiresAt = expiresAt
+	return token, nil
+}
+
+// mint exchanges an app JWT for a new installation access token
+func (s *TokenSource) mint(ctx context.Context) (string, time.Time, error) {
+	jwt, err := s.JWT()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", s.apiURL, s.installationID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("creating token request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("requesting installation token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", time.Time{}, fmt.Errorf("requesting installation token: GitHub returned %s", resp.Status)
+	}
+
+	var result struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", time.Time{}, fmt.Errorf("decoding installation token: %w", err)
+	}
+	if result.Token == "" {
+		return "", time.Time{}, fmt.Errorf("GitHub returned an empty installation token")
+	}
+
+	return result.Token, result.ExpiresAt, nil
+}
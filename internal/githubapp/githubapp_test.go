@@ -0,0 +1,168 @@
+package githubapp_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"hubproxy/internal/githubapp"
+)
+
+func newKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return key
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key := newKey(t)
+
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	parsed, err := githubapp.ParsePrivateKey(pkcs1)
+	require.NoError(t, err)
+	assert.True(t, key.Equal(parsed))
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	parsed, err = githubapp.ParsePrivateKey(pkcs8)
+	require.NoError(t, err)
+	assert.True(t, key.Equal(parsed))
+
+	_, err = githubapp.ParsePrivateKey([]byte("not a key"))
+	assert.Error(t, err)
+}
+
+func TestJWT(t *testing.T) {
+	key := newKey(t)
+	source, err := githubapp.NewTokenSource(githubapp.Options{
+		AppID:          12345,
+		InstallationID: 678,
+		PrivateKey:     key,
+	})
+	require.NoError(t, err)
+
+	jwt, err := source.JWT()
+	require.NoError(t, err)
+
+	parts := strings.Split(jwt, ".")
+	require.Len(t, parts, 3)
+
+	// The signature verifies with the app's public key
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	require.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature))
+
+	var header map[string]string
+	decodeSegment(t, parts[0], &header)
+	assert.Equal(t, "RS256", header["alg"])
+
+	var claims struct {
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+		Issuer    string `json:"iss"`
+	}
+	decodeSegment(t, parts[1], &claims)
+	assert.Equal(t, "12345", claims.Issuer)
+
+	now := time.Now().Unix()
+	assert.Less(t, claims.IssuedAt, now, "iat is backdated for clock skew")
+	assert.Greater(t, claims.ExpiresAt, now)
+	assert.LessOrEqual(t, claims.ExpiresAt-claims.IssuedAt, int64(10*time.Minute/time.Second), "GitHub rejects JWTs valid for more than 10 minutes")
+}
+
+func decodeSegment(t *testing.T, segment string, v interface{}) {
+	t.Helper()
+
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, v))
+}
+
+func TestTokenCaching(t *testing.T) {
+	tests := []struct {
+		name             string
+		expiresIn        time.Duration
+		expectedRequests int32
+	}{
+		{name: "cached until near expiry", expiresIn: time.Hour, expectedRequests: 1},
+		{name: "refreshed when about to expire", expiresIn: 2 * time.Minute, expectedRequests: 3},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := requests.Add(1)
+
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, "/app/installations/678/access_tokens", r.URL.Path)
+				assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "Bearer "))
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{
+					"token":      fmt.Sprintf("ghs_token_%d", n),
+					"expires_at": time.Now().Add(tc.expiresIn).UTC().Format(time.RFC3339),
+				})
+			}))
+			defer server.Close()
+
+			source, err := githubapp.NewTokenSource(githubapp.Options{
+				AppID:          12345,
+				InstallationID: 678,
+				PrivateKey:     newKey(t),
+				APIURL:         server.URL,
+			})
+			require.NoError(t, err)
+
+			ctx := context.Background()
+			var tokens []string
+			for range 3 {
+				token, err := source.Token(ctx)
+				require.NoError(t, err)
+				tokens = append(tokens, token)
+			}
+
+			assert.Equal(t, tc.expectedRequests, requests.Load())
+			assert.Equal(t, fmt.Sprintf("ghs_token_%d", tc.expectedRequests), tokens[2])
+		})
+	}
+}
+
+func TestTokenError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Bad credentials", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	source, err := githubapp.NewTokenSource(githubapp.Options{
+		AppID:          12345,
+		InstallationID: 678,
+		PrivateKey:     newKey(t),
+		APIURL:         server.URL,
+	})
+	require.NoError(t, err)
+
+	_, err = source.Token(context.Background())
+	assert.ErrorContains(t, err, "401")
+}
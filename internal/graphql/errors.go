@@ -0,0 +1,44 @@
+package graphql
+
+// Codes set in the extensions of resolver errors, so clients can tell
+// failures apart without parsing messages
+const (
+	CodeNotFound        = "NOT_FOUND"
+	CodeInvalidArgument = "INVALID_ARGUMENT"
+	CodeInternal        = "INTERNAL"
+	CodeUnavailable     = "UNAVAILABLE"
+)
+
+// resolverError is returned by resolvers. graphql-go puts its extensions,
+// including the code, on the error in the response.
+type resolverError struct {
+	code    string
+	message string
+}
+
+func (e *resolverError) Error() string {
+	return e.message
+}
+
+// Extensions implements gqlerrors.ExtendedError
+func (e *resolverError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.code}
+}
+
+func notFoundError(message string) error {
+	return &resolverError{code: CodeNotFound, message: message}
+}
+
+func invalidArgumentError(message string) error {
+	return &resolverError{code: CodeInvalidArgument, message: message}
+}
+
+func unavailableError(message string) error {
+	return &resolverError{code: CodeUnavailable, message: message}
+}
+
+// internalError hides the underlying error, which may reveal database
+// details, behind a generic message. Callers log the real error.
+func internalError() error {
+	return &resolverError{code: CodeInternal, message: "internal error"}
+}
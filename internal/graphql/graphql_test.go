@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
@@ -13,9 +16,14 @@ import (
 	"testing"
 	"time"
 
+	"hubproxy/internal/api"
+	"hubproxy/internal/security"
 	"hubproxy/internal/storage"
 	"hubproxy/internal/testutil"
+	"hubproxy/internal/webhook"
 
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
 	"github.com/graphql-go/graphql"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -189,6 +197,47 @@ func TestGraphQLQueries(t *testing.T) {
 	}
 }
 
+func TestGraphQLEventTypeFilters(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+	setupTestData(t, store)
+	require.NoError(t, store.StoreEvent(context.Background(), &storage.Event{
+		ID:         "test-event-3",
+		Type:       "issues",
+		Payload:    []byte(`{"action": "opened"}`),
+		CreatedAt:  time.Now(),
+		Repository: "test/repo",
+	}))
+
+	schema, err := NewSchema(store, logger)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		args     string
+		expected []string
+	}{
+		{name: "single type", args: `type: "push"`, expected: []string{"test-event-1"}},
+		{name: "type list", args: `types: ["push", "pull_request"]`, expected: []string{"test-event-1", "test-event-2"}},
+		{name: "type and type list", args: `type: "issues", types: ["push"]`, expected: []string{"test-event-1", "test-event-3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := executeQuery(schema.schema, fmt.Sprintf(`{ events(%s) { events { id } } }`, tt.args), nil)
+			require.Empty(t, result.Errors)
+
+			events := result.Data.(map[string]interface{})["events"].(map[string]interface{})["events"].([]interface{})
+			var ids []string
+			for _, event := range events {
+				ids = append(ids, event.(map[string]interface{})["id"].(string))
+			}
+			sort.Strings(ids)
+			assert.Equal(t, tt.expected, ids)
+		})
+	}
+}
+
 func TestGraphQLMutations(t *testing.T) {
 	// Setup test environment
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
@@ -244,6 +293,75 @@ func TestGraphQLMutations(t *testing.T) {
 		assert.Equal(t, "push", event["type"])
 		assert.Equal(t, "test-event-1", event["replayedFrom"])
 	})
+
+	t.Run("Replay Range Dry Run", func(t *testing.T) {
+		before, err := store.CountEvents(context.Background(), storage.QueryOptions{})
+		require.NoError(t, err)
+
+		query := fmt.Sprintf(`
+			mutation {
+				replayRange(since: %q, until: %q, type: "pull_request", dryRun: true) {
+					replayedCount
+					dryRun
+					ids
+				}
+			}
+		`, time.Now().Add(-2*time.Hour).Format(time.RFC3339), time.Now().Add(time.Minute).Format(time.RFC3339))
+		result := executeQuery(schema.schema, query, nil)
+		require.Empty(t, result.Errors)
+
+		replayRange := result.Data.(map[string]interface{})["replayRange"].(map[string]interface{})
+		assert.Equal(t, 0, replayRange["replayedCount"])
+		assert.Equal(t, true, replayRange["dryRun"])
+		assert.Equal(t, []interface{}{"test-event-2"}, replayRange["ids"])
+
+		after, err := store.CountEvents(context.Background(), storage.QueryOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, before, after)
+	})
+}
+
+func TestGraphQLReplayEventToTarget(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+	setupTestData(t, store)
+
+	var gotBody []byte
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL: "http://forward.example.com",
+		Storage:   store,
+		Logger:    logger,
+	})
+	allowlist, err := security.NewHostAllowlist([]string{"127.0.0.1"})
+	require.NoError(t, err)
+
+	schema, err := NewSchema(store, logger, WithReplayer(webhook.NewReplayer(forwarder, allowlist)))
+	require.NoError(t, err)
+
+	t.Run("allowed target", func(t *testing.T) {
+		query := fmt.Sprintf(`mutation { replayEvent(id: "test-event-1", targetUrl: %q) { replayedCount targetUrl statusCode error } }`, target.URL)
+		result := executeQuery(schema.schema, query, nil)
+		require.Empty(t, result.Errors)
+
+		replayEvent := result.Data.(map[string]interface{})["replayEvent"].(map[string]interface{})
+		assert.Equal(t, 1, replayEvent["replayedCount"])
+		assert.Equal(t, target.URL, replayEvent["targetUrl"])
+		assert.Equal(t, http.StatusServiceUnavailable, replayEvent["statusCode"])
+		assert.NotEmpty(t, replayEvent["error"])
+		assert.JSONEq(t, `{"ref": "refs/heads/main"}`, string(gotBody))
+	})
+
+	t.Run("host not allowed", func(t *testing.T) {
+		result := executeQuery(schema.schema, `mutation { replayEvent(id: "test-event-1", targetUrl: "http://internal.example.com") { statusCode } }`, nil)
+		require.Len(t, result.Errors, 1)
+		assert.Equal(t, CodeInvalidArgument, result.Errors[0].Extensions["code"])
+	})
 }
 
 func TestGraphQLHandler(t *testing.T) {
@@ -286,6 +404,96 @@ func TestGraphQLHandler(t *testing.T) {
 	assert.Len(t, events["events"], 2)
 }
 
+func TestGraphQLErrorCodes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	store := testutil.NewTestDB(t)
+	setupTestData(t, store)
+
+	handler, err := NewHandler(store, logger)
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		query   string
+		code    string
+		message string
+	}{
+		{
+			name:    "missing event",
+			query:   `{ event(id: "missing") { id } }`,
+			code:    CodeNotFound,
+			message: "event not found",
+		},
+		{
+			name:    "empty event ID",
+			query:   `{ event(id: "") { id } }`,
+			code:    CodeInvalidArgument,
+			message: "invalid event ID",
+		},
+		{
+			name:    "replay of missing event",
+			query:   `mutation { replayEvent(id: "missing") { replayedCount } }`,
+			code:    CodeNotFound,
+			message: "event not found",
+		},
+		{
+			name:    "invalid sort column",
+			query:   `{ events(sort: "payload") { total } }`,
+			code:    CodeInvalidArgument,
+			message: `invalid sort column: "payload"`,
+		},
+		{
+			name:    "replay to a target while disabled",
+			query:   `mutation { replayEvent(id: "test-event-1", targetUrl: "http://127.0.0.1/hook") { statusCode } }`,
+			code:    CodeInvalidArgument,
+			message: "replay target host is not allowed: replaying to a target is disabled, set --replay-allowed-hosts",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(map[string]string{"query": tt.query})
+			require.NoError(t, err)
+			resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			var result struct {
+				Errors []struct {
+					Message    string                 `json:"message"`
+					Extensions map[string]interface{} `json:"extensions"`
+				} `json:"errors"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+			require.Len(t, result.Errors, 1)
+			assert.Equal(t, tt.message, result.Errors[0].Message)
+			assert.Equal(t, tt.code, result.Errors[0].Extensions["code"])
+		})
+	}
+}
+
+// failingStore fails every lookup with an error revealing database details
+type failingStore struct {
+	storage.Storage
+}
+
+func (failingStore) GetEvent(context.Context, string) (*storage.Event, error) {
+	return nil, errors.New("dial tcp db.internal:5432: connection refused")
+}
+
+func TestGraphQLInternalErrorsHideDetails(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	schema, err := NewSchema(failingStore{}, logger)
+	require.NoError(t, err)
+
+	result := executeQuery(schema.schema, `{ event(id: "any") { id } }`, nil)
+	require.Len(t, result.Errors, 1)
+	assert.Equal(t, "internal error", result.Errors[0].Message)
+	assert.Equal(t, CodeInternal, result.Errors[0].Extensions["code"])
+}
+
 // Helper function to execute GraphQL queries
 func executeQuery(schema graphql.Schema, query string, variables map[string]interface{}) *graphql.Result {
 	result := graphql.Do(graphql.Params{
@@ -297,6 +505,43 @@ func executeQuery(schema graphql.Schema, query string, variables map[string]inte
 	return result
 }
 
+func TestGraphQLEventAttempts(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+	setupTestData(t, store)
+	require.NoError(t, store.IncrementAttempts(context.Background(), "test-event-1"))
+	require.NoError(t, store.IncrementAttempts(context.Background(), "test-event-1"))
+
+	schema, err := NewSchema(store, logger)
+	require.NoError(t, err)
+
+	result := executeQuery(schema.schema, `{ event(id: "test-event-1") { id attempts nextAttemptAt } }`, nil)
+	require.Empty(t, result.Errors)
+
+	event := result.Data.(map[string]interface{})["event"].(map[string]interface{})
+	assert.Equal(t, 2, event["attempts"])
+	assert.Nil(t, event["nextAttemptAt"])
+}
+
+func TestGraphQLEventForwardedAt(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+	setupTestData(t, store)
+	require.NoError(t, store.MarkForwarded(context.Background(), "test-event-1"))
+
+	schema, err := NewSchema(store, logger)
+	require.NoError(t, err)
+
+	forwardedAt := func(id string) interface{} {
+		result := executeQuery(schema.schema, fmt.Sprintf(`{ event(id: %q) { forwardedAt } }`, id), nil)
+		require.Empty(t, result.Errors)
+		return result.Data.(map[string]interface{})["event"].(map[string]interface{})["forwardedAt"]
+	}
+
+	assert.NotNil(t, forwardedAt("test-event-1"), "forwarded event")
+	assert.Nil(t, forwardedAt("test-event-2"), "event not yet forwarded")
+}
+
 // Helper function to set up test data
 func setupTestData(t *testing.T, store storage.Storage) {
 	// Add test events
@@ -328,3 +573,73 @@ func setupTestData(t *testing.T, store storage.Storage) {
 	err = store.StoreEvent(context.Background(), event2)
 	require.NoError(t, err)
 }
+
+func TestGraphQLSubscription(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+	hub := api.NewEventHub()
+
+	handler, err := NewHandler(store, logger, WithEventSource(hub))
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, server.URL, &websocket.DialOptions{
+		Subprotocols: []string{"graphql-transport-ws"},
+	})
+	require.NoError(t, err)
+	defer conn.CloseNow()
+
+	require.NoError(t, wsjson.Write(ctx, conn, map[string]string{"type": "connection_init"}))
+	var msg struct {
+		ID      string          `json:"id"`
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	require.NoError(t, wsjson.Read(ctx, conn, &msg))
+	require.Equal(t, "connection_ack", msg.Type)
+
+	require.NoError(t, wsjson.Write(ctx, conn, map[string]interface{}{
+		"id":   "1",
+		"type": "subscribe",
+		"payload": map[string]string{
+			"query": `subscription { eventAdded(type: "push", repository: "org/a") { id type repository } }`,
+		},
+	}))
+
+	// The subscription starts in the background, so keep publishing until it
+	// sees an event. Only the push to org/a matches its filters.
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			hub.Publish(&storage.Event{ID: "other-type", Type: "issues", Repository: "org/a"})
+			hub.Publish(&storage.Event{ID: "other-repository", Type: "push", Repository: "org/b"})
+			hub.Publish(&storage.Event{ID: "wanted", Type: "push", Repository: "org/a"})
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	require.NoError(t, wsjson.Read(ctx, conn, &msg))
+	assert.Equal(t, "next", msg.Type)
+	assert.Equal(t, "1", msg.ID)
+	assert.JSONEq(t, `{"data": {"eventAdded": {"id": "wanted", "type": "push", "repository": "org/a"}}}`, string(msg.Payload))
+
+	// Completing the subscription ends it without closing the connection
+	require.NoError(t, wsjson.Write(ctx, conn, map[string]string{"id": "1", "type": "complete"}))
+	require.NoError(t, wsjson.Write(ctx, conn, map[string]string{"type": "ping"}))
+	for {
+		require.NoError(t, wsjson.Read(ctx, conn, &msg))
+		if msg.Type != "next" {
+			break
+		}
+	}
+	assert.Equal(t, "pong", msg.Type)
+}
@@ -9,9 +9,10 @@ import (
 	"github.com/graphql-go/handler"
 )
 
-// NewHandler creates a new GraphQL HTTP handler
-func NewHandler(store storage.Storage, logger *slog.Logger) (http.Handler, error) {
-	schema, err := NewSchema(store, logger)
+// NewHandler creates a new GraphQL HTTP handler. WebSocket upgrade requests
+// are served over the graphql-transport-ws protocol, for subscriptions.
+func NewHandler(store storage.Storage, logger *slog.Logger, opts ...Option) (http.Handler, error) {
+	schema, err := NewSchema(store, logger, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -24,5 +25,11 @@ func NewHandler(store storage.Storage, logger *slog.Logger) (http.Handler, error
 		Playground: true, // Enable Playground interface as an alternative to GraphiQL
 	})
 
-	return h, nil
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWebSocketUpgrade(r) {
+			schema.serveWebSocket(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}), nil
 }
@@ -1,10 +1,12 @@
 package graphql
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
 	"hubproxy/internal/storage"
+	"hubproxy/internal/webhook"
 
 	"github.com/google/uuid"
 	"github.com/graphql-go/graphql"
@@ -18,9 +20,16 @@ func (s *Schema) resolveEvents(p graphql.ResolveParams) (interface{}, error) {
 		Offset: 0,  // Default offset
 	}
 
-	// Parse type filter
+	// Parse type filters
 	if t, ok := p.Args["type"].(string); ok && t != "" {
-		opts.Types = []string{t} // Single type for now
+		opts.Types = []string{t}
+	}
+	if types, ok := p.Args["types"].([]interface{}); ok {
+		for _, t := range types {
+			if t, ok := t.(string); ok && t != "" {
+				opts.Types = append(opts.Types, t)
+			}
+		}
 	}
 
 	// Parse other filters
@@ -32,6 +41,10 @@ func (s *Schema) resolveEvents(p graphql.ResolveParams) (interface{}, error) {
 		opts.Sender = sender
 	}
 
+	if targetID, ok := p.Args["installationTargetID"].(string); ok && targetID != "" {
+		opts.InstallationTargetID = targetID
+	}
+
 	// Parse since/until
 	if since, ok := p.Args["since"].(time.Time); ok {
 		opts.Since = since
@@ -50,11 +63,29 @@ func (s *Schema) resolveEvents(p graphql.ResolveParams) (interface{}, error) {
 		opts.Offset = offset
 	}
 
+	// Parse sort/order
+	if sortBy, ok := p.Args["sort"].(string); ok {
+		opts.SortBy = sortBy
+	}
+
+	if order, ok := p.Args["order"].(string); ok {
+		switch order {
+		case "", "asc":
+		case "desc":
+			opts.SortDesc = true
+		default:
+			return nil, invalidArgumentError("invalid order, expected asc or desc")
+		}
+	}
+
 	// Get events
 	events, total, err := s.store.ListEvents(p.Context, opts)
+	if errors.Is(err, storage.ErrInvalidSort) {
+		return nil, invalidArgumentError(err.Error())
+	}
 	if err != nil {
 		s.logger.Error("Error listing events", "error", err)
-		return nil, err
+		return nil, internalError()
 	}
 
 	return map[string]interface{}{
@@ -67,17 +98,17 @@ func (s *Schema) resolveEvents(p graphql.ResolveParams) (interface{}, error) {
 func (s *Schema) resolveEvent(p graphql.ResolveParams) (interface{}, error) {
 	id, ok := p.Args["id"].(string)
 	if !ok || id == "" {
-		return nil, fmt.Errorf("invalid event ID")
+		return nil, invalidArgumentError("invalid event ID")
 	}
 
 	event, err := s.store.GetEvent(p.Context, id)
 	if err != nil {
 		s.logger.Error("Error getting event", "error", err)
-		return nil, err
+		return nil, internalError()
 	}
 
 	if event == nil {
-		return nil, fmt.Errorf("event not found")
+		return nil, notFoundError("event not found")
 	}
 
 	return event, nil
@@ -93,7 +124,7 @@ func (s *Schema) resolveStats(p graphql.ResolveParams) (interface{}, error) {
 	statsMap, err := s.store.GetStats(p.Context, since)
 	if err != nil {
 		s.logger.Error("Error getting stats", "error", err)
-		return nil, err
+		return nil, internalError()
 	}
 
 	// Convert map to array of stats
@@ -112,18 +143,22 @@ func (s *Schema) resolveStats(p graphql.ResolveParams) (interface{}, error) {
 func (s *Schema) resolveReplayEvent(p graphql.ResolveParams) (interface{}, error) {
 	id, ok := p.Args["id"].(string)
 	if !ok || id == "" {
-		return nil, fmt.Errorf("invalid event ID")
+		return nil, invalidArgumentError("invalid event ID")
 	}
 
 	// Get event from storage
 	event, err := s.store.GetEvent(p.Context, id)
 	if err != nil {
 		s.logger.Error("Error getting event", "error", err)
-		return nil, err
+		return nil, internalError()
 	}
 
 	if event == nil {
-		return nil, fmt.Errorf("event not found")
+		return nil, notFoundError("event not found")
+	}
+
+	if target, ok := p.Args["targetUrl"].(string); ok && target != "" {
+		return s.replayToTarget(p, event, target)
 	}
 
 	// Create new event with same payload but new ID and timestamp
@@ -137,12 +172,15 @@ func (s *Schema) resolveReplayEvent(p graphql.ResolveParams) (interface{}, error
 		Sender:       event.Sender,
 		ReplayedFrom: event.ID,
 		OriginalTime: event.CreatedAt,
+
+		InstallationTargetType: event.InstallationTargetType,
+		InstallationTargetID:   event.InstallationTargetID,
 	}
 
 	// Store the replayed event
 	if err := s.store.StoreEvent(p.Context, replayEvent); err != nil {
 		s.logger.Error("Error storing replayed event", "error", err)
-		return nil, err
+		return nil, internalError()
 	}
 
 	return map[string]interface{}{
@@ -151,6 +189,27 @@ func (s *Schema) resolveReplayEvent(p graphql.ResolveParams) (interface{}, error
 	}, nil
 }
 
+// replayToTarget delivers a stored event to target rather than storing a
+// replay for the forwarder, and reports how the target responded
+func (s *Schema) replayToTarget(p graphql.ResolveParams, event *storage.Event, target string) (interface{}, error) {
+	statusCode, err := s.replayer.Replay(p.Context, event, target)
+	if errors.Is(err, webhook.ErrInvalidReplayTarget) || errors.Is(err, webhook.ErrReplayTargetNotAllowed) {
+		return nil, invalidArgumentError(err.Error())
+	}
+
+	response := map[string]interface{}{
+		"replayedCount": 1,
+		"events":        []*storage.Event{event},
+		"targetUrl":     target,
+		"statusCode":    statusCode,
+	}
+	if err != nil {
+		s.logger.Warn("Error replaying event to target", "event", event.ID, "target", target, "error", err)
+		response["error"] = err.Error()
+	}
+	return response, nil
+}
+
 // resolveReplayRange handles the replayRange mutation
 func (s *Schema) resolveReplayRange(p graphql.ResolveParams) (interface{}, error) {
 	// Parse query parameters for time range
@@ -167,13 +226,13 @@ func (s *Schema) resolveReplayRange(p graphql.ResolveParams) (interface{}, error
 	// Parse since/until (both required for range replay)
 	since, ok := p.Args["since"].(time.Time)
 	if !ok {
-		return nil, fmt.Errorf("missing since parameter")
+		return nil, invalidArgumentError("missing since parameter")
 	}
 	opts.Since = since
 
 	until, ok := p.Args["until"].(time.Time)
 	if !ok {
-		return nil, fmt.Errorf("missing until parameter")
+		return nil, invalidArgumentError("missing until parameter")
 	}
 	opts.Until = until
 
@@ -190,15 +249,33 @@ func (s *Schema) resolveReplayRange(p graphql.ResolveParams) (interface{}, error
 		opts.Sender = sender
 	}
 
+	if targetID, ok := p.Args["installationTargetID"].(string); ok && targetID != "" {
+		opts.InstallationTargetID = targetID
+	}
+
 	// Get events in range
 	events, _, err := s.store.ListEvents(p.Context, opts)
 	if err != nil {
 		s.logger.Error("Error listing events", "error", err)
-		return nil, err
+		return nil, internalError()
 	}
 
 	if len(events) == 0 {
-		return nil, fmt.Errorf("no events found in range")
+		return nil, notFoundError("no events found in range")
+	}
+
+	// A dry run reports the events that would be replayed without storing replays
+	if dryRun, _ := p.Args["dryRun"].(bool); dryRun {
+		ids := make([]string, 0, len(events))
+		for _, event := range events {
+			ids = append(ids, event.ID)
+		}
+		return map[string]interface{}{
+			"replayedCount": 0,
+			"events":        []*storage.Event{},
+			"dryRun":        true,
+			"ids":           ids,
+		}, nil
 	}
 
 	// Replay each event
@@ -214,11 +291,14 @@ func (s *Schema) resolveReplayRange(p graphql.ResolveParams) (interface{}, error
 			Sender:       event.Sender,
 			ReplayedFrom: event.ID,
 			OriginalTime: event.CreatedAt,
+
+			InstallationTargetType: event.InstallationTargetType,
+			InstallationTargetID:   event.InstallationTargetID,
 		}
 
 		if err := s.store.StoreEvent(p.Context, replayEvent); err != nil {
 			s.logger.Error("Error storing replayed event", "error", err)
-			return nil, err
+			return nil, internalError()
 		}
 
 		replayedEvents = append(replayedEvents, replayEvent)
@@ -229,3 +309,45 @@ func (s *Schema) resolveReplayRange(p graphql.ResolveParams) (interface{}, error
 		"events":        replayedEvents,
 	}, nil
 }
+
+// subscribeEventAdded handles the eventAdded subscription, sending each newly
+// stored event matching the type and repository arguments. Events are
+// dropped rather than queued for a subscriber that falls behind, so a slow
+// client never holds up webhook handling.
+func (s *Schema) subscribeEventAdded(p graphql.ResolveParams) (interface{}, error) {
+	if s.events == nil {
+		return nil, unavailableError("subscriptions are not enabled")
+	}
+
+	var types []string
+	if t, ok := p.Args["type"].(string); ok && t != "" {
+		types = []string{t}
+	}
+	repository, _ := p.Args["repository"].(string)
+
+	events, unsubscribe := s.events.Subscribe(types)
+	results := make(chan interface{})
+	go func() {
+		defer close(results)
+		defer unsubscribe()
+		for {
+			select {
+			case <-p.Context.Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				if repository != "" && event.Repository != repository {
+					continue
+				}
+				select {
+				case results <- event:
+				case <-p.Context.Done():
+					return
+				}
+			}
+		}
+	}()
+	return results, nil
+}
@@ -4,23 +4,53 @@ import (
 	"log/slog"
 
 	"hubproxy/internal/storage"
+	"hubproxy/internal/webhook"
 
 	"github.com/graphql-go/graphql"
 )
 
 // Schema defines the GraphQL schema and resolvers
 type Schema struct {
-	schema graphql.Schema
-	store  storage.Storage
-	logger *slog.Logger
+	schema   graphql.Schema
+	store    storage.Storage
+	events   EventSource
+	replayer *webhook.Replayer
+	logger   *slog.Logger
+}
+
+// EventSource delivers newly stored events to subscriptions. The channel
+// receives events of the given types, or of every type if none are given,
+// until the returned function is called or the source closes it.
+type EventSource interface {
+	Subscribe(types []string) (<-chan *storage.Event, func())
+}
+
+// Option configures optional Schema features
+type Option func(*Schema)
+
+// WithEventSource enables the eventAdded subscription, fed by source
+func WithEventSource(source EventSource) Option {
+	return func(s *Schema) {
+		s.events = source
+	}
+}
+
+// WithReplayer enables replaying an event to the targetUrl given to replayEvent
+func WithReplayer(replayer *webhook.Replayer) Option {
+	return func(s *Schema) {
+		s.replayer = replayer
+	}
 }
 
 // NewSchema creates a new GraphQL schema with the given storage
-func NewSchema(store storage.Storage, logger *slog.Logger) (*Schema, error) {
+func NewSchema(store storage.Storage, logger *slog.Logger, opts ...Option) (*Schema, error) {
 	s := &Schema{
 		store:  store,
 		logger: logger,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
 
 	// Define Event type
 	eventType := graphql.NewObject(graphql.ObjectConfig{
@@ -59,6 +89,15 @@ func NewSchema(store storage.Storage, logger *slog.Logger) (*Schema, error) {
 					return nil, nil
 				},
 			},
+			"forwardedAt": &graphql.Field{
+				Type: graphql.DateTime,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if event, ok := p.Source.(*storage.Event); ok && event.ForwardedAt != nil {
+						return *event.ForwardedAt, nil
+					}
+					return nil, nil
+				},
+			},
 			"status": &graphql.Field{
 				Type: graphql.String,
 			},
@@ -71,6 +110,24 @@ func NewSchema(store storage.Storage, logger *slog.Logger) (*Schema, error) {
 			"sender": &graphql.Field{
 				Type: graphql.String,
 			},
+			"installationTargetType": &graphql.Field{
+				Type: graphql.String,
+			},
+			"installationTargetID": &graphql.Field{
+				Type: graphql.String,
+			},
+			"attempts": &graphql.Field{
+				Type: graphql.Int,
+			},
+			"nextAttemptAt": &graphql.Field{
+				Type: graphql.DateTime,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if event, ok := p.Source.(*storage.Event); ok && event.NextAttemptAt != nil {
+						return *event.NextAttemptAt, nil
+					}
+					return nil, nil
+				},
+			},
 			"replayedFrom": &graphql.Field{
 				Type: graphql.String,
 			},
@@ -109,6 +166,23 @@ func NewSchema(store storage.Storage, logger *slog.Logger) (*Schema, error) {
 			"events": &graphql.Field{
 				Type: graphql.NewList(eventType),
 			},
+			// Set when replaying to a target
+			"targetUrl": &graphql.Field{
+				Type: graphql.String,
+			},
+			"statusCode": &graphql.Field{
+				Type: graphql.Int,
+			},
+			"error": &graphql.Field{
+				Type: graphql.String,
+			},
+			// Set for a dry run, which replays nothing
+			"dryRun": &graphql.Field{
+				Type: graphql.Boolean,
+			},
+			"ids": &graphql.Field{
+				Type: graphql.NewList(graphql.String),
+			},
 		},
 	})
 
@@ -135,12 +209,18 @@ func NewSchema(store storage.Storage, logger *slog.Logger) (*Schema, error) {
 					"type": &graphql.ArgumentConfig{
 						Type: graphql.String,
 					},
+					"types": &graphql.ArgumentConfig{
+						Type: graphql.NewList(graphql.String),
+					},
 					"repository": &graphql.ArgumentConfig{
 						Type: graphql.String,
 					},
 					"sender": &graphql.ArgumentConfig{
 						Type: graphql.String,
 					},
+					"installationTargetID": &graphql.ArgumentConfig{
+						Type: graphql.String,
+					},
 					"status": &graphql.ArgumentConfig{
 						Type: graphql.String,
 					},
@@ -156,6 +236,12 @@ func NewSchema(store storage.Storage, logger *slog.Logger) (*Schema, error) {
 					"offset": &graphql.ArgumentConfig{
 						Type: graphql.Int,
 					},
+					"sort": &graphql.ArgumentConfig{
+						Type: graphql.String,
+					},
+					"order": &graphql.ArgumentConfig{
+						Type: graphql.String,
+					},
 				},
 				Resolve: s.resolveEvents,
 			},
@@ -190,6 +276,9 @@ func NewSchema(store storage.Storage, logger *slog.Logger) (*Schema, error) {
 					"id": &graphql.ArgumentConfig{
 						Type: graphql.NewNonNull(graphql.String),
 					},
+					"targetUrl": &graphql.ArgumentConfig{
+						Type: graphql.String,
+					},
 				},
 				Resolve: s.resolveReplayEvent,
 			},
@@ -211,19 +300,48 @@ func NewSchema(store storage.Storage, logger *slog.Logger) (*Schema, error) {
 					"sender": &graphql.ArgumentConfig{
 						Type: graphql.String,
 					},
+					"installationTargetID": &graphql.ArgumentConfig{
+						Type: graphql.String,
+					},
 					"limit": &graphql.ArgumentConfig{
 						Type: graphql.Int,
 					},
+					"dryRun": &graphql.ArgumentConfig{
+						Type: graphql.Boolean,
+					},
 				},
 				Resolve: s.resolveReplayRange,
 			},
 		},
 	})
 
+	// Define root subscription
+	rootSubscription := graphql.NewObject(graphql.ObjectConfig{
+		Name: "RootSubscription",
+		Fields: graphql.Fields{
+			"eventAdded": &graphql.Field{
+				Type: eventType,
+				Args: graphql.FieldConfigArgument{
+					"type": &graphql.ArgumentConfig{
+						Type: graphql.String,
+					},
+					"repository": &graphql.ArgumentConfig{
+						Type: graphql.String,
+					},
+				},
+				Subscribe: s.subscribeEventAdded,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source, nil
+				},
+			},
+		},
+	})
+
 	// Create schema
 	schema, err := graphql.NewSchema(graphql.SchemaConfig{
-		Query:    rootQuery,
-		Mutation: rootMutation,
+		Query:        rootQuery,
+		Mutation:     rootMutation,
+		Subscription: rootSubscription,
 	})
 	if err != nil {
 		return nil, err
@@ -0,0 +1,270 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// transportWSProtocol is the graphql-ws WebSocket subprotocol, spoken by
+// clients such as graphql-ws and Apollo Client
+const transportWSProtocol = "graphql-transport-ws"
+
+// connectionInitTimeout is how long a client has to send connection_init
+const connectionInitTimeout = 10 * time.Second
+
+// graphql-transport-ws message types
+const (
+	msgConnectionInit = "connection_init"
+	msgConnectionAck  = "connection_ack"
+	msgPing           = "ping"
+	msgPong           = "pong"
+	msgSubscribe      = "subscribe"
+	msgNext           = "next"
+	msgError          = "error"
+	msgComplete       = "complete"
+)
+
+// graphql-transport-ws close codes
+const (
+	closeBadRequest         websocket.StatusCode = 4400
+	closeUnauthorized       websocket.StatusCode = 4401
+	closeInitTimeout        websocket.StatusCode = 4408
+	closeSubscriberExists   websocket.StatusCode = 4409
+	closeTooManyInitRequest websocket.StatusCode = 4429
+)
+
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type wsSubscribePayload struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// isWebSocketUpgrade reports whether r asks to switch to a WebSocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// serveWebSocket runs GraphQL operations, subscriptions in particular, over
+// a graphql-transport-ws connection until the client disconnects
+func (s *Schema) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	// The connection outlives the server's read and write timeouts
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols: []string{transportWSProtocol},
+	})
+	if err != nil {
+		s.logger.Warn("Error accepting GraphQL WebSocket", "error", err)
+		return
+	}
+	defer conn.CloseNow()
+
+	if conn.Subprotocol() != transportWSProtocol {
+		conn.Close(websocket.StatusPolicyViolation, "unsupported subprotocol, use "+transportWSProtocol)
+		return
+	}
+
+	ws := &wsConnection{
+		schema:     s,
+		conn:       conn,
+		logger:     s.logger,
+		operations: make(map[string]context.CancelFunc),
+	}
+	ws.serve(r.Context())
+}
+
+type wsConnection struct {
+	schema *Schema
+	conn   *websocket.Conn
+	logger *slog.Logger
+
+	mu         sync.Mutex
+	operations map[string]context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+func (c *wsConnection) serve(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		c.wg.Wait()
+	}()
+
+	initCtx, initCancel := context.WithTimeout(ctx, connectionInitTimeout)
+	var msg wsMessage
+	err := wsjson.Read(initCtx, c.conn, &msg)
+	initCancel()
+	if err != nil {
+		c.conn.Close(closeInitTimeout, "connection initialisation timeout")
+		return
+	}
+	if msg.Type != msgConnectionInit {
+		c.conn.Close(closeUnauthorized, "unauthorized")
+		return
+	}
+	if err := c.write(ctx, wsMessage{Type: msgConnectionAck}); err != nil {
+		return
+	}
+
+	for {
+		var msg wsMessage
+		if err := wsjson.Read(ctx, c.conn, &msg); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				c.conn.Close(closeBadRequest, "invalid message")
+			}
+			return
+		}
+
+		switch msg.Type {
+		case msgPing:
+			if err := c.write(ctx, wsMessage{Type: msgPong}); err != nil {
+				return
+			}
+		case msgPong:
+		case msgConnectionInit:
+			c.conn.Close(closeTooManyInitRequest, "too many initialisation requests")
+			return
+		case msgSubscribe:
+			var payload wsSubscribePayload
+			if msg.ID == "" || json.Unmarshal(msg.Payload, &payload) != nil {
+				c.conn.Close(closeBadRequest, "invalid subscribe message")
+				return
+			}
+			if !c.start(ctx, msg.ID, payload) {
+				c.conn.Close(closeSubscriberExists, "subscriber for "+msg.ID+" already exists")
+				return
+			}
+		case msgComplete:
+			c.stop(msg.ID)
+		default:
+			c.conn.Close(closeBadRequest, "unknown message type "+msg.Type)
+			return
+		}
+	}
+}
+
+// start runs an operation in the background, reporting false if one with the
+// same ID is already running
+func (c *wsConnection) start(ctx context.Context, id string, payload wsSubscribePayload) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.operations[id]; ok {
+		return false
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c.operations[id] = cancel
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer c.stop(id)
+		c.run(ctx, id, payload)
+	}()
+	return true
+}
+
+// stop cancels an operation, whether it was completed by the client or ran out
+func (c *wsConnection) stop(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cancel, ok := c.operations[id]; ok {
+		cancel()
+		delete(c.operations, id)
+	}
+}
+
+func (c *wsConnection) run(ctx context.Context, id string, payload wsSubscribePayload) {
+	params := graphql.Params{
+		Schema:         c.schema.schema,
+		RequestString:  payload.Query,
+		VariableValues: payload.Variables,
+		OperationName:  payload.OperationName,
+		Context:        ctx,
+	}
+
+	if !isSubscription(payload.Query, payload.OperationName) {
+		result := graphql.Do(params)
+		if c.send(ctx, id, msgNext, result) == nil {
+			_ = c.write(ctx, wsMessage{ID: id, Type: msgComplete})
+		}
+		return
+	}
+
+	// Keep draining results once the operation ends, so graphql-go's
+	// subscription goroutine can finish
+	failed := false
+	for result := range graphql.Subscribe(params) {
+		if ctx.Err() != nil || failed {
+			continue
+		}
+		// A subscription that couldn't start, such as an invalid one, ends with an error
+		if result.Data == nil && len(result.Errors) > 0 {
+			_ = c.send(ctx, id, msgError, result.Errors)
+			failed = true
+			continue
+		}
+		_ = c.send(ctx, id, msgNext, result)
+	}
+	// Operations the client completed aren't completed back
+	if !failed && ctx.Err() == nil {
+		_ = c.write(ctx, wsMessage{ID: id, Type: msgComplete})
+	}
+}
+
+// send writes a message with payload encoded as JSON
+func (c *wsConnection) send(ctx context.Context, id, messageType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		c.logger.Error("Error encoding GraphQL WebSocket message", "error", err)
+		return err
+	}
+	return c.write(ctx, wsMessage{ID: id, Type: messageType, Payload: data})
+}
+
+func (c *wsConnection) write(ctx context.Context, msg wsMessage) error {
+	err := wsjson.Write(ctx, c.conn, msg)
+	if err != nil && ctx.Err() == nil {
+		c.logger.Debug("Error writing GraphQL WebSocket message", "error", err)
+	}
+	return err
+}
+
+// isSubscription reports whether the operation a request runs is a
+// subscription. Unparseable requests aren't, so graphql.Do reports the error.
+func isSubscription(query, operationName string) bool {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return false
+	}
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if operationName == "" || (op.Name != nil && op.Name.Value == operationName) {
+			return op.Operation == ast.OperationTypeSubscription
+		}
+	}
+	return false
+}
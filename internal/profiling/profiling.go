@@ -0,0 +1,26 @@
+// Package profiling serves Go's runtime profiles, for diagnosing goroutine
+// leaks or memory growth in a running HubProxy. It's only mounted on the API
+// server, and only when enabled.
+package profiling
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// Prefix is the path the profiles are served under
+const Prefix = "/debug/pprof/"
+
+// Handler returns an http.Handler serving the net/http/pprof endpoints under
+// Prefix. Unlike importing net/http/pprof for its side effects, it doesn't
+// register them on http.DefaultServeMux.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	// Index also serves the named profiles, such as goroutine and heap
+	mux.HandleFunc(Prefix, pprof.Index)
+	mux.HandleFunc(Prefix+"cmdline", pprof.Cmdline)
+	mux.HandleFunc(Prefix+"profile", pprof.Profile)
+	mux.HandleFunc(Prefix+"symbol", pprof.Symbol)
+	mux.HandleFunc(Prefix+"trace", pprof.Trace)
+	return mux
+}
@@ -0,0 +1,48 @@
+package profiling_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"hubproxy/internal/profiling"
+)
+
+func TestProfilingHandler(t *testing.T) {
+	get := func(t *testing.T, router chi.Router, path string) (int, string) {
+		server := httptest.NewServer(router)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("Enabled", func(t *testing.T) {
+		router := chi.NewRouter()
+		router.Mount(profiling.Prefix, profiling.Handler())
+
+		status, body := get(t, router, "/debug/pprof/goroutine?debug=1")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, "goroutine profile:")
+
+		status, _ = get(t, router, "/debug/pprof/")
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		router := chi.NewRouter()
+
+		status, _ := get(t, router, "/debug/pprof/goroutine?debug=1")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+}
@@ -0,0 +1,61 @@
+// Package requestid tags each HTTP request with an ID, so the log lines a
+// webhook produces, from receipt to forwarding, can be correlated.
+package requestid
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+)
+
+// Header carries the request ID on inbound requests, responses and
+// forwarded webhooks
+const Header = "X-Request-ID"
+
+// maxLength bounds inbound request IDs, which are logged and stored
+const maxLength = 128
+
+type contextKey struct{}
+
+// Middleware honors a valid inbound X-Request-ID, or generates one, and sets
+// it on the request context and the response
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !valid(id) {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set(Header, id)
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+// NewContext returns a copy of ctx carrying id. chi's request logger reads
+// it too.
+func NewContext(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, middleware.RequestIDKey, id)
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID in ctx, or "" if there is none
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// valid reports whether an inbound request ID is short and printable ASCII,
+// so it can't break up log lines
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
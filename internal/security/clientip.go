@@ -0,0 +1,52 @@
+package security
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIP returns the IP address a request originated from. The peer
+// address is used unless it's one of the trusted proxies, in which case the
+// client is the right-most X-Forwarded-For entry that isn't a trusted proxy
+// itself. Entries further left were supplied by the client and could be
+// forged, so X-Forwarded-For is ignored entirely for untrusted peers.
+func ClientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !containsIP(trustedProxies, net.ParseIP(host)) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	client := host
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		client = hop
+		if !containsIP(trustedProxies, net.ParseIP(hop)) {
+			break
+		}
+	}
+	return client
+}
+
+func containsIP(cidrs []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package security
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Methods and request headers browsers may use on cross-origin API requests
+const (
+	corsAllowedMethods = "GET, POST, DELETE, OPTIONS"
+	corsAllowedHeaders = "Authorization, Content-Type"
+)
+
+// CORSOptions configures cross-origin access to the API server
+type CORSOptions struct {
+	// AllowedOrigins are the origins, such as https://dash.example.com, that
+	// browsers may call the API from. "*" allows any origin.
+	AllowedOrigins []string
+	// AllowCredentials lets browsers send cookies and client certificates,
+	// which is only possible with explicitly listed origins
+	AllowCredentials bool
+}
+
+// CORS adds Cross-Origin Resource Sharing headers for allowed origins and
+// answers preflight requests
+type CORS struct {
+	origins          map[string]struct{}
+	anyOrigin        bool
+	allowCredentials bool
+}
+
+// NewCORS creates CORS middleware. It returns an error when credentials are
+// allowed for any origin.
+func NewCORS(opts CORSOptions) (*CORS, error) {
+	c := &CORS{
+		origins:          make(map[string]struct{}),
+		allowCredentials: opts.AllowCredentials,
+	}
+
+	for _, origin := range opts.AllowedOrigins {
+		origin = strings.TrimSpace(origin)
+		switch origin {
+		case "":
+		case "*":
+			c.anyOrigin = true
+		default:
+			c.origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = struct{}{}
+		}
+	}
+
+	if c.anyOrigin && c.allowCredentials {
+		return nil, errors.New("credentials can't be allowed for the * origin, list the allowed origins instead")
+	}
+
+	return c, nil
+}
+
+// Enabled reports whether any origin is allowed
+func (c *CORS) Enabled() bool {
+	return c != nil && (c.anyOrigin || len(c.origins) > 0)
+}
+
+func (c *CORS) allows(origin string) bool {
+	if c.anyOrigin {
+		return true
+	}
+	_, ok := c.origins[strings.ToLower(origin)]
+	return ok
+}
+
+// Middleware sets CORS headers on responses to allowed origins and responds
+// to their preflight requests itself, before authentication, since browsers
+// send preflights without credentials
+func (c *CORS) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		headers := w.Header()
+		headers.Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			headers.Add("Vary", "Access-Control-Request-Method")
+			headers.Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if !c.allows(origin) {
+			if preflight {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if c.anyOrigin {
+			headers.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			headers.Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.allowCredentials {
+			headers.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !slices.Contains(strings.Split(corsAllowedMethods, ", "), r.Header.Get("Access-Control-Request-Method")) {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		headers.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+		headers.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+		headers.Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
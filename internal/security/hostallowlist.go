@@ -0,0 +1,84 @@
+package security
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// HostAllowlist restricts outbound requests to a set of hostnames and CIDRs
+type HostAllowlist struct {
+	hosts map[string]struct{}
+	cidrs []*net.IPNet
+}
+
+// NewHostAllowlist creates an allowlist from hostnames, IP addresses and CIDRs.
+// Unix socket targets are matched by their full URL (e.g. unix:///run/app.sock).
+// An empty list allows every host.
+func NewHostAllowlist(entries []string) (*HostAllowlist, error) {
+	a := &HostAllowlist{
+		hosts: make(map[string]struct{}),
+	}
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.Contains(entry, "/") && !strings.HasPrefix(entry, "unix://") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("parsing CIDR %q: %w", entry, err)
+			}
+			a.cidrs = append(a.cidrs, ipNet)
+			continue
+		}
+
+		a.hosts[strings.ToLower(entry)] = struct{}{}
+	}
+
+	return a, nil
+}
+
+// Empty reports whether the allowlist has no entries and so allows every host
+func (a *HostAllowlist) Empty() bool {
+	return a == nil || (len(a.hosts) == 0 && len(a.cidrs) == 0)
+}
+
+// Allows reports whether requests to the target URL are permitted
+func (a *HostAllowlist) Allows(target string) bool {
+	if a.Empty() {
+		return true
+	}
+
+	if strings.HasPrefix(target, "unix://") {
+		_, ok := a.hosts[strings.ToLower(target)]
+		return ok
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return false
+	}
+
+	if _, ok := a.hosts[host]; ok {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range a.cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
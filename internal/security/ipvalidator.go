@@ -1,12 +1,43 @@
 package security
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	githubIPUpdates = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hubproxy_github_ip_update_total",
+			Help: "Total number of GitHub webhook IP range updates from the meta API by result (success, error)",
+		},
+		[]string{"result"},
+	)
+
+	githubIPRanges = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "hubproxy_github_ip_ranges",
+			Help: "Number of GitHub webhook CIDR ranges currently loaded",
+		},
+	)
+
+	githubIPLastUpdate = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "hubproxy_github_ip_last_update_timestamp_seconds",
+			Help: "Unix time the loaded GitHub webhook IP ranges were fetched",
+		},
+	)
 )
 
 // GitHubMeta represents the response from GitHub's /meta API
@@ -14,26 +45,64 @@ type GitHubMeta struct {
 	Hooks []string `json:"hooks"`
 }
 
+// metaUpdateTimeout bounds each fetch from the meta API, so a hung server
+// can't stall the background updater
+const metaUpdateTimeout = 30 * time.Second
+
+// DefaultGitHubMetaURL is github.com's meta API. GitHub Enterprise Server
+// serves its own at https://<host>/api/v3/meta.
+const DefaultGitHubMetaURL = "https://api.github.com/meta"
+
+// ipCache is the on-disk form of the last ranges fetched from the meta API
+type ipCache struct {
+	Hooks     []string  `json:"hooks"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
 // IPValidator validates if IP addresses are from GitHub's webhook range
 type IPValidator struct {
+	logger      *slog.Logger
+	client      *http.Client
+	metaURL     string
+	cacheFile   string
 	mu          sync.RWMutex
 	webhookCIDR []*net.IPNet
+	trustedCIDR []*net.IPNet // Allowed besides GitHub's ranges; kept across updates
 	lastUpdate  time.Time
 	updateFreq  time.Duration
 }
 
 // NewIPValidator creates a new IP validator that updates GitHub's IP ranges
-// at the specified frequency. If skipUpdates is true, it will not perform the
-// initial update or start background updates (useful for testing).
-func NewIPValidator(updateFreq time.Duration, skipUpdates bool) *IPValidator {
+// from the meta API at metaURL, or DefaultGitHubMetaURL if it's empty, at the
+// specified frequency. If cacheFile is set, each successful update is saved
+// there and the saved ranges are loaded first, so the validator starts with
+// the last known good set even if the meta API is unreachable. If
+// skipUpdates is true, it will not perform the initial update or start
+// background updates (useful for testing).
+func NewIPValidator(logger *slog.Logger, metaURL, cacheFile string, updateFreq time.Duration, skipUpdates bool) *IPValidator {
+	if metaURL == "" {
+		metaURL = DefaultGitHubMetaURL
+	}
 	v := &IPValidator{
+		logger:     logger,
+		client:     &http.Client{Timeout: metaUpdateTimeout},
+		metaURL:    metaURL,
+		cacheFile:  cacheFile,
 		updateFreq: updateFreq,
 	}
+	if cacheFile != "" {
+		if err := v.loadCache(); err != nil && !os.IsNotExist(err) {
+			logger.Warn("loading cached GitHub IP ranges failed", "file", cacheFile, "error", err)
+		}
+	}
 	if !skipUpdates {
 		// Initial update
-		if err := v.Update(); err != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), metaUpdateTimeout)
+		err := v.Update(ctx)
+		cancel()
+		if err != nil {
 			// Log error but continue - we'll retry later
-			fmt.Printf("Initial GitHub IP range update failed: %v\n", err)
+			logger.Error("initial GitHub IP range update failed", "error", err)
 		}
 		// Start background updater
 		go v.backgroundUpdate()
@@ -42,36 +111,132 @@ func NewIPValidator(updateFreq time.Duration, skipUpdates bool) *IPValidator {
 }
 
 // Update fetches the latest IP ranges from GitHub
-func (v *IPValidator) Update() error {
-	resp, err := http.Get("https://api.github.com/meta")
+func (v *IPValidator) Update(ctx context.Context) error {
+	if err := v.update(ctx); err != nil {
+		githubIPUpdates.WithLabelValues("error").Inc()
+		return err
+	}
+	githubIPUpdates.WithLabelValues("success").Inc()
+	return nil
+}
+
+func (v *IPValidator) update(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.metaURL, nil)
+	if err != nil {
+		return fmt.Errorf("creating GitHub meta request: %w", err)
+	}
+	resp, err := v.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("fetching GitHub meta: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching GitHub meta: %s returned %s", v.metaURL, resp.Status)
+	}
+
 	var meta GitHubMeta
 	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
 		return fmt.Errorf("decoding GitHub meta: %w", err)
 	}
 
-	cidrs := make([]*net.IPNet, 0, len(meta.Hooks))
-	for _, cidr := range meta.Hooks {
-		_, ipNet, err := net.ParseCIDR(cidr)
-		if err != nil {
-			return fmt.Errorf("parsing CIDR %q: %w", cidr, err)
+	cidrs, err := ParseCIDRs(meta.Hooks)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	v.setWebhookCIDRs(cidrs, now)
+
+	if v.cacheFile != "" {
+		// The fresh ranges are already in use; a failed write only costs
+		// the fallback on the next start
+		if err := v.saveCache(meta.Hooks, now); err != nil {
+			v.logger.Warn("caching GitHub IP ranges failed", "file", v.cacheFile, "error", err)
 		}
-		cidrs = append(cidrs, ipNet)
 	}
 
+	return nil
+}
+
+// loadCache sets the ranges from the cache file
+func (v *IPValidator) loadCache() error {
+	data, err := os.ReadFile(v.cacheFile)
+	if err != nil {
+		return err
+	}
+
+	var cache ipCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return fmt.Errorf("decoding IP cache %s: %w", v.cacheFile, err)
+	}
+	cidrs, err := ParseCIDRs(cache.Hooks)
+	if err != nil {
+		return fmt.Errorf("IP cache %s: %w", v.cacheFile, err)
+	}
+
+	v.setWebhookCIDRs(cidrs, cache.UpdatedAt)
+	return nil
+}
+
+// setWebhookCIDRs replaces GitHub's ranges, fetched at updatedAt
+func (v *IPValidator) setWebhookCIDRs(cidrs []*net.IPNet, updatedAt time.Time) {
 	v.mu.Lock()
 	v.webhookCIDR = cidrs
-	v.lastUpdate = time.Now()
+	v.lastUpdate = updatedAt
 	v.mu.Unlock()
 
-	return nil
+	githubIPRanges.Set(float64(len(cidrs)))
+	githubIPLastUpdate.Set(float64(updatedAt.Unix()))
+}
+
+// saveCache writes the ranges to the cache file, replacing it atomically so
+// a crash mid-write can't leave a truncated cache behind
+func (v *IPValidator) saveCache(hooks []string, updatedAt time.Time) error {
+	data, err := json.Marshal(ipCache{Hooks: hooks, UpdatedAt: updatedAt})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(v.cacheFile), filepath.Base(v.cacheFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), v.cacheFile)
+}
+
+// ParseCIDRs parses a list of CIDR ranges, failing on the first invalid one
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	parsed := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing CIDR %q: %w", cidr, err)
+		}
+		parsed = append(parsed, ipNet)
+	}
+	return parsed, nil
 }
 
-// IsGitHubIP checks if the given IP is in GitHub's webhook range
+// AddTrustedCIDRs allows requests from the given ranges as well as GitHub's,
+// such as the fixed address of an egress proxy or relay in front of hubproxy
+func (v *IPValidator) AddTrustedCIDRs(cidrs []*net.IPNet) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.trustedCIDR = append(v.trustedCIDR, cidrs...)
+}
+
+// IsGitHubIP checks if the given IP is in GitHub's webhook range or one of
+// the trusted ranges
 func (v *IPValidator) IsGitHubIP(ipStr string) bool {
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
@@ -81,12 +246,7 @@ func (v *IPValidator) IsGitHubIP(ipStr string) bool {
 	v.mu.RLock()
 	defer v.mu.RUnlock()
 
-	for _, cidr := range v.webhookCIDR {
-		if cidr.Contains(ip) {
-			return true
-		}
-	}
-	return false
+	return containsIP(v.webhookCIDR, ip) || containsIP(v.trustedCIDR, ip)
 }
 
 // LastUpdate returns when the IP ranges were last updated
@@ -98,20 +258,12 @@ func (v *IPValidator) LastUpdate() time.Time {
 
 // SetWebhookCIDRs sets the webhook CIDRs directly - only used for testing
 func (v *IPValidator) SetWebhookCIDRs(cidrs []string) error {
-	parsedCIDRs := make([]*net.IPNet, 0, len(cidrs))
-	for _, cidr := range cidrs {
-		_, ipNet, err := net.ParseCIDR(cidr)
-		if err != nil {
-			return fmt.Errorf("parsing CIDR %q: %w", cidr, err)
-		}
-		parsedCIDRs = append(parsedCIDRs, ipNet)
+	parsedCIDRs, err := ParseCIDRs(cidrs)
+	if err != nil {
+		return err
 	}
 
-	v.mu.Lock()
-	v.webhookCIDR = parsedCIDRs
-	v.lastUpdate = time.Now()
-	v.mu.Unlock()
-
+	v.setWebhookCIDRs(parsedCIDRs, time.Now())
 	return nil
 }
 
@@ -120,8 +272,11 @@ func (v *IPValidator) backgroundUpdate() {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		if err := v.Update(); err != nil {
-			fmt.Printf("GitHub IP range update failed: %v\n", err)
+		ctx, cancel := context.WithTimeout(context.Background(), metaUpdateTimeout)
+		err := v.Update(ctx)
+		cancel()
+		if err != nil {
+			v.logger.Error("GitHub IP range update failed", "error", err)
 		}
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 )
 
 // GenerateSignature generates a SHA256 HMAC signature for the given payload and secret
@@ -18,3 +19,10 @@ func VerifySignature(signature string, payload []byte, secret string) bool {
 	expectedSignature := GenerateSignature(payload, secret)
 	return hmac.Equal([]byte(signature), []byte(expectedSignature))
 }
+
+// RedactSecret describes a secret for logs by its length and the start of
+// its SHA-256, so operators can tell secrets apart without revealing them
+func RedactSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return fmt.Sprintf("len=%d sha256=%s", len(secret), hex.EncodeToString(sum[:])[:8])
+}
@@ -1,9 +1,18 @@
 package security_test
 
 import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -11,7 +20,8 @@ import (
 )
 
 func TestIPValidation(t *testing.T) {
-	validator := security.NewIPValidator(1*time.Hour, true) // Skip updates
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	validator := security.NewIPValidator(logger, "", "", 1*time.Hour, true) // Skip updates
 	require.NotNil(t, validator)
 
 	// Set test CIDRs that include GitHub's documented webhook ranges
@@ -73,6 +83,237 @@ func TestIPValidation(t *testing.T) {
 	}
 }
 
+func TestIPValidatorTrustedCIDRs(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	meta := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"hooks": ["192.30.252.0/22"]}`))
+	}))
+	defer meta.Close()
+
+	validator := security.NewIPValidator(logger, meta.URL, "", 1*time.Hour, true)
+	trusted, err := security.ParseCIDRs([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	validator.AddTrustedCIDRs(trusted)
+	require.NoError(t, validator.Update(context.Background()))
+
+	assert.True(t, validator.IsGitHubIP("192.30.252.1"), "GitHub range")
+	assert.True(t, validator.IsGitHubIP("10.20.30.40"), "trusted range")
+	assert.False(t, validator.IsGitHubIP("172.16.0.1"))
+
+	// Refreshing GitHub's ranges keeps the trusted ones
+	require.NoError(t, validator.Update(context.Background()))
+	assert.True(t, validator.IsGitHubIP("10.20.30.40"))
+
+	_, err = security.ParseCIDRs([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := security.ParseCIDRs([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		expectedIP   string
+	}{
+		{
+			name:       "Direct connection",
+			remoteAddr: "192.30.252.1:54321",
+			expectedIP: "192.30.252.1",
+		},
+		{
+			name:         "Single trusted proxy",
+			remoteAddr:   "10.0.0.5:54321",
+			forwardedFor: []string{"192.30.252.1"},
+			expectedIP:   "192.30.252.1",
+		},
+		{
+			name:         "Chained trusted proxies",
+			remoteAddr:   "10.0.0.5:54321",
+			forwardedFor: []string{"192.30.252.1, 10.0.0.9"},
+			expectedIP:   "192.30.252.1",
+		},
+		{
+			name:         "Client-supplied entry left of the real client",
+			remoteAddr:   "10.0.0.5:54321",
+			forwardedFor: []string{"192.30.252.1", "203.0.113.7"},
+			expectedIP:   "203.0.113.7",
+		},
+		{
+			name:         "Spoofed header from untrusted peer",
+			remoteAddr:   "203.0.113.7:54321",
+			forwardedFor: []string{"192.30.252.1"},
+			expectedIP:   "203.0.113.7",
+		},
+		{
+			name:       "Trusted proxy without header",
+			remoteAddr: "10.0.0.5:54321",
+			expectedIP: "10.0.0.5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			assert.Equal(t, tt.expectedIP, security.ClientIP(r, trusted))
+		})
+	}
+}
+
+func TestIPValidatorMetaURL(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	meta := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"hooks": ["198.51.100.0/24", "2001:db8:1::/48"]}`))
+	}))
+	defer meta.Close()
+
+	validator := security.NewIPValidator(logger, meta.URL, "", 1*time.Hour, true)
+	require.NoError(t, validator.Update(context.Background()))
+
+	assert.True(t, validator.IsGitHubIP("198.51.100.7"))
+	assert.True(t, validator.IsGitHubIP("2001:db8:1::1"))
+	assert.False(t, validator.IsGitHubIP("192.30.252.1"), "github.com ranges should not be loaded")
+	assert.False(t, validator.LastUpdate().IsZero())
+
+	t.Run("Error status", func(t *testing.T) {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "not found", http.StatusNotFound)
+		}))
+		defer failing.Close()
+
+		validator := security.NewIPValidator(logger, failing.URL, "", 1*time.Hour, true)
+		assert.Error(t, validator.Update(context.Background()))
+	})
+}
+
+func TestIPValidatorUpdateTimeout(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	validator := security.NewIPValidator(logger, slow.URL, "", 1*time.Hour, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := validator.Update(ctx)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.True(t, validator.LastUpdate().IsZero(), "ranges should not be replaced")
+}
+
+func TestIPValidatorUpdateMetrics(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	validator := security.NewIPValidator(logger, failing.URL, "", 1*time.Hour, true)
+	before := updateCount(t, "error")
+	require.Error(t, validator.Update(context.Background()))
+	assert.Equal(t, before+1, updateCount(t, "error"))
+
+	meta := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"hooks": ["192.30.252.0/22", "185.199.108.0/22"]}`))
+	}))
+	defer meta.Close()
+
+	validator = security.NewIPValidator(logger, meta.URL, "", 1*time.Hour, true)
+	before = updateCount(t, "success")
+	require.NoError(t, validator.Update(context.Background()))
+	assert.Equal(t, before+1, updateCount(t, "success"))
+	assert.Equal(t, 2.0, gaugeValue(t, "hubproxy_github_ip_ranges"))
+	assert.Equal(t, float64(validator.LastUpdate().Unix()),
+		gaugeValue(t, "hubproxy_github_ip_last_update_timestamp_seconds"))
+}
+
+// updateCount returns hubproxy_github_ip_update_total for the given result
+func updateCount(t *testing.T, result string) float64 {
+	t.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "hubproxy_github_ip_update_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "result" && label.GetValue() == result {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// gaugeValue returns the value of the named gauge
+func gaugeValue(t *testing.T, name string) float64 {
+	t.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == name {
+			require.Len(t, family.GetMetric(), 1)
+			return family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
+
+func TestIPValidatorCache(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cacheFile := filepath.Join(t.TempDir(), "github-ips.json")
+
+	t.Run("Cached ranges are used when the meta API is unreachable", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(cacheFile,
+			[]byte(`{"hooks": ["198.51.100.0/24"], "updated_at": "2024-01-02T03:04:05Z"}`), 0o600))
+
+		unreachable := httptest.NewServer(http.NotFoundHandler())
+		unreachable.Close()
+
+		validator := security.NewIPValidator(logger, unreachable.URL, cacheFile, 1*time.Hour, false)
+		assert.True(t, validator.IsGitHubIP("198.51.100.7"))
+		assert.False(t, validator.IsGitHubIP("203.0.113.7"))
+		assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), validator.LastUpdate().UTC())
+	})
+
+	t.Run("Successful update refreshes the cache", func(t *testing.T) {
+		meta := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"hooks": ["203.0.113.0/24"]}`))
+		}))
+		defer meta.Close()
+
+		validator := security.NewIPValidator(logger, meta.URL, cacheFile, 1*time.Hour, true)
+		require.NoError(t, validator.Update(context.Background()))
+
+		restarted := security.NewIPValidator(logger, meta.URL, cacheFile, 1*time.Hour, true)
+		assert.True(t, restarted.IsGitHubIP("203.0.113.7"))
+		assert.False(t, restarted.IsGitHubIP("198.51.100.7"))
+	})
+}
+
 func TestSignatureVerification(t *testing.T) {
 	secret := "test-secret"
 	payload := []byte(`{"test": "payload"}`)
@@ -135,3 +376,272 @@ func TestSignatureVerification(t *testing.T) {
 		})
 	}
 }
+
+func TestRedactSecret(t *testing.T) {
+	redacted := security.RedactSecret("super-secret-value")
+	assert.Equal(t, "len=18 sha256=", redacted[:14])
+	assert.NotContains(t, redacted, "super-secret-value")
+	assert.Equal(t, redacted, security.RedactSecret("super-secret-value"), "redaction should be stable")
+	assert.NotEqual(t, redacted, security.RedactSecret("super-secret-valuf"))
+}
+
+func TestHostAllowlist(t *testing.T) {
+	allowlist, err := security.NewHostAllowlist([]string{
+		"ci.example.com",
+		"10.0.0.0/8",
+		"unix:///run/app.sock",
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		target   string
+		expected bool
+	}{
+		{
+			name:     "Allowed hostname",
+			target:   "https://ci.example.com/webhook",
+			expected: true,
+		},
+		{
+			name:     "Hostname is case-insensitive",
+			target:   "https://CI.Example.com:8443/webhook",
+			expected: true,
+		},
+		{
+			name:     "IP within allowed CIDR",
+			target:   "http://10.1.2.3:8080/webhook",
+			expected: true,
+		},
+		{
+			name:     "Allowed Unix socket",
+			target:   "unix:///run/app.sock",
+			expected: true,
+		},
+		{
+			name:     "Other Unix socket",
+			target:   "unix:///var/run/docker.sock",
+			expected: false,
+		},
+		{
+			name:     "Subdomain of allowed hostname",
+			target:   "https://evil.ci.example.com/webhook",
+			expected: false,
+		},
+		{
+			name:     "IP outside allowed CIDR",
+			target:   "http://169.254.169.254/latest/meta-data",
+			expected: false,
+		},
+		{
+			name:     "Invalid URL",
+			target:   "://",
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, allowlist.Allows(tt.target))
+		})
+	}
+
+	t.Run("Empty allowlist allows everything", func(t *testing.T) {
+		empty, err := security.NewHostAllowlist(nil)
+		require.NoError(t, err)
+		assert.True(t, empty.Allows("http://169.254.169.254/"))
+	})
+
+	t.Run("Invalid CIDR", func(t *testing.T) {
+		_, err := security.NewHostAllowlist([]string{"10.0.0.0/99"})
+		assert.Error(t, err)
+	})
+}
+
+func TestRequireBearerToken(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := security.RequireBearerToken("s3cret", "/metrics")(next)
+
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		expected      int
+	}{
+		{
+			name:          "Valid token",
+			path:          "/api/events",
+			authorization: "Bearer s3cret",
+			expected:      http.StatusNoContent,
+		},
+		{
+			name:          "Scheme is case-insensitive",
+			path:          "/api/events",
+			authorization: "bearer s3cret",
+			expected:      http.StatusNoContent,
+		},
+		{
+			name:     "Missing header",
+			path:     "/api/events",
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:          "Wrong token",
+			path:          "/api/events",
+			authorization: "Bearer s3cre",
+			expected:      http.StatusUnauthorized,
+		},
+		{
+			name:          "Wrong scheme",
+			path:          "/api/events",
+			authorization: "Basic s3cret",
+			expected:      http.StatusUnauthorized,
+		},
+		{
+			name:     "Exempt path",
+			path:     "/metrics",
+			expected: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expected, rec.Code)
+			if tt.expected == http.StatusUnauthorized {
+				assert.Contains(t, rec.Header().Get("WWW-Authenticate"), "Bearer")
+			}
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	cors, err := security.NewCORS(security.CORSOptions{
+		AllowedOrigins:   []string{"https://dash.example.com"},
+		AllowCredentials: true,
+	})
+	require.NoError(t, err)
+	handler := cors.Middleware(next)
+
+	request := func(method, origin string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/events", nil)
+		req.Header.Set("Origin", origin)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Preflight from allowed origin", func(t *testing.T) {
+		rec := request(http.MethodOptions, "https://dash.example.com", map[string]string{
+			"Access-Control-Request-Method":  "POST",
+			"Access-Control-Request-Headers": "Authorization",
+		})
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		assert.Equal(t, "https://dash.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+		assert.Contains(t, rec.Header().Get("Access-Control-Allow-Methods"), "POST")
+		assert.Contains(t, rec.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+	})
+
+	t.Run("Preflight from disallowed origin", func(t *testing.T) {
+		rec := request(http.MethodOptions, "https://evil.example.com", map[string]string{
+			"Access-Control-Request-Method": "GET",
+		})
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("GET from allowed origin", func(t *testing.T) {
+		rec := request(http.MethodGet, "https://dash.example.com", nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "https://dash.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+		assert.Contains(t, rec.Header().Values("Vary"), "Origin")
+	})
+
+	t.Run("GET from disallowed origin", func(t *testing.T) {
+		rec := request(http.MethodGet, "https://evil.example.com", nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"))
+	})
+
+	t.Run("Any origin", func(t *testing.T) {
+		cors, err := security.NewCORS(security.CORSOptions{AllowedOrigins: []string{"*"}})
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/events", nil)
+		req.Header.Set("Origin", "https://anywhere.example.com")
+		rec := httptest.NewRecorder()
+		cors.Middleware(next).ServeHTTP(rec, req)
+		assert.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"))
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"))
+	})
+
+	t.Run("Credentials with any origin", func(t *testing.T) {
+		_, err := security.NewCORS(security.CORSOptions{
+			AllowedOrigins:   []string{"*"},
+			AllowCredentials: true,
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestTailscaleFunnelIP(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var seenAddr string
+	handler := security.TailscaleFunnelIP(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenAddr = r.RemoteAddr
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		value any
+	}{
+		{
+			name: "No connection in context",
+		},
+		{
+			name:  "Context value is not a net.Conn",
+			value: "not a connection",
+		},
+		{
+			name:  "Connection is not a Funnel connection",
+			value: server,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			if tt.value != nil {
+				r = r.WithContext(context.WithValue(r.Context(), security.ConnectionContextKey, tt.value))
+			}
+			w := httptest.NewRecorder()
+
+			require.NotPanics(t, func() { handler.ServeHTTP(w, r) })
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "192.0.2.1:1234", seenAddr, "RemoteAddr should be left alone")
+		})
+	}
+}
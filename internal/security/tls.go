@@ -0,0 +1,58 @@
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TargetTLSOptions configures how HubProxy verifies and authenticates to
+// https targets
+type TargetTLSOptions struct {
+	CACertFile         string // PEM bundle of CAs trusted in addition to the system pool
+	ClientCertFile     string // PEM client certificate presented for mTLS
+	ClientKeyFile      string // PEM private key of the client certificate
+	InsecureSkipVerify bool   // Skip verifying the target's certificate
+}
+
+// NewTargetTLSConfig builds the TLS config for forwarding to https targets.
+// It returns nil when no option is set, leaving Go's defaults in place.
+func NewTargetTLSConfig(opts TargetTLSOptions) (*tls.Config, error) {
+	if opts == (TargetTLSOptions{}) {
+		return nil, nil
+	}
+	if (opts.ClientCertFile == "") != (opts.ClientKeyFile == "") {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: opts.InsecureSkipVerify, //nolint:gosec // Opt-in for targets with self-signed certificates
+	}
+
+	if opts.CACertFile != "" {
+		pem, err := os.ReadFile(opts.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificate: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CACertFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if opts.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
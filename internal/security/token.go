@@ -0,0 +1,36 @@
+package security
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// RequireBearerToken returns middleware responding 401 to requests without an
+// "Authorization: Bearer <token>" header carrying token. Requests for the
+// exempt paths are served without one.
+func RequireBearerToken(token string, exemptPaths ...string) func(http.Handler) http.Handler {
+	// Comparing digests keeps the comparison constant-time regardless of length
+	want := sha256.Sum256([]byte(token))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(exemptPaths, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			scheme, got, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+			gotSum := sha256.Sum256([]byte(strings.TrimSpace(got)))
+			if !ok || !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare(gotSum[:], want[:]) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="hubproxy"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
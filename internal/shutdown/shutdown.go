@@ -0,0 +1,148 @@
+// Package shutdown reports the progress of HubProxy's graceful shutdown, so
+// load balancers stop routing to it as soon as it begins and operators can
+// see what it's waiting on.
+package shutdown
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"hubproxy/internal/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Phase is a step of the shutdown sequence
+type Phase int32
+
+// Shutdown phases, in order
+const (
+	PhaseRunning    Phase = iota // Not shutting down
+	PhaseDraining                // Listeners closed, waiting for in-flight requests
+	PhaseForwarding              // Final sweep forwarding pending events
+	PhaseClosing                 // Closing storage and other resources
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseRunning:
+		return "running"
+	case PhaseDraining:
+		return "draining"
+	case PhaseForwarding:
+		return "forwarding"
+	case PhaseClosing:
+		return "closing"
+	default:
+		return "unknown"
+	}
+}
+
+var shutdownPhase = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "hubproxy_shutdown_phase",
+		Help: "Current shutdown phase: 0 running, 1 draining requests, 2 final forward sweep, 3 closing",
+	},
+)
+
+// readyPingTimeout bounds the database ping of a readiness check
+const readyPingTimeout = 2 * time.Second
+
+// Status tracks the shutdown phase and the requests in flight
+type Status struct {
+	phase    atomic.Int32
+	inFlight atomic.Int64
+	logger   *slog.Logger
+
+	store   storage.Storage
+	backend string
+	metrics *storage.DBMetricsCollector
+}
+
+// NewStatus returns a Status in the running phase
+func NewStatus(logger *slog.Logger) *Status {
+	shutdownPhase.Set(float64(PhaseRunning))
+	return &Status{logger: logger}
+}
+
+// CheckStorage makes readiness depend on store being reachable, and reports
+// its backend and when metrics were last gathered from it
+func (s *Status) CheckStorage(store storage.Storage, backend string, metrics *storage.DBMetricsCollector) {
+	s.store = store
+	s.backend = backend
+	s.metrics = metrics
+}
+
+// Enter moves to phase, updating the hubproxy_shutdown_phase gauge and
+// logging it with attrs
+func (s *Status) Enter(phase Phase, attrs ...any) {
+	s.phase.Store(int32(phase))
+	shutdownPhase.Set(float64(phase))
+	s.logger.Info("shutdown phase", append([]any{"phase", phase.String()}, attrs...)...)
+}
+
+// Phase returns the current phase
+func (s *Status) Phase() Phase {
+	return Phase(s.phase.Load())
+}
+
+// ShuttingDown reports whether shutdown has begun
+func (s *Status) ShuttingDown() bool {
+	return s.Phase() != PhaseRunning
+}
+
+// InFlight returns the number of requests being served through Middleware
+func (s *Status) InFlight() int64 {
+	return s.inFlight.Load()
+}
+
+// Middleware counts the requests in flight, for reporting while draining
+func (s *Status) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Ready handles GET /readyz, responding 503 once shutdown has begun so load
+// balancers stop routing new requests here, or while the database can't be
+// reached
+func (s *Status) Ready(w http.ResponseWriter, r *http.Request) {
+	phase := s.Phase()
+	body := map[string]string{
+		"status": "ready",
+		"phase":  phase.String(),
+	}
+
+	code := http.StatusOK
+	if phase != PhaseRunning {
+		body["status"] = "shutting_down"
+		code = http.StatusServiceUnavailable
+	} else if s.store != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), readyPingTimeout)
+		defer cancel()
+		if err := s.store.Ping(ctx); err != nil {
+			s.logger.Warn("readiness check failed to ping database", "error", err)
+			body["status"] = "unavailable"
+			body["error"] = "database unreachable"
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	if s.store != nil {
+		body["storage"] = s.backend
+		if gathered := s.metrics.LastGathered(); !gathered.IsZero() {
+			body["last_metrics_gather"] = gathered.UTC().Format(time.RFC3339)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
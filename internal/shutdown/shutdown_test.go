@@ -0,0 +1,122 @@
+package shutdown
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"hubproxy/internal/storage"
+	"hubproxy/internal/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadyDuringShutdown(t *testing.T) {
+	status := NewStatus(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", status.Ready)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	server := httptest.NewServer(status.Middleware(mux))
+	defer server.Close()
+
+	ready := func(t *testing.T) (int, string) {
+		t.Helper()
+
+		resp, err := http.Get(server.URL + "/readyz")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body["phase"]
+	}
+
+	code, phase := ready(t)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "running", phase)
+
+	// Start a request that's still in flight when shutdown begins
+	slow := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(server.URL + "/slow")
+		if err != nil {
+			slow <- 0
+			return
+		}
+		resp.Body.Close()
+		slow <- resp.StatusCode
+	}()
+	require.Eventually(t, func() bool { return status.InFlight() == 1 }, time.Second, 10*time.Millisecond)
+
+	status.Enter(PhaseDraining, "inFlight", status.InFlight())
+	assert.True(t, status.ShuttingDown())
+
+	code, phase = ready(t)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "draining", phase)
+
+	// Draining waits for the in-flight request, which completes normally
+	drained := make(chan error, 1)
+	go func() { drained <- server.Config.Shutdown(context.Background()) }()
+	close(release)
+
+	assert.Equal(t, http.StatusOK, <-slow)
+	require.NoError(t, <-drained)
+	assert.Zero(t, status.InFlight())
+}
+
+func TestReadyChecksStorage(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+	metrics := storage.NewDBMetricsCollector(store, logger)
+
+	status := NewStatus(logger)
+	status.CheckStorage(store, "sqlite3", metrics)
+	server := httptest.NewServer(http.HandlerFunc(status.Ready))
+	defer server.Close()
+
+	ready := func(t *testing.T) (int, map[string]string) {
+		t.Helper()
+
+		resp, err := http.Get(server.URL + "/readyz")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body
+	}
+
+	t.Run("healthy store", func(t *testing.T) {
+		code, body := ready(t)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "ready", body["status"])
+		assert.Equal(t, "sqlite3", body["storage"])
+		assert.NotContains(t, body, "last_metrics_gather")
+
+		require.NoError(t, metrics.GatherMetrics(context.Background()))
+		_, body = ready(t)
+		assert.NotEmpty(t, body["last_metrics_gather"])
+	})
+
+	t.Run("closed store", func(t *testing.T) {
+		require.NoError(t, store.Close())
+
+		code, body := ready(t)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, "unavailable", body["status"])
+		assert.Equal(t, "database unreachable", body["error"])
+		assert.Equal(t, "sqlite3", body["storage"])
+	})
+}
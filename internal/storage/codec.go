@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Supported codec names
+const (
+	CodecJSON    = "json"
+	CodecMsgpack = "msgpack"
+)
+
+// Codec encodes event payloads and headers for storage. The codec name is
+// recorded with each stored event so rows written with any codec can be read back.
+type Codec interface {
+	// Name returns the name recorded alongside encoded data
+	Name() string
+
+	// Encode converts JSON into the codec's storage format
+	Encode(data json.RawMessage) ([]byte, error)
+
+	// Decode converts data in the codec's storage format back into JSON
+	Decode(data []byte) (json.RawMessage, error)
+}
+
+// CodecByName returns the codec with the given name. An empty name is
+// treated as JSON, which is how events were stored before codecs existed.
+func CodecByName(name string) (Codec, error) {
+	switch name {
+	case "", CodecJSON:
+		return JSONCodec{}, nil
+	case CodecMsgpack:
+		return MsgpackCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage codec: %s", name)
+	}
+}
+
+// JSONCodec stores data as-is
+type JSONCodec struct{}
+
+// Name returns "json"
+func (JSONCodec) Name() string {
+	return CodecJSON
+}
+
+// Encode returns data unchanged
+func (JSONCodec) Encode(data json.RawMessage) ([]byte, error) {
+	return data, nil
+}
+
+// Decode returns data unchanged
+func (JSONCodec) Decode(data []byte) (json.RawMessage, error) {
+	return data, nil
+}
+
+// MsgpackCodec stores data as MessagePack. Decoded JSON is equivalent to the
+// original but not byte-for-byte identical (key order and whitespace change).
+type MsgpackCodec struct{}
+
+// Name returns "msgpack"
+func (MsgpackCodec) Name() string {
+	return CodecMsgpack
+}
+
+// Encode converts JSON to MessagePack
+func (MsgpackCodec) Encode(data json.RawMessage) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("decoding JSON: %w", err)
+	}
+
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.UseCompactInts(true)
+	if err := encoder.Encode(fromJSONNumbers(value)); err != nil {
+		return nil, fmt.Errorf("encoding msgpack: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode converts MessagePack back to JSON
+func (MsgpackCodec) Decode(data []byte) (json.RawMessage, error) {
+	var value any
+	if err := msgpack.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("decoding msgpack: %w", err)
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, fmt.Errorf("encoding JSON: %w", err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// fromJSONNumbers replaces json.Number values with int64 or float64 so large
+// integer IDs survive the round trip without losing precision
+func fromJSONNumbers(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for key, item := range v {
+			v[key] = fromJSONNumbers(item)
+		}
+		return v
+	case []any:
+		for i, item := range v {
+			v[i] = fromJSONNumbers(item)
+		}
+		return v
+	default:
+		return value
+	}
+}
@@ -1,5 +1,13 @@
 package storage
 
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // Config represents database configuration
 type Config struct {
 	Host     string
@@ -8,3 +16,73 @@ type Config struct {
 	Username string
 	Password string
 }
+
+// PoolConfig tunes the connection pool of a SQL database. Zero values keep
+// the database/sql defaults.
+type PoolConfig struct {
+	MaxOpen         int           // Maximum open connections
+	MaxIdle         int           // Maximum idle connections kept for reuse
+	ConnMaxLifetime time.Duration // How long a connection is reused before it's closed
+	ConnMaxIdleTime time.Duration // How long a connection may sit idle before it's closed
+}
+
+// Database URI query parameters setting PoolConfig fields
+const (
+	poolParamMaxOpen         = "max_open_conns"
+	poolParamMaxIdle         = "max_idle_conns"
+	poolParamConnMaxLifetime = "conn_max_lifetime"
+	poolParamConnMaxIdleTime = "conn_max_idle_time"
+)
+
+// SplitPoolConfig removes the connection pool parameters, such as
+// ?max_open_conns=50, from a database URI, since drivers would otherwise pass
+// them on to the server, and returns their values
+func SplitPoolConfig(uri string) (string, PoolConfig, error) {
+	var config PoolConfig
+
+	base, rawQuery, ok := strings.Cut(uri, "?")
+	if !ok {
+		return uri, config, nil
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return uri, config, nil
+	}
+
+	ints := map[string]*int{
+		poolParamMaxOpen: &config.MaxOpen,
+		poolParamMaxIdle: &config.MaxIdle,
+	}
+	for param, field := range ints {
+		if !query.Has(param) {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(param))
+		if err != nil || n < 0 {
+			return "", PoolConfig{}, fmt.Errorf("invalid %s %q: must be a number of connections", param, query.Get(param))
+		}
+		*field = n
+		query.Del(param)
+	}
+
+	durations := map[string]*time.Duration{
+		poolParamConnMaxLifetime: &config.ConnMaxLifetime,
+		poolParamConnMaxIdleTime: &config.ConnMaxIdleTime,
+	}
+	for param, field := range durations {
+		if !query.Has(param) {
+			continue
+		}
+		d, err := time.ParseDuration(query.Get(param))
+		if err != nil || d < 0 {
+			return "", PoolConfig{}, fmt.Errorf("invalid %s %q: must be a duration such as 5m", param, query.Get(param))
+		}
+		*field = d
+		query.Del(param)
+	}
+
+	if len(query) == 0 {
+		return base, config, nil
+	}
+	return base + "?" + query.Encode(), config, nil
+}
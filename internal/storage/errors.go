@@ -4,5 +4,8 @@ import "errors"
 
 // Common storage errors
 var (
-	ErrDuplicateKey = errors.New("duplicate key")
+	ErrDuplicateKey  = errors.New("duplicate key")
+	ErrEventNotFound = errors.New("event not found")
+	ErrInvalidSort   = errors.New("invalid sort column")
+	ErrInvalidStats  = errors.New("invalid stats dimension")
 )
@@ -0,0 +1,82 @@
+// Package factory creates event storage for any supported backend from a URI
+package factory
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"hubproxy/internal/storage"
+	"hubproxy/internal/storage/redis"
+	"hubproxy/internal/storage/sql"
+)
+
+// isRedis reports whether a URI selects the Redis backend
+func isRedis(uri string) bool {
+	scheme, _, _ := strings.Cut(uri, "://")
+	scheme = strings.ToLower(scheme)
+	return scheme == "redis" || scheme == "rediss"
+}
+
+// supportedURIs describes every database URI NewStorageFromURI accepts
+const supportedURIs = sql.SupportedURIs + ", or redis://host:6379/0"
+
+// ValidateURI checks that a database URI selects a supported backend,
+// returning an error that names the supported schemes if it doesn't
+func ValidateURI(uri string) error {
+	if isRedis(uri) {
+		return nil
+	}
+	if err := sql.ValidateURI(uri); err != nil {
+		return fmt.Errorf("%w; use %s", err, supportedURIs)
+	}
+	return nil
+}
+
+// NewStorageFromURI creates storage for a URI: redis:// or rediss:// for
+// Redis, and any URI sql.New accepts for SQL databases. SQL URIs may tune
+// the connection pool with the max_open_conns, max_idle_conns,
+// conn_max_lifetime and conn_max_idle_time parameters. The SQL options
+// don't apply to Redis and are ignored for it.
+func NewStorageFromURI(uri string, opts ...sql.Option) (storage.Storage, error) {
+	if err := ValidateURI(uri); err != nil {
+		return nil, err
+	}
+	if isRedis(uri) {
+		return redis.New(uri)
+	}
+
+	uri, pool, err := storage.SplitPoolConfig(uri)
+	if err != nil {
+		return nil, err
+	}
+	return sql.New(uri, append(slices.Clip(opts), sql.WithPoolConfig(pool))...)
+}
+
+// NewReadOnlyStorageFromURI creates storage for a database HubProxy only
+// reads from, such as a read replica. It accepts the same URIs and options as
+// NewStorageFromURI, but SQL databases are opened with sql.NewReadOnly, so
+// the schema is checked rather than created.
+func NewReadOnlyStorageFromURI(uri string, opts ...sql.Option) (storage.Storage, error) {
+	if err := ValidateURI(uri); err != nil {
+		return nil, err
+	}
+	if isRedis(uri) {
+		return redis.New(uri)
+	}
+
+	uri, pool, err := storage.SplitPoolConfig(uri)
+	if err != nil {
+		return nil, err
+	}
+	return sql.NewReadOnly(uri, append(slices.Clip(opts), sql.WithPoolConfig(pool))...)
+}
+
+// Backend returns the name of the backend a URI selects, such as redis,
+// sqlite3, postgres or mysql
+func Backend(uri string) string {
+	if isRedis(uri) {
+		return "redis"
+	}
+	return sql.Backend(uri)
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrPayloadCorrupted is returned when a stored payload no longer matches its hash
+var ErrPayloadCorrupted = errors.New("stored payload does not match its hash")
+
+var storageCorruption = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "hubproxy_storage_corruption_total",
+	Help: "Total number of stored payloads that failed hash verification on read",
+})
+
+// PayloadHash returns the hex SHA-256 of a payload's canonical JSON form, so
+// the hash survives databases and codecs that reformat JSON on the way back.
+// Payloads that aren't valid JSON are hashed as-is.
+func PayloadHash(payload json.RawMessage) string {
+	data := []byte(payload)
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err == nil {
+		// encoding/json sorts object keys, making the output canonical
+		if canonical, err := json.Marshal(canonicalNumbers(value)); err == nil {
+			data = canonical
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyPayloadHash checks an event's payload against its stored hash. Events
+// stored without a hash are not checked.
+func VerifyPayloadHash(event *Event) error {
+	if event.PayloadHash == "" {
+		return nil
+	}
+	if PayloadHash(event.Payload) != event.PayloadHash {
+		storageCorruption.Inc()
+		return ErrPayloadCorrupted
+	}
+	return nil
+}
+
+// canonicalNumbers rewrites numbers so equal values hash the same however
+// they were written (1.50 and 1.5, 1e2 and 100)
+func canonicalNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = canonicalNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = canonicalNumbers(item)
+		}
+	case json.Number:
+		if i, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return json.Number(strconv.FormatInt(i, 10))
+		}
+		if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return json.Number(strconv.FormatUint(u, 10))
+		}
+		if f, err := v.Float64(); err == nil {
+			if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+				return json.Number(strconv.FormatInt(int64(f), 10))
+			}
+			return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+	}
+	return value
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DefaultJanitorInterval is how often the janitor prunes events when no interval is given
+const DefaultJanitorInterval = time.Hour
+
+var (
+	janitorDeletedEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hubproxy_janitor_deleted_events_total",
+		Help: "Total number of events deleted by the retention janitor",
+	})
+
+	prunedEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hubproxy_db_events_pruned_total",
+		Help: "Total number of settled events deleted for being older than the retention period",
+	})
+)
+
+// Janitor periodically prunes stored events according to the retention settings
+type Janitor struct {
+	storage        Storage
+	logger         *slog.Logger
+	retentionCount int
+	retention      time.Duration
+	interval       time.Duration
+}
+
+type JanitorOptions struct {
+	Storage        Storage
+	Logger         *slog.Logger
+	RetentionCount int           // Events to keep per repository; 0 keeps all
+	Retention      time.Duration // Age after which settled events are deleted; 0 keeps all
+	Interval       time.Duration // Time between runs; defaults to DefaultJanitorInterval
+}
+
+func NewJanitor(opts JanitorOptions) *Janitor {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultJanitorInterval
+	}
+
+	return &Janitor{
+		storage:        opts.Storage,
+		logger:         opts.Logger,
+		retentionCount: opts.RetentionCount,
+		retention:      opts.Retention,
+		interval:       opts.Interval,
+	}
+}
+
+// Enabled reports whether any retention rule is configured
+func (j *Janitor) Enabled() bool {
+	return j.retentionCount > 0 || j.retention > 0
+}
+
+// Run prunes events once, returning the number of events deleted
+func (j *Janitor) Run(ctx context.Context) (int64, error) {
+	var total int64
+
+	if j.retention > 0 {
+		// Pending events are kept so nothing is lost while the target is down
+		cutoff := time.Now().Add(-j.retention)
+		deleted, err := j.storage.DeleteEventsBefore(ctx, cutoff)
+		if err != nil {
+			return 0, err
+		}
+
+		prunedEvents.Add(float64(deleted))
+		janitorDeletedEvents.Add(float64(deleted))
+		if deleted > 0 {
+			j.logger.Info("pruned expired events", "deleted", deleted, "retention", j.retention)
+		}
+		total += deleted
+	}
+
+	if j.retentionCount > 0 {
+		deleted, err := j.storage.DeleteEventsKeepingLatestN(ctx, j.retentionCount)
+		if err != nil {
+			return total, err
+		}
+
+		janitorDeletedEvents.Add(float64(deleted))
+		if deleted > 0 {
+			j.logger.Info("pruned old events", "deleted", deleted, "keep_per_repository", j.retentionCount)
+		}
+		total += deleted
+	}
+
+	return total, nil
+}
+
+// Start runs the janitor immediately and then on every interval until ctx is done
+func (j *Janitor) Start(ctx context.Context) {
+	if !j.Enabled() {
+		j.logger.Debug("no retention configured, not starting janitor")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+
+		j.logger.Debug("starting janitor", "interval", j.interval)
+
+		for {
+			if _, err := j.Run(ctx); err != nil {
+				j.logger.Error("failed to prune events", "error", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				j.logger.Debug("stopped janitor")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
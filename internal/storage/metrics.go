@@ -2,7 +2,9 @@ package storage
 
 import (
 	"context"
+	"database/sql"
 	"log/slog"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -14,12 +16,24 @@ var (
 		Name: "hubproxy_db_events_count",
 		Help: "Number of events stored in the database",
 	}, []string{"type"})
+
+	metricsQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "hubproxy_metrics_queue_depth",
+		Help: "Number of pending database metrics gathering jobs",
+	})
+
+	metricsGatherPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "hubproxy_metrics_gather_pending",
+		Help: "Whether a database metrics gather is queued or running (1) or not (0)",
+	})
 )
 
 type DBMetricsCollector struct {
 	storage Storage
 	logger  *slog.Logger
 	queue   chan struct{}
+
+	lastGathered atomic.Int64 // Unix nanoseconds
 }
 
 func NewDBMetricsCollector(storage Storage, logger *slog.Logger) *DBMetricsCollector {
@@ -42,9 +56,23 @@ func (c *DBMetricsCollector) GatherMetrics(ctx context.Context) error {
 		eventCount.WithLabelValues(eventType).Set(float64(count))
 	}
 
+	c.lastGathered.Store(time.Now().UnixNano())
 	return nil
 }
 
+// LastGathered returns when metrics were last gathered successfully, or the
+// zero time if they haven't been
+func (c *DBMetricsCollector) LastGathered() time.Time {
+	if c == nil {
+		return time.Time{}
+	}
+	nanos := c.lastGathered.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
 func (c *DBMetricsCollector) EnqueueGatherMetrics(ctx context.Context) {
 	select {
 	case c.queue <- struct{}{}:
@@ -52,6 +80,8 @@ func (c *DBMetricsCollector) EnqueueGatherMetrics(ctx context.Context) {
 	default:
 		c.logger.Debug("metrics job already pending")
 	}
+	metricsQueueDepth.Set(float64(len(c.queue)))
+	metricsGatherPending.Set(1)
 }
 
 func (c *DBMetricsCollector) StartMetricsCollection(ctx context.Context, interval time.Duration) {
@@ -67,9 +97,14 @@ func (c *DBMetricsCollector) StartMetricsCollection(ctx context.Context, interva
 				c.logger.Debug("stopped metrics collector")
 				return
 			case <-c.queue:
+				metricsQueueDepth.Set(float64(len(c.queue)))
 				if err := c.GatherMetrics(ctx); err != nil {
 					c.logger.Error("failed to gather metrics", "error", err)
 				}
+				// Another gather may have been queued while this one ran
+				if len(c.queue) == 0 {
+					metricsGatherPending.Set(0)
+				}
 			}
 		}
 	}()
@@ -96,3 +131,82 @@ func (c *DBMetricsCollector) StartMetricsCollection(ctx context.Context, interva
 
 	c.EnqueueGatherMetrics(ctx)
 }
+
+// PoolStatser is implemented by storage backed by a database/sql connection pool
+type PoolStatser interface {
+	PoolStats() sql.DBStats
+}
+
+// unwrapper is implemented by storage wrapping other storage
+type unwrapper interface {
+	Unwrap() Storage
+}
+
+// poolStatser finds the connection pool behind storage and its wrappers
+func poolStatser(s Storage) (PoolStatser, bool) {
+	for s != nil {
+		if p, ok := s.(PoolStatser); ok {
+			return p, true
+		}
+		u, ok := s.(unwrapper)
+		if !ok {
+			break
+		}
+		s = u.Unwrap()
+	}
+	return nil, false
+}
+
+// poolCollector reports connection pool statistics when Prometheus scrapes,
+// so they're current however often database metrics are gathered
+type poolCollector struct {
+	pool PoolStatser
+
+	maxOpen      *prometheus.Desc
+	open         *prometheus.Desc
+	inUse        *prometheus.Desc
+	idle         *prometheus.Desc
+	waitCount    *prometheus.Desc
+	waitDuration *prometheus.Desc
+}
+
+// RegisterPoolMetrics registers metrics of the connection pool behind storage,
+// labelled with database, such as primary or replica. Storage without a
+// connection pool, such as Redis, registers nothing.
+func RegisterPoolMetrics(registerer prometheus.Registerer, database string, s Storage) error {
+	pool, ok := poolStatser(s)
+	if !ok {
+		return nil
+	}
+
+	labels := prometheus.Labels{"database": database}
+	return registerer.Register(&poolCollector{
+		pool:         pool,
+		maxOpen:      prometheus.NewDesc("hubproxy_db_pool_max_open_connections", "Maximum number of open database connections, 0 if unlimited", nil, labels),
+		open:         prometheus.NewDesc("hubproxy_db_pool_open_connections", "Number of open database connections", nil, labels),
+		inUse:        prometheus.NewDesc("hubproxy_db_pool_in_use_connections", "Number of database connections in use", nil, labels),
+		idle:         prometheus.NewDesc("hubproxy_db_pool_idle_connections", "Number of idle database connections", nil, labels),
+		waitCount:    prometheus.NewDesc("hubproxy_db_pool_wait_count_total", "Total number of times a query waited for a database connection", nil, labels),
+		waitDuration: prometheus.NewDesc("hubproxy_db_pool_wait_seconds_total", "Total time queries waited for a database connection", nil, labels),
+	})
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.maxOpen
+	ch <- c.open
+	ch <- c.inUse
+	ch <- c.idle
+	ch <- c.waitCount
+	ch <- c.waitDuration
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.pool.PoolStats()
+	ch <- prometheus.MustNewConstMetric(c.maxOpen, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.open, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.Idle))
+	// database/sql only ever adds to the wait totals
+	ch <- prometheus.MustNewConstMetric(c.waitCount, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds())
+}
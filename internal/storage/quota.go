@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrStorageFull is returned when storing an event would exceed the event cap
+var ErrStorageFull = errors.New("storage is full")
+
+// What QuotaStorage does when the event cap is reached
+const (
+	// FullPolicyReject refuses new events with ErrStorageFull
+	FullPolicyReject = "reject"
+	// FullPolicyPrune deletes the oldest settled events to make room, and
+	// refuses new events with ErrStorageFull when only pending ones are left
+	FullPolicyPrune = "prune"
+)
+
+// quotaRecountInterval is how long QuotaStorage trusts its own tally of
+// stored events before counting them again, picking up events deleted by
+// something else such as the janitor
+const quotaRecountInterval = 10 * time.Second
+
+var (
+	storageFull = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "hubproxy_storage_full",
+		Help: "Whether the event cap was reached when the last event was stored (1) or not (0)",
+	})
+
+	quotaPrunedEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hubproxy_storage_quota_pruned_events_total",
+		Help: "Total number of events deleted to stay under the event cap",
+	})
+)
+
+// QuotaStorage caps the number of stored events. Once the cap is reached it
+// either rejects new events or prunes the oldest settled ones, depending on
+// its policy; events still waiting to be forwarded are never pruned. Events
+// are counted in storage at most every quotaRecountInterval while under the
+// cap, and on every store once it's reached. Concurrent stores may briefly
+// overshoot the cap.
+type QuotaStorage struct {
+	Storage
+	maxEvents int
+	policy    string
+	logger    *slog.Logger
+
+	counting  singleflight.Group // Shares a recount between concurrent stores
+	mu        sync.Mutex
+	count     int       // Events counted at countedAt, plus those stored since
+	countedAt time.Time // Zero until the first count
+}
+
+type QuotaOptions struct {
+	MaxEvents int    // Maximum number of stored events
+	Policy    string // One of FullPolicyReject (default) or FullPolicyPrune
+	Logger    *slog.Logger
+}
+
+// NewQuotaStorage wraps storage so it holds at most opts.MaxEvents events
+func NewQuotaStorage(storage Storage, opts QuotaOptions) (*QuotaStorage, error) {
+	if opts.MaxEvents <= 0 {
+		return nil, fmt.Errorf("max events must be positive")
+	}
+	if opts.Policy == "" {
+		opts.Policy = FullPolicyReject
+	}
+	if opts.Policy != FullPolicyReject && opts.Policy != FullPolicyPrune {
+		return nil, fmt.Errorf("unknown storage full policy: %s", opts.Policy)
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+
+	return &QuotaStorage{
+		Storage:   storage,
+		maxEvents: opts.MaxEvents,
+		policy:    opts.Policy,
+		logger:    opts.Logger,
+	}, nil
+}
+
+// Unwrap returns the wrapped storage
+func (s *QuotaStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+// StoreEvent stores an event if there's room for it, making room first
+// under the prune policy
+func (s *QuotaStorage) StoreEvent(ctx context.Context, event *Event) error {
+	if err := s.makeRoom(ctx); err != nil {
+		return err
+	}
+	if err := s.Storage.StoreEvent(ctx, event); err != nil {
+		return err
+	}
+	s.stored()
+	return nil
+}
+
+// StoreEventIfNew stores an event unless it's already stored, subject to the
+// same cap as StoreEvent. A redelivery of a stored event isn't refused when
+// the cap is reached, since it wouldn't be stored anyway.
+func (s *QuotaStorage) StoreEventIfNew(ctx context.Context, event *Event) (bool, error) {
+	existing, err := s.Storage.GetEvent(ctx, event.ID)
+	if err != nil {
+		return false, fmt.Errorf("checking for existing event: %w", err)
+	}
+	if existing != nil {
+		return false, nil
+	}
+	if err := s.makeRoom(ctx); err != nil {
+		return false, err
+	}
+	inserted, err := s.Storage.StoreEventIfNew(ctx, event)
+	if inserted {
+		s.stored()
+	}
+	return inserted, err
+}
+
+// stored adds a newly stored event to the tally
+func (s *QuotaStorage) stored() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count++
+}
+
+// makeRoom checks the event cap before an insert, pruning the oldest settled
+// events or returning ErrStorageFull once it's reached. The tally is only
+// read and updated under s.mu; storage is counted and pruned outside it.
+func (s *QuotaStorage) makeRoom(ctx context.Context) error {
+	s.mu.Lock()
+	// The tally can only overcount between counts, since events are only
+	// deleted elsewhere, so it's confirmed before acting on the cap
+	stale := s.count >= s.maxEvents || time.Since(s.countedAt) >= quotaRecountInterval
+	s.mu.Unlock()
+	if stale {
+		if err := s.recount(ctx); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	count := s.count
+	s.mu.Unlock()
+
+	if count < s.maxEvents {
+		storageFull.Set(0)
+		return nil
+	}
+	storageFull.Set(1)
+
+	if s.policy == FullPolicyReject {
+		return fmt.Errorf("%w: %d events stored, cap is %d", ErrStorageFull, count, s.maxEvents)
+	}
+
+	excess := count - s.maxEvents + 1
+	deleted, err := s.Storage.DeleteOldestSettledEvents(ctx, excess)
+	if err != nil {
+		return fmt.Errorf("pruning events: %w", err)
+	}
+	s.mu.Lock()
+	s.count -= int(deleted)
+	count = s.count
+	s.mu.Unlock()
+	if deleted > 0 {
+		quotaPrunedEvents.Add(float64(deleted))
+		s.logger.Warn("event cap reached, pruned oldest settled events", "deleted", deleted, "maxEvents", s.maxEvents)
+	}
+	if int(deleted) < excess {
+		return fmt.Errorf("%w: %d events stored, cap is %d, and the rest are still waiting to be forwarded",
+			ErrStorageFull, count, s.maxEvents)
+	}
+	return nil
+}
+
+// recount replaces the tally with a count from storage. Concurrent callers
+// share a single count rather than each querying storage.
+func (s *QuotaStorage) recount(ctx context.Context) error {
+	_, err, _ := s.counting.Do("count", func() (any, error) {
+		count, err := s.Storage.CountEvents(ctx, QueryOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("checking event count: %w", err)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.count, s.countedAt = count, time.Now()
+		return nil, nil
+	})
+	return err
+}
@@ -0,0 +1,288 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"hubproxy/internal/storage"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// Hash fields of a stored event
+const (
+	fieldID                     = "id"
+	fieldType                   = "type"
+	fieldHeaders                = "headers"
+	fieldPayload                = "payload"
+	fieldCreatedAt              = "created_at"
+	fieldReceivedAt             = "received_at"
+	fieldForwardedAt            = "forwarded_at"
+	fieldStatus                 = "status"
+	fieldError                  = "error"
+	fieldRepository             = "repository"
+	fieldSender                 = "sender"
+	fieldReplayedFrom           = "replayed_from"
+	fieldOriginalTime           = "original_time"
+	fieldPayloadHash            = "payload_hash"
+	fieldAttempts               = "attempts"
+	fieldNextAttemptAt          = "next_attempt_at"
+	fieldInstallationTargetType = "installation_target_type"
+	fieldInstallationTargetID   = "installation_target_id"
+	fieldRequestID              = "request_id"
+)
+
+// matchFields are the fields read to filter events, in the order of
+// indexedEvent.values
+var matchFields = []string{
+	fieldType,
+	fieldRepository,
+	fieldSender,
+	fieldInstallationTargetID,
+	fieldPayloadHash,
+	fieldStatus,
+	fieldCreatedAt,
+	fieldReceivedAt,
+	fieldForwardedAt,
+	fieldNextAttemptAt,
+}
+
+// formatTime formats a time to be stored, keeping its sort order as a string.
+// The zero time is stored as "".
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z07:00")
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+func formatTimePtr(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return formatTime(*t)
+}
+
+// encodeEvent returns an event's hash fields and values. Every field is
+// always set, so a stored event's fields can be read without checking for
+// missing ones.
+func encodeEvent(event *storage.Event) []interface{} {
+	return []interface{}{
+		fieldID, event.ID,
+		fieldType, event.Type,
+		fieldHeaders, string(event.Headers),
+		fieldPayload, string(event.Payload),
+		fieldCreatedAt, formatTime(event.CreatedAt),
+		fieldReceivedAt, formatTime(event.ReceivedAt),
+		fieldForwardedAt, formatTimePtr(event.ForwardedAt),
+		fieldStatus, event.Status,
+		fieldError, event.Error,
+		fieldRepository, event.Repository,
+		fieldSender, event.Sender,
+		fieldReplayedFrom, event.ReplayedFrom,
+		fieldOriginalTime, formatTime(event.OriginalTime),
+		fieldPayloadHash, event.PayloadHash,
+		fieldAttempts, event.Attempts,
+		fieldNextAttemptAt, formatTimePtr(event.NextAttemptAt),
+		fieldInstallationTargetType, event.InstallationTargetType,
+		fieldInstallationTargetID, event.InstallationTargetID,
+		fieldRequestID, event.RequestID,
+	}
+}
+
+// decodeEvent builds an event from its hash fields
+func decodeEvent(fields map[string]string) (*storage.Event, error) {
+	event := &storage.Event{
+		ID:                     fields[fieldID],
+		Type:                   fields[fieldType],
+		Status:                 fields[fieldStatus],
+		Error:                  fields[fieldError],
+		Repository:             fields[fieldRepository],
+		Sender:                 fields[fieldSender],
+		ReplayedFrom:           fields[fieldReplayedFrom],
+		PayloadHash:            fields[fieldPayloadHash],
+		InstallationTargetType: fields[fieldInstallationTargetType],
+		InstallationTargetID:   fields[fieldInstallationTargetID],
+		RequestID:              fields[fieldRequestID],
+	}
+	if headers := fields[fieldHeaders]; headers != "" {
+		event.Headers = []byte(headers)
+	}
+	if payload := fields[fieldPayload]; payload != "" {
+		event.Payload = []byte(payload)
+	}
+
+	var err error
+	if event.CreatedAt, err = parseTime(fields[fieldCreatedAt]); err != nil {
+		return nil, fmt.Errorf("parsing created_at of event %s: %w", event.ID, err)
+	}
+	if event.ReceivedAt, err = parseTime(fields[fieldReceivedAt]); err != nil {
+		return nil, fmt.Errorf("parsing received_at of event %s: %w", event.ID, err)
+	}
+	if event.OriginalTime, err = parseTime(fields[fieldOriginalTime]); err != nil {
+		return nil, fmt.Errorf("parsing original_time of event %s: %w", event.ID, err)
+	}
+	if event.ForwardedAt, err = parseTimePtr(fields[fieldForwardedAt]); err != nil {
+		return nil, fmt.Errorf("parsing forwarded_at of event %s: %w", event.ID, err)
+	}
+	if event.NextAttemptAt, err = parseTimePtr(fields[fieldNextAttemptAt]); err != nil {
+		return nil, fmt.Errorf("parsing next_attempt_at of event %s: %w", event.ID, err)
+	}
+	if attempts := fields[fieldAttempts]; attempts != "" {
+		if event.Attempts, err = strconv.Atoi(attempts); err != nil {
+			return nil, fmt.Errorf("parsing attempts of event %s: %w", event.ID, err)
+		}
+	}
+	return event, nil
+}
+
+func parseTimePtr(value string) (*time.Time, error) {
+	t, err := parseTime(value)
+	if err != nil || t.IsZero() {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// indexedEvent is an event's ID and the fields queries filter on
+type indexedEvent struct {
+	id        string
+	createdAt time.Time
+	values    []string
+}
+
+// field returns one of the matchFields
+func (e *indexedEvent) field(name string) string {
+	return e.values[slices.Index(matchFields, name)]
+}
+
+// match returns the events matching the query options, ignoring the limit
+// and offset, in created_at order with the ID breaking ties
+func (s *Storage) match(ctx context.Context, opts storage.QueryOptions) ([]*indexedEvent, error) {
+	// The created_at index narrows the time range; the pending set holds
+	// fewer events when only those are wanted
+	key := s.eventsKey()
+	if opts.OnlyNonForwarded {
+		key = s.pendingKey()
+	}
+	rangeBy := &goredis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if !opts.Since.IsZero() {
+		rangeBy.Min = strconv.FormatInt(opts.Since.UnixMicro(), 10)
+	}
+	if !opts.Until.IsZero() {
+		rangeBy.Max = strconv.FormatInt(opts.Until.UnixMicro(), 10)
+	}
+
+	ids, err := s.client.ZRangeByScore(ctx, key, rangeBy).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []*indexedEvent
+	for start := 0; start < len(ids); start += batchSize {
+		batch := ids[start:min(start+batchSize, len(ids))]
+
+		pipe := s.client.Pipeline()
+		cmds := make([]*goredis.SliceCmd, len(batch))
+		for i, id := range batch {
+			cmds[i] = pipe.HMGet(ctx, s.eventKey(id), matchFields...)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+
+		for i, cmd := range cmds {
+			event, err := newIndexedEvent(batch[i], cmd.Val())
+			if err != nil {
+				return nil, err
+			}
+			// Deleted since the index was read
+			if event == nil {
+				continue
+			}
+			if event.matches(opts) {
+				matched = append(matched, event)
+			}
+		}
+	}
+	return matched, nil
+}
+
+func newIndexedEvent(id string, raw []interface{}) (*indexedEvent, error) {
+	values := make([]string, len(raw))
+	set := false
+	for i, v := range raw {
+		if str, ok := v.(string); ok {
+			values[i] = str
+			set = true
+		}
+	}
+	if !set {
+		return nil, nil
+	}
+
+	event := &indexedEvent{id: id, values: values}
+	createdAt, err := parseTime(event.field(fieldCreatedAt))
+	if err != nil {
+		return nil, fmt.Errorf("parsing created_at of event %s: %w", id, err)
+	}
+	event.createdAt = createdAt
+	return event, nil
+}
+
+// matches applies the query options the indexes don't. Times are compared
+// as stored strings, which sort in time order.
+func (e *indexedEvent) matches(opts storage.QueryOptions) bool {
+	if opts.IDPrefix != "" && !strings.HasPrefix(e.id, opts.IDPrefix) {
+		return false
+	}
+	if len(opts.Types) > 0 && !slices.Contains(opts.Types, e.field(fieldType)) {
+		return false
+	}
+	// Scores are in microseconds, so check the exact bounds
+	if !opts.Since.IsZero() && e.createdAt.Before(opts.Since) {
+		return false
+	}
+	if !opts.Until.IsZero() && e.createdAt.After(opts.Until) {
+		return false
+	}
+	if opts.Repository != "" && e.field(fieldRepository) != opts.Repository {
+		return false
+	}
+	if opts.Sender != "" && e.field(fieldSender) != opts.Sender {
+		return false
+	}
+	if opts.InstallationTargetID != "" && e.field(fieldInstallationTargetID) != opts.InstallationTargetID {
+		return false
+	}
+	if opts.PayloadHash != "" && e.field(fieldPayloadHash) != opts.PayloadHash {
+		return false
+	}
+	if !opts.ReceivedSince.IsZero() {
+		receivedAt := e.field(fieldReceivedAt)
+		if receivedAt == "" || receivedAt < formatTime(opts.ReceivedSince) {
+			return false
+		}
+	}
+	if len(opts.Statuses) > 0 && !slices.Contains(opts.Statuses, e.field(fieldStatus)) {
+		return false
+	}
+	if opts.OnlyNonForwarded && !pending(e.field(fieldForwardedAt) != "", e.field(fieldStatus)) {
+		return false
+	}
+	if !opts.DueBy.IsZero() && e.field(fieldNextAttemptAt) > formatTime(opts.DueBy) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,729 @@
+// Package redis stores events in Redis, for high-throughput deployments that
+// only keep events for a short time.
+//
+// Each event is a hash. A sorted set of every event ID scored by created_at
+// serves time range queries, a second sorted set holds the events still
+// waiting to be forwarded, and a hash counts events per type for GetStats.
+// Writes that touch several keys run as Lua scripts, so each is atomic.
+//
+// Queries other than by ID or time range filter events in the proxy rather
+// than in Redis, reading the indexed fields of every event in the time range,
+// so they slow down as more events are kept. Redis only persists events as
+// durably as it's configured to: with the default snapshotting, events
+// received since the last snapshot are lost if Redis restarts. Redis Cluster
+// isn't supported, since the scripts touch keys in different slots.
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"hubproxy/internal/storage"
+
+	"github.com/google/uuid"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// DefaultKeyPrefix prefixes every key HubProxy creates
+const DefaultKeyPrefix = "hubproxy:"
+
+// claimTimeout is how long a claim holds before the event can be claimed
+// again, so events claimed by a worker that died aren't stuck forever
+const claimTimeout = 5 * time.Minute
+
+// batchSize is how many events are read or deleted per round trip
+const batchSize = 500
+
+// Option configures Redis storage
+type Option func(*Storage)
+
+// WithKeyPrefix sets the prefix of every key, so several HubProxy instances
+// can share a Redis database
+func WithKeyPrefix(prefix string) Option {
+	return func(s *Storage) {
+		s.prefix = prefix
+	}
+}
+
+// Storage implements storage.Storage on Redis
+type Storage struct {
+	client *goredis.Client
+	prefix string
+}
+
+// New connects to the Redis server at a redis:// or rediss:// URI
+func New(uri string, opts ...Option) (*Storage, error) {
+	redisOpts, err := goredis.ParseURL(uri)
+	if err != nil {
+		// url.Parse errors quote the whole URL, password included
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+
+	s := &Storage{
+		client: goredis.NewClient(redisOpts),
+		prefix: DefaultKeyPrefix,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := s.client.Ping(context.Background()).Err(); err != nil {
+		s.client.Close()
+		return nil, fmt.Errorf("pinging Redis: %w", err)
+	}
+	return s, nil
+}
+
+func (s *Storage) eventKey(id string) string { return s.prefix + "event:" + id }
+func (s *Storage) eventsKey() string         { return s.prefix + "events" }
+func (s *Storage) pendingKey() string        { return s.prefix + "pending" }
+func (s *Storage) typeCountsKey() string     { return s.prefix + "stats:type" }
+
+// score orders events by created_at. Microseconds stay exact in a float64;
+// events in the same microsecond are ordered by ID, as Redis orders members
+// with equal scores.
+func score(t time.Time) float64 {
+	return float64(t.UnixMicro())
+}
+
+// pending reports whether an event is still waiting to be forwarded
+func pending(forwarded bool, status string) bool {
+	return !forwarded && !slices.Contains(storage.SettledStatuses, status)
+}
+
+// storeScript stores an event unless its key exists, indexing it and counting
+// it under its type.
+// KEYS: event, events, pending, type counts
+// ARGV: id, score, pending flag, type, then the event's field/value pairs
+var storeScript = goredis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], unpack(ARGV, 5))
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+if ARGV[3] == '1' then
+	redis.call('ZADD', KEYS[3], ARGV[2], ARGV[1])
+end
+redis.call('HINCRBY', KEYS[4], ARGV[4], 1)
+return 1
+`)
+
+// markForwardedScript sets forwarded_at, clears the next attempt and removes
+// the event from the pending set.
+// KEYS: event, pending
+// ARGV: id, forwarded_at
+var markForwardedScript = goredis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'forwarded_at', ARGV[2], 'next_attempt_at', '')
+redis.call('ZREM', KEYS[2], ARGV[1])
+return 1
+`)
+
+// updateStatusScript sets the status, moving the event out of the pending
+// set if it's now settled, clearing its next attempt, or back into it if it's
+// pending again.
+// KEYS: event, events, pending
+// ARGV: id, status, settled flag
+var updateStatusScript = goredis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'status', ARGV[2])
+if ARGV[3] == '1' then
+	redis.call('HSET', KEYS[1], 'next_attempt_at', '')
+end
+local forwarded = redis.call('HGET', KEYS[1], 'forwarded_at')
+if ARGV[3] == '1' or (forwarded and forwarded ~= '') then
+	redis.call('ZREM', KEYS[3], ARGV[1])
+else
+	local score = redis.call('ZSCORE', KEYS[2], ARGV[1])
+	if score then
+		redis.call('ZADD', KEYS[3], score, ARGV[1])
+	end
+end
+return 1
+`)
+
+// incrementAttemptsScript adds one to an existing event's attempts.
+// KEYS: event
+var incrementAttemptsScript = goredis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HINCRBY', KEYS[1], 'attempts', 1)
+return 1
+`)
+
+// scheduleNextAttemptScript sets an existing event's next attempt.
+// KEYS: event
+// ARGV: next attempt time
+var scheduleNextAttemptScript = goredis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'next_attempt_at', ARGV[1])
+return 1
+`)
+
+// deleteScript deletes events, unindexing them and uncounting them from
+// their type. With the settled-only flag, events still pending are kept.
+// KEYS: events, pending, type counts, then each event's key
+// ARGV: settled-only flag, then each event's ID
+var deleteScript = goredis.NewScript(`
+local deleted = 0
+for i = 2, #ARGV do
+	local id = ARGV[i]
+	local key = KEYS[i + 2]
+	if ARGV[1] ~= '1' or not redis.call('ZSCORE', KEYS[2], id) then
+		local eventType = redis.call('HGET', KEYS[i + 2], 'type')
+		if redis.call('DEL', key) == 1 then
+			redis.call('ZREM', KEYS[1], id)
+			redis.call('ZREM', KEYS[2], id)
+			if eventType and redis.call('HINCRBY', KEYS[3], eventType, -1) <= 0 then
+				redis.call('HDEL', KEYS[3], eventType)
+			end
+			deleted = deleted + 1
+		end
+	end
+end
+return deleted
+`)
+
+// claimScript claims up to n pending events not claimed since the stale
+// cutoff, oldest first, and returns their IDs.
+// KEYS: pending
+// ARGV: n, worker ID, now and stale cutoff in Unix microseconds, event key prefix
+var claimScript = goredis.NewScript(`
+local n = tonumber(ARGV[1])
+local cutoff = tonumber(ARGV[4])
+local claimed = {}
+local start = 0
+while #claimed < n do
+	local ids = redis.call('ZRANGE', KEYS[1], start, start + 99)
+	if #ids == 0 then
+		break
+	end
+	for _, id in ipairs(ids) do
+		local key = ARGV[5] .. id
+		local claimedAt = tonumber(redis.call('HGET', key, 'claimed_at') or '')
+		if claimedAt == nil or claimedAt < cutoff then
+			redis.call('HSET', key, 'claimed_by', ARGV[2], 'claimed_at', ARGV[3])
+			table.insert(claimed, id)
+			if #claimed >= n then
+				break
+			end
+		end
+	end
+	start = start + 100
+end
+return claimed
+`)
+
+// StoreEvent stores a webhook event
+func (s *Storage) StoreEvent(ctx context.Context, event *storage.Event) error {
+	_, err := s.StoreEventIfNew(ctx, event)
+	return err
+}
+
+// StoreEventIfNew stores an event unless one with the same ID is already
+// stored, and reports whether it was inserted
+func (s *Storage) StoreEventIfNew(ctx context.Context, event *storage.Event) (bool, error) {
+	if event.ID == "" {
+		event.ID = uuid.New().String()
+	}
+	if event.PayloadHash == "" {
+		event.PayloadHash = storage.PayloadHash(event.Payload)
+	}
+
+	pendingFlag := "0"
+	if pending(event.ForwardedAt != nil, event.Status) {
+		pendingFlag = "1"
+	}
+	args := append([]interface{}{event.ID, score(event.CreatedAt), pendingFlag, event.Type}, encodeEvent(event)...)
+
+	inserted, err := storeScript.Run(ctx, s.client,
+		[]string{s.eventKey(event.ID), s.eventsKey(), s.pendingKey(), s.typeCountsKey()},
+		args...,
+	).Int()
+	if err != nil {
+		return false, fmt.Errorf("inserting event: %w", err)
+	}
+	return inserted == 1, nil
+}
+
+// MarkForwarded marks an event as forwarded by setting the forwarded_at timestamp
+func (s *Storage) MarkForwarded(ctx context.Context, id string) error {
+	found, err := markForwardedScript.Run(ctx, s.client,
+		[]string{s.eventKey(id), s.pendingKey()},
+		id, formatTime(time.Now()),
+	).Int()
+	if err != nil {
+		return fmt.Errorf("marking event as forwarded: %w", err)
+	}
+	if found == 0 {
+		return fmt.Errorf("event not found")
+	}
+	return nil
+}
+
+// UpdateEventStatus sets the status of an event
+func (s *Storage) UpdateEventStatus(ctx context.Context, id string, status string) error {
+	settled := "0"
+	if slices.Contains(storage.SettledStatuses, status) {
+		settled = "1"
+	}
+
+	found, err := updateStatusScript.Run(ctx, s.client,
+		[]string{s.eventKey(id), s.eventsKey(), s.pendingKey()},
+		id, status, settled,
+	).Int()
+	if err != nil {
+		return fmt.Errorf("updating event status: %w", err)
+	}
+	if found == 0 {
+		return fmt.Errorf("event not found")
+	}
+	return nil
+}
+
+// ScheduleNextAttempt records when an event's next forward attempt is due
+func (s *Storage) ScheduleNextAttempt(ctx context.Context, id string, at time.Time) error {
+	found, err := scheduleNextAttemptScript.Run(ctx, s.client, []string{s.eventKey(id)}, formatTime(at)).Int()
+	if err != nil {
+		return fmt.Errorf("scheduling next attempt: %w", err)
+	}
+	if found == 0 {
+		return fmt.Errorf("event not found")
+	}
+	return nil
+}
+
+// IncrementAttempts adds one to the number of forward attempts of an event
+func (s *Storage) IncrementAttempts(ctx context.Context, id string) error {
+	found, err := incrementAttemptsScript.Run(ctx, s.client, []string{s.eventKey(id)}).Int()
+	if err != nil {
+		return fmt.Errorf("incrementing attempts: %w", err)
+	}
+	if found == 0 {
+		return fmt.Errorf("event not found")
+	}
+	return nil
+}
+
+// ClaimPendingEvents claims up to n pending, unclaimed events for workerID
+// and returns them, oldest first
+func (s *Storage) ClaimPendingEvents(ctx context.Context, n int, workerID string) ([]*storage.Event, error) {
+	if workerID == "" {
+		return nil, fmt.Errorf("worker ID is required")
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	ids, err := claimScript.Run(ctx, s.client,
+		[]string{s.pendingKey()},
+		n, workerID, now.UnixMicro(), now.Add(-claimTimeout).UnixMicro(), s.eventKey(""),
+	).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("claiming pending events: %w", err)
+	}
+	return s.loadEvents(ctx, ids)
+}
+
+// DeleteEventsKeepingLatestN deletes all but the perRepo most recent events
+// of each repository
+func (s *Storage) DeleteEventsKeepingLatestN(ctx context.Context, perRepo int) (int64, error) {
+	if perRepo < 0 {
+		return 0, fmt.Errorf("events to keep per repository must not be negative")
+	}
+
+	events, err := s.match(ctx, storage.QueryOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("deleting old events: %w", err)
+	}
+
+	// Newest first, so each repository's first perRepo events are kept
+	kept := make(map[string]int)
+	var ids []string
+	for i := len(events) - 1; i >= 0; i-- {
+		repository := events[i].field(fieldRepository)
+		if kept[repository] < perRepo {
+			kept[repository]++
+			continue
+		}
+		ids = append(ids, events[i].id)
+	}
+
+	deleted, err := s.deleteEvents(ctx, ids, false)
+	if err != nil {
+		return 0, fmt.Errorf("deleting old events: %w", err)
+	}
+	return deleted, nil
+}
+
+// DeleteOldestSettledEvents deletes up to n of the oldest settled events,
+// ordered by created_at with the ID breaking ties, leaving pending ones for
+// the forwarder
+func (s *Storage) DeleteOldestSettledEvents(ctx context.Context, n int) (int64, error) {
+	var ids []string
+	for start := int64(0); len(ids) < n; start += batchSize {
+		batch, err := s.client.ZRange(ctx, s.eventsKey(), start, start+batchSize-1).Result()
+		if err != nil {
+			return 0, fmt.Errorf("finding oldest settled events: %w", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		pipe := s.client.Pipeline()
+		cmds := make([]*goredis.FloatCmd, len(batch))
+		for i, id := range batch {
+			cmds[i] = pipe.ZScore(ctx, s.pendingKey(), id)
+		}
+		// Exec returns redis.Nil for every event that isn't pending
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, goredis.Nil) {
+			return 0, fmt.Errorf("finding oldest settled events: %w", err)
+		}
+		for i, cmd := range cmds {
+			if errors.Is(cmd.Err(), goredis.Nil) && len(ids) < n {
+				ids = append(ids, batch[i])
+			}
+		}
+	}
+
+	deleted, err := s.deleteEvents(ctx, ids, true)
+	if err != nil {
+		return 0, fmt.Errorf("deleting oldest settled events: %w", err)
+	}
+	return deleted, nil
+}
+
+// DeleteEvent deletes a single event by ID
+func (s *Storage) DeleteEvent(ctx context.Context, id string) error {
+	deleted, err := s.deleteEvents(ctx, []string{id}, false)
+	if err != nil {
+		return fmt.Errorf("deleting event: %w", err)
+	}
+	if deleted == 0 {
+		return storage.ErrEventNotFound
+	}
+	return nil
+}
+
+// DeleteEventsBefore deletes settled events created before cutoff, leaving
+// pending ones for the forwarder
+func (s *Storage) DeleteEventsBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	events, err := s.match(ctx, storage.QueryOptions{Until: cutoff})
+	if err != nil {
+		return 0, fmt.Errorf("deleting events before cutoff: %w", err)
+	}
+
+	var ids []string
+	for _, event := range events {
+		if event.createdAt.Before(cutoff) {
+			ids = append(ids, event.id)
+		}
+	}
+
+	deleted, err := s.deleteEvents(ctx, ids, true)
+	if err != nil {
+		return 0, fmt.Errorf("deleting events before cutoff: %w", err)
+	}
+	return deleted, nil
+}
+
+// deleteEvents deletes events in batches, keeping pending ones if
+// onlySettled is set, and returns the number deleted
+func (s *Storage) deleteEvents(ctx context.Context, ids []string, onlySettled bool) (int64, error) {
+	flag := "0"
+	if onlySettled {
+		flag = "1"
+	}
+
+	var deleted int64
+	for start := 0; start < len(ids); start += batchSize {
+		batch := ids[start:min(start+batchSize, len(ids))]
+
+		keys := []string{s.eventsKey(), s.pendingKey(), s.typeCountsKey()}
+		args := []interface{}{flag}
+		for _, id := range batch {
+			keys = append(keys, s.eventKey(id))
+			args = append(args, id)
+		}
+
+		n, err := deleteScript.Run(ctx, s.client, keys, args...).Int64()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// LatestEventsPerRepository returns the most recent event matching the
+// query options for each repository, ordered by repository
+func (s *Storage) LatestEventsPerRepository(ctx context.Context, opts storage.QueryOptions) ([]*storage.Event, error) {
+	events, err := s.match(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("querying latest events: %w", err)
+	}
+
+	latest := make(map[string]string)
+	for i := len(events) - 1; i >= 0; i-- {
+		repository := events[i].field(fieldRepository)
+		if _, ok := latest[repository]; !ok {
+			latest[repository] = events[i].id
+		}
+	}
+
+	repositories := make([]string, 0, len(latest))
+	for repository := range latest {
+		repositories = append(repositories, repository)
+	}
+	sort.Strings(repositories)
+
+	ids := make([]string, 0, len(repositories))
+	for _, repository := range repositories {
+		ids = append(ids, latest[repository])
+	}
+	return s.loadEvents(ctx, ids)
+}
+
+// sortFields are the fields ListEvents may order by
+var sortFields = map[string]string{
+	storage.SortByCreatedAt:  fieldCreatedAt,
+	storage.SortByType:       fieldType,
+	storage.SortByRepository: fieldRepository,
+}
+
+// ListEvents lists webhook events based on query options
+func (s *Storage) ListEvents(ctx context.Context, opts storage.QueryOptions) ([]*storage.Event, int, error) {
+	sortBy := opts.SortBy
+	if sortBy == "" {
+		sortBy = storage.SortByCreatedAt
+	}
+	field, ok := sortFields[sortBy]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %q", storage.ErrInvalidSort, sortBy)
+	}
+
+	events, err := s.match(ctx, opts)
+	if err != nil {
+		return nil, 0, fmt.Errorf("querying events: %w", err)
+	}
+
+	// Events are already in created_at order, with the ID breaking ties
+	if field != fieldCreatedAt {
+		sort.Slice(events, func(i, j int) bool {
+			a, b := events[i].field(field), events[j].field(field)
+			if a != b {
+				return a < b
+			}
+			return events[i].id < events[j].id
+		})
+	}
+	if opts.SortDesc {
+		slices.Reverse(events)
+	}
+
+	total := len(events)
+	events = page(events, opts.Limit, opts.Offset)
+
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.id
+	}
+	loaded, err := s.loadEvents(ctx, ids)
+	if err != nil {
+		return nil, 0, fmt.Errorf("querying events: %w", err)
+	}
+	return loaded, total, nil
+}
+
+// IterateEvents calls fn for each matching event, oldest first, reading
+// events in batches
+func (s *Storage) IterateEvents(ctx context.Context, opts storage.QueryOptions, fn func(*storage.Event) error) error {
+	events, err := s.match(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("querying events: %w", err)
+	}
+	events = page(events, opts.Limit, opts.Offset)
+
+	for start := 0; start < len(events); start += batchSize {
+		batch := events[start:min(start+batchSize, len(events))]
+		ids := make([]string, len(batch))
+		for i, event := range batch {
+			ids[i] = event.id
+		}
+
+		loaded, err := s.loadEvents(ctx, ids)
+		if err != nil {
+			return fmt.Errorf("querying events: %w", err)
+		}
+		for _, event := range loaded {
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CountEvents returns the number of events matching the query options
+func (s *Storage) CountEvents(ctx context.Context, opts storage.QueryOptions) (int, error) {
+	events, err := s.match(ctx, opts)
+	if err != nil {
+		return 0, fmt.Errorf("counting events: %w", err)
+	}
+	return len(events), nil
+}
+
+// GetStats returns event type statistics
+func (s *Storage) GetStats(ctx context.Context, since time.Time) (map[string]int64, error) {
+	return s.GetStatsBy(ctx, storage.StatsByType, since)
+}
+
+// statsFields are the fields GetStatsBy may group by
+var statsFields = map[string]string{
+	storage.StatsByType:       fieldType,
+	storage.StatsByRepository: fieldRepository,
+	storage.StatsBySender:     fieldSender,
+	storage.StatsByStatus:     fieldStatus,
+}
+
+// GetStatsBy returns event counts grouped by dimension. Counts of all events
+// by type come from the per-type counters; anything else reads every event
+// in range.
+func (s *Storage) GetStatsBy(ctx context.Context, dimension string, since time.Time) (map[string]int64, error) {
+	field, ok := statsFields[dimension]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", storage.ErrInvalidStats, dimension)
+	}
+
+	stats := make(map[string]int64)
+	if field == fieldType && since.IsZero() {
+		counts, err := s.client.HGetAll(ctx, s.typeCountsKey()).Result()
+		if err != nil {
+			return nil, fmt.Errorf("querying stats: %w", err)
+		}
+		for eventType, count := range counts {
+			n, err := strconv.ParseInt(count, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parsing count of %q events: %w", eventType, err)
+			}
+			if n > 0 {
+				stats[eventType] = n
+			}
+		}
+		return stats, nil
+	}
+
+	events, err := s.match(ctx, storage.QueryOptions{Since: since})
+	if err != nil {
+		return nil, fmt.Errorf("querying stats: %w", err)
+	}
+	for _, event := range events {
+		stats[event.field(field)]++
+	}
+	return stats, nil
+}
+
+// GetEvent returns a single event by ID, or nil if there's no such event
+func (s *Storage) GetEvent(ctx context.Context, id string) (*storage.Event, error) {
+	fields, err := s.client.HGetAll(ctx, s.eventKey(id)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("getting event: %w", err)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return decodeEvent(fields)
+}
+
+// GetEvents returns the events with the given IDs, keyed by ID
+func (s *Storage) GetEvents(ctx context.Context, ids []string) (map[string]*storage.Event, error) {
+	loaded, err := s.loadEvents(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("getting events: %w", err)
+	}
+
+	events := make(map[string]*storage.Event, len(loaded))
+	for _, event := range loaded {
+		events[event.ID] = event
+	}
+	return events, nil
+}
+
+// loadEvents reads events by ID in batches, keeping their order and skipping
+// IDs that don't exist
+func (s *Storage) loadEvents(ctx context.Context, ids []string) ([]*storage.Event, error) {
+	events := make([]*storage.Event, 0, len(ids))
+
+	for start := 0; start < len(ids); start += batchSize {
+		batch := ids[start:min(start+batchSize, len(ids))]
+
+		pipe := s.client.Pipeline()
+		cmds := make([]*goredis.MapStringStringCmd, len(batch))
+		for i, id := range batch {
+			cmds[i] = pipe.HGetAll(ctx, s.eventKey(id))
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+
+		for _, cmd := range cmds {
+			fields := cmd.Val()
+			if len(fields) == 0 {
+				continue
+			}
+			event, err := decodeEvent(fields)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// CreateSchema does nothing, since Redis keys need no schema
+func (s *Storage) CreateSchema(ctx context.Context) error {
+	return nil
+}
+
+// Ping checks that Redis is reachable
+func (s *Storage) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+// Close closes the connections to Redis
+func (s *Storage) Close() error {
+	return s.client.Close()
+}
+
+// page applies a limit and offset to matching events
+func page[T any](items []T, limit, offset int) []T {
+	if offset > 0 {
+		if offset >= len(items) {
+			return nil
+		}
+		items = items[offset:]
+	}
+	if limit > 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
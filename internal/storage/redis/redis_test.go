@@ -0,0 +1,241 @@
+package redis_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"hubproxy/internal/storage"
+	"hubproxy/internal/storage/redis"
+	"hubproxy/internal/storage/storagetest"
+)
+
+// newTestStorage connects to the Redis server at REDIS_URL under a key prefix
+// of its own, deleting its keys when the test ends
+func newTestStorage(t *testing.T) *redis.Storage {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		t.Skip("Skipping Redis test - set REDIS_URL to run it")
+	}
+
+	prefix := fmt.Sprintf("hubproxy-test:%d:", time.Now().UnixNano())
+	store, err := redis.New(redisURL, redis.WithKeyPrefix(prefix))
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		defer store.Close()
+
+		opts, err := goredis.ParseURL(redisURL)
+		require.NoError(t, err)
+		client := goredis.NewClient(opts)
+		defer client.Close()
+
+		ctx := context.Background()
+		iter := client.Scan(ctx, 0, prefix+"*", 0).Iterator()
+		for iter.Next(ctx) {
+			client.Del(ctx, iter.Val())
+		}
+		require.NoError(t, iter.Err())
+	})
+	return store
+}
+
+func newEvent(id, eventType, repository string, createdAt time.Time) *storage.Event {
+	return &storage.Event{
+		ID:         id,
+		Type:       eventType,
+		Headers:    []byte(`{"X-GitHub-Event": ["` + eventType + `"]}`),
+		Payload:    []byte(`{"ref": "refs/heads/main"}`),
+		CreatedAt:  createdAt,
+		ReceivedAt: createdAt,
+		Repository: repository,
+		Sender:     "test-user",
+	}
+}
+
+func TestConformance(t *testing.T) {
+	if os.Getenv("REDIS_URL") == "" {
+		t.Skip("Skipping Redis test - set REDIS_URL to run it")
+	}
+	storagetest.RunConformance(t, func() storage.Storage {
+		return newTestStorage(t)
+	})
+}
+
+func TestRedisStorage(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStorage(t)
+	require.NoError(t, store.Ping(ctx))
+
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	events := []*storage.Event{
+		newEvent("event-1", "push", "test/repo", base),
+		newEvent("event-2", "pull_request", "test/repo", base.Add(time.Minute)),
+		newEvent("event-3", "push", "other/repo", base.Add(2*time.Minute)),
+		newEvent("event-4", "push", "test/repo", base.Add(3*time.Minute)),
+	}
+	for _, event := range events {
+		require.NoError(t, store.StoreEvent(ctx, event))
+	}
+
+	t.Run("Store and get", func(t *testing.T) {
+		event, err := store.GetEvent(ctx, "event-1")
+		require.NoError(t, err)
+		require.NotNil(t, event)
+		assert.Equal(t, "push", event.Type)
+		assert.Equal(t, "test/repo", event.Repository)
+		assert.JSONEq(t, `{"ref": "refs/heads/main"}`, string(event.Payload))
+		assert.True(t, base.Equal(event.CreatedAt))
+		assert.Nil(t, event.ForwardedAt)
+		assert.NotEmpty(t, event.PayloadHash)
+
+		missing, err := store.GetEvent(ctx, "missing")
+		require.NoError(t, err)
+		assert.Nil(t, missing)
+	})
+
+	t.Run("Store if new", func(t *testing.T) {
+		duplicate := newEvent("event-1", "issues", "test/repo", base)
+		inserted, err := store.StoreEventIfNew(ctx, duplicate)
+		require.NoError(t, err)
+		assert.False(t, inserted)
+
+		event, err := store.GetEvent(ctx, "event-1")
+		require.NoError(t, err)
+		assert.Equal(t, "push", event.Type)
+	})
+
+	t.Run("List with filters", func(t *testing.T) {
+		listed, total, err := store.ListEvents(ctx, storage.QueryOptions{
+			Types:      []string{"push"},
+			Repository: "test/repo",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 2, total)
+		require.Len(t, listed, 2)
+		assert.Equal(t, "event-1", listed[0].ID)
+		assert.Equal(t, "event-4", listed[1].ID)
+
+		listed, total, err = store.ListEvents(ctx, storage.QueryOptions{
+			Since:    base.Add(time.Minute),
+			Until:    base.Add(2 * time.Minute),
+			SortDesc: true,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 2, total)
+		require.Len(t, listed, 2)
+		assert.Equal(t, "event-3", listed[0].ID)
+		assert.Equal(t, "event-2", listed[1].ID)
+
+		listed, total, err = store.ListEvents(ctx, storage.QueryOptions{Limit: 2, Offset: 1})
+		require.NoError(t, err)
+		assert.Equal(t, 4, total)
+		require.Len(t, listed, 2)
+		assert.Equal(t, "event-2", listed[0].ID)
+
+		_, _, err = store.ListEvents(ctx, storage.QueryOptions{SortBy: "payload"})
+		assert.ErrorIs(t, err, storage.ErrInvalidSort)
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		stats, err := store.GetStats(ctx, time.Time{})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int64{"push": 3, "pull_request": 1}, stats)
+
+		stats, err = store.GetStatsBy(ctx, storage.StatsByRepository, base.Add(time.Minute))
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int64{"test/repo": 2, "other/repo": 1}, stats)
+
+		_, err = store.GetStatsBy(ctx, "payload", time.Time{})
+		assert.ErrorIs(t, err, storage.ErrInvalidStats)
+	})
+
+	t.Run("Forwarding", func(t *testing.T) {
+		count, err := store.CountEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true})
+		require.NoError(t, err)
+		assert.Equal(t, 4, count)
+
+		require.NoError(t, store.MarkForwarded(ctx, "event-1"))
+		require.NoError(t, store.UpdateEventStatus(ctx, "event-2", storage.StatusFailed))
+		require.NoError(t, store.IncrementAttempts(ctx, "event-3"))
+
+		pending, _, err := store.ListEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true})
+		require.NoError(t, err)
+		require.Len(t, pending, 2)
+		assert.Equal(t, "event-3", pending[0].ID)
+		assert.Equal(t, 1, pending[0].Attempts)
+
+		event, err := store.GetEvent(ctx, "event-1")
+		require.NoError(t, err)
+		assert.NotNil(t, event.ForwardedAt)
+
+		assert.Error(t, store.MarkForwarded(ctx, "missing"))
+		assert.Error(t, store.UpdateEventStatus(ctx, "missing", storage.StatusFailed))
+		assert.Error(t, store.IncrementAttempts(ctx, "missing"))
+	})
+
+	t.Run("Claim pending events", func(t *testing.T) {
+		claimed, err := store.ClaimPendingEvents(ctx, 1, "worker-1")
+		require.NoError(t, err)
+		require.Len(t, claimed, 1)
+		assert.Equal(t, "event-3", claimed[0].ID)
+
+		claimed, err = store.ClaimPendingEvents(ctx, 10, "worker-2")
+		require.NoError(t, err)
+		require.Len(t, claimed, 1)
+		assert.Equal(t, "event-4", claimed[0].ID)
+
+		claimed, err = store.ClaimPendingEvents(ctx, 10, "worker-3")
+		require.NoError(t, err)
+		assert.Empty(t, claimed)
+	})
+
+	t.Run("Latest per repository", func(t *testing.T) {
+		latest, err := store.LatestEventsPerRepository(ctx, storage.QueryOptions{})
+		require.NoError(t, err)
+		require.Len(t, latest, 2)
+		assert.Equal(t, "event-3", latest[0].ID)
+		assert.Equal(t, "event-4", latest[1].ID)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		// event-1 was forwarded and event-2 failed; event-3 is still pending
+		deleted, err := store.DeleteEventsBefore(ctx, base.Add(150*time.Second))
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), deleted)
+
+		stats, err := store.GetStats(ctx, time.Time{})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int64{"push": 2}, stats)
+
+		require.NoError(t, store.DeleteEvent(ctx, "event-3"))
+		require.NoError(t, store.DeleteEvent(ctx, "event-4"))
+		assert.ErrorIs(t, store.DeleteEvent(ctx, "event-4"), storage.ErrEventNotFound)
+
+		count, err := store.CountEvents(ctx, storage.QueryOptions{})
+		require.NoError(t, err)
+		assert.Zero(t, count)
+	})
+
+	t.Run("Keep latest per repository", func(t *testing.T) {
+		for i := range 3 {
+			event := newEvent(fmt.Sprintf("keep-%d", i), "push", "test/repo", base.Add(time.Duration(i)*time.Minute))
+			require.NoError(t, store.StoreEvent(ctx, event))
+		}
+
+		deleted, err := store.DeleteEventsKeepingLatestN(ctx, 1)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), deleted)
+
+		events, err := store.GetEvents(ctx, []string{"keep-0", "keep-1", "keep-2"})
+		require.NoError(t, err)
+		assert.Len(t, events, 1)
+		assert.Contains(t, events, "keep-2")
+	})
+}
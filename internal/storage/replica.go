@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ReplicaStorage sends writes to a primary and reads to a read replica.
+// Lookups by ID fall back to the primary when the replica hasn't caught up yet.
+type ReplicaStorage struct {
+	primary Storage
+	replica Storage
+}
+
+// NewReplicaStorage creates a Storage that splits reads and writes between primary and replica
+func NewReplicaStorage(primary, replica Storage) *ReplicaStorage {
+	return &ReplicaStorage{
+		primary: primary,
+		replica: replica,
+	}
+}
+
+// StoreEvent stores a webhook event on the primary
+func (s *ReplicaStorage) StoreEvent(ctx context.Context, event *Event) error {
+	return s.primary.StoreEvent(ctx, event)
+}
+
+// StoreEventIfNew stores a webhook event on the primary unless it's already there
+func (s *ReplicaStorage) StoreEventIfNew(ctx context.Context, event *Event) (bool, error) {
+	return s.primary.StoreEventIfNew(ctx, event)
+}
+
+// MarkForwarded marks an event as forwarded on the primary
+func (s *ReplicaStorage) MarkForwarded(ctx context.Context, id string) error {
+	return s.primary.MarkForwarded(ctx, id)
+}
+
+// UpdateEventStatus sets the status of an event on the primary
+func (s *ReplicaStorage) UpdateEventStatus(ctx context.Context, id string, status string) error {
+	return s.primary.UpdateEventStatus(ctx, id, status)
+}
+
+// DeleteEventsKeepingLatestN prunes old events on the primary
+func (s *ReplicaStorage) DeleteEventsKeepingLatestN(ctx context.Context, perRepo int) (int64, error) {
+	return s.primary.DeleteEventsKeepingLatestN(ctx, perRepo)
+}
+
+// IncrementAttempts records a forward attempt on the primary
+func (s *ReplicaStorage) IncrementAttempts(ctx context.Context, id string) error {
+	return s.primary.IncrementAttempts(ctx, id)
+}
+
+// ClaimPendingEvents claims pending events on the primary, since claiming writes
+func (s *ReplicaStorage) ClaimPendingEvents(ctx context.Context, n int, workerID string) ([]*Event, error) {
+	return s.primary.ClaimPendingEvents(ctx, n, workerID)
+}
+
+// ScheduleNextAttempt records when an event's next forward attempt is due on the primary
+func (s *ReplicaStorage) ScheduleNextAttempt(ctx context.Context, id string, at time.Time) error {
+	return s.primary.ScheduleNextAttempt(ctx, id, at)
+}
+
+// DeleteOldestSettledEvents prunes the oldest settled events on the primary
+func (s *ReplicaStorage) DeleteOldestSettledEvents(ctx context.Context, n int) (int64, error) {
+	return s.primary.DeleteOldestSettledEvents(ctx, n)
+}
+
+// DeleteEvent deletes a single event on the primary
+func (s *ReplicaStorage) DeleteEvent(ctx context.Context, id string) error {
+	return s.primary.DeleteEvent(ctx, id)
+}
+
+// DeleteEventsBefore prunes settled events older than cutoff on the primary
+func (s *ReplicaStorage) DeleteEventsBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	return s.primary.DeleteEventsBefore(ctx, cutoff)
+}
+
+// ListEvents lists webhook events from the replica
+func (s *ReplicaStorage) ListEvents(ctx context.Context, opts QueryOptions) ([]*Event, int, error) {
+	return s.replica.ListEvents(ctx, opts)
+}
+
+// LatestEventsPerRepository returns each repository's latest matching event from the replica
+func (s *ReplicaStorage) LatestEventsPerRepository(ctx context.Context, opts QueryOptions) ([]*Event, error) {
+	return s.replica.LatestEventsPerRepository(ctx, opts)
+}
+
+// IterateEvents streams matching events from the replica
+func (s *ReplicaStorage) IterateEvents(ctx context.Context, opts QueryOptions, fn func(*Event) error) error {
+	return s.replica.IterateEvents(ctx, opts, fn)
+}
+
+// CountEvents counts webhook events on the replica
+func (s *ReplicaStorage) CountEvents(ctx context.Context, opts QueryOptions) (int, error) {
+	return s.replica.CountEvents(ctx, opts)
+}
+
+// GetStats returns event type statistics from the replica
+func (s *ReplicaStorage) GetStats(ctx context.Context, since time.Time) (map[string]int64, error) {
+	return s.replica.GetStats(ctx, since)
+}
+
+// GetStatsBy returns event statistics grouped by dimension from the replica
+func (s *ReplicaStorage) GetStatsBy(ctx context.Context, dimension string, since time.Time) (map[string]int64, error) {
+	return s.replica.GetStatsBy(ctx, dimension, since)
+}
+
+// GetEvent returns a single event from the replica, or from the primary if
+// the replica doesn't have it yet
+func (s *ReplicaStorage) GetEvent(ctx context.Context, id string) (*Event, error) {
+	event, err := s.replica.GetEvent(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if event != nil {
+		return event, nil
+	}
+	return s.primary.GetEvent(ctx, id)
+}
+
+// GetEvents returns events from the replica, looking up any the replica
+// doesn't have yet on the primary
+func (s *ReplicaStorage) GetEvents(ctx context.Context, ids []string) (map[string]*Event, error) {
+	events, err := s.replica.GetEvents(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, id := range ids {
+		if _, ok := events[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return events, nil
+	}
+
+	lagging, err := s.primary.GetEvents(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	if events == nil {
+		events = make(map[string]*Event, len(lagging))
+	}
+	for id, event := range lagging {
+		events[id] = event
+	}
+	return events, nil
+}
+
+// CreateSchema creates the database schema on the primary; the replica
+// receives it through replication
+func (s *ReplicaStorage) CreateSchema(ctx context.Context) error {
+	return s.primary.CreateSchema(ctx)
+}
+
+// Ping checks that both the primary and the replica are reachable
+func (s *ReplicaStorage) Ping(ctx context.Context) error {
+	if err := s.primary.Ping(ctx); err != nil {
+		return err
+	}
+	if err := s.replica.Ping(ctx); err != nil {
+		return fmt.Errorf("replica: %w", err)
+	}
+	return nil
+}
+
+// Close closes both the primary and the replica
+func (s *ReplicaStorage) Close() error {
+	return errors.Join(s.primary.Close(), s.replica.Close())
+}
@@ -0,0 +1,119 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"hubproxy/internal/storage"
+)
+
+// fakeStorage is an in-memory Storage that records which methods were called
+type fakeStorage struct {
+	storage.Storage
+	events map[string]*storage.Event
+	calls  []string
+}
+
+func newFakeStorage(events ...*storage.Event) *fakeStorage {
+	s := &fakeStorage{events: make(map[string]*storage.Event)}
+	for _, event := range events {
+		s.events[event.ID] = event
+	}
+	return s
+}
+
+func (s *fakeStorage) StoreEvent(_ context.Context, event *storage.Event) error {
+	s.calls = append(s.calls, "StoreEvent")
+	s.events[event.ID] = event
+	return nil
+}
+
+func (s *fakeStorage) MarkForwarded(_ context.Context, id string) error {
+	s.calls = append(s.calls, "MarkForwarded")
+	return nil
+}
+
+func (s *fakeStorage) ListEvents(_ context.Context, _ storage.QueryOptions) ([]*storage.Event, int, error) {
+	s.calls = append(s.calls, "ListEvents")
+	events := make([]*storage.Event, 0, len(s.events))
+	for _, event := range s.events {
+		events = append(events, event)
+	}
+	return events, len(events), nil
+}
+
+func (s *fakeStorage) GetStats(_ context.Context, _ time.Time) (map[string]int64, error) {
+	s.calls = append(s.calls, "GetStats")
+	return map[string]int64{}, nil
+}
+
+func (s *fakeStorage) GetEvent(_ context.Context, id string) (*storage.Event, error) {
+	s.calls = append(s.calls, "GetEvent")
+	return s.events[id], nil
+}
+
+func (s *fakeStorage) GetEvents(_ context.Context, ids []string) (map[string]*storage.Event, error) {
+	s.calls = append(s.calls, "GetEvents")
+	events := make(map[string]*storage.Event)
+	for _, id := range ids {
+		if event, ok := s.events[id]; ok {
+			events[id] = event
+		}
+	}
+	return events, nil
+}
+
+func TestReplicaStorage(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Reads hit replica and writes hit primary", func(t *testing.T) {
+		primary := newFakeStorage()
+		replica := newFakeStorage(&storage.Event{ID: "replicated"})
+		store := storage.NewReplicaStorage(primary, replica)
+
+		require.NoError(t, store.StoreEvent(ctx, &storage.Event{ID: "new"}))
+		require.NoError(t, store.MarkForwarded(ctx, "new"))
+
+		_, _, err := store.ListEvents(ctx, storage.QueryOptions{})
+		require.NoError(t, err)
+		_, err = store.GetStats(ctx, time.Time{})
+		require.NoError(t, err)
+		event, err := store.GetEvent(ctx, "replicated")
+		require.NoError(t, err)
+		require.NotNil(t, event)
+
+		assert.Equal(t, []string{"StoreEvent", "MarkForwarded"}, primary.calls)
+		assert.Equal(t, []string{"ListEvents", "GetStats", "GetEvent"}, replica.calls)
+	})
+
+	t.Run("GetEvent falls back to primary on replica miss", func(t *testing.T) {
+		primary := newFakeStorage(&storage.Event{ID: "lagging"})
+		replica := newFakeStorage()
+		store := storage.NewReplicaStorage(primary, replica)
+
+		event, err := store.GetEvent(ctx, "lagging")
+		require.NoError(t, err)
+		require.NotNil(t, event)
+		assert.Equal(t, "lagging", event.ID)
+
+		event, err = store.GetEvent(ctx, "missing")
+		require.NoError(t, err)
+		assert.Nil(t, event)
+	})
+
+	t.Run("GetEvents fills replica misses from primary", func(t *testing.T) {
+		primary := newFakeStorage(&storage.Event{ID: "a"}, &storage.Event{ID: "b"})
+		replica := newFakeStorage(&storage.Event{ID: "a"})
+		store := storage.NewReplicaStorage(primary, replica)
+
+		events, err := store.GetEvents(ctx, []string{"a", "b", "c"})
+		require.NoError(t, err)
+		assert.Len(t, events, 2)
+		assert.Contains(t, events, "a")
+		assert.Contains(t, events, "b")
+	})
+}
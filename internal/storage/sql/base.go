@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"math"
+	"strings"
 	"time"
 
 	"hubproxy/internal/storage"
@@ -17,6 +18,11 @@ type BaseStorage struct {
 	db        *sql.DB
 	dialect   SQLDialect
 	tableName string
+	codec     storage.Codec // Encodes payload and headers on write
+	// Check payloads against their stored hash when reading single events
+	verifyPayloadHash bool
+	// Start even if the database was migrated by a newer version
+	allowSchemaDowngrade bool
 	// Use squirrel's placeholder format based on dialect
 	builder sq.StatementBuilderType
 }
@@ -35,57 +41,186 @@ func NewBaseStorage(db *sql.DB, dialect SQLDialect, tableName string) *BaseStora
 		db:        db,
 		dialect:   dialect,
 		tableName: tableName,
+		codec:     storage.JSONCodec{},
 		builder:   builder,
 	}
 }
 
+// selectColumns lists the columns selected for an event, in the order scanEvent expects
+var selectColumns = []string{
+	"id", "type", "payload", "headers", "created_at", "received_at", "forwarded_at", "status", "error", "repository", "sender",
+	"replayed_from", "original_time", "codec", "payload_hash", "installation_target_type", "installation_target_id", "attempts", "next_attempt_at",
+	"request_id",
+}
+
+// scanEvent scans a row selected with selectColumns into an Event
+func scanEvent(row sq.RowScanner) (*storage.Event, error) {
+	var (
+		event      storage.Event
+		payload    []byte
+		headers    []byte
+		receivedAt sql.NullTime
+		status     sql.NullString
+		errorText  sql.NullString
+		repository sql.NullString
+		sender     sql.NullString
+		replayedOf sql.NullString
+		origTime   sql.NullTime
+		codecName  sql.NullString
+		hash       sql.NullString
+		targetType sql.NullString
+		targetID   sql.NullString
+		attempts   sql.NullInt64
+		requestID  sql.NullString
+	)
+	err := row.Scan(
+		&event.ID,
+		&event.Type,
+		&payload,
+		&headers,
+		&event.CreatedAt,
+		&receivedAt,
+		&event.ForwardedAt,
+		&status,
+		&errorText,
+		&repository,
+		&sender,
+		&replayedOf,
+		&origTime,
+		&codecName,
+		&hash,
+		&targetType,
+		&targetID,
+		&attempts,
+		&event.NextAttemptAt,
+		&requestID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows record the codec they were written with, so decode with that
+	// rather than whatever codec is configured now
+	codec, err := storage.CodecByName(codecName.String)
+	if err != nil {
+		return nil, err
+	}
+	if event.Payload, err = codec.Decode(payload); err != nil {
+		return nil, fmt.Errorf("decoding payload: %w", err)
+	}
+	if len(headers) > 0 {
+		if event.Headers, err = codec.Decode(headers); err != nil {
+			return nil, fmt.Errorf("decoding headers: %w", err)
+		}
+	}
+	event.Codec = codec.Name()
+	event.ReceivedAt = receivedAt.Time
+	event.Status = status.String
+	event.Error = errorText.String
+	event.Repository = repository.String
+	event.Sender = sender.String
+	event.ReplayedFrom = replayedOf.String
+	event.OriginalTime = origTime.Time
+	event.PayloadHash = hash.String
+	event.InstallationTargetType = targetType.String
+	event.InstallationTargetID = targetID.String
+	event.Attempts = int(attempts.Int64)
+	event.RequestID = requestID.String
+	return &event, nil
+}
+
 // StoreEvent stores a webhook event in the database
 func (s *BaseStorage) StoreEvent(ctx context.Context, event *storage.Event) error {
+	_, err := s.StoreEventIfNew(ctx, event)
+	return err
+}
+
+// StoreEventIfNew stores an event unless one with the same ID is already
+// stored, and reports whether it was inserted
+func (s *BaseStorage) StoreEventIfNew(ctx context.Context, event *storage.Event) (bool, error) {
+	if event.PayloadHash == "" {
+		event.PayloadHash = storage.PayloadHash(event.Payload)
+	}
+
+	payload, err := s.codec.Encode(event.Payload)
+	if err != nil {
+		return false, fmt.Errorf("encoding payload: %w", err)
+	}
+	var headers []byte
+	if len(event.Headers) > 0 {
+		if headers, err = s.codec.Encode(event.Headers); err != nil {
+			return false, fmt.Errorf("encoding headers: %w", err)
+		}
+	}
+
 	// Use the existing builder's placeholder format
 	query := s.builder.
 		Insert(s.tableName).
-		Columns("id", "type", "payload", "headers", "created_at", "forwarded_at", "error", "repository", "sender").
+		Columns("id", "type", "payload", "headers", "created_at", "received_at", "forwarded_at", "status", "error", "repository", "sender",
+			"replayed_from", "original_time", "codec", "payload_hash", "installation_target_type", "installation_target_id", "request_id").
 		Values(
 			event.ID,
 			event.Type,
-			event.Payload,
-			event.Headers,
+			payload,
+			headers,
 			event.CreatedAt,
+			event.ReceivedAt,
 			event.ForwardedAt,
+			event.Status,
 			event.Error,
 			event.Repository,
 			event.Sender,
+			event.ReplayedFrom,
+			nullTime(event.OriginalTime),
+			s.codec.Name(),
+			event.PayloadHash,
+			event.InstallationTargetType,
+			event.InstallationTargetID,
+			event.RequestID,
 		)
 
+	result, err := s.insertIgnore(query).RunWith(s.db).ExecContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("inserting event: %w", err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("checking inserted rows: %w", err)
+	}
+	return inserted > 0, nil
+}
+
+// nullTime stores the zero time as NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// insertIgnore makes an insert skip rows whose primary key already exists
+func (s *BaseStorage) insertIgnore(query sq.InsertBuilder) sq.InsertBuilder {
 	if _, ok := s.dialect.(*SQLiteDialect); ok {
-		query = query.Options("OR IGNORE")
+		return query.Options("OR IGNORE")
 	} else if _, ok := s.dialect.(*PostgresDialect); ok {
-		query = query.Suffix("ON CONFLICT DO NOTHING")
+		return query.Suffix("ON CONFLICT DO NOTHING")
 	} else if _, ok := s.dialect.(*MySQLDialect); ok {
-		query = query.Options("IGNORE")
-	} else {
-		panic("unsupported dialect")
-	}
-
-	_, err := query.RunWith(s.db).ExecContext(ctx)
-	if err != nil {
-		return fmt.Errorf("inserting event: %w", err)
+		return query.Options("IGNORE")
 	}
-	return nil
+	panic("unsupported dialect")
 }
 
 // ListEvents lists webhook events based on query options
 func (s *BaseStorage) ListEvents(ctx context.Context, opts storage.QueryOptions) ([]*storage.Event, int, error) {
 	// Build base query
-	query := s.builder.Select(
-		"id", "type", "payload", "headers", "created_at", "error", "repository", "sender",
-	).From(s.tableName)
+	query := s.builder.Select(selectColumns...).From(s.tableName)
 
 	// Add conditions
 	query = s.addQueryConditions(query, opts)
 
 	// Add order and limit
-	query = query.OrderBy("created_at DESC")
+	orderBy, err := sortOrder(opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	query = query.OrderBy(orderBy...)
 	if opts.Limit > 0 {
 		// Ensure values are within uint64 bounds
 		limit := opts.Limit
@@ -115,21 +250,11 @@ func (s *BaseStorage) ListEvents(ctx context.Context, opts storage.QueryOptions)
 	// Scan results
 	var events []*storage.Event
 	for rows.Next() {
-		var event storage.Event
-		scanErr := rows.Scan(
-			&event.ID,
-			&event.Type,
-			&event.Payload,
-			&event.Headers,
-			&event.CreatedAt,
-			&event.Error,
-			&event.Repository,
-			&event.Sender,
-		)
+		event, scanErr := scanEvent(rows)
 		if scanErr != nil {
 			return nil, 0, fmt.Errorf("scanning row: %w", scanErr)
 		}
-		events = append(events, &event)
+		events = append(events, event)
 	}
 
 	// Get total count
@@ -157,10 +282,30 @@ func (s *BaseStorage) CountEvents(ctx context.Context, opts storage.QueryOptions
 
 // GetStats returns event type statistics
 func (s *BaseStorage) GetStats(ctx context.Context, since time.Time) (map[string]int64, error) {
+	return s.GetStatsBy(ctx, storage.StatsByType, since)
+}
+
+// statsColumns are the columns GetStatsBy may group by. The column is
+// interpolated into the query, so anything else is rejected.
+var statsColumns = map[string]bool{
+	storage.StatsByType:       true,
+	storage.StatsByRepository: true,
+	storage.StatsBySender:     true,
+	storage.StatsByStatus:     true,
+}
+
+// GetStatsBy returns event counts grouped by dimension. Events without a
+// value for it, such as pending events by status, are counted under "".
+func (s *BaseStorage) GetStatsBy(ctx context.Context, dimension string, since time.Time) (map[string]int64, error) {
+	if !statsColumns[dimension] {
+		return nil, fmt.Errorf("%w: %q", storage.ErrInvalidStats, dimension)
+	}
+
+	column := fmt.Sprintf("COALESCE(%s, '')", dimension)
 	query := s.builder.
-		Select("type", "COUNT(*) as count").
+		Select(column, "COUNT(*) as count").
 		From(s.tableName).
-		GroupBy("type")
+		GroupBy(column)
 
 	if !since.IsZero() {
 		query = query.Where(sq.GtOrEq{"created_at": since})
@@ -168,28 +313,28 @@ func (s *BaseStorage) GetStats(ctx context.Context, since time.Time) (map[string
 
 	rows, err := query.RunWith(s.db).QueryContext(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("executing query: %w", err)
+		return nil, fmt.Errorf("querying stats: %w", err)
 	}
 	defer rows.Close()
 
 	stats := make(map[string]int64)
 	for rows.Next() {
 		var (
-			eventType string
-			count     int64
+			value string
+			count int64
 		)
-		if err := rows.Scan(&eventType, &count); err != nil {
-			return nil, fmt.Errorf("scanning row: %w", err)
+		if err := rows.Scan(&value, &count); err != nil {
+			return nil, fmt.Errorf("scanning stats: %w", err)
 		}
-		stats[eventType] = count
+		stats[value] = count
 	}
 
-	return stats, nil
+	return stats, rows.Err()
 }
 
 // GetEvent returns a single event by ID
 func (s *BaseStorage) GetEvent(ctx context.Context, id string) (*storage.Event, error) {
-	query := s.builder.Select("id", "type", "payload", "headers", "created_at", "forwarded_at", "error", "repository", "sender").From(s.tableName).
+	query := s.builder.Select(selectColumns...).From(s.tableName).
 		Where(sq.Eq{"id": id}).
 		Limit(1)
 
@@ -203,18 +348,7 @@ func (s *BaseStorage) GetEvent(ctx context.Context, id string) (*storage.Event,
 		return nil, nil
 	}
 
-	event := &storage.Event{}
-	scanErr := rows.Scan(
-		&event.ID,
-		&event.Type,
-		&event.Payload,
-		&event.Headers,
-		&event.CreatedAt,
-		&event.ForwardedAt,
-		&event.Error,
-		&event.Repository,
-		&event.Sender,
-	)
+	event, scanErr := scanEvent(rows)
 	if scanErr != nil {
 		return nil, fmt.Errorf("scanning row: %w", scanErr)
 	}
@@ -222,8 +356,77 @@ func (s *BaseStorage) GetEvent(ctx context.Context, id string) (*storage.Event,
 	return event, nil
 }
 
+// getEventsChunkSize bounds the number of IDs in a single IN clause, staying
+// well under SQLite's default limit on bound parameters
+const getEventsChunkSize = 500
+
+// GetEvents returns the events with the given IDs, keyed by ID
+func (s *BaseStorage) GetEvents(ctx context.Context, ids []string) (map[string]*storage.Event, error) {
+	events := make(map[string]*storage.Event, len(ids))
+
+	for start := 0; start < len(ids); start += getEventsChunkSize {
+		end := min(start+getEventsChunkSize, len(ids))
+
+		query := s.builder.
+			Select(selectColumns...).
+			From(s.tableName).
+			Where(sq.Eq{"id": ids[start:end]})
+
+		rows, err := query.RunWith(s.db).QueryContext(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("executing query: %w", err)
+		}
+
+		for rows.Next() {
+			event, scanErr := scanEvent(rows)
+			if scanErr != nil {
+				rows.Close()
+				return nil, fmt.Errorf("scanning row: %w", scanErr)
+			}
+			events[event.ID] = event
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("iterating rows: %w", err)
+		}
+	}
+
+	return events, nil
+}
+
+// sortColumns are the columns ListEvents may order by. Sort columns are
+// interpolated into the query, so anything else is rejected.
+var sortColumns = map[string]bool{
+	storage.SortByCreatedAt:  true,
+	storage.SortByType:       true,
+	storage.SortByRepository: true,
+}
+
+// sortOrder returns the ORDER BY clauses for ListEvents, breaking ties by ID
+// so pages are stable
+func sortOrder(opts storage.QueryOptions) ([]string, error) {
+	column := opts.SortBy
+	if column == "" {
+		column = storage.SortByCreatedAt
+	}
+	if !sortColumns[column] {
+		return nil, fmt.Errorf("%w: %q", storage.ErrInvalidSort, column)
+	}
+
+	direction := ""
+	if opts.SortDesc {
+		direction = " DESC"
+	}
+	return []string{column + direction, "id" + direction}, nil
+}
+
 // addQueryConditions adds WHERE conditions based on query options
 func (s *BaseStorage) addQueryConditions(query sq.SelectBuilder, opts storage.QueryOptions) sq.SelectBuilder {
+	if opts.IDPrefix != "" {
+		query = query.Where("id LIKE ? ESCAPE '!'", escapeLike(opts.IDPrefix)+"%")
+	}
 	if len(opts.Types) > 0 {
 		query = query.Where(sq.Eq{"type": opts.Types})
 	}
@@ -240,8 +443,139 @@ func (s *BaseStorage) addQueryConditions(query sq.SelectBuilder, opts storage.Qu
 	if opts.Sender != "" {
 		query = query.Where(sq.Eq{"sender": opts.Sender})
 	}
+	if opts.InstallationTargetID != "" {
+		query = query.Where(sq.Eq{"installation_target_id": opts.InstallationTargetID})
+	}
+	if opts.PayloadHash != "" {
+		query = query.Where(sq.Eq{"payload_hash": opts.PayloadHash})
+	}
+	if !opts.ReceivedSince.IsZero() {
+		query = query.Where(sq.GtOrEq{"received_at": opts.ReceivedSince})
+	}
+	if len(opts.Statuses) > 0 {
+		query = query.Where(sq.Eq{"status": opts.Statuses})
+	}
 	if opts.OnlyNonForwarded {
-		query = query.Where("forwarded_at IS NULL")
+		query = query.Where(pendingCondition)
+	}
+	if !opts.DueBy.IsZero() {
+		query = query.Where(sq.Or{sq.Eq{"next_attempt_at": nil}, sq.LtOrEq{"next_attempt_at": opts.DueBy.UTC()}})
 	}
 	return query
 }
+
+// settledStatuses are the statuses of events that won't be forwarded
+var settledStatuses = storage.SettledStatuses
+
+// pendingCondition matches events still waiting to be forwarded
+var pendingCondition = sq.And{
+	sq.Expr("forwarded_at IS NULL"),
+	sq.Or{sq.Eq{"status": nil}, sq.NotEq{"status": settledStatuses}},
+}
+
+// settledCondition matches events no longer waiting to be forwarded, the
+// complement of pendingCondition
+var settledCondition = sq.Or{
+	sq.Expr("forwarded_at IS NOT NULL"),
+	sq.Eq{"status": settledStatuses},
+}
+
+// DeleteEvent deletes a single event by ID
+func (s *BaseStorage) DeleteEvent(ctx context.Context, id string) error {
+	result, err := s.builder.
+		Delete(s.tableName).
+		Where(sq.Eq{"id": id}).
+		RunWith(s.db).
+		ExecContext(ctx)
+	if err != nil {
+		return fmt.Errorf("deleting event: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("getting rows affected: %w", err)
+	}
+	if rows == 0 {
+		return storage.ErrEventNotFound
+	}
+	return nil
+}
+
+// DeleteEventsBefore deletes settled events created before cutoff, leaving
+// pending ones for the forwarder
+func (s *BaseStorage) DeleteEventsBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	result, err := s.builder.
+		Delete(s.tableName).
+		Where(sq.Lt{"created_at": cutoff}).
+		Where(settledCondition).
+		RunWith(s.db).
+		ExecContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("deleting events before cutoff: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("getting rows affected: %w", err)
+	}
+	return deleted, nil
+}
+
+// DeleteOldestSettledEvents deletes up to n of the oldest settled events,
+// ordered by created_at with the ID breaking ties, leaving pending ones for
+// the forwarder
+func (s *BaseStorage) DeleteOldestSettledEvents(ctx context.Context, n int) (int64, error) {
+	if n <= 0 {
+		return 0, nil
+	}
+
+	rows, err := s.builder.
+		Select("id").
+		From(s.tableName).
+		Where(settledCondition).
+		OrderBy("created_at", "id").
+		Limit(uint64(n)).
+		RunWith(s.db).
+		QueryContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("finding oldest settled events: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return 0, fmt.Errorf("scanning event ID: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("finding oldest settled events: %w", err)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// Checked again in case an event was requeued since it was read
+	result, err := s.builder.
+		Delete(s.tableName).
+		Where(sq.Eq{"id": ids}).
+		Where(settledCondition).
+		RunWith(s.db).
+		ExecContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("deleting oldest settled events: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("getting rows affected: %w", err)
+	}
+	return deleted, nil
+}
+
+// likeEscaper escapes LIKE wildcards so a value only matches literally,
+// using '!' as the escape character since backslash handling varies by database
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+func escapeLike(value string) string {
+	return likeEscaper.Replace(value)
+}
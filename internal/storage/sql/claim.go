@@ -0,0 +1,172 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"hubproxy/internal/storage"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// claimTimeout is how long a claim holds before the event can be claimed
+// again, so events claimed by a worker that died aren't stuck forever
+const claimTimeout = 5 * time.Minute
+
+// ClaimPendingEvents marks up to n pending, unclaimed events as claimed by
+// workerID and returns them, oldest first. Postgres and SQLite claim and
+// return the rows in a single UPDATE ... RETURNING; MySQL, which has no
+// RETURNING, locks the rows in a transaction, claims them and reads them back.
+func (s *Storage) ClaimPendingEvents(ctx context.Context, n int, workerID string) ([]*storage.Event, error) {
+	if workerID == "" {
+		return nil, fmt.Errorf("worker ID is required")
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	claimable := sq.And{
+		pendingCondition,
+		sq.Or{sq.Eq{"claimed_at": nil}, sq.Lt{"claimed_at": now.Add(-claimTimeout)}},
+	}
+
+	var (
+		events []*storage.Event
+		err    error
+	)
+	if _, ok := s.dialect.(*MySQLDialect); ok {
+		events, err = s.claimInTx(ctx, n, workerID, now, claimable)
+	} else {
+		events, err = s.claimReturning(ctx, n, workerID, now, claimable)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claiming pending events: %w", err)
+	}
+
+	// RETURNING gives no order guarantee
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].CreatedAt.Equal(events[j].CreatedAt) {
+			return events[i].CreatedAt.Before(events[j].CreatedAt)
+		}
+		return events[i].ID < events[j].ID
+	})
+	return events, nil
+}
+
+// claimReturning claims events with a single UPDATE ... RETURNING statement
+func (s *Storage) claimReturning(ctx context.Context, n int, workerID string, now time.Time, claimable sq.Sqlizer) ([]*storage.Event, error) {
+	// Built without the dialect's placeholders since it's nested in the update
+	candidates := sq.Select("id").
+		From(s.tableName).
+		Where(claimable).
+		OrderBy("created_at", "id").
+		Limit(uint64(n))
+	if _, ok := s.dialect.(*PostgresDialect); ok {
+		// Concurrent claimers skip each other's rows rather than wait on them
+		candidates = candidates.Suffix("FOR UPDATE SKIP LOCKED")
+	}
+
+	query := s.builder.
+		Update(s.tableName).
+		Set("claimed_by", workerID).
+		Set("claimed_at", now).
+		Where(sq.Expr("id IN (?)", candidates)).
+		Suffix("RETURNING " + strings.Join(selectColumns, ", "))
+
+	rows, err := query.RunWith(s.db).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*storage.Event
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scanning event: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// claimInTx locks candidate events, claims them and reads them back in one
+// transaction
+func (s *Storage) claimInTx(ctx context.Context, n int, workerID string, now time.Time, claimable sq.Sqlizer) ([]*storage.Event, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := s.builder.
+		Select("id").
+		From(s.tableName).
+		Where(claimable).
+		OrderBy("created_at", "id").
+		Limit(uint64(n)).
+		Suffix("FOR UPDATE SKIP LOCKED").
+		RunWith(tx).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("selecting events to claim: %w", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scanning event ID: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	_, err = s.builder.
+		Update(s.tableName).
+		Set("claimed_by", workerID).
+		Set("claimed_at", now).
+		Where(sq.Eq{"id": ids}).
+		RunWith(tx).
+		ExecContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("marking events claimed: %w", err)
+	}
+
+	rows, err = s.builder.
+		Select(selectColumns...).
+		From(s.tableName).
+		Where(sq.Eq{"id": ids}).
+		RunWith(tx).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading claimed events: %w", err)
+	}
+	var events []*storage.Event
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scanning event: %w", err)
+		}
+		events = append(events, event)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return events, tx.Commit()
+}
@@ -1,6 +1,9 @@
 package sql
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // SQLDialect defines database-specific SQL syntax
 type SQLDialect interface {
@@ -15,6 +18,111 @@ type SQLDialect interface {
 
 	// CreateTableSQL returns SQL for creating the events table
 	CreateTableSQL(tableName string) string
+
+	// ListIndexesSQL returns a query for the index names on a table, taking
+	// the table name as its only parameter
+	ListIndexesSQL() string
+
+	// DeleteKeepingLatestSQL returns a statement deleting all but the newest
+	// events per repository, taking the number to keep as its only parameter
+	DeleteKeepingLatestSQL(tableName string) string
+}
+
+// EventColumns is the canonical set of columns in the events table. Every
+// dialect creates exactly these columns so an Event behaves the same on all backends.
+var EventColumns = []string{
+	"id",
+	"type",
+	"payload",
+	"headers",
+	"created_at",
+	"received_at",
+	"forwarded_at",
+	"status",
+	"error",
+	"repository",
+	"sender",
+	"replayed_from",
+	"original_time",
+	"codec",
+	"payload_hash",
+	"installation_target_type",
+	"installation_target_id",
+	"claimed_by",
+	"claimed_at",
+	"attempts",
+	"next_attempt_at",
+	"request_id",
+}
+
+// EventIndexes maps each index on the events table to its column
+var EventIndexes = map[string]string{
+	"idx_created_at":             "created_at",
+	"idx_forwarded_at":           "forwarded_at",
+	"idx_status":                 "status",
+	"idx_type":                   "type",
+	"idx_repository":             "repository",
+	"idx_sender":                 "sender",
+	"idx_replayed_from":          "replayed_from",
+	"idx_installation_target_id": "installation_target_id",
+	"idx_payload_hash":           "payload_hash",
+}
+
+// columnType returns the dialect's column definition for a canonical column
+func columnType(d SQLDialect, column string) string {
+	switch column {
+	case "id":
+		return "VARCHAR(255) PRIMARY KEY"
+	case "type":
+		return "VARCHAR(50) NOT NULL"
+	case "payload":
+		return d.JSONType() + " NOT NULL"
+	case "headers":
+		return d.JSONType()
+	case "created_at":
+		return d.TimeType() + " NOT NULL"
+	case "received_at", "forwarded_at", "original_time", "claimed_at", "next_attempt_at":
+		return d.TimeType()
+	case "status", "codec", "installation_target_type":
+		return "VARCHAR(20)"
+	case "error":
+		return "TEXT"
+	case "repository", "sender", "replayed_from", "installation_target_id", "claimed_by", "request_id":
+		return "VARCHAR(255)"
+	case "payload_hash":
+		return "VARCHAR(64)"
+	case "attempts":
+		return "INTEGER NOT NULL DEFAULT 0"
+	default:
+		panic(fmt.Sprintf("unknown column %q", column))
+	}
+}
+
+// createTableSQL builds the events table and indexes for a dialect
+func createTableSQL(d SQLDialect, tableName string) string {
+	columns := make([]string, 0, len(EventColumns))
+	for _, column := range EventColumns {
+		columns = append(columns, fmt.Sprintf("%s %s", column, columnType(d, column)))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CREATE TABLE IF NOT EXISTS %s (\n\t%s\n);\n", tableName, strings.Join(columns, ",\n\t"))
+	for _, column := range EventColumns {
+		for index, indexed := range EventIndexes {
+			if indexed == column {
+				fmt.Fprintf(&b, "CREATE INDEX IF NOT EXISTS %s ON %s (%s);\n", index, tableName, column)
+			}
+		}
+	}
+	return b.String()
+}
+
+// repositoryRank numbers events newest first within each repository
+const repositoryRank = "ROW_NUMBER() OVER (PARTITION BY repository ORDER BY created_at DESC, id DESC) AS rn"
+
+// rankedEventsSQL ranks events newest first within each repository
+func rankedEventsSQL(tableName string) string {
+	return fmt.Sprintf("SELECT id, %s FROM %s", repositoryRank, tableName)
 }
 
 // BaseDialect provides common implementations
@@ -37,26 +145,15 @@ func (d *BaseDialect) TimeType() string {
 
 // CreateTableSQL returns the default table creation SQL
 func (d *BaseDialect) CreateTableSQL(tableName string) string {
-	return fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS %s (
-			id VARCHAR(36) PRIMARY KEY,
-			type VARCHAR(50) NOT NULL,
-			payload %s NOT NULL,
-			headers %s,
-			created_at %s NOT NULL,
-			forwarded_at %s,
-			error TEXT,
-			repository VARCHAR(255),
-			sender VARCHAR(255),
-			replayed_from VARCHAR(255),
-			original_time %s
-		);
-		CREATE INDEX IF NOT EXISTS idx_created_at ON %s (created_at);
-		CREATE INDEX IF NOT EXISTS idx_forwarded_at ON %s (forwarded_at);
-		CREATE INDEX IF NOT EXISTS idx_type ON %s (type);
-		CREATE INDEX IF NOT EXISTS idx_repository ON %s (repository);
-		CREATE INDEX IF NOT EXISTS idx_sender ON %s (sender);
-		CREATE INDEX IF NOT EXISTS idx_replayed_from ON %s (replayed_from);
-	`, tableName, d.JSONType(), d.JSONType(), d.TimeType(), d.TimeType(), d.TimeType(),
-		tableName, tableName, tableName, tableName, tableName, tableName)
+	return createTableSQL(d, tableName)
+}
+
+// ListIndexesSQL returns the default index listing query
+func (d *BaseDialect) ListIndexesSQL() string {
+	return "SELECT indexname FROM pg_indexes WHERE tablename = $1"
+}
+
+// DeleteKeepingLatestSQL returns the default ranked delete
+func (d *BaseDialect) DeleteKeepingLatestSQL(tableName string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE id IN (SELECT id FROM (%s) ranked WHERE rn > $1)", tableName, rankedEventsSQL(tableName))
 }
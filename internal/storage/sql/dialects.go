@@ -1,5 +1,7 @@
 package sql
 
+import "fmt"
+
 // SQLiteDialect implements SQLDialect for SQLite
 type SQLiteDialect struct {
 	BaseDialect
@@ -17,6 +19,18 @@ func (d *SQLiteDialect) TimeType() string {
 	return "DATETIME"
 }
 
+func (d *SQLiteDialect) CreateTableSQL(tableName string) string {
+	return createTableSQL(d, tableName)
+}
+
+func (d *SQLiteDialect) ListIndexesSQL() string {
+	return "SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ?"
+}
+
+func (d *SQLiteDialect) DeleteKeepingLatestSQL(tableName string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE id IN (SELECT id FROM (%s) ranked WHERE rn > ?)", tableName, rankedEventsSQL(tableName))
+}
+
 // PostgresDialect implements SQLDialect for PostgreSQL
 type PostgresDialect struct {
 	BaseDialect
@@ -34,6 +48,18 @@ func (d *PostgresDialect) TimeType() string {
 	return "TIMESTAMP WITH TIME ZONE"
 }
 
+func (d *PostgresDialect) CreateTableSQL(tableName string) string {
+	return createTableSQL(d, tableName)
+}
+
+func (d *PostgresDialect) ListIndexesSQL() string {
+	return "SELECT indexname FROM pg_indexes WHERE tablename = $1"
+}
+
+func (d *PostgresDialect) DeleteKeepingLatestSQL(tableName string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE id IN (SELECT id FROM (%s) ranked WHERE rn > $1)", tableName, rankedEventsSQL(tableName))
+}
+
 // MySQLDialect implements SQLDialect for MySQL
 type MySQLDialect struct {
 	BaseDialect
@@ -50,3 +76,17 @@ func (d *MySQLDialect) JSONType() string {
 func (d *MySQLDialect) TimeType() string {
 	return "DATETIME"
 }
+
+func (d *MySQLDialect) CreateTableSQL(tableName string) string {
+	return createTableSQL(d, tableName)
+}
+
+func (d *MySQLDialect) ListIndexesSQL() string {
+	return "SELECT DISTINCT index_name FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ?"
+}
+
+// DeleteKeepingLatestSQL joins against the ranking since MySQL can't select
+// from the table being deleted from in a subquery
+func (d *MySQLDialect) DeleteKeepingLatestSQL(tableName string) string {
+	return fmt.Sprintf("DELETE e FROM %s e JOIN (%s) ranked ON e.id = ranked.id WHERE ranked.rn > ?", tableName, rankedEventsSQL(tableName))
+}
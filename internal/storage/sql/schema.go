@@ -0,0 +1,308 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SchemaVersion is the version of the schema this binary creates and
+// understands. Bump it, and add a migration, whenever EventColumns or
+// EventIndexes change, so older binaries can tell they're running against a
+// database they don't know.
+const SchemaVersion = 5
+
+// schemaMigrationsTable records each schema version applied to the database
+const schemaMigrationsTable = "schema_migrations"
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer
+// version of HubProxy than this one
+var ErrSchemaTooNew = errors.New("database schema is newer than this version of HubProxy supports")
+
+// SchemaReport lists the differences between the events table and the
+// schema defined by EventColumns and EventIndexes
+type SchemaReport struct {
+	MissingColumns []string
+	MissingIndexes []string
+}
+
+// OK reports whether the table matches the expected schema
+func (r *SchemaReport) OK() bool {
+	return len(r.MissingColumns) == 0 && len(r.MissingIndexes) == 0
+}
+
+// CheckSchema inspects the events table and reports missing columns and indexes
+func (s *Storage) CheckSchema(ctx context.Context) (*SchemaReport, error) {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s LIMIT 0", s.tableName))
+	if err != nil {
+		return nil, fmt.Errorf("inspecting columns: %w", err)
+	}
+	columns, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading columns: %w", err)
+	}
+
+	existingColumns := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		existingColumns[strings.ToLower(column)] = true
+	}
+
+	rows, err = s.db.QueryContext(ctx, s.dialect.ListIndexesSQL(), s.tableName)
+	if err != nil {
+		return nil, fmt.Errorf("inspecting indexes: %w", err)
+	}
+	defer rows.Close()
+
+	existingIndexes := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("scanning index: %w", err)
+		}
+		existingIndexes[strings.ToLower(name)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating indexes: %w", err)
+	}
+
+	report := &SchemaReport{}
+	for _, column := range EventColumns {
+		if !existingColumns[column] {
+			report.MissingColumns = append(report.MissingColumns, column)
+		}
+	}
+	for _, column := range EventColumns {
+		for index, indexed := range EventIndexes {
+			if indexed == column && !existingIndexes[index] {
+				report.MissingIndexes = append(report.MissingIndexes, index)
+			}
+		}
+	}
+	return report, nil
+}
+
+// RepairSchema adds the columns and indexes listed in report. Columns are
+// added as nullable since existing rows have no value for them.
+func (s *Storage) RepairSchema(ctx context.Context, report *SchemaReport) error {
+	for _, column := range report.MissingColumns {
+		if column == "id" {
+			return fmt.Errorf("column id is missing and can't be added to an existing table")
+		}
+
+		definition := strings.TrimSuffix(columnType(s.dialect, column), " NOT NULL")
+		stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", s.tableName, column, definition)
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("adding column %s: %w", column, err)
+		}
+	}
+
+	for _, index := range report.MissingIndexes {
+		stmt := fmt.Sprintf("CREATE INDEX %s ON %s (%s)", index, s.tableName, EventIndexes[index])
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("creating index %s: %w", index, err)
+		}
+	}
+
+	return nil
+}
+
+// migration brings the events table from the previous schema version to its
+// version by adding columns and indexes. Columns are added as nullable or
+// with a default, so existing rows stay valid.
+type migration struct {
+	version     int
+	description string
+	columns     []string
+	indexes     []string
+}
+
+// migrations are applied in order to a database at an older schema version.
+// Each only adds what's missing, so one interrupted partway, which MySQL
+// can't roll back, completes when it runs again.
+var migrations = []migration{
+	{
+		// Tables created before versions were recorded have some of these,
+		// depending on the release that created them
+		version:     1,
+		description: "add the columns and indexes predating schema versions",
+		columns: []string{
+			"headers", "received_at", "forwarded_at", "status", "error", "repository", "sender",
+			"replayed_from", "original_time", "codec", "payload_hash",
+			"installation_target_type", "installation_target_id",
+		},
+		indexes: []string{
+			"idx_created_at", "idx_forwarded_at", "idx_status", "idx_type", "idx_repository",
+			"idx_sender", "idx_replayed_from", "idx_installation_target_id",
+		},
+	},
+	{
+		version:     2,
+		description: "add claims on pending events",
+		columns:     []string{"claimed_by", "claimed_at"},
+	},
+	{
+		version:     3,
+		description: "index payload hashes to find redeliveries",
+		indexes:     []string{"idx_payload_hash"},
+	},
+	{
+		version:     4,
+		description: "track forward attempts",
+		columns:     []string{"attempts", "next_attempt_at"},
+	},
+	{
+		version:     5,
+		description: "record the request that delivered each event",
+		columns:     []string{"request_id"},
+	},
+}
+
+// tableExists reports whether the events table has been created
+func (s *Storage) tableExists(ctx context.Context) bool {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s LIMIT 0", s.tableName))
+	if err != nil {
+		return false
+	}
+	rows.Close()
+	return true
+}
+
+// migrate applies the migrations newer than version to an existing events
+// table, recording each once it's applied
+func (s *Storage) migrate(ctx context.Context, version int) error {
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		report, err := s.CheckSchema(ctx)
+		if err != nil {
+			return err
+		}
+		missing := &SchemaReport{}
+		for _, column := range m.columns {
+			if slices.Contains(report.MissingColumns, column) {
+				missing.MissingColumns = append(missing.MissingColumns, column)
+			}
+		}
+		for _, index := range m.indexes {
+			if slices.Contains(report.MissingIndexes, index) {
+				missing.MissingIndexes = append(missing.MissingIndexes, index)
+			}
+		}
+
+		slog.Info("migrating events table",
+			"version", m.version,
+			"migration", m.description,
+			"columns", missing.MissingColumns,
+			"indexes", missing.MissingIndexes)
+		if err := s.RepairSchema(ctx, missing); err != nil {
+			return fmt.Errorf("migrating to schema version %d: %w", m.version, err)
+		}
+		if err := s.recordSchemaVersion(ctx, m.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMissingColumns adds columns the recorded schema version says the events
+// table has but it doesn't, such as after a column was dropped by hand.
+// Missing indexes are left to CreateTableSQL.
+func (s *Storage) addMissingColumns(ctx context.Context) error {
+	report, err := s.CheckSchema(ctx)
+	if err != nil {
+		return err
+	}
+	if len(report.MissingColumns) == 0 {
+		return nil
+	}
+
+	slog.Warn("events table is missing columns its schema version should have, adding them", "columns", report.MissingColumns)
+	return s.RepairSchema(ctx, &SchemaReport{MissingColumns: report.MissingColumns})
+}
+
+// DatabaseSchemaVersion returns the newest schema version applied to the
+// database, or 0 if none has been recorded
+func (s *Storage) DatabaseSchemaVersion(ctx context.Context) (int, error) {
+	var version sql.NullInt64
+	err := s.builder.
+		Select("MAX(version)").
+		From(schemaMigrationsTable).
+		RunWith(s.db).
+		QueryRowContext(ctx).
+		Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("reading schema version: %w", err)
+	}
+	return int(version.Int64), nil
+}
+
+// checkSchemaVersion refuses a database migrated past SchemaVersion, since
+// this binary may misread columns it doesn't know about, unless downgrades
+// are allowed
+func (s *Storage) checkSchemaVersion(ctx context.Context) error {
+	stmt := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version INTEGER PRIMARY KEY, applied_at %s NOT NULL)",
+		schemaMigrationsTable, s.dialect.TimeType())
+	if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+		return fmt.Errorf("creating %s table: %w", schemaMigrationsTable, err)
+	}
+
+	version, err := s.DatabaseSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	return s.checkNotTooNew(version)
+}
+
+// checkNotTooNew fails with ErrSchemaTooNew if version is newer than
+// SchemaVersion, unless downgrades are allowed
+func (s *Storage) checkNotTooNew(version int) error {
+	if version <= SchemaVersion {
+		return nil
+	}
+
+	if !s.allowSchemaDowngrade {
+		return fmt.Errorf("%w: database is at version %d, this binary supports up to %d (upgrade HubProxy, or set --allow-schema-downgrade to start anyway)",
+			ErrSchemaTooNew, version, SchemaVersion)
+	}
+	slog.Warn("database schema is newer than this binary supports, continuing because downgrades are allowed",
+		"databaseVersion", version,
+		"supportedVersion", SchemaVersion)
+	return nil
+}
+
+// checkReadOnlySchema checks the schema version of a database HubProxy only
+// reads from, such as a read replica, without creating or migrating
+// anything. The primary migrates the schema, so a replica that isn't at
+// SchemaVersion yet hasn't caught up with it.
+func (s *Storage) checkReadOnlySchema(ctx context.Context) error {
+	version, err := s.DatabaseSchemaVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("%w (has the primary database been migrated?)", err)
+	}
+	if version < SchemaVersion {
+		return fmt.Errorf("database schema is at version %d, this binary needs %d; wait for the primary's migrations to replicate",
+			version, SchemaVersion)
+	}
+	return s.checkNotTooNew(version)
+}
+
+// recordSchemaVersion records a schema version as applied, if it isn't already
+func (s *Storage) recordSchemaVersion(ctx context.Context, version int) error {
+	query := s.builder.
+		Insert(schemaMigrationsTable).
+		Columns("version", "applied_at").
+		Values(version, time.Now().UTC())
+
+	if _, err := s.insertIgnore(query).RunWith(s.db).ExecContext(ctx); err != nil {
+		return fmt.Errorf("recording schema version %d: %w", version, err)
+	}
+	return nil
+}
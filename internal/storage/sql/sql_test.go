@@ -2,6 +2,14 @@ package sql_test
 
 import (
 	"context"
+	dbsql "database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -10,6 +18,7 @@ import (
 
 	"hubproxy/internal/storage"
 	"hubproxy/internal/storage/sql"
+	"hubproxy/internal/storage/storagetest"
 )
 
 func TestDuplicateEventHandling(t *testing.T) {
@@ -30,8 +39,9 @@ func TestDuplicateEventHandling(t *testing.T) {
 	}
 
 	// Store the event first time
-	err = store.StoreEvent(ctx, event)
+	inserted, err := store.StoreEventIfNew(ctx, event)
 	require.NoError(t, err)
+	assert.True(t, inserted)
 
 	// Verify event was stored
 	stored, err := store.GetEvent(ctx, event.ID)
@@ -39,6 +49,10 @@ func TestDuplicateEventHandling(t *testing.T) {
 	require.NotNil(t, stored)
 
 	// Try to store the same event with different status
+	event.Status = storage.StatusFailed
+	inserted, err = store.StoreEventIfNew(ctx, event)
+	require.NoError(t, err)
+	assert.False(t, inserted, "A stored delivery ID should not be inserted again")
 
 	err = store.StoreEvent(ctx, event)
 	require.NoError(t, err)
@@ -47,6 +61,7 @@ func TestDuplicateEventHandling(t *testing.T) {
 	stored, err = store.GetEvent(ctx, event.ID)
 	require.NoError(t, err)
 	require.NotNil(t, stored)
+	assert.Empty(t, stored.Status)
 
 	// Count events to ensure no duplicates
 	count, err := store.CountEvents(ctx, storage.QueryOptions{})
@@ -253,3 +268,1043 @@ func TestForwardedAtField(t *testing.T) {
 		}
 	}
 }
+
+func TestOnlyNonForwarded(t *testing.T) {
+	ctx := context.Background()
+	store, err := sql.New("sqlite:file:test_only_non_forwarded.db?mode=memory&cache=shared")
+	require.NoError(t, err)
+	defer store.Close()
+
+	now := time.Now().UTC()
+	forwardedAt := now
+	for _, event := range []*storage.Event{
+		{ID: "pending"},
+		{ID: "forwarded", ForwardedAt: &forwardedAt},
+		{ID: "failed", Status: storage.StatusFailed},
+		{ID: "expired", Status: storage.StatusExpired},
+		{ID: "duplicate", Status: storage.StatusDuplicate},
+	} {
+		event.Type = "push"
+		event.Payload = []byte(`{"ref": "refs/heads/main"}`)
+		event.CreatedAt = now
+		require.NoError(t, store.StoreEvent(ctx, event))
+	}
+
+	events, total, err := store.ListEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, total)
+
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	assert.Equal(t, []string{"pending"}, ids)
+
+	count, err := store.CountEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// Failed events can still be listed by status
+	failed, _, err := store.ListEvents(ctx, storage.QueryOptions{Statuses: []string{storage.StatusFailed}})
+	require.NoError(t, err)
+	require.Len(t, failed, 1)
+	assert.Equal(t, "failed", failed[0].ID)
+}
+
+func TestListEventsSort(t *testing.T) {
+	ctx := context.Background()
+	store, err := sql.New("sqlite:file:test_list_sort.db?mode=memory&cache=shared")
+	require.NoError(t, err)
+	defer store.Close()
+
+	now := time.Now().UTC()
+	for i, event := range []struct{ id, eventType, repository string }{
+		{"sort-1", "push", "org/b"},
+		{"sort-2", "issues", "org/c"},
+		{"sort-3", "pull_request", "org/a"},
+	} {
+		require.NoError(t, store.StoreEvent(ctx, &storage.Event{
+			ID:         event.id,
+			Type:       event.eventType,
+			Payload:    []byte(`{}`),
+			CreatedAt:  now.Add(time.Duration(i) * time.Minute),
+			Repository: event.repository,
+		}))
+	}
+
+	tests := []struct {
+		name     string
+		opts     storage.QueryOptions
+		expected []string
+	}{
+		{name: "default", opts: storage.QueryOptions{}, expected: []string{"sort-1", "sort-2", "sort-3"}},
+		{name: "created_at descending", opts: storage.QueryOptions{SortDesc: true}, expected: []string{"sort-3", "sort-2", "sort-1"}},
+		{name: "type ascending", opts: storage.QueryOptions{SortBy: storage.SortByType}, expected: []string{"sort-2", "sort-3", "sort-1"}},
+		{name: "repository descending", opts: storage.QueryOptions{SortBy: storage.SortByRepository, SortDesc: true}, expected: []string{"sort-2", "sort-1", "sort-3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, _, err := store.ListEvents(ctx, tt.opts)
+			require.NoError(t, err)
+			var ids []string
+			for _, event := range events {
+				ids = append(ids, event.ID)
+			}
+			assert.Equal(t, tt.expected, ids)
+		})
+	}
+
+	_, _, err = store.ListEvents(ctx, storage.QueryOptions{SortBy: "payload; DROP TABLE events"})
+	assert.ErrorIs(t, err, storage.ErrInvalidSort)
+}
+
+func TestGetStatsBy(t *testing.T) {
+	ctx := context.Background()
+	store, err := sql.New("sqlite:file:test_stats_by.db?mode=memory&cache=shared")
+	require.NoError(t, err)
+	defer store.Close()
+
+	for _, event := range []*storage.Event{
+		{ID: "stats-1", Type: "push", Repository: "org/a", Sender: "alice"},
+		{ID: "stats-2", Type: "push", Repository: "org/a", Sender: "bob", Status: storage.StatusFailed},
+		{ID: "stats-3", Type: "issues", Repository: "org/b", Sender: "alice"},
+	} {
+		event.Payload = []byte(`{}`)
+		event.CreatedAt = time.Now().UTC()
+		require.NoError(t, store.StoreEvent(ctx, event))
+	}
+
+	tests := []struct {
+		dimension string
+		expected  map[string]int64
+	}{
+		{dimension: storage.StatsByType, expected: map[string]int64{"push": 2, "issues": 1}},
+		{dimension: storage.StatsByRepository, expected: map[string]int64{"org/a": 2, "org/b": 1}},
+		{dimension: storage.StatsBySender, expected: map[string]int64{"alice": 2, "bob": 1}},
+		{dimension: storage.StatsByStatus, expected: map[string]int64{"": 2, storage.StatusFailed: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dimension, func(t *testing.T) {
+			stats, err := store.GetStatsBy(ctx, tt.dimension, time.Time{})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, stats)
+		})
+	}
+
+	// Nothing was received in the future
+	stats, err := store.GetStatsBy(ctx, storage.StatsByType, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, stats)
+
+	_, err = store.GetStatsBy(ctx, "payload", time.Time{})
+	assert.ErrorIs(t, err, storage.ErrInvalidStats)
+}
+
+func TestGetEvents(t *testing.T) {
+	ctx := context.Background()
+	store, err := sql.New("sqlite:file:test_get_events.db?mode=memory&cache=shared")
+	require.NoError(t, err)
+	defer store.Close()
+
+	for _, id := range []string{"test-get-1", "test-get-2", "test-get-3"} {
+		err = store.StoreEvent(ctx, &storage.Event{
+			ID:         id,
+			Type:       "push",
+			Payload:    []byte(`{"ref": "refs/heads/main"}`),
+			Headers:    []byte(`{"X-GitHub-Event": ["push"]}`),
+			CreatedAt:  time.Now().UTC(),
+			Repository: "test/repo",
+			Sender:     "test-user",
+		})
+		require.NoError(t, err)
+	}
+
+	events, err := store.GetEvents(ctx, []string{"test-get-1", "test-get-3", "test-get-missing"})
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+
+	require.Contains(t, events, "test-get-1")
+	require.Contains(t, events, "test-get-3")
+	assert.NotContains(t, events, "test-get-missing")
+	assert.Equal(t, "push", events["test-get-1"].Type)
+	assert.JSONEq(t, `{"X-GitHub-Event": ["push"]}`, string(events["test-get-3"].Headers))
+
+	// No IDs is not an error
+	events, err = store.GetEvents(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+}
+
+func TestDeleteEventsKeepingLatestN(t *testing.T) {
+	ctx := context.Background()
+	store, err := sql.New("sqlite:file:test_keep_latest.db?mode=memory&cache=shared")
+	require.NoError(t, err)
+	defer store.Close()
+
+	base := time.Now().UTC().Add(-time.Hour)
+	seed := map[string]int{"busy/repo": 5, "quiet/repo": 2}
+	for repo, count := range seed {
+		for i := range count {
+			err = store.StoreEvent(ctx, &storage.Event{
+				ID:         fmt.Sprintf("%s-%d", repo, i),
+				Type:       "push",
+				Payload:    []byte(`{"ref": "refs/heads/main"}`),
+				Headers:    []byte(`{"X-GitHub-Event": ["push"]}`),
+				CreatedAt:  base.Add(time.Duration(i) * time.Minute),
+				Repository: repo,
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	deleted, err := store.DeleteEventsKeepingLatestN(ctx, 3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+
+	events, _, err := store.ListEvents(ctx, storage.QueryOptions{Repository: "busy/repo"})
+	require.NoError(t, err)
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	assert.ElementsMatch(t, []string{"busy/repo-2", "busy/repo-3", "busy/repo-4"}, ids)
+
+	// Repositories already under the limit are untouched
+	count, err := store.CountEvents(ctx, storage.QueryOptions{Repository: "quiet/repo"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Running again is a no-op
+	deleted, err = store.DeleteEventsKeepingLatestN(ctx, 3)
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+}
+
+func TestIterateEvents(t *testing.T) {
+	ctx := context.Background()
+	store, err := sql.New("sqlite:file:test_iterate.db?mode=memory&cache=shared")
+	require.NoError(t, err)
+	defer store.Close()
+
+	const total = 300
+	base := time.Now().UTC().Add(-time.Hour)
+	for i := range total {
+		err = store.StoreEvent(ctx, &storage.Event{
+			ID:         fmt.Sprintf("event-%03d", i),
+			Type:       "push",
+			Payload:    []byte(`{"ref": "refs/heads/main"}`),
+			Headers:    []byte(`{"X-GitHub-Event": ["push"]}`),
+			CreatedAt:  base.Add(time.Duration(i) * time.Second),
+			Repository: "test/repo",
+		})
+		require.NoError(t, err)
+	}
+
+	seen := make(map[string]int)
+	var order []string
+	err = store.IterateEvents(ctx, storage.QueryOptions{}, func(event *storage.Event) error {
+		seen[event.ID]++
+		order = append(order, event.ID)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Len(t, seen, total)
+	for id, visits := range seen {
+		assert.Equal(t, 1, visits, "event %s", id)
+	}
+	assert.Equal(t, "event-000", order[0])
+	assert.Equal(t, fmt.Sprintf("event-%03d", total-1), order[total-1])
+
+	// An error from the callback stops iteration and is returned
+	stop := fmt.Errorf("stop")
+	visited := 0
+	err = store.IterateEvents(ctx, storage.QueryOptions{}, func(*storage.Event) error {
+		visited++
+		if visited == 10 {
+			return stop
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 10, visited)
+}
+
+func TestOpTimeoutParameter(t *testing.T) {
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "op_timeout.db")
+
+	store, err := sql.New("sqlite:" + dbPath + "?op_timeout=5s")
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, ok := store.(*storage.TimeoutStorage)
+	assert.True(t, ok, "op_timeout wraps the storage")
+
+	// The parameter is stripped before the URI reaches the driver
+	require.NoError(t, store.StoreEvent(ctx, &storage.Event{
+		ID:        "op-timeout-event",
+		Type:      "push",
+		Payload:   []byte(`{}`),
+		CreatedAt: time.Now(),
+	}))
+	event, err := store.GetEvent(ctx, "op-timeout-event")
+	require.NoError(t, err)
+	require.NotNil(t, event)
+
+	_, err = sql.New("sqlite:" + dbPath + "?op_timeout=soon")
+	assert.ErrorContains(t, err, "invalid op_timeout")
+}
+
+func TestLatestEventsPerRepository(t *testing.T) {
+	ctx := context.Background()
+	store, err := sql.New("sqlite:file:test_latest_per_repo.db?mode=memory&cache=shared")
+	require.NoError(t, err)
+	defer store.Close()
+
+	base := time.Now().UTC().Add(-time.Hour)
+	for i, event := range []*storage.Event{
+		{ID: "a-1", Repository: "org/a", Type: "push"},
+		{ID: "a-2", Repository: "org/a", Type: "push"},
+		{ID: "a-3", Repository: "org/a", Type: "issues"},
+		{ID: "b-1", Repository: "org/b", Type: "push"},
+	} {
+		event.Payload = []byte(`{}`)
+		event.CreatedAt = base.Add(time.Duration(i) * time.Minute)
+		require.NoError(t, store.StoreEvent(ctx, event))
+	}
+
+	events, err := store.LatestEventsPerRepository(ctx, storage.QueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, "a-3", events[0].ID)
+	assert.Equal(t, "b-1", events[1].ID)
+
+	// Filters apply before picking the latest event
+	events, err = store.LatestEventsPerRepository(ctx, storage.QueryOptions{Types: []string{"push"}, Repository: "org/a"})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "a-2", events[0].ID)
+}
+
+func TestVerifyPayloadHash(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "hash.db")
+	uri := "sqlite://" + path
+
+	for _, codec := range []storage.Codec{storage.JSONCodec{}, storage.MsgpackCodec{}} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			store, err := sql.New(uri, sql.WithCodec(codec), sql.WithPayloadHashVerification(true))
+			require.NoError(t, err)
+			defer store.Close()
+
+			id := "hash-" + codec.Name()
+			err = store.StoreEvent(ctx, &storage.Event{
+				ID:        id,
+				Type:      "push",
+				Payload:   []byte(`{"ref": "refs/heads/main", "size": 1.50}`),
+				CreatedAt: time.Now().UTC(),
+			})
+			require.NoError(t, err)
+
+			// An intact payload verifies, even when the codec reformats it
+			event, err := store.GetEvent(ctx, id)
+			require.NoError(t, err)
+			assert.Len(t, event.PayloadHash, 64)
+		})
+	}
+
+	// Tamper with a stored payload behind the storage's back
+	db, err := dbsql.Open("sqlite3", path)
+	require.NoError(t, err)
+	_, err = db.Exec(`UPDATE events SET payload = '{"ref": "refs/heads/evil", "size": 1.50}' WHERE id = 'hash-json'`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	store, err := sql.New(uri, sql.WithPayloadHashVerification(true))
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.GetEvent(ctx, "hash-json")
+	assert.ErrorIs(t, err, storage.ErrPayloadCorrupted)
+
+	// Without verification the tampered payload is returned as stored
+	unverified, err := sql.New(uri)
+	require.NoError(t, err)
+	defer unverified.Close()
+
+	event, err := unverified.GetEvent(ctx, "hash-json")
+	require.NoError(t, err)
+	assert.Contains(t, string(event.Payload), "evil")
+}
+
+func TestDialectsShareColumns(t *testing.T) {
+	dialects := []struct {
+		name     string
+		dialect  sql.SQLDialect
+		jsonType string
+	}{
+		{name: "sqlite", dialect: &sql.SQLiteDialect{}, jsonType: "TEXT"},
+		{name: "postgres", dialect: &sql.PostgresDialect{}, jsonType: "JSONB"},
+		{name: "mysql", dialect: &sql.MySQLDialect{}, jsonType: "JSON"},
+	}
+
+	for _, tc := range dialects {
+		t.Run(tc.name, func(t *testing.T) {
+			ddl := tc.dialect.CreateTableSQL("events")
+
+			for _, column := range sql.EventColumns {
+				assert.Regexp(t, regexp.MustCompile(`(?m)^\s*`+column+` `), ddl, "missing column %s", column)
+			}
+			for index, column := range sql.EventIndexes {
+				assert.Contains(t, ddl, index+" ON events ("+column+")")
+			}
+
+			// Each dialect must use its own column types
+			assert.Contains(t, ddl, "payload "+tc.jsonType+" NOT NULL")
+		})
+	}
+
+	t.Run("live sqlite table", func(t *testing.T) {
+		const dsn = "file:test_columns.db?mode=memory&cache=shared"
+		store, err := sql.New("sqlite:" + dsn)
+		require.NoError(t, err)
+		defer store.Close()
+
+		db, err := dbsql.Open("sqlite3", dsn)
+		require.NoError(t, err)
+		defer db.Close()
+
+		rows, err := db.Query("SELECT * FROM events LIMIT 0")
+		require.NoError(t, err)
+		defer rows.Close()
+
+		columns, err := rows.Columns()
+		require.NoError(t, err)
+		assert.ElementsMatch(t, sql.EventColumns, columns)
+	})
+}
+
+func TestStorageCodecs(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "codecs.db")
+	uri := "sqlite://" + path
+	payload := `{"ref": "refs/heads/main", "repository": {"id": 9007199254740993, "full_name": "test/repo"}, "size": 1.5}`
+	headers := `{"X-GitHub-Event": ["push"], "Content-Type": ["application/json"]}`
+
+	for _, codec := range []storage.Codec{storage.JSONCodec{}, storage.MsgpackCodec{}} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			store, err := sql.New(uri, sql.WithCodec(codec))
+			require.NoError(t, err)
+			defer store.Close()
+
+			err = store.StoreEvent(ctx, &storage.Event{
+				ID:        "codec-" + codec.Name(),
+				Type:      "push",
+				Payload:   []byte(payload),
+				Headers:   []byte(headers),
+				CreatedAt: time.Now().UTC(),
+			})
+			require.NoError(t, err)
+
+			stored, err := store.GetEvent(ctx, "codec-"+codec.Name())
+			require.NoError(t, err)
+			require.NotNil(t, stored)
+			assert.JSONEq(t, payload, string(stored.Payload))
+			assert.JSONEq(t, headers, string(stored.Headers))
+		})
+	}
+
+	// Rows are decoded with the codec they were written with, whatever is configured now
+	store, err := sql.New(uri)
+	require.NoError(t, err)
+	defer store.Close()
+
+	events, _, err := store.ListEvents(ctx, storage.QueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	for _, event := range events {
+		assert.JSONEq(t, payload, string(event.Payload), event.ID)
+	}
+
+	// The codec is recorded per row and msgpack rows aren't stored as JSON
+	db, err := dbsql.Open("sqlite3", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var codecName string
+	var raw []byte
+	err = db.QueryRow("SELECT codec, payload FROM events WHERE id = ?", "codec-msgpack").Scan(&codecName, &raw)
+	require.NoError(t, err)
+	assert.Equal(t, storage.CodecMsgpack, codecName)
+	assert.False(t, json.Valid(raw))
+}
+
+func TestSchemaDoctor(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "doctor.db")
+
+	store, err := sql.New("sqlite://" + path)
+	require.NoError(t, err)
+	store.Close()
+
+	// Simulate manual tinkering: drop an index and a column
+	db, err := dbsql.Open("sqlite3", path)
+	require.NoError(t, err)
+	_, err = db.Exec("DROP INDEX idx_sender")
+	require.NoError(t, err)
+	_, err = db.Exec("ALTER TABLE events DROP COLUMN error")
+	require.NoError(t, err)
+	db.Close()
+
+	doctor, err := sql.Open("sqlite://" + path)
+	require.NoError(t, err)
+	defer doctor.Close()
+
+	report, err := doctor.CheckSchema(ctx)
+	require.NoError(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, []string{"error"}, report.MissingColumns)
+	assert.Equal(t, []string{"idx_sender"}, report.MissingIndexes)
+
+	require.NoError(t, doctor.RepairSchema(ctx, report))
+
+	report, err = doctor.CheckSchema(ctx)
+	require.NoError(t, err)
+	assert.True(t, report.OK(), "schema should be repaired: %+v", report)
+
+	// The repaired table works for normal reads and writes
+	err = doctor.StoreEvent(ctx, &storage.Event{
+		ID:        "after-repair",
+		Type:      "push",
+		Payload:   []byte(`{}`),
+		CreatedAt: time.Now().UTC(),
+		Error:     "boom",
+	})
+	require.NoError(t, err)
+	event, err := doctor.GetEvent(ctx, "after-repair")
+	require.NoError(t, err)
+	require.NotNil(t, event)
+	assert.Equal(t, "boom", event.Error)
+}
+
+func TestSQLiteCreatesParentDirs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	for _, uri := range []string{
+		"sqlite://" + filepath.Join(dir, "a", "b", "events.db"),
+		"sqlite:file:" + filepath.Join(dir, "c", "d", "events.db") + "?cache=shared",
+	} {
+		store, err := sql.New(uri)
+		require.NoError(t, err, uri)
+
+		_, err = store.CountEvents(ctx, storage.QueryOptions{})
+		require.NoError(t, err)
+		require.NoError(t, store.Close())
+	}
+	assert.FileExists(t, filepath.Join(dir, "a", "b", "events.db"))
+	assert.FileExists(t, filepath.Join(dir, "c", "d", "events.db"))
+
+	// Directory creation can be turned off
+	_, err := sql.New("sqlite://" + filepath.Join(dir, "e", "events.db") + "?_create_dirs=false")
+	require.Error(t, err)
+	assert.NoDirExists(t, filepath.Join(dir, "e"))
+}
+
+func TestSQLitePragmas(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	t.Run("concurrent writers wait for the lock", func(t *testing.T) {
+		path := filepath.Join(dir, "concurrent.db")
+		store, err := sql.New("sqlite:" + path + "?_busy_timeout=5000&_journal_mode=WAL&_synchronous=NORMAL")
+		require.NoError(t, err)
+		defer store.Close()
+
+		const writers, perWriter = 20, 25
+		var wg sync.WaitGroup
+		errs := make(chan error, 2*writers*perWriter)
+		for w := range writers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range perWriter {
+					id := fmt.Sprintf("writer-%d-%d", w, i)
+					errs <- store.StoreEvent(ctx, &storage.Event{
+						ID:        id,
+						Type:      "push",
+						Payload:   []byte(`{}`),
+						CreatedAt: time.Now().UTC(),
+					})
+					errs <- store.MarkForwarded(ctx, id)
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.NoError(t, err)
+		}
+		count, err := store.CountEvents(ctx, storage.QueryOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, writers*perWriter, count)
+		assert.FileExists(t, path+"-wal", "the journal mode should be honored")
+	})
+
+	t.Run("invalid values fail at startup", func(t *testing.T) {
+		for _, params := range []string{
+			"_journal_mode=fast",
+			"_journal=fast",
+			"_synchronous=sometimes",
+			"_busy_timeout=5s",
+			"_timeout=-1",
+		} {
+			_, err := sql.New("sqlite:"+filepath.Join(dir, "invalid.db")+"?"+params, sql.WithConnectRetry(5, time.Second))
+			require.Error(t, err, params)
+			assert.Contains(t, err.Error(), strings.Split(params, "=")[0])
+		}
+	})
+}
+
+func TestConnectRetry(t *testing.T) {
+	// SQLite can't open a database until its directory exists, which stands
+	// in for a database server that comes up after the proxy
+	dir := filepath.Join(t.TempDir(), "not-yet")
+	uri := "sqlite://" + filepath.Join(dir, "events.db") + "?_create_dirs=false"
+
+	_, err := sql.New(uri)
+	require.Error(t, err, "without retries the first failed ping is fatal")
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		assert.NoError(t, os.Mkdir(dir, 0o755))
+	}()
+
+	start := time.Now()
+	store, err := sql.New(uri, sql.WithConnectRetry(5, time.Second))
+	require.NoError(t, err)
+	defer store.Close()
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+
+	count, err := store.CountEvents(context.Background(), storage.QueryOptions{})
+	require.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func TestSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	uri := "sqlite:" + filepath.Join(t.TempDir(), "hubproxy.db")
+
+	store, err := sql.New(uri)
+	require.NoError(t, err)
+	version, err := store.(*sql.Storage).DatabaseSchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, sql.SchemaVersion, version)
+
+	// Reopening at the same version records nothing new
+	require.NoError(t, store.CreateSchema(ctx))
+	require.NoError(t, store.Close())
+
+	// Simulate a newer binary having migrated the database
+	db, err := dbsql.Open("sqlite3", strings.TrimPrefix(uri, "sqlite:"))
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", sql.SchemaVersion+1, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = sql.New(uri)
+	require.ErrorIs(t, err, sql.ErrSchemaTooNew)
+	assert.Contains(t, err.Error(), "--allow-schema-downgrade")
+
+	store, err = sql.New(uri, sql.WithAllowSchemaDowngrade(true))
+	require.NoError(t, err)
+	defer store.Close()
+	version, err = store.(*sql.Storage).DatabaseSchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, sql.SchemaVersion+1, version)
+}
+
+func TestNewReadOnly(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "hubproxy.db")
+	// A read-only connection stands in for a read replica's standby
+	readOnlyURI := "sqlite:file:" + path + "?mode=ro"
+
+	// The primary hasn't created the schema yet, and the replica can't
+	db, err := dbsql.Open("sqlite3", path)
+	require.NoError(t, err)
+	require.NoError(t, db.Ping())
+	require.NoError(t, db.Close())
+	_, err = sql.New(readOnlyURI)
+	require.Error(t, err, "creating the schema needs write access")
+	assert.Contains(t, err.Error(), "readonly database")
+	_, err = sql.NewReadOnly(readOnlyURI)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "has the primary database been migrated?")
+
+	primary, err := sql.New("sqlite:" + path)
+	require.NoError(t, err)
+	defer primary.Close()
+	require.NoError(t, primary.StoreEvent(ctx, &storage.Event{
+		ID:        "event-1",
+		Type:      "push",
+		Payload:   []byte(`{}`),
+		Headers:   []byte(`{}`),
+		CreatedAt: time.Now(),
+	}))
+
+	replica, err := sql.NewReadOnly(readOnlyURI + "&op_timeout=5s")
+	require.NoError(t, err)
+	defer replica.Close()
+	event, err := replica.GetEvent(ctx, "event-1")
+	require.NoError(t, err)
+	require.NotNil(t, event)
+	assert.Equal(t, "push", event.Type)
+
+	// A replica migrated by a newer primary is refused like the primary would be
+	db, err = dbsql.Open("sqlite3", path)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", sql.SchemaVersion+1, time.Now())
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	_, err = sql.NewReadOnly(readOnlyURI)
+	require.ErrorIs(t, err, sql.ErrSchemaTooNew)
+}
+
+func TestClaimPendingEvents(t *testing.T) {
+	ctx := context.Background()
+	store, err := sql.New("sqlite://" + filepath.Join(t.TempDir(), "claim.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	const total = 100
+	base := time.Now().UTC().Add(-time.Hour)
+	for i := range total {
+		err = store.StoreEvent(ctx, &storage.Event{
+			ID:         fmt.Sprintf("event-%03d", i),
+			Type:       "push",
+			Payload:    []byte(`{"ref": "refs/heads/main"}`),
+			CreatedAt:  base.Add(time.Duration(i) * time.Second),
+			Repository: "test/repo",
+		})
+		require.NoError(t, err)
+	}
+
+	// Forwarded and expired events aren't pending, so are never claimed
+	require.NoError(t, store.MarkForwarded(ctx, "event-000"))
+	require.NoError(t, store.UpdateEventStatus(ctx, "event-001", storage.StatusExpired))
+
+	// Several workers claim in small batches until nothing is left
+	const workers = 4
+	claims := make([][]string, workers)
+	errs := make(chan error, workers)
+	for w := range workers {
+		go func() {
+			workerID := fmt.Sprintf("worker-%d", w)
+			for {
+				events, err := store.ClaimPendingEvents(ctx, 5, workerID)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(events) == 0 {
+					errs <- nil
+					return
+				}
+				for _, event := range events {
+					claims[w] = append(claims[w], event.ID)
+				}
+			}
+		}()
+	}
+	for range workers {
+		require.NoError(t, <-errs)
+	}
+
+	claimedBy := make(map[string]int)
+	for w, ids := range claims {
+		for _, id := range ids {
+			previous, dup := claimedBy[id]
+			assert.False(t, dup, "event %s claimed by worker %d and worker %d", id, previous, w)
+			claimedBy[id] = w
+		}
+	}
+	assert.Len(t, claimedBy, total-2)
+	assert.NotContains(t, claimedBy, "event-000")
+	assert.NotContains(t, claimedBy, "event-001")
+
+	events, err := store.ClaimPendingEvents(ctx, 5, "late-worker")
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	// Claimed events come back oldest first
+
+	require.NoError(t, store.StoreEvent(ctx, &storage.Event{
+		ID: "new-b", Type: "push", Payload: []byte(`{}`), CreatedAt: base.Add(2 * time.Hour),
+	}))
+	require.NoError(t, store.StoreEvent(ctx, &storage.Event{
+		ID: "new-a", Type: "push", Payload: []byte(`{}`), CreatedAt: base.Add(time.Hour),
+	}))
+	events, err = store.ClaimPendingEvents(ctx, 5, "late-worker")
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, "new-a", events[0].ID)
+	assert.Equal(t, "new-b", events[1].ID)
+
+	_, err = store.ClaimPendingEvents(ctx, 5, "")
+	assert.Error(t, err)
+}
+
+func TestIncrementAttempts(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "attempts.db")
+
+	store, err := sql.New("sqlite://" + path)
+	require.NoError(t, err)
+	require.NoError(t, store.StoreEvent(ctx, &storage.Event{
+		ID:        "existing",
+		Type:      "push",
+		Payload:   []byte(`{}`),
+		CreatedAt: time.Now().UTC(),
+	}))
+	store.Close()
+
+	// Simulate a database created before attempts were tracked
+	db, err := dbsql.Open("sqlite3", path)
+	require.NoError(t, err)
+	_, err = db.Exec("ALTER TABLE events DROP COLUMN attempts")
+	require.NoError(t, err)
+	_, err = db.Exec("ALTER TABLE events DROP COLUMN next_attempt_at")
+	require.NoError(t, err)
+	db.Close()
+
+	// Startup adds the columns back, defaulting existing rows to no attempts
+	store, err = sql.New("sqlite://" + path)
+	require.NoError(t, err)
+	defer store.Close()
+
+	event, err := store.GetEvent(ctx, "existing")
+	require.NoError(t, err)
+	require.NotNil(t, event)
+	assert.Zero(t, event.Attempts)
+	assert.Nil(t, event.NextAttemptAt)
+
+	for range 3 {
+		require.NoError(t, store.IncrementAttempts(ctx, "existing"))
+	}
+	event, err = store.GetEvent(ctx, "existing")
+	require.NoError(t, err)
+	assert.Equal(t, 3, event.Attempts)
+
+	assert.Error(t, store.IncrementAttempts(ctx, "missing"))
+}
+
+func TestEventRoundTrip(t *testing.T) {
+	backends := []struct {
+		name string
+		uri  string
+	}{
+		{name: "sqlite", uri: "sqlite:" + filepath.Join(t.TempDir(), "roundtrip.db")},
+		// The other backends need a server; point these at a scratch database to cover them
+		{name: "postgres", uri: os.Getenv("HUBPROXY_TEST_POSTGRES_URI")},
+		{name: "mysql", uri: os.Getenv("HUBPROXY_TEST_MYSQL_URI")},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			if backend.uri == "" {
+				t.Skipf("set HUBPROXY_TEST_%s_URI to test against %s", strings.ToUpper(backend.name), backend.name)
+			}
+
+			ctx := context.Background()
+			store, err := sql.New(backend.uri)
+			require.NoError(t, err)
+			defer store.Close()
+
+			// Truncated to a second so every backend's timestamp precision keeps it
+			now := time.Now().UTC().Truncate(time.Second)
+			forwardedAt := now.Add(time.Minute)
+			event := &storage.Event{
+				ID:           fmt.Sprintf("roundtrip-%d", time.Now().UnixNano()),
+				Type:         "push",
+				Payload:      []byte(`{"ref":"refs/heads/main"}`),
+				Headers:      []byte(`{"X-GitHub-Event":["push"]}`),
+				CreatedAt:    now,
+				ReceivedAt:   now.Add(time.Second),
+				ForwardedAt:  &forwardedAt,
+				Status:       storage.StatusFailed,
+				Error:        "connection refused",
+				Repository:   "test/repo",
+				Sender:       "test-user",
+				ReplayedFrom: "original-delivery",
+				OriginalTime: now.Add(-time.Hour),
+
+				InstallationTargetType: "repository",
+				InstallationTargetID:   "1001",
+			}
+			require.NoError(t, store.StoreEvent(ctx, event))
+
+			stored, err := store.GetEvent(ctx, event.ID)
+			require.NoError(t, err)
+			require.NotNil(t, stored)
+
+			assert.Equal(t, event.ID, stored.ID)
+			assert.Equal(t, event.Type, stored.Type)
+			assert.JSONEq(t, string(event.Payload), string(stored.Payload))
+			assert.JSONEq(t, string(event.Headers), string(stored.Headers))
+			assert.True(t, event.CreatedAt.Equal(stored.CreatedAt), "created_at %s", stored.CreatedAt)
+			assert.True(t, event.ReceivedAt.Equal(stored.ReceivedAt), "received_at %s", stored.ReceivedAt)
+			require.NotNil(t, stored.ForwardedAt)
+			assert.True(t, forwardedAt.Equal(*stored.ForwardedAt), "forwarded_at %s", stored.ForwardedAt)
+			assert.Equal(t, event.Status, stored.Status)
+			assert.Equal(t, event.Error, stored.Error)
+			assert.Equal(t, event.Repository, stored.Repository)
+			assert.Equal(t, event.Sender, stored.Sender)
+			assert.Equal(t, event.ReplayedFrom, stored.ReplayedFrom)
+			assert.True(t, event.OriginalTime.Equal(stored.OriginalTime), "original_time %s", stored.OriginalTime)
+			assert.Equal(t, event.PayloadHash, stored.PayloadHash)
+			assert.Equal(t, event.InstallationTargetType, stored.InstallationTargetType)
+			assert.Equal(t, event.InstallationTargetID, stored.InstallationTargetID)
+
+			// Events that aren't replays leave the replay columns empty
+			plain := &storage.Event{
+				ID:        event.ID + "-plain",
+				Type:      "push",
+				Payload:   []byte(`{}`),
+				CreatedAt: now,
+			}
+			require.NoError(t, store.StoreEvent(ctx, plain))
+			stored, err = store.GetEvent(ctx, plain.ID)
+			require.NoError(t, err)
+			require.NotNil(t, stored)
+			assert.Empty(t, stored.ReplayedFrom)
+			assert.True(t, stored.OriginalTime.IsZero())
+			assert.Nil(t, stored.ForwardedAt)
+		})
+	}
+}
+
+func TestConformance(t *testing.T) {
+	backends := []struct {
+		name string
+		uri  func(t *testing.T) string
+	}{
+		{name: "sqlite", uri: func(t *testing.T) string { return "sqlite:" + filepath.Join(t.TempDir(), "conformance.db") }},
+		{name: "memory", uri: func(t *testing.T) string { return "sqlite::memory:" }},
+		// The other backends need a server; point these at a scratch database to cover them
+		{name: "postgres", uri: func(t *testing.T) string { return os.Getenv("HUBPROXY_TEST_POSTGRES_URI") }},
+		{name: "mysql", uri: func(t *testing.T) string { return os.Getenv("HUBPROXY_TEST_MYSQL_URI") }},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			if backend.uri(t) == "" {
+				t.Skipf("set HUBPROXY_TEST_%s_URI to test against %s", strings.ToUpper(backend.name), backend.name)
+			}
+
+			storagetest.RunConformance(t, func() storage.Storage {
+				store, err := sql.New(backend.uri(t))
+				require.NoError(t, err)
+				t.Cleanup(func() { store.Close() })
+
+				// Server databases keep events from earlier tests
+				_, err = store.DeleteEventsKeepingLatestN(context.Background(), 0)
+				require.NoError(t, err)
+				return store
+			})
+		})
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "v1.db")
+
+	// A database at schema version 1, before claims, the payload hash index
+	// and forward attempts
+	db, err := dbsql.Open("sqlite3", path)
+	require.NoError(t, err)
+	for _, stmt := range []string{
+		`CREATE TABLE events (
+			id VARCHAR(255) PRIMARY KEY,
+			type VARCHAR(50) NOT NULL,
+			payload JSON NOT NULL,
+			headers JSON,
+			created_at DATETIME NOT NULL,
+			received_at DATETIME,
+			forwarded_at DATETIME,
+			status VARCHAR(20),
+			error TEXT,
+			repository VARCHAR(255),
+			sender VARCHAR(255),
+			replayed_from VARCHAR(255),
+			original_time DATETIME,
+			codec VARCHAR(20),
+			payload_hash VARCHAR(64),
+			installation_target_type VARCHAR(20),
+			installation_target_id VARCHAR(255)
+		)`,
+		"CREATE INDEX idx_created_at ON events (created_at)",
+		"CREATE INDEX idx_repository ON events (repository)",
+		"CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, applied_at DATETIME NOT NULL)",
+		"INSERT INTO schema_migrations (version, applied_at) VALUES (1, CURRENT_TIMESTAMP)",
+		`INSERT INTO events (id, type, payload, created_at, status, repository)
+			VALUES ('existing', 'push', '{"ref":"refs/heads/main"}', '2024-01-02 03:04:05', 'failed', 'test/repo')`,
+	} {
+		_, err := db.Exec(stmt)
+		require.NoError(t, err, stmt)
+	}
+	require.NoError(t, db.Close())
+
+	store, err := sql.New("sqlite:" + path)
+	require.NoError(t, err)
+	defer store.Close()
+	sqlStore := store.(*sql.Storage)
+
+	t.Run("records each version", func(t *testing.T) {
+		version, err := sqlStore.DatabaseSchemaVersion(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, sql.SchemaVersion, version)
+
+		db, err := dbsql.Open("sqlite3", path)
+		require.NoError(t, err)
+		defer db.Close()
+		rows, err := db.Query("SELECT version FROM schema_migrations ORDER BY version")
+		require.NoError(t, err)
+		defer rows.Close()
+
+		var versions []int
+		for rows.Next() {
+			var version int
+			require.NoError(t, rows.Scan(&version))
+			versions = append(versions, version)
+		}
+		require.NoError(t, rows.Err())
+		assert.Equal(t, []int{1, 2, 3, 4, 5}, versions)
+	})
+
+	t.Run("adds columns and indexes", func(t *testing.T) {
+		report, err := sqlStore.CheckSchema(ctx)
+		require.NoError(t, err)
+		assert.True(t, report.OK(), "missing columns %v, indexes %v", report.MissingColumns, report.MissingIndexes)
+	})
+
+	t.Run("keeps existing events", func(t *testing.T) {
+		event, err := store.GetEvent(ctx, "existing")
+		require.NoError(t, err)
+		require.NotNil(t, event)
+		assert.Equal(t, "push", event.Type)
+		assert.Equal(t, storage.StatusFailed, event.Status)
+		assert.Equal(t, "test/repo", event.Repository)
+		assert.JSONEq(t, `{"ref":"refs/heads/main"}`, string(event.Payload))
+		assert.Zero(t, event.Attempts)
+
+		require.NoError(t, store.IncrementAttempts(ctx, "existing"))
+		claimed, err := store.ClaimPendingEvents(ctx, 1, "worker")
+		require.NoError(t, err)
+		assert.Empty(t, claimed, "a failed event shouldn't be claimed")
+	})
+}
@@ -2,6 +2,7 @@ package storage_test
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
@@ -83,3 +84,200 @@ func TestStorageImplementations(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, 1, count)
 }
+
+func TestJanitorRetentionCount(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	ctx := context.Background()
+
+	base := time.Now().UTC().Add(-time.Hour)
+	for i := range 4 {
+		err := store.StoreEvent(ctx, &storage.Event{
+			Type:       "push",
+			Payload:    []byte(`{"ref": "refs/heads/main"}`),
+			Headers:    []byte(`{"X-GitHub-Event": ["push"]}`),
+			CreatedAt:  base.Add(time.Duration(i) * time.Minute),
+			Repository: "test/repo",
+		})
+		require.NoError(t, err)
+	}
+
+	// Without a retention count the janitor keeps everything
+	deleted, err := storage.NewJanitor(storage.JanitorOptions{Storage: store}).Run(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+
+	janitor := storage.NewJanitor(storage.JanitorOptions{Storage: store, RetentionCount: 1})
+	deleted, err = janitor.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), deleted)
+
+	events, _, err := store.ListEvents(ctx, storage.QueryOptions{})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.WithinDuration(t, base.Add(3*time.Minute), events[0].CreatedAt, time.Second)
+}
+
+func TestJanitorRetention(t *testing.T) {
+	store := testutil.NewTestDB(t)
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	forwardedAt := now
+	for _, event := range []*storage.Event{
+		{ID: "old-forwarded", CreatedAt: now.Add(-48 * time.Hour), ForwardedAt: &forwardedAt},
+		{ID: "old-expired", CreatedAt: now.Add(-48 * time.Hour), Status: storage.StatusExpired},
+		{ID: "old-pending", CreatedAt: now.Add(-48 * time.Hour)},
+		{ID: "new-forwarded", CreatedAt: now.Add(-time.Hour), ForwardedAt: &forwardedAt},
+	} {
+		event.Type = "push"
+		event.Payload = []byte(`{"ref": "refs/heads/main"}`)
+		require.NoError(t, store.StoreEvent(ctx, event))
+	}
+
+	janitor := storage.NewJanitor(storage.JanitorOptions{Storage: store, Retention: 24 * time.Hour})
+	assert.True(t, janitor.Enabled())
+	deleted, err := janitor.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+
+	events, _, err := store.ListEvents(ctx, storage.QueryOptions{})
+	require.NoError(t, err)
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	assert.ElementsMatch(t, []string{"old-pending", "new-forwarded"}, ids)
+
+	require.NoError(t, store.DeleteEvent(ctx, "old-pending"))
+	assert.ErrorIs(t, store.DeleteEvent(ctx, "old-pending"), storage.ErrEventNotFound)
+}
+
+// countingStorage counts the CountEvents calls made to the storage it wraps
+type countingStorage struct {
+	storage.Storage
+	counts int
+}
+
+func (s *countingStorage) CountEvents(ctx context.Context, opts storage.QueryOptions) (int, error) {
+	s.counts++
+	return s.Storage.CountEvents(ctx, opts)
+}
+
+func TestQuotaStorage(t *testing.T) {
+	ctx := context.Background()
+	base := time.Now().UTC().Add(-time.Hour)
+
+	storeEvent := func(store storage.Storage, i int) error {
+		return store.StoreEvent(ctx, &storage.Event{
+			ID:        fmt.Sprintf("quota-%d", i),
+			Type:      "push",
+			Payload:   []byte(`{"ref": "refs/heads/main"}`),
+			CreatedAt: base.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	storeN := func(t *testing.T, store storage.Storage, n int) []error {
+		var errs []error
+		for i := range n {
+			errs = append(errs, storeEvent(store, i))
+		}
+		return errs
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		store, err := storage.NewQuotaStorage(testutil.NewTestDB(t), storage.QuotaOptions{MaxEvents: 3})
+		require.NoError(t, err)
+
+		errs := storeN(t, store, 4)
+		for _, err := range errs[:3] {
+			require.NoError(t, err)
+		}
+		assert.ErrorIs(t, errs[3], storage.ErrStorageFull)
+
+		count, err := store.CountEvents(ctx, storage.QueryOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, 3, count)
+	})
+
+	t.Run("redelivery when full", func(t *testing.T) {
+		store, err := storage.NewQuotaStorage(testutil.NewTestDB(t), storage.QuotaOptions{MaxEvents: 3})
+		require.NoError(t, err)
+
+		for _, err := range storeN(t, store, 3) {
+			require.NoError(t, err)
+		}
+
+		// An event already stored is reported as a duplicate, not refused
+		inserted, err := store.StoreEventIfNew(ctx, &storage.Event{
+			ID:        "quota-0",
+			Type:      "push",
+			Payload:   []byte(`{"ref": "refs/heads/main"}`),
+			CreatedAt: base,
+		})
+		require.NoError(t, err)
+		assert.False(t, inserted)
+
+		_, err = store.StoreEventIfNew(ctx, &storage.Event{
+			ID:        "quota-3",
+			Type:      "push",
+			Payload:   []byte(`{"ref": "refs/heads/main"}`),
+			CreatedAt: base,
+		})
+		assert.ErrorIs(t, err, storage.ErrStorageFull)
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		store, err := storage.NewQuotaStorage(testutil.NewTestDB(t), storage.QuotaOptions{
+			MaxEvents: 3,
+			Policy:    storage.FullPolicyPrune,
+		})
+		require.NoError(t, err)
+
+		for _, err := range storeN(t, store, 3) {
+			require.NoError(t, err)
+		}
+		require.NoError(t, store.MarkForwarded(ctx, "quota-0"))
+		require.NoError(t, store.UpdateEventStatus(ctx, "quota-1", storage.StatusFailed))
+		for i := 3; i < 5; i++ {
+			require.NoError(t, storeEvent(store, i))
+		}
+
+		listIDs := func() []string {
+			events, _, err := store.ListEvents(ctx, storage.QueryOptions{})
+			require.NoError(t, err)
+			var ids []string
+			for _, event := range events {
+				ids = append(ids, event.ID)
+			}
+			return ids
+		}
+		assert.Equal(t, []string{"quota-2", "quota-3", "quota-4"}, listIDs())
+
+		// Events still waiting to be forwarded are never pruned
+		assert.ErrorIs(t, storeEvent(store, 5), storage.ErrStorageFull)
+		assert.Equal(t, []string{"quota-2", "quota-3", "quota-4"}, listIDs())
+	})
+
+	t.Run("counts on an interval", func(t *testing.T) {
+		counting := &countingStorage{Storage: testutil.NewTestDB(t)}
+		store, err := storage.NewQuotaStorage(counting, storage.QuotaOptions{MaxEvents: 3})
+		require.NoError(t, err)
+
+		errs := storeN(t, store, 4)
+		for _, err := range errs[:3] {
+			require.NoError(t, err)
+		}
+		assert.ErrorIs(t, errs[3], storage.ErrStorageFull)
+		// Once for the first store, then again each time the tally reaches the cap
+		assert.Equal(t, 2, counting.counts)
+
+		// Events deleted elsewhere make room again
+		require.NoError(t, store.DeleteEvent(ctx, "quota-0"))
+		require.NoError(t, storeEvent(store, 4))
+		assert.Equal(t, 3, counting.counts)
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		_, err := storage.NewQuotaStorage(testutil.NewTestDB(t), storage.QuotaOptions{MaxEvents: 3, Policy: "drop"})
+		assert.Error(t, err)
+	})
+}
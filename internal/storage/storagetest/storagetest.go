@@ -0,0 +1,389 @@
+// Package storagetest checks that a storage.Storage implementation behaves
+// like every other backend, so each backend runs the same assertions and new
+// ones are covered without writing their own.
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"hubproxy/internal/storage"
+)
+
+// RunConformance runs the conformance tests against stores from newStore.
+// Each test calls newStore for a store of its own, which must hold no events;
+// the caller closes it, such as from a t.Cleanup registered by newStore.
+func RunConformance(t *testing.T, newStore func() storage.Storage) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, store storage.Storage)
+	}{
+		{"StoreAndGet", testStoreAndGet},
+		{"GetMissing", testGetMissing},
+		{"Duplicates", testDuplicates},
+		{"ListEvents", testListEvents},
+		{"CountEvents", testCountEvents},
+		{"Stats", testStats},
+		{"MarkForwarded", testMarkForwarded},
+		{"ReplayFields", testReplayFields},
+		{"OnlyNonForwarded", testOnlyNonForwarded},
+		{"DeleteOldestSettled", testDeleteOldestSettled},
+		{"NextAttempt", testNextAttempt},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, newStore())
+		})
+	}
+}
+
+// base is when the test events were created, truncated to a second so every
+// backend's timestamp precision keeps it
+var base = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func newEvent(id, eventType, repository string, createdAt time.Time) *storage.Event {
+	return &storage.Event{
+		ID:         id,
+		Type:       eventType,
+		Headers:    []byte(`{"X-GitHub-Event":["` + eventType + `"]}`),
+		Payload:    []byte(`{"ref":"refs/heads/main"}`),
+		CreatedAt:  createdAt,
+		ReceivedAt: createdAt,
+		Repository: repository,
+		Sender:     "test-user",
+	}
+}
+
+// storeEvents stores events created a minute apart, alternating between
+// push and pull_request events on test/repo and other/repo
+func storeEvents(t *testing.T, store storage.Storage, n int) []*storage.Event {
+	t.Helper()
+
+	events := make([]*storage.Event, n)
+	for i := range n {
+		eventType, repository := "push", "test/repo"
+		if i%2 == 1 {
+			eventType, repository = "pull_request", "other/repo"
+		}
+		events[i] = newEvent(fmt.Sprintf("event-%02d", i), eventType, repository, base.Add(time.Duration(i)*time.Minute))
+		require.NoError(t, store.StoreEvent(context.Background(), events[i]))
+	}
+	return events
+}
+
+func ids(events []*storage.Event) []string {
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	return ids
+}
+
+func testStoreAndGet(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+
+	event := newEvent("stored", "push", "test/repo", base)
+	event.Status = "received"
+	event.InstallationTargetType = "repository"
+	event.InstallationTargetID = "1001"
+	event.RequestID = "request-1"
+	require.NoError(t, store.StoreEvent(ctx, event))
+
+	stored, err := store.GetEvent(ctx, "stored")
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	assert.Equal(t, "stored", stored.ID)
+	assert.Equal(t, "push", stored.Type)
+	assert.JSONEq(t, string(event.Payload), string(stored.Payload))
+	assert.JSONEq(t, string(event.Headers), string(stored.Headers))
+	assert.True(t, base.Equal(stored.CreatedAt), "created_at %s", stored.CreatedAt)
+	assert.True(t, base.Equal(stored.ReceivedAt), "received_at %s", stored.ReceivedAt)
+	assert.Nil(t, stored.ForwardedAt)
+	assert.Equal(t, "received", stored.Status)
+	assert.Equal(t, "test/repo", stored.Repository)
+	assert.Equal(t, "test-user", stored.Sender)
+	assert.Equal(t, "repository", stored.InstallationTargetType)
+	assert.Equal(t, "1001", stored.InstallationTargetID)
+	assert.Equal(t, "request-1", stored.RequestID)
+	assert.Equal(t, storage.PayloadHash(event.Payload), stored.PayloadHash)
+
+	t.Run("generates an ID", func(t *testing.T) {
+		event := newEvent("", "push", "test/repo", base)
+		require.NoError(t, store.StoreEvent(ctx, event))
+		require.NotEmpty(t, event.ID)
+
+		stored, err := store.GetEvent(ctx, event.ID)
+		require.NoError(t, err)
+		assert.NotNil(t, stored)
+	})
+
+	t.Run("gets several events", func(t *testing.T) {
+		events, err := store.GetEvents(ctx, []string{"stored", "missing"})
+		require.NoError(t, err)
+		assert.Len(t, events, 1)
+		assert.Contains(t, events, "stored")
+	})
+}
+
+func testGetMissing(t *testing.T, store storage.Storage) {
+	event, err := store.GetEvent(context.Background(), "missing")
+	require.NoError(t, err)
+	assert.Nil(t, event)
+}
+
+func testDuplicates(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+
+	event := newEvent("delivery", "push", "test/repo", base)
+	inserted, err := store.StoreEventIfNew(ctx, event)
+	require.NoError(t, err)
+	assert.True(t, inserted)
+
+	redelivery := newEvent("delivery", "issues", "other/repo", base.Add(time.Minute))
+	inserted, err = store.StoreEventIfNew(ctx, redelivery)
+	require.NoError(t, err)
+	assert.False(t, inserted, "a stored delivery ID should not be inserted again")
+
+	require.NoError(t, store.StoreEvent(ctx, redelivery), "storing a duplicate should be a no-op")
+
+	stored, err := store.GetEvent(ctx, "delivery")
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	assert.Equal(t, "push", stored.Type, "the original event should be kept")
+
+	count, err := store.CountEvents(ctx, storage.QueryOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func testListEvents(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+	events := storeEvents(t, store, 6)
+
+	t.Run("all, oldest first", func(t *testing.T) {
+		listed, total, err := store.ListEvents(ctx, storage.QueryOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, 6, total)
+		assert.Equal(t, ids(events), ids(listed))
+	})
+
+	t.Run("by type and repository", func(t *testing.T) {
+		listed, total, err := store.ListEvents(ctx, storage.QueryOptions{
+			Types:      []string{"push"},
+			Repository: "test/repo",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 3, total)
+		assert.Equal(t, []string{"event-00", "event-02", "event-04"}, ids(listed))
+
+		listed, _, err = store.ListEvents(ctx, storage.QueryOptions{Repository: "missing/repo"})
+		require.NoError(t, err)
+		assert.Empty(t, listed)
+	})
+
+	t.Run("by time range", func(t *testing.T) {
+		listed, total, err := store.ListEvents(ctx, storage.QueryOptions{
+			Since: base.Add(time.Minute),
+			Until: base.Add(3 * time.Minute),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 3, total)
+		assert.Equal(t, []string{"event-01", "event-02", "event-03"}, ids(listed))
+	})
+
+	t.Run("paginated", func(t *testing.T) {
+		listed, total, err := store.ListEvents(ctx, storage.QueryOptions{Limit: 2, Offset: 3})
+		require.NoError(t, err)
+		assert.Equal(t, 6, total, "the total should ignore pagination")
+		assert.Equal(t, []string{"event-03", "event-04"}, ids(listed))
+	})
+
+	t.Run("sorted", func(t *testing.T) {
+		listed, _, err := store.ListEvents(ctx, storage.QueryOptions{SortDesc: true, Limit: 2})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"event-05", "event-04"}, ids(listed))
+
+		listed, _, err = store.ListEvents(ctx, storage.QueryOptions{SortBy: storage.SortByType})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"event-01", "event-03", "event-05", "event-00", "event-02", "event-04"}, ids(listed))
+
+		_, _, err = store.ListEvents(ctx, storage.QueryOptions{SortBy: "payload"})
+		assert.ErrorIs(t, err, storage.ErrInvalidSort)
+	})
+}
+
+func testCountEvents(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+
+	count, err := store.CountEvents(ctx, storage.QueryOptions{})
+	require.NoError(t, err)
+	assert.Zero(t, count)
+
+	storeEvents(t, store, 5)
+
+	count, err = store.CountEvents(ctx, storage.QueryOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 5, count)
+
+	count, err = store.CountEvents(ctx, storage.QueryOptions{Types: []string{"pull_request"}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = store.CountEvents(ctx, storage.QueryOptions{Since: base.Add(3 * time.Minute), Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count, "the count should ignore the limit")
+}
+
+func testStats(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+	storeEvents(t, store, 5)
+
+	stats, err := store.GetStats(ctx, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"push": 3, "pull_request": 2}, stats)
+
+	stats, err = store.GetStats(ctx, base.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"push": 2, "pull_request": 1}, stats)
+
+	stats, err = store.GetStatsBy(ctx, storage.StatsByRepository, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"test/repo": 3, "other/repo": 2}, stats)
+
+	_, err = store.GetStatsBy(ctx, "payload", time.Time{})
+	assert.ErrorIs(t, err, storage.ErrInvalidStats)
+}
+
+func testMarkForwarded(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+	storeEvents(t, store, 2)
+
+	before := time.Now().Add(-time.Second)
+	require.NoError(t, store.MarkForwarded(ctx, "event-00"))
+
+	forwarded, err := store.GetEvent(ctx, "event-00")
+	require.NoError(t, err)
+	require.NotNil(t, forwarded.ForwardedAt)
+	assert.False(t, forwarded.ForwardedAt.Before(before), "forwarded_at %s", forwarded.ForwardedAt)
+
+	pending, err := store.GetEvent(ctx, "event-01")
+	require.NoError(t, err)
+	assert.Nil(t, pending.ForwardedAt)
+
+	assert.Error(t, store.MarkForwarded(ctx, "missing"))
+}
+
+func testReplayFields(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+
+	original := newEvent("original", "push", "test/repo", base)
+	require.NoError(t, store.StoreEvent(ctx, original))
+
+	replay := newEvent("original-replay-1", "push", "test/repo", base.Add(time.Hour))
+	replay.Status = "replayed"
+	replay.ReplayedFrom = original.ID
+	replay.OriginalTime = original.CreatedAt
+	require.NoError(t, store.StoreEvent(ctx, replay))
+
+	stored, err := store.GetEvent(ctx, replay.ID)
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	assert.Equal(t, "original", stored.ReplayedFrom)
+	assert.True(t, base.Equal(stored.OriginalTime), "original_time %s", stored.OriginalTime)
+	assert.Equal(t, "replayed", stored.Status)
+
+	stored, err = store.GetEvent(ctx, original.ID)
+	require.NoError(t, err)
+	assert.Empty(t, stored.ReplayedFrom)
+	assert.True(t, stored.OriginalTime.IsZero())
+}
+
+func testOnlyNonForwarded(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+	storeEvents(t, store, 5)
+
+	require.NoError(t, store.MarkForwarded(ctx, "event-00"))
+	require.NoError(t, store.UpdateEventStatus(ctx, "event-01", storage.StatusFailed))
+	require.NoError(t, store.UpdateEventStatus(ctx, "event-02", storage.StatusExpired))
+
+	opts := storage.QueryOptions{OnlyNonForwarded: true}
+	listed, total, err := store.ListEvents(ctx, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, []string{"event-03", "event-04"}, ids(listed))
+
+	count, err := store.CountEvents(ctx, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// Requeueing a failed event makes it pending again
+	require.NoError(t, store.UpdateEventStatus(ctx, "event-01", ""))
+	count, err = store.CountEvents(ctx, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func testDeleteOldestSettled(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+	storeEvents(t, store, 5)
+
+	// event-00 and event-02 are pending, older than the settled event-03
+	require.NoError(t, store.MarkForwarded(ctx, "event-01"))
+	require.NoError(t, store.UpdateEventStatus(ctx, "event-03", storage.StatusFailed))
+	require.NoError(t, store.MarkForwarded(ctx, "event-04"))
+
+	deleted, err := store.DeleteOldestSettledEvents(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+
+	listed, _, err := store.ListEvents(ctx, storage.QueryOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"event-00", "event-02", "event-04"}, ids(listed))
+
+	// Only one settled event is left to delete
+	deleted, err = store.DeleteOldestSettledEvents(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	count, err := store.CountEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func testNextAttempt(t *testing.T, store storage.Storage) {
+	ctx := context.Background()
+	storeEvents(t, store, 3)
+
+	due := base.Add(time.Hour)
+	require.NoError(t, store.ScheduleNextAttempt(ctx, "event-00", due))
+	require.NoError(t, store.ScheduleNextAttempt(ctx, "event-01", due))
+	assert.Error(t, store.ScheduleNextAttempt(ctx, "missing", due))
+
+	event, err := store.GetEvent(ctx, "event-00")
+	require.NoError(t, err)
+	require.NotNil(t, event.NextAttemptAt)
+	assert.True(t, due.Equal(*event.NextAttemptAt), "got %v", event.NextAttemptAt)
+
+	// Scheduled events are skipped until they're due
+	listed, _, err := store.ListEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true, DueBy: due.Add(-time.Second)})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"event-02"}, ids(listed))
+	listed, _, err = store.ListEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true, DueBy: due})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"event-00", "event-01", "event-02"}, ids(listed))
+
+	// Forwarded and settled events have no next attempt
+	require.NoError(t, store.MarkForwarded(ctx, "event-00"))
+	require.NoError(t, store.UpdateEventStatus(ctx, "event-01", storage.StatusFailed))
+	for _, id := range []string{"event-00", "event-01"} {
+		event, err := store.GetEvent(ctx, id)
+		require.NoError(t, err)
+		assert.Nil(t, event.NextAttemptAt, id)
+	}
+}
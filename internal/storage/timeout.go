@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrOperationTimeout is returned when a storage operation exceeds its timeout
+var ErrOperationTimeout = errors.New("storage operation timed out")
+
+// TimeoutStorage applies a timeout to every operation on the wrapped storage,
+// so a hung database can't block callers indefinitely
+type TimeoutStorage struct {
+	storage Storage
+	timeout time.Duration
+}
+
+// NewTimeoutStorage wraps storage so each operation is cancelled after timeout
+func NewTimeoutStorage(storage Storage, timeout time.Duration) *TimeoutStorage {
+	return &TimeoutStorage{
+		storage: storage,
+		timeout: timeout,
+	}
+}
+
+// Unwrap returns the wrapped storage
+func (s *TimeoutStorage) Unwrap() Storage {
+	return s.storage
+}
+
+// run calls fn with a context limited to the timeout, turning a deadline
+// caused by the timeout into ErrOperationTimeout
+func (s *TimeoutStorage) run(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	err := fn(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s: %w after %s", op, ErrOperationTimeout, s.timeout)
+	}
+	return err
+}
+
+// StoreEvent stores a webhook event
+func (s *TimeoutStorage) StoreEvent(ctx context.Context, event *Event) error {
+	return s.run(ctx, "storing event", func(ctx context.Context) error {
+		return s.storage.StoreEvent(ctx, event)
+	})
+}
+
+// StoreEventIfNew stores a webhook event unless it's already stored
+func (s *TimeoutStorage) StoreEventIfNew(ctx context.Context, event *Event) (bool, error) {
+	var inserted bool
+	err := s.run(ctx, "storing event", func(ctx context.Context) (err error) {
+		inserted, err = s.storage.StoreEventIfNew(ctx, event)
+		return err
+	})
+	return inserted, err
+}
+
+// MarkForwarded marks an event as forwarded
+func (s *TimeoutStorage) MarkForwarded(ctx context.Context, id string) error {
+	return s.run(ctx, "marking event as forwarded", func(ctx context.Context) error {
+		return s.storage.MarkForwarded(ctx, id)
+	})
+}
+
+// UpdateEventStatus sets the status of an event
+func (s *TimeoutStorage) UpdateEventStatus(ctx context.Context, id string, status string) error {
+	return s.run(ctx, "updating event status", func(ctx context.Context) error {
+		return s.storage.UpdateEventStatus(ctx, id, status)
+	})
+}
+
+// DeleteEventsKeepingLatestN prunes old events
+func (s *TimeoutStorage) DeleteEventsKeepingLatestN(ctx context.Context, perRepo int) (int64, error) {
+	var deleted int64
+	err := s.run(ctx, "deleting old events", func(ctx context.Context) (err error) {
+		deleted, err = s.storage.DeleteEventsKeepingLatestN(ctx, perRepo)
+		return err
+	})
+	return deleted, err
+}
+
+// IncrementAttempts records a forward attempt
+func (s *TimeoutStorage) IncrementAttempts(ctx context.Context, id string) error {
+	return s.run(ctx, "incrementing attempts", func(ctx context.Context) error {
+		return s.storage.IncrementAttempts(ctx, id)
+	})
+}
+
+// ClaimPendingEvents claims pending events for a worker
+func (s *TimeoutStorage) ClaimPendingEvents(ctx context.Context, n int, workerID string) ([]*Event, error) {
+	var events []*Event
+	err := s.run(ctx, "claiming pending events", func(ctx context.Context) (err error) {
+		events, err = s.storage.ClaimPendingEvents(ctx, n, workerID)
+		return err
+	})
+	return events, err
+}
+
+// ScheduleNextAttempt records when an event's next forward attempt is due
+func (s *TimeoutStorage) ScheduleNextAttempt(ctx context.Context, id string, at time.Time) error {
+	return s.run(ctx, "scheduling next attempt", func(ctx context.Context) error {
+		return s.storage.ScheduleNextAttempt(ctx, id, at)
+	})
+}
+
+// DeleteOldestSettledEvents prunes the oldest settled events
+func (s *TimeoutStorage) DeleteOldestSettledEvents(ctx context.Context, n int) (int64, error) {
+	var deleted int64
+	err := s.run(ctx, "deleting oldest settled events", func(ctx context.Context) (err error) {
+		deleted, err = s.storage.DeleteOldestSettledEvents(ctx, n)
+		return err
+	})
+	return deleted, err
+}
+
+// DeleteEvent deletes a single event
+func (s *TimeoutStorage) DeleteEvent(ctx context.Context, id string) error {
+	return s.run(ctx, "deleting event", func(ctx context.Context) error {
+		return s.storage.DeleteEvent(ctx, id)
+	})
+}
+
+// DeleteEventsBefore prunes settled events older than cutoff
+func (s *TimeoutStorage) DeleteEventsBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	var deleted int64
+	err := s.run(ctx, "deleting events before cutoff", func(ctx context.Context) (err error) {
+		deleted, err = s.storage.DeleteEventsBefore(ctx, cutoff)
+		return err
+	})
+	return deleted, err
+}
+
+// ListEvents lists webhook events
+func (s *TimeoutStorage) ListEvents(ctx context.Context, opts QueryOptions) ([]*Event, int, error) {
+	var (
+		events []*Event
+		total  int
+	)
+	err := s.run(ctx, "listing events", func(ctx context.Context) (err error) {
+		events, total, err = s.storage.ListEvents(ctx, opts)
+		return err
+	})
+	return events, total, err
+}
+
+// LatestEventsPerRepository returns each repository's latest matching event
+func (s *TimeoutStorage) LatestEventsPerRepository(ctx context.Context, opts QueryOptions) ([]*Event, error) {
+	var events []*Event
+	err := s.run(ctx, "listing latest events", func(ctx context.Context) (err error) {
+		events, err = s.storage.LatestEventsPerRepository(ctx, opts)
+		return err
+	})
+	return events, err
+}
+
+// IterateEvents streams matching events. The timeout covers the whole
+// iteration, callbacks included.
+func (s *TimeoutStorage) IterateEvents(ctx context.Context, opts QueryOptions, fn func(*Event) error) error {
+	return s.run(ctx, "iterating events", func(ctx context.Context) error {
+		return s.storage.IterateEvents(ctx, opts, fn)
+	})
+}
+
+// CountEvents counts webhook events
+func (s *TimeoutStorage) CountEvents(ctx context.Context, opts QueryOptions) (int, error) {
+	var count int
+	err := s.run(ctx, "counting events", func(ctx context.Context) (err error) {
+		count, err = s.storage.CountEvents(ctx, opts)
+		return err
+	})
+	return count, err
+}
+
+// GetStats returns event type statistics
+func (s *TimeoutStorage) GetStats(ctx context.Context, since time.Time) (map[string]int64, error) {
+	var stats map[string]int64
+	err := s.run(ctx, "getting stats", func(ctx context.Context) (err error) {
+		stats, err = s.storage.GetStats(ctx, since)
+		return err
+	})
+	return stats, err
+}
+
+// GetStatsBy returns event statistics grouped by dimension
+func (s *TimeoutStorage) GetStatsBy(ctx context.Context, dimension string, since time.Time) (map[string]int64, error) {
+	var stats map[string]int64
+	err := s.run(ctx, "getting stats", func(ctx context.Context) (err error) {
+		stats, err = s.storage.GetStatsBy(ctx, dimension, since)
+		return err
+	})
+	return stats, err
+}
+
+// GetEvent returns a single event
+func (s *TimeoutStorage) GetEvent(ctx context.Context, id string) (*Event, error) {
+	var event *Event
+	err := s.run(ctx, "getting event", func(ctx context.Context) (err error) {
+		event, err = s.storage.GetEvent(ctx, id)
+		return err
+	})
+	return event, err
+}
+
+// GetEvents returns the events with the given IDs
+func (s *TimeoutStorage) GetEvents(ctx context.Context, ids []string) (map[string]*Event, error) {
+	var events map[string]*Event
+	err := s.run(ctx, "getting events", func(ctx context.Context) (err error) {
+		events, err = s.storage.GetEvents(ctx, ids)
+		return err
+	})
+	return events, err
+}
+
+// CreateSchema creates the database schema
+func (s *TimeoutStorage) CreateSchema(ctx context.Context) error {
+	return s.run(ctx, "creating schema", s.storage.CreateSchema)
+}
+
+// Ping checks that the database is reachable
+func (s *TimeoutStorage) Ping(ctx context.Context) error {
+	return s.run(ctx, "pinging database", s.storage.Ping)
+}
+
+// Close closes the wrapped storage
+func (s *TimeoutStorage) Close() error {
+	return s.storage.Close()
+}
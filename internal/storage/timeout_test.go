@@ -0,0 +1,85 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"hubproxy/internal/storage"
+)
+
+// slowStorage blocks every call until its context is done or delay passes
+type slowStorage struct {
+	storage.Storage
+	delay time.Duration
+}
+
+func (s *slowStorage) wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(s.delay):
+		return nil
+	}
+}
+
+func (s *slowStorage) GetEvent(ctx context.Context, id string) (*storage.Event, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &storage.Event{ID: id}, nil
+}
+
+func (s *slowStorage) ListEvents(ctx context.Context, _ storage.QueryOptions) ([]*storage.Event, int, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, 0, err
+	}
+	return nil, 0, nil
+}
+
+func (s *slowStorage) StoreEvent(ctx context.Context, _ *storage.Event) error {
+	return s.wait(ctx)
+}
+
+func TestTimeoutStorage(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("slow operations time out", func(t *testing.T) {
+		store := storage.NewTimeoutStorage(&slowStorage{delay: time.Second}, 20*time.Millisecond)
+
+		start := time.Now()
+		_, err := store.GetEvent(ctx, "event-1")
+		assert.ErrorIs(t, err, storage.ErrOperationTimeout)
+		assert.ErrorContains(t, err, "getting event: storage operation timed out after 20ms")
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+		_, _, err = store.ListEvents(ctx, storage.QueryOptions{})
+		assert.ErrorIs(t, err, storage.ErrOperationTimeout)
+
+		err = store.StoreEvent(ctx, &storage.Event{ID: "event-1"})
+		assert.ErrorIs(t, err, storage.ErrOperationTimeout)
+	})
+
+	t.Run("fast operations succeed", func(t *testing.T) {
+		store := storage.NewTimeoutStorage(&slowStorage{delay: time.Millisecond}, time.Second)
+
+		event, err := store.GetEvent(ctx, "event-1")
+		require.NoError(t, err)
+		assert.Equal(t, "event-1", event.ID)
+	})
+
+	t.Run("caller cancellation is not reported as a timeout", func(t *testing.T) {
+		store := storage.NewTimeoutStorage(&slowStorage{delay: time.Second}, time.Minute)
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := store.GetEvent(cancelled, "event-1")
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.False(t, errors.Is(err, storage.ErrOperationTimeout))
+	})
+}
@@ -13,26 +13,82 @@ type Event struct {
 	Headers      json.RawMessage `json:"headers"`
 	Payload      json.RawMessage `json:"payload"`
 	CreatedAt    time.Time       `json:"created_at"`
+	ReceivedAt   time.Time       `json:"received_at,omitempty"` // When HubProxy received the event
 	ForwardedAt  *time.Time      `json:"forwarded_at,omitempty"`
+	Status       string          `json:"status,omitempty"`
 	Error        string          `json:"error,omitempty"`
 	Repository   string          `json:"repository,omitempty"`
 	Sender       string          `json:"sender,omitempty"`
 	ReplayedFrom string          `json:"replayed_from,omitempty"` // Original event ID if this is a replay
 	OriginalTime time.Time       `json:"original_time,omitempty"` // Original event time if this is a replay
+	PayloadHash  string          `json:"payload_hash,omitempty"`  // SHA-256 of the canonical payload, set when stored
+	RequestID    string          `json:"request_id,omitempty"`    // X-Request-ID of the webhook request that delivered the event, for correlating logs
+	Codec        string          `json:"-"`                       // Name of the codec the event was stored with; empty means JSON
+
+	Attempts      int        `json:"attempts"`                  // Number of times forwarding has been attempted
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"` // When the next forward attempt is due, if the target's rate or Retry-After put one off
+
+	// The GitHub App installation, repository or organization the webhook was
+	// configured on, from the X-GitHub-Hook-Installation-Target-* headers
+	InstallationTargetType string `json:"installation_target_type,omitempty"`
+	InstallationTargetID   string `json:"installation_target_id,omitempty"`
+}
+
+// Event statuses
+const (
+	// StatusExpired marks an event that was too old to forward when its turn came
+	StatusExpired = "expired"
+	// StatusCoalesced marks a push superseded by a later push to the same ref before it was forwarded
+	StatusCoalesced = "coalesced"
+	// StatusSampledOut marks an event stored but not forwarded because it fell outside the forward sample rate
+	StatusSampledOut = "sampled_out"
+	// StatusFailed marks an event whose delivery failed more times than the
+	// forwarder retries; it isn't forwarded again unless requeued
+	StatusFailed = "failed"
+	// StatusDuplicate marks a redelivery of content already received, stored but not forwarded
+	StatusDuplicate = "duplicate"
+)
+
+// SettledStatuses are the statuses of events that won't be forwarded
+var SettledStatuses = []string{
+	StatusFailed, StatusExpired, StatusCoalesced, StatusSampledOut, StatusDuplicate,
 }
 
 // QueryOptions contains options for querying events
 type QueryOptions struct {
-	Types            []string  // Event types to filter by
-	Repository       string    // Repository to filter by
-	Sender           string    // Sender to filter by
-	Since            time.Time // Start time for events
-	Until            time.Time // End time for events
-	Limit            int       // Maximum number of events to return
-	Offset           int       // Offset for pagination
-	OnlyNonForwarded bool      // Only return events that have not been forwarded (forwarded_at IS NULL)
+	IDPrefix             string    // Only return events whose ID starts with this prefix
+	Types                []string  // Event types to filter by
+	Repository           string    // Repository to filter by
+	Sender               string    // Sender to filter by
+	InstallationTargetID string    // Installation target ID to filter by
+	PayloadHash          string    // Payload hash to filter by
+	Statuses             []string  // Event statuses to filter by
+	Since                time.Time // Start time for events
+	Until                time.Time // End time for events
+	ReceivedSince        time.Time // Only return events HubProxy received at or after this time
+	Limit                int       // Maximum number of events to return
+	Offset               int       // Offset for pagination
+	OnlyNonForwarded     bool      // Only return events still waiting to be forwarded (not forwarded, failed, expired, coalesced, sampled out or duplicate)
+	DueBy                time.Time // Skip events whose next forward attempt is scheduled after this time
+	SortBy               string    // Column ListEvents orders by, one of the SortBy constants; defaults to SortByCreatedAt
+	SortDesc             bool      // Order ListEvents results descending rather than ascending
 }
 
+// Dimensions GetStatsBy can group events by
+const (
+	StatsByType       = "type"
+	StatsByRepository = "repository"
+	StatsBySender     = "sender"
+	StatsByStatus     = "status"
+)
+
+// Columns ListEvents can order by
+const (
+	SortByCreatedAt  = "created_at"
+	SortByType       = "type"
+	SortByRepository = "repository"
+)
+
 // TypeStat represents event type statistics
 type TypeStat struct {
 	Type  string `json:"type"`
@@ -44,24 +100,83 @@ type Storage interface {
 	// StoreEvent stores a webhook event
 	StoreEvent(ctx context.Context, event *Event) error
 
+	// StoreEventIfNew stores a webhook event unless an event with the same ID
+	// is already stored, and reports whether it was inserted
+	StoreEventIfNew(ctx context.Context, event *Event) (inserted bool, err error)
+
 	// MarkForwarded marks an event as forwarded by setting the forwarded_at timestamp
 	MarkForwarded(ctx context.Context, id string) error
 
+	// UpdateEventStatus sets the status of an event
+	UpdateEventStatus(ctx context.Context, id string, status string) error
+
+	// IncrementAttempts adds one to the number of forward attempts of an event
+	IncrementAttempts(ctx context.Context, id string) error
+
+	// ScheduleNextAttempt records when the next forward attempt of an event
+	// is due. MarkForwarded, and UpdateEventStatus with a settled status,
+	// clear it.
+	ScheduleNextAttempt(ctx context.Context, id string, at time.Time) error
+
+	// ClaimPendingEvents atomically claims up to n events still waiting to be
+	// forwarded for workerID and returns them, oldest first. An event claimed
+	// by one caller isn't returned to another until the claim goes stale.
+	ClaimPendingEvents(ctx context.Context, n int, workerID string) ([]*Event, error)
+
+	// DeleteEventsKeepingLatestN deletes all but the perRepo most recent events
+	// of each repository, returning the number of events deleted
+	DeleteEventsKeepingLatestN(ctx context.Context, perRepo int) (int64, error)
+
+	// DeleteOldestSettledEvents deletes up to n of the oldest events that are
+	// no longer waiting to be forwarded, returning the number of events
+	// deleted. Pending events are kept however old they are.
+	DeleteOldestSettledEvents(ctx context.Context, n int) (int64, error)
+
+	// DeleteEvent deletes a single event, returning ErrEventNotFound if there's
+	// no event with that ID
+	DeleteEvent(ctx context.Context, id string) error
+
+	// DeleteEventsBefore deletes events created before cutoff that are no
+	// longer waiting to be forwarded, returning the number of events deleted.
+	// Pending events are kept however old they are.
+	DeleteEventsBefore(ctx context.Context, cutoff time.Time) (int64, error)
+
+	// LatestEventsPerRepository returns the most recent event matching the
+	// query options for each repository
+	LatestEventsPerRepository(ctx context.Context, opts QueryOptions) ([]*Event, error)
+
 	// ListEvents lists webhook events based on query options
 	ListEvents(ctx context.Context, opts QueryOptions) ([]*Event, int, error)
 
+	// IterateEvents calls fn for each event matching the query options, oldest
+	// first, streaming rows from a single query rather than loading them all.
+	// Iteration stops at the first error fn returns, which IterateEvents
+	// returns.
+	IterateEvents(ctx context.Context, opts QueryOptions, fn func(*Event) error) error
+
 	// CountEvents returns the total number of events matching the given options
 	CountEvents(ctx context.Context, opts QueryOptions) (int, error)
 
 	// GetStats returns event type statistics
 	GetStats(ctx context.Context, since time.Time) (map[string]int64, error)
 
+	// GetStatsBy counts events since a time grouped by a StatsBy dimension
+	GetStatsBy(ctx context.Context, dimension string, since time.Time) (map[string]int64, error)
+
 	// GetEvent returns a single event by ID
 	GetEvent(ctx context.Context, id string) (*Event, error)
 
-	// CreateSchema creates the database schema
+	// GetEvents returns the events with the given IDs, keyed by ID. IDs that
+	// don't exist are omitted from the result.
+	GetEvents(ctx context.Context, ids []string) (map[string]*Event, error)
+
+	// CreateSchema creates the database schema, or migrates an existing one
+	// to the current version
 	CreateSchema(ctx context.Context) error
 
+	// Ping checks that the database is reachable
+	Ping(ctx context.Context) error
+
 	// Close closes the storage
 	Close() error
 }
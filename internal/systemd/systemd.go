@@ -0,0 +1,108 @@
+// Package systemd supports systemd socket activation, so systemd can bind
+// the listening sockets (including privileged ports) and hand them to
+// HubProxy, keeping them open across restarts.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd (SD_LISTEN_FDS_START)
+var listenFdsStart = 3
+
+// Listeners returns the listening sockets passed by systemd socket
+// activation for the given names. Sockets are matched by the names in
+// LISTEN_FDNAMES (FileDescriptorName= in the socket unit), falling back to
+// the order of names when the passed sockets aren't named after them. It
+// returns nil when the process wasn't socket activated, and names with no
+// socket are left out of the result.
+//
+// The LISTEN_* variables are unset so child processes don't inherit them.
+func Listeners(names ...string) (map[string]net.Listener, error) {
+	pid := os.Getenv("LISTEN_PID")
+	fds := os.Getenv("LISTEN_FDS")
+	fdNames := os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		// The sockets were meant for another process
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	var passedNames []string
+	if fdNames != "" {
+		passedNames = strings.Split(fdNames, ":")
+	}
+
+	files := make([]*os.File, count)
+	for i := range files {
+		fd := listenFdsStart + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(passedNames) {
+			name = passedNames[i]
+		}
+		files[i] = os.NewFile(uintptr(fd), name)
+	}
+
+	// Match by name when every requested name was passed, otherwise by order
+	byName := true
+	for _, name := range names {
+		if !containsName(files, name) {
+			byName = false
+			break
+		}
+	}
+
+	listeners := make(map[string]net.Listener)
+	for i, name := range names {
+		var file *os.File
+		if byName {
+			for _, f := range files {
+				if f.Name() == name {
+					file = f
+					break
+				}
+			}
+		} else if i < len(files) {
+			file = files[i]
+		}
+		if file == nil {
+			continue
+		}
+
+		ln, err := net.FileListener(file)
+		if err != nil {
+			return nil, fmt.Errorf("using socket %s for %s: %w", file.Name(), name, err)
+		}
+		listeners[name] = ln
+	}
+
+	// net.FileListener dups the descriptors, so the originals can be closed
+	for _, file := range files {
+		file.Close()
+	}
+	return listeners, nil
+}
+
+func containsName(files []*os.File, name string) bool {
+	for _, file := range files {
+		if file.Name() == name {
+			return true
+		}
+	}
+	return false
+}
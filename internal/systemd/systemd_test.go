@@ -0,0 +1,113 @@
+//go:build linux
+
+package systemd
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// passListeners simulates systemd passing listeners to the process: it
+// duplicates them onto consecutive descriptors and sets the LISTEN_* variables
+func passListeners(t *testing.T, names string, listeners ...net.Listener) {
+	t.Helper()
+
+	const start = 200
+	for i, ln := range listeners {
+		file, err := ln.(*net.TCPListener).File()
+		require.NoError(t, err)
+		require.NoError(t, syscall.Dup3(int(file.Fd()), start+i, 0))
+		file.Close()
+	}
+
+	previous := listenFdsStart
+	listenFdsStart = start
+	t.Cleanup(func() { listenFdsStart = previous })
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(len(listeners)))
+	if names != "" {
+		t.Setenv("LISTEN_FDNAMES", names)
+	}
+}
+
+// serves reports whether an HTTP server on ln answers requests sent to addr
+func serves(t *testing.T, ln net.Listener, addr string) bool {
+	t.Helper()
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body) == "ok"
+}
+
+func TestListeners(t *testing.T) {
+	tests := []struct {
+		name    string
+		fdNames string
+		order   []int // Index of the passed listener expected for webhook and api
+	}{
+		{name: "matched by name", fdNames: "api:webhook", order: []int{1, 0}},
+		{name: "matched by order", fdNames: "hubproxy.socket:hubproxy.socket", order: []int{0, 1}},
+		{name: "unnamed", order: []int{0, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var passed []net.Listener
+			for range 2 {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				require.NoError(t, err)
+				defer ln.Close()
+				passed = append(passed, ln)
+			}
+			passListeners(t, tt.fdNames, passed...)
+
+			listeners, err := Listeners("webhook", "api")
+			require.NoError(t, err)
+			require.Len(t, listeners, 2)
+
+			for i, name := range []string{"webhook", "api"} {
+				ln := listeners[name]
+				require.NotNil(t, ln, name)
+				addr := passed[tt.order[i]].Addr().String()
+				assert.Equal(t, addr, ln.Addr().String(), name)
+				assert.True(t, serves(t, ln, addr), "%s should serve on the passed socket", name)
+			}
+
+			// The variables aren't passed on to children
+			assert.Empty(t, os.Getenv("LISTEN_FDS"))
+		})
+	}
+}
+
+func TestListenersNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "")
+	listeners, err := Listeners("webhook", "api")
+	require.NoError(t, err)
+	assert.Nil(t, listeners)
+
+	// Sockets passed to another process are ignored
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "2")
+	listeners, err = Listeners("webhook", "api")
+	require.NoError(t, err)
+	assert.Nil(t, listeners)
+}
@@ -0,0 +1,137 @@
+package webhook
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Results recorded for a forwarding attempt
+const (
+	AttemptResultSuccess = "success"
+	AttemptResultFailure = "failure"
+)
+
+// DefaultAttemptWindow is the number of recent attempts per target used for success rates
+const DefaultAttemptWindow = 100
+
+var forwardAttempts = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "hubproxy_forward_attempts_total",
+		Help: "Total number of webhook forwarding attempts by target and result",
+	},
+	[]string{"target", "result"},
+)
+
+// TargetSummary describes recent forwarding results for one target
+type TargetSummary struct {
+	Target        string     `json:"target"`
+	Attempts      int        `json:"attempts"`
+	Successes     int        `json:"successes"`
+	Failures      int        `json:"failures"`
+	SuccessRate   float64    `json:"success_rate"`
+	LastAttemptAt time.Time  `json:"last_attempt_at"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+}
+
+// AttemptTracker records the most recent forwarding attempts per target
+type AttemptTracker struct {
+	mu      sync.Mutex
+	window  int
+	targets map[string]*targetAttempts
+}
+
+type targetAttempts struct {
+	results       []bool // Ring buffer of recent results, true for success
+	next          int
+	lastAttemptAt time.Time
+	lastError     string
+	lastErrorAt   time.Time
+}
+
+// NewAttemptTracker creates a tracker that keeps the last window attempts per target
+func NewAttemptTracker(window int) *AttemptTracker {
+	if window <= 0 {
+		window = DefaultAttemptWindow
+	}
+	return &AttemptTracker{
+		window:  window,
+		targets: make(map[string]*targetAttempts),
+	}
+}
+
+// Record records the result of a forwarding attempt; a nil err is a success
+func (t *AttemptTracker) Record(target string, err error) {
+	result := AttemptResultSuccess
+	if err != nil {
+		result = AttemptResultFailure
+	}
+	forwardAttempts.WithLabelValues(target, result).Inc()
+
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	attempts, ok := t.targets[target]
+	if !ok {
+		attempts = &targetAttempts{}
+		t.targets[target] = attempts
+	}
+
+	if len(attempts.results) < t.window {
+		attempts.results = append(attempts.results, err == nil)
+	} else {
+		attempts.results[attempts.next] = err == nil
+		attempts.next = (attempts.next + 1) % t.window
+	}
+
+	now := time.Now()
+	attempts.lastAttemptAt = now
+	if err != nil {
+		attempts.lastError = err.Error()
+		attempts.lastErrorAt = now
+	}
+}
+
+// Summaries returns a summary of recent attempts for every target, sorted by target
+func (t *AttemptTracker) Summaries() []TargetSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	summaries := make([]TargetSummary, 0, len(t.targets))
+	for target, attempts := range t.targets {
+		summary := TargetSummary{
+			Target:        target,
+			Attempts:      len(attempts.results),
+			LastAttemptAt: attempts.lastAttemptAt,
+			LastError:     attempts.lastError,
+		}
+		for _, success := range attempts.results {
+			if success {
+				summary.Successes++
+			} else {
+				summary.Failures++
+			}
+		}
+		if summary.Attempts > 0 {
+			summary.SuccessRate = float64(summary.Successes) / float64(summary.Attempts)
+		}
+		if !attempts.lastErrorAt.IsZero() {
+			lastErrorAt := attempts.lastErrorAt
+			summary.LastErrorAt = &lastErrorAt
+		}
+		summaries = append(summaries, summary)
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Target < summaries[j].Target
+	})
+	return summaries
+}
@@ -0,0 +1,97 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Delivery stages recorded in audit receipts, in pipeline order
+const (
+	AuditStageReceived  = "received"
+	AuditStageVerified  = "verified"
+	AuditStageStored    = "stored"
+	AuditStageForwarded = "forwarded"
+)
+
+// Audit receipt outcomes
+const (
+	AuditOutcomeOK     = "ok"
+	AuditOutcomeFailed = "failed"
+)
+
+// Receipt records the outcome of one stage of a delivery
+type Receipt struct {
+	Time       time.Time `json:"time"`
+	DeliveryID string    `json:"delivery_id"`
+	EventType  string    `json:"event_type,omitempty"`
+	Stage      string    `json:"stage"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+	Target     string    `json:"target,omitempty"` // Forward target, for the forwarded stage
+}
+
+// AuditSink records delivery receipts. Receipts are only ever appended, so
+// a sink may be backed by write-once storage.
+type AuditSink interface {
+	Record(ctx context.Context, receipt Receipt) error
+}
+
+// FileAuditSink appends receipts to a file as JSON lines
+type FileAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileAuditSink opens path for appending receipts, creating it if needed
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit file: %w", err)
+	}
+	return &FileAuditSink{file: file}, nil
+}
+
+// Record appends a receipt as a single line
+func (s *FileAuditSink) Record(_ context.Context, receipt Receipt) error {
+	line, err := json.Marshal(receipt)
+	if err != nil {
+		return fmt.Errorf("encoding receipt: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(line); err != nil {
+		return fmt.Errorf("writing receipt: %w", err)
+	}
+	return nil
+}
+
+// Close closes the audit file
+func (s *FileAuditSink) Close() error {
+	return s.file.Close()
+}
+
+// recordReceipt records a stage's outcome to sink, if there is one. A
+// receipt that can't be recorded is logged but doesn't fail the delivery.
+func recordReceipt(ctx context.Context, sink AuditSink, logger *slog.Logger, receipt Receipt, stageErr error) {
+	if sink == nil {
+		return
+	}
+
+	receipt.Time = time.Now().UTC()
+	receipt.Outcome = AuditOutcomeOK
+	if stageErr != nil {
+		receipt.Outcome = AuditOutcomeFailed
+		receipt.Error = stageErr.Error()
+	}
+
+	if err := sink.Record(ctx, receipt); err != nil {
+		logger.Error("error recording audit receipt", "delivery", receipt.DeliveryID, "stage", receipt.Stage, "error", err)
+	}
+}
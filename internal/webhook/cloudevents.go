@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"hubproxy/internal/storage"
+)
+
+// Formats for forwarded requests
+const (
+	// ForwardFormatGitHub forwards the webhook exactly as GitHub sent it
+	ForwardFormatGitHub = "github"
+	// ForwardFormatCloudEvents wraps the webhook as a CloudEvent
+	ForwardFormatCloudEvents = "cloudevents"
+)
+
+// CloudEvents HTTP content modes
+const (
+	// CloudEventsModeBinary carries attributes in ce-* headers and the payload as the body
+	CloudEventsModeBinary = "binary"
+	// CloudEventsModeStructured carries the whole event, payload included, as a JSON body
+	CloudEventsModeStructured = "structured"
+)
+
+const (
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsTypePrefix  = "com.github."
+	cloudEventsContentType = "application/cloudevents+json"
+)
+
+// cloudEvent is a CloudEvent in the structured JSON format
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// newCloudEvent sets the CloudEvent attributes for a webhook event
+func newCloudEvent(event *storage.Event) cloudEvent {
+	source := "https://github.com"
+	if event.Repository != "" {
+		source += "/" + event.Repository
+	}
+
+	return cloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              event.ID,
+		Source:          source,
+		Type:            cloudEventsTypePrefix + event.Type,
+		Time:            event.CreatedAt.UTC().Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		Data:            event.Payload,
+	}
+}
+
+// encodeCloudEvent encodes an event as a CloudEvent in the given content
+// mode, returning the request body and the headers to set on the request
+func encodeCloudEvent(event *storage.Event, mode string) ([]byte, http.Header, error) {
+	ce := newCloudEvent(event)
+	headers := make(http.Header)
+
+	switch mode {
+	case CloudEventsModeStructured:
+		body, err := json.Marshal(ce)
+		if err != nil {
+			return nil, nil, fmt.Errorf("encoding CloudEvent: %w", err)
+		}
+		headers.Set("Content-Type", cloudEventsContentType)
+		return body, headers, nil
+	case CloudEventsModeBinary, "":
+		headers.Set("ce-specversion", ce.SpecVersion)
+		headers.Set("ce-id", ce.ID)
+		headers.Set("ce-source", ce.Source)
+		headers.Set("ce-type", ce.Type)
+		headers.Set("ce-time", ce.Time)
+		headers.Set("Content-Type", ce.DataContentType)
+		return ce.Data, headers, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown CloudEvents mode: %s", mode)
+	}
+}
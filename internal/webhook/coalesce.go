@@ -0,0 +1,118 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"hubproxy/internal/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var webhookCoalescedEvents = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "hubproxy_webhook_coalesced_events_total",
+		Help: "Total number of push events superseded by a later push to the same ref and not forwarded",
+	},
+)
+
+// pushKey identifies the ref a push event updated
+type pushKey struct {
+	repository string
+	ref        string
+}
+
+// coalescePushes returns the pending events to forward now. Push events to a
+// ref that was pushed again within the coalesce window are superseded by the
+// later push and marked coalesced instead of forwarded. The latest push to a
+// ref is held until the window has passed without another push, and a sweep
+// is scheduled for when it has.
+func (f *WebhookForwarder) coalescePushes(ctx context.Context, events []*storage.Event) []*storage.Event {
+	if f.coalesceWindow <= 0 {
+		return events
+	}
+
+	pushes := make(map[pushKey][]*storage.Event)
+	for _, event := range events {
+		if key, ok := pushRef(event); ok {
+			pushes[key] = append(pushes[key], event)
+		}
+	}
+
+	skip := make(map[string]bool)
+	var wait time.Duration
+	for _, group := range pushes {
+		sort.SliceStable(group, func(i, j int) bool {
+			return receivedAt(group[i]).Before(receivedAt(group[j]))
+		})
+
+		for i, event := range group {
+			if i+1 < len(group) {
+				// Superseded by the next push if it arrived within the window
+				if receivedAt(group[i+1]).Sub(receivedAt(event)) <= f.coalesceWindow {
+					skip[event.ID] = true
+					f.markCoalesced(ctx, event, group[i+1])
+				}
+				continue
+			}
+
+			// The latest push waits in case another one follows
+			if remaining := f.coalesceWindow - time.Since(receivedAt(event)); remaining > 0 {
+				skip[event.ID] = true
+				if wait == 0 || remaining < wait {
+					wait = remaining
+				}
+			}
+		}
+	}
+
+	if wait > 0 {
+		f.logger.Debug("holding pushes for coalescing", "wait", wait)
+		time.AfterFunc(wait, f.EnqueueProcessEvents)
+	}
+
+	forward := make([]*storage.Event, 0, len(events))
+	for _, event := range events {
+		if !skip[event.ID] {
+			forward = append(forward, event)
+		}
+	}
+	return forward
+}
+
+// markCoalesced records that event was superseded by a later push
+func (f *WebhookForwarder) markCoalesced(ctx context.Context, event, latest *storage.Event) {
+	if err := f.storage.UpdateEventStatus(ctx, event.ID, storage.StatusCoalesced); err != nil {
+		f.logger.Error("error marking event as coalesced", "event", event.ID, "error", err)
+		return
+	}
+	webhookCoalescedEvents.Inc()
+	f.logger.Debug("coalesced push", "event", event.ID, "supersededBy", latest.ID, "repository", event.Repository)
+}
+
+// pushRef returns the repository and ref a push event updated
+func pushRef(event *storage.Event) (pushKey, bool) {
+	if event.Type != "push" || event.Repository == "" {
+		return pushKey{}, false
+	}
+
+	var payload struct {
+		Ref string `json:"ref"`
+	}
+	if err := json.Unmarshal(event.Payload, &payload); err != nil || payload.Ref == "" {
+		return pushKey{}, false
+	}
+	return pushKey{repository: event.Repository, ref: payload.Ref}, true
+}
+
+// receivedAt returns when HubProxy received an event, falling back to its
+// creation time for events stored without one
+func receivedAt(event *storage.Event) time.Time {
+	if event.ReceivedAt.IsZero() {
+		return event.CreatedAt
+	}
+	return event.ReceivedAt
+}
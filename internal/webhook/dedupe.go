@@ -0,0 +1,59 @@
+package webhook
+
+import (
+	"context"
+	"time"
+
+	"hubproxy/internal/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// What makes two webhooks the same delivery
+const (
+	// DedupeKeyDelivery treats webhooks with the same X-GitHub-Delivery ID as
+	// one delivery. GitHub's manual redeliveries get a new ID, so they're
+	// forwarded again.
+	DedupeKeyDelivery = "delivery"
+	// DedupeKeyPayload also treats a webhook as a redelivery when an event of
+	// the same type with the same payload was received within the dedupe window
+	DedupeKeyPayload = "payload"
+)
+
+// DefaultDedupeWindow is how far back payload dedupe looks for earlier deliveries
+const DefaultDedupeWindow = 24 * time.Hour
+
+var webhookDuplicateEvents = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "hubproxy_webhook_duplicate_events_total",
+		Help: "Total number of webhooks stored as duplicates of content already received and not forwarded",
+	},
+)
+
+// markRedelivery marks event as a duplicate, so it's stored but not
+// forwarded, when it repeats the content of an event received within the
+// dedupe window. Lookup errors are logged and the event is treated as new.
+func (h *Handler) markRedelivery(ctx context.Context, event *storage.Event) {
+	if h.dedupeKey != DedupeKeyPayload {
+		return
+	}
+
+	event.PayloadHash = storage.PayloadHash(event.Payload)
+	count, err := h.store.CountEvents(ctx, storage.QueryOptions{
+		PayloadHash:   event.PayloadHash,
+		Types:         []string{event.Type},
+		ReceivedSince: event.ReceivedAt.Add(-h.dedupeWindow),
+	})
+	if err != nil {
+		h.logger.Error("error checking for redelivery", "delivery", event.ID, "error", err)
+		return
+	}
+	if count == 0 {
+		return
+	}
+
+	event.Status = storage.StatusDuplicate
+	webhookDuplicateEvents.Inc()
+	h.logger.Info("redelivered payload, storing without forwarding", "delivery", event.ID, "type", event.Type, "payloadHash", event.PayloadHash)
+}
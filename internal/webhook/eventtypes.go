@@ -0,0 +1,90 @@
+package webhook
+
+// otherEventType labels metrics for event types outside knownEventTypes
+const otherEventType = "other"
+
+// knownEventTypes are the GitHub webhook event types metrics are labeled
+// with. Anything else is counted as otherEventType, so a sender can't grow
+// metric cardinality by inventing X-GitHub-Event values.
+var knownEventTypes = map[string]bool{
+	"branch_protection_configuration": true,
+	"branch_protection_rule":          true,
+	"check_run":                       true,
+	"check_suite":                     true,
+	"code_scanning_alert":             true,
+	"commit_comment":                  true,
+	"create":                          true,
+	"custom_property":                 true,
+	"custom_property_values":          true,
+	"delete":                          true,
+	"dependabot_alert":                true,
+	"deploy_key":                      true,
+	"deployment":                      true,
+	"deployment_protection_rule":      true,
+	"deployment_review":               true,
+	"deployment_status":               true,
+	"discussion":                      true,
+	"discussion_comment":              true,
+	"fork":                            true,
+	"github_app_authorization":        true,
+	"gollum":                          true,
+	"installation":                    true,
+	"installation_repositories":       true,
+	"installation_target":             true,
+	"issue_comment":                   true,
+	"issues":                          true,
+	"label":                           true,
+	"marketplace_purchase":            true,
+	"member":                          true,
+	"membership":                      true,
+	"merge_group":                     true,
+	"meta":                            true,
+	"milestone":                       true,
+	"org_block":                       true,
+	"organization":                    true,
+	"package":                         true,
+	"page_build":                      true,
+	"personal_access_token_request":   true,
+	"ping":                            true,
+	"project":                         true,
+	"project_card":                    true,
+	"project_column":                  true,
+	"projects_v2":                     true,
+	"projects_v2_item":                true,
+	"public":                          true,
+	"pull_request":                    true,
+	"pull_request_review":             true,
+	"pull_request_review_comment":     true,
+	"pull_request_review_thread":      true,
+	"push":                            true,
+	"registry_package":                true,
+	"release":                         true,
+	"repository":                      true,
+	"repository_advisory":             true,
+	"repository_dispatch":             true,
+	"repository_import":               true,
+	"repository_ruleset":              true,
+	"repository_vulnerability_alert":  true,
+	"secret_scanning_alert":           true,
+	"secret_scanning_alert_location":  true,
+	"security_advisory":               true,
+	"security_and_analysis":           true,
+	"sponsorship":                     true,
+	"star":                            true,
+	"status":                          true,
+	"sub_issues":                      true,
+	"team":                            true,
+	"team_add":                        true,
+	"watch":                           true,
+	"workflow_dispatch":               true,
+	"workflow_job":                    true,
+	"workflow_run":                    true,
+}
+
+// eventTypeLabel returns the metric label for an event type
+func eventTypeLabel(eventType string) string {
+	if knownEventTypes[eventType] {
+		return eventType
+	}
+	return otherEventType
+}
@@ -1,26 +1,40 @@
 package webhook
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"net"
+	"math/rand/v2"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"hubproxy/internal/githubapp"
+	"hubproxy/internal/requestid"
+	"hubproxy/internal/security"
 	"hubproxy/internal/storage"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 )
 
 var (
-	webhookForwardedEvents = promauto.NewCounter(
+	webhookForwardedEvents = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "hubproxy_webhook_forwarded_events_total",
-			Help: "Total number of webhook events forwarded to the target",
+			Help: "Total number of webhook events forwarded to the target, by event type",
 		},
+		[]string{"event_type"},
 	)
 
 	webhookForwardingErrors = promauto.NewCounter(
@@ -29,25 +43,127 @@ var (
 			Help: "Total number of webhook forwarding errors",
 		},
 	)
+
+	webhookExpiredEvents = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "hubproxy_webhook_expired_events_total",
+			Help: "Total number of webhook events expired instead of forwarded because they exceeded the max age",
+		},
+	)
+
+	webhookDeadLettered = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "hubproxy_webhook_dead_lettered_total",
+			Help: "Total number of events marked failed after exhausting their forward retries",
+		},
+	)
+
+	forwardBacklog = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "hubproxy_forward_backlog",
+			Help: "Number of stored events not yet forwarded, as of the last forwarding run",
+		},
+	)
+
+	webhookPendingEvents = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "hubproxy_webhook_pending_events",
+			Help: "Number of unforwarded events the last forwarding run started with",
+		},
+	)
 )
 
 type WebhookForwarder struct {
 	storage          storage.Storage
 	metricsCollector *storage.DBMetricsCollector
 	httpClient       *http.Client
-	targetURL        string
+	targets          atomic.Pointer[forwardTargets] // Swapped as a whole by SetTargets
+	allowedHosts     *security.HostAllowlist
+	headerFilter     *HeaderFilter
+	startupDelay     time.Duration
+	attempts         *AttemptTracker
+	maxAge           time.Duration
+	maxRetries       int
+	appTokens        *githubapp.TokenSource
+	secret           atomic.Pointer[string] // Swapped by SetSecret
+	format           string
+	cloudEventsMode  string
+	readyURL         string
+	readyInterval    time.Duration
+	readyTimeout     time.Duration
+	forwardTimeout   time.Duration
+	maxRetryAfter    time.Duration
+	hostLimiter      *hostLimiter
+	rateLimiter      *targetRateLimiter
+	forwardLimiter   *rate.Limiter // Paces forwards across all targets; nil is unlimited
+	concurrency      int           // Events forwarded at once by each ProcessEvents run
+	userAgent        string
+	coalesceWindow   time.Duration
+	sampleRate       float64
+	audit            AuditSink
+	ready            atomic.Bool // Whether the target has passed its readiness probe
 	logger           *slog.Logger
 	queue            chan struct{}
+	inflight         sync.Map // IDs of events currently being delivered
+	traces           sync.Map // Span contexts events were received in, by event ID, until they're forwarded
+}
+
+// forwardTargets are where events are forwarded to
+type forwardTargets struct {
+	url          string       // Default target, for events no route matches
+	router       *Router      // Routes events to other targets; nil routes nothing
+	socketClient *http.Client // Dials the default target's Unix socket, if it has one
 }
 
 type WebhookForwarderOptions struct {
 	Storage          storage.Storage
 	MetricsCollector *storage.DBMetricsCollector
 	HTTPClient       *http.Client
-	TargetURL        string
+	TLSConfig        *tls.Config             // Used for https targets, such as to trust a private CA or present a client certificate; optional
+	TargetURL        string                  // Default target, for events no route matches
+	Router           *Router                 // Routes events to other targets by type and repository; optional
+	AllowedHosts     *security.HostAllowlist // Hosts events may be forwarded to; nil allows all
+	HeaderFilter     *HeaderFilter           // Stored headers to forward; nil forwards all
+	StartupJitter    time.Duration           // Upper bound of a random delay before the first forwarding run
+	Attempts         *AttemptTracker         // Records recent attempts per target; optional
+	MaxAge           time.Duration           // Events received longer ago than this are expired instead of forwarded; 0 disables
+	MaxRetries       int                     // Failed forwards retried before the event is marked failed; 0 retries forever
+	AppTokens        *githubapp.TokenSource  // Authenticates forwards with a GitHub App installation token; optional
+	Secret           string                  // Webhook secret, for re-signing payloads stored with a codec other than JSON
+	Format           string                  // One of ForwardFormatGitHub (default) or ForwardFormatCloudEvents
+	CloudEventsMode  string                  // One of CloudEventsModeBinary (default) or CloudEventsModeStructured
+	ReadyURL         string                  // Polled until it returns 2xx before forwarding starts; optional
+	ReadyInterval    time.Duration           // Time between readiness probes; defaults to DefaultReadyInterval
+	ReadyTimeout     time.Duration           // Timeout for each readiness probe; defaults to DefaultReadyTimeout
+	ForwardTimeout   time.Duration           // Timeout for each forward request, including reading the response; defaults to DefaultForwardTimeout
+	MaxRetryAfter    time.Duration           // Longest Retry-After from a 429 waited out before retrying; longer ones leave the event pending. Defaults to DefaultMaxRetryAfter
+	MaxConnsPerHost  int                     // Maximum concurrent forwards to each target host; 0 is unlimited
+	RatePerTarget    float64                 // Maximum forwards per second to each target, excess events staying pending; 0 is unlimited
+	ForwardRate      float64                 // Maximum forwards per second across all targets, waiting rather than skipping; 0 is unlimited
+	ForwardBurst     int                     // Forwards allowed at once above ForwardRate; defaults to 1
+	Concurrency      int                     // Events each run forwards at once; defaults to 1, which forwards in order
+	UserAgent        string                  // User-Agent sent on forwards and readiness probes; defaults to DefaultUserAgent
+	CoalesceWindow   time.Duration           // Pushes to a ref followed by another push within this window are coalesced into the latest; 0 disables
+	SampleRate       float64                 // Fraction of events forwarded, between 0 and 1; the rest are only stored. 0 forwards everything
+	Audit            AuditSink               // Records a receipt for each delivery attempt; optional
 	Logger           *slog.Logger
 }
 
+// DefaultForwardTimeout bounds each forward request when no timeout is configured
+const DefaultForwardTimeout = 30 * time.Second
+
+// DefaultUserAgent identifies HubProxy to targets when no User-Agent is configured
+const DefaultUserAgent = "HubProxy"
+
+// Defaults for the target readiness probe
+const (
+	DefaultReadyInterval = 2 * time.Second
+	DefaultReadyTimeout  = 5 * time.Second
+)
+
+// errTargetNotReady is returned by ForwardEvent while the target hasn't passed its readiness probe
+var errTargetNotReady = errors.New("target is not ready")
+
 func NewWebhookForwarder(opts WebhookForwarderOptions) *WebhookForwarder {
 	if opts.TargetURL == "" {
 		panic("target URL is required")
@@ -61,132 +177,634 @@ func NewWebhookForwarder(opts WebhookForwarderOptions) *WebhookForwarder {
 
 	httpClient := opts.HTTPClient
 
-	// Swap out HTTP client to use Unix socket
-	if strings.HasPrefix(opts.TargetURL, "unix://") {
-		socketPath := strings.TrimPrefix(opts.TargetURL, "unix://")
-		httpClient = &http.Client{
-			Transport: &http.Transport{
-				DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
-					return net.Dial("unix", socketPath)
-				},
-			},
-		}
-	}
-
 	// Use default HTTP client if not provided
 	if httpClient == nil {
 		httpClient = &http.Client{}
 	}
+	if opts.TLSConfig != nil {
+		httpClient = withTLSConfig(httpClient, opts.TLSConfig)
+	}
+	httpClient = withAllowedRedirects(httpClient, opts.AllowedHosts)
 
-	return &WebhookForwarder{
-		targetURL:        opts.TargetURL,
+	if opts.Format == "" {
+		opts.Format = ForwardFormatGitHub
+	}
+	if opts.CloudEventsMode == "" {
+		opts.CloudEventsMode = CloudEventsModeBinary
+	}
+	if opts.SampleRate <= 0 || opts.SampleRate > 1 {
+		opts.SampleRate = 1
+	}
+	if opts.UserAgent == "" {
+		opts.UserAgent = DefaultUserAgent
+	}
+	if opts.ReadyInterval <= 0 {
+		opts.ReadyInterval = DefaultReadyInterval
+	}
+	if opts.ReadyTimeout <= 0 {
+		opts.ReadyTimeout = DefaultReadyTimeout
+	}
+	if opts.ForwardTimeout <= 0 {
+		opts.ForwardTimeout = DefaultForwardTimeout
+	}
+	if opts.MaxRetryAfter <= 0 {
+		opts.MaxRetryAfter = DefaultMaxRetryAfter
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+
+	// Spread out the first run so replicas started together don't all hit the target at once
+	var startupDelay time.Duration
+	if opts.StartupJitter > 0 {
+		startupDelay = rand.N(opts.StartupJitter)
+	}
+
+	f := &WebhookForwarder{
+		allowedHosts:     opts.AllowedHosts,
+		headerFilter:     opts.HeaderFilter,
+		startupDelay:     startupDelay,
+		attempts:         opts.Attempts,
+		maxAge:           opts.MaxAge,
+		maxRetries:       opts.MaxRetries,
+		appTokens:        opts.AppTokens,
+		format:           opts.Format,
+		cloudEventsMode:  opts.CloudEventsMode,
+		readyURL:         opts.ReadyURL,
+		readyInterval:    opts.ReadyInterval,
+		readyTimeout:     opts.ReadyTimeout,
+		forwardTimeout:   opts.ForwardTimeout,
+		maxRetryAfter:    opts.MaxRetryAfter,
+		hostLimiter:      newHostLimiter(opts.MaxConnsPerHost),
+		rateLimiter:      newTargetRateLimiter(opts.RatePerTarget),
+		forwardLimiter:   newForwardLimiter(opts.ForwardRate, opts.ForwardBurst),
+		concurrency:      opts.Concurrency,
+		userAgent:        opts.UserAgent,
+		coalesceWindow:   opts.CoalesceWindow,
+		sampleRate:       opts.SampleRate,
+		audit:            opts.Audit,
 		httpClient:       httpClient,
 		storage:          opts.Storage,
 		metricsCollector: opts.MetricsCollector,
 		logger:           opts.Logger,
 		queue:            make(chan struct{}, 1), // Buffer size 1 to allow one pending job
 	}
+	f.SetTargets(opts.TargetURL, opts.Router)
+	f.secret.Store(&opts.Secret)
+	f.ready.Store(opts.ReadyURL == "")
+	return f
+}
+
+// SetSecret replaces the webhook secret payloads are re-signed with
+func (f *WebhookForwarder) SetSecret(secret string) {
+	f.secret.Store(&secret)
+}
+
+// SetTargets replaces the default target and routing rules. Forwards already
+// under way finish with the previous targets.
+func (f *WebhookForwarder) SetTargets(targetURL string, router *Router) {
+	if targetURL == "" {
+		panic("target URL is required")
+	}
+
+	// Use a separate client dialing the Unix socket for a socket target, so
+	// routed targets still go over the network
+	targets := &forwardTargets{url: targetURL, router: router}
+	if strings.HasPrefix(targetURL, "unix://") {
+		targets.socketClient = newUnixSocketClient(strings.TrimPrefix(targetURL, "unix://"), f.forwardTimeout)
+	}
+	f.targets.Store(targets)
+}
+
+// withTLSConfig returns a copy of client whose transport uses config for
+// https requests, keeping the rest of its transport, such as a Tailscale dialer
+func withTLSConfig(client *http.Client, config *tls.Config) *http.Client {
+	var transport *http.Transport
+	switch t := client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		panic(fmt.Sprintf("TLS config requires an *http.Transport, got %T", client.Transport))
+	}
+	transport.TLSClientConfig = config
+
+	withTLS := *client
+	withTLS.Transport = transport
+	return &withTLS
+}
+
+// withAllowedRedirects returns a copy of client that only follows redirects
+// to hosts in the allowlist, so an allowed target can't bounce forwards on to
+// a host that isn't allowed, such as an internal service
+func withAllowedRedirects(client *http.Client, allowed *security.HostAllowlist) *http.Client {
+	next := client.CheckRedirect
+	checked := *client
+	checked.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !allowed.Allows(req.URL.String()) {
+			return fmt.Errorf("redirect to %s: target host is not in the forward allowlist", req.URL.Host)
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		// The default policy of http.Client
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &checked
 }
 
 // TargetURL returns the configured target URL
 func (f *WebhookForwarder) TargetURL() string {
-	return f.targetURL
+	return f.targets.Load().url
 }
 
-func (f *WebhookForwarder) forwardEvent(ctx context.Context, event *storage.Event) {
-	var targetURL string
-	// http.NewRequest still needs a valid http URI, make a fake one for unix socket path
-	if strings.HasPrefix(f.targetURL, "unix://") {
-		targetURL = "http://127.0.0.1/webhook"
-	} else {
-		targetURL = f.targetURL
+// StartupDelay returns how long StartForwarder waits before the first run
+func (f *WebhookForwarder) StartupDelay() time.Duration {
+	return f.startupDelay
+}
+
+// ForwardEvent delivers a single stored event to the target and marks it
+// forwarded. It's used for inline forwarding from the webhook handler; events
+// already being delivered by another caller are skipped.
+func (f *WebhookForwarder) ForwardEvent(ctx context.Context, event *storage.Event) error {
+	// Leave the event pending until the target is ready
+	if !f.ready.Load() {
+		return errTargetNotReady
+	}
+	if !f.claim(event.ID) {
+		return nil
+	}
+	defer f.release(event.ID)
+
+	return f.forwardEvent(ctx, event)
+}
+
+// WaitForTarget polls the readiness URL until the target responds with a 2xx
+// status, returning false if ctx is done first. It returns immediately when
+// no readiness URL is configured.
+func (f *WebhookForwarder) WaitForTarget(ctx context.Context) bool {
+	if f.ready.Load() {
+		return true
+	}
+
+	f.logger.Info("waiting for target to become ready", "url", f.readyURL)
+	for {
+		err := f.probeTarget(ctx)
+		if err == nil {
+			f.ready.Store(true)
+			f.logger.Info("target is ready, starting forwarding", "url", f.readyURL)
+			return true
+		}
+		f.logger.Debug("target not ready", "url", f.readyURL, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(f.readyInterval):
+		}
+	}
+}
+
+// probeTarget makes a single readiness request
+func (f *WebhookForwarder) probeTarget(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, f.readyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.readyURL, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
 	}
+	req.Header.Set("User-Agent", f.userAgent)
 
-	req, err := http.NewRequest(http.MethodPost, targetURL, strings.NewReader(string(event.Payload)))
+	// A socket target is probed over its socket
+	client := f.httpClient
+	if socketClient := f.targets.Load().socketClient; socketClient != nil {
+		client = socketClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("target returned %s", resp.Status)
+	}
+	return nil
+}
+
+// claim marks an event as being delivered, returning false if it already is
+func (f *WebhookForwarder) claim(id string) bool {
+	_, loaded := f.inflight.LoadOrStore(id, struct{}{})
+	return !loaded
+}
+
+func (f *WebhookForwarder) release(id string) {
+	f.inflight.Delete(id)
+}
+
+func (f *WebhookForwarder) forwardEvent(ctx context.Context, event *storage.Event) error {
+	logger := f.eventLogger(event)
+	if f.expired(event) {
+		webhookExpiredEvents.Inc()
+		logger.Warn("event exceeded max age, expiring instead of forwarding", "event", event.ID, "maxAge", f.maxAge)
+		if err := f.storage.UpdateEventStatus(ctx, event.ID, storage.StatusExpired); err != nil {
+			logger.Error("error marking event as expired", "error", err)
+		}
+		return nil
+	}
+
+	if !f.sampled(event.ID) {
+		webhookSampledOutEvents.Inc()
+		logger.Debug("event outside the forward sample rate, storing only", "event", event.ID, "sampleRate", f.sampleRate)
+		if err := f.storage.UpdateEventStatus(ctx, event.ID, storage.StatusSampledOut); err != nil {
+			logger.Error("error marking event as sampled out", "error", err)
+		}
+		return nil
+	}
+
+	target := f.targetFor(event)
+	if !f.rateLimiter.allow(target) {
+		webhookForwardThrottled.Inc()
+		logger.Debug("target forward rate reached, leaving event pending", "event", event.ID, "targetURL", target)
+		f.scheduleNextAttempt(ctx, event, f.rateLimiter.delay(target))
+		return errTargetThrottled
+	}
+
+	// Inline forwards continue the receive span's trace; sweeps link to it
+	ctx, span := tracer().Start(ctx, spanForward,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithLinks(f.receivedTrace(event.ID)...),
+		trace.WithAttributes(
+			attribute.String("event.type", event.Type),
+			attribute.String("delivery.id", event.ID),
+			attribute.String("forward.target", target),
+		))
+
+	if err := f.storage.IncrementAttempts(ctx, event.ID); err != nil {
+		logger.Error("error recording forward attempt", "event", event.ID, "error", err)
+	}
+
+	status, err := f.deliver(ctx, event, target, f.authenticates(target))
+	var retryAfter *retryAfterError
+	if errors.As(err, &retryAfter) {
+		status, err = f.retryAfter(ctx, event, target, retryAfter)
+	}
+	if status != 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+	}
+	endSpan(span, err)
+	f.attempts.Record(target, err)
+	recordReceipt(ctx, f.audit, f.logger, Receipt{
+		DeliveryID: event.ID,
+		EventType:  event.Type,
+		Stage:      AuditStageForwarded,
+		Target:     target,
+	}, err)
 	if err != nil {
 		webhookForwardingErrors.Inc()
-		f.logger.Error("failed to create request", "targetURL", targetURL, "error", err)
+		logger.Error("failed to forward event", "event", event.ID, "targetURL", target, "error", err)
+		f.deadLetterIfExhausted(ctx, event)
+		return err
+	}
+
+	webhookForwardedEvents.WithLabelValues(eventTypeLabel(event.Type)).Inc()
+
+	err = f.storage.MarkForwarded(ctx, event.ID)
+	if err != nil {
+		logger.Error("error marking event as forwarded", "error", err)
+	}
+	return nil
+}
+
+// retryAfter waits out a target's Retry-After and delivers the event once
+// more, returning the status of the last response. A wait longer than the
+// cap isn't attempted, leaving the event for a later run.
+func (f *WebhookForwarder) retryAfter(ctx context.Context, event *storage.Event, target string, retryAfter *retryAfterError) (int, error) {
+	logger := f.eventLogger(event)
+	if retryAfter.wait > f.maxRetryAfter {
+		logger.Warn("target's Retry-After exceeds the cap, leaving event pending",
+			"event", event.ID, "targetURL", target, "retryAfter", retryAfter.wait, "maxRetryAfter", f.maxRetryAfter)
+		f.scheduleNextAttempt(ctx, event, retryAfter.wait)
+		return http.StatusTooManyRequests, retryAfter
+	}
+
+	webhookForwardThrottled.Inc()
+	logger.Info("target asked to retry later, waiting", "event", event.ID, "targetURL", target, "retryAfter", retryAfter.wait)
+
+	timer := time.NewTimer(retryAfter.wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return http.StatusTooManyRequests, ctx.Err()
+	case <-timer.C:
+	}
+
+	return f.deliver(ctx, event, target, f.authenticates(target))
+}
+
+// authenticates reports whether forwards to target carry the GitHub App
+// installation token. Only the configured default target gets it, so routed
+// targets aren't handed a credential meant for the operator's own service.
+func (f *WebhookForwarder) authenticates(target string) bool {
+	return f.appTokens != nil && target == f.targets.Load().url
+}
+
+// scheduleNextAttempt records that an event left pending is due to be
+// attempted again after wait
+func (f *WebhookForwarder) scheduleNextAttempt(ctx context.Context, event *storage.Event, wait time.Duration) {
+	if err := f.storage.ScheduleNextAttempt(ctx, event.ID, time.Now().Add(wait)); err != nil {
+		f.eventLogger(event).Error("error scheduling next forward attempt", "event", event.ID, "error", err)
+	}
+}
+
+// eventLogger returns the forwarder's logger, tagged with the ID of the
+// request that delivered the event if it was recorded
+func (f *WebhookForwarder) eventLogger(event *storage.Event) *slog.Logger {
+	if event.RequestID != "" {
+		return f.logger.With("request_id", event.RequestID)
+	}
+	return f.logger
+}
+
+// targetFor returns the target an event is forwarded to
+func (f *WebhookForwarder) targetFor(event *storage.Event) string {
+	targets := f.targets.Load()
+	if target, ok := targets.router.Target(event); ok {
+		return target
+	}
+	return targets.url
+}
+
+// deadLetterIfExhausted marks an event failed once its latest failed attempt
+// used up its retries, so sweeps stop picking it up
+func (f *WebhookForwarder) deadLetterIfExhausted(ctx context.Context, event *storage.Event) {
+	logger := f.eventLogger(event)
+	// event.Attempts was read before this attempt was counted
+	attempts := event.Attempts + 1
+	if f.maxRetries <= 0 || attempts <= f.maxRetries {
+		return
+	}
+
+	if err := f.storage.UpdateEventStatus(ctx, event.ID, storage.StatusFailed); err != nil {
+		logger.Error("error marking event as failed", "event", event.ID, "error", err)
 		return
 	}
+	webhookDeadLettered.Inc()
+	logger.Warn("event exhausted its retries, marked failed", "event", event.ID, "attempts", attempts, "maxRetries", f.maxRetries)
+}
+
+// expired reports whether an event is older than the configured max age
+func (f *WebhookForwarder) expired(event *storage.Event) bool {
+	if f.maxAge <= 0 {
+		return false
+	}
+
+	return time.Since(receivedAt(event)) > f.maxAge
+}
+
+// deliver sends a single event to the target, returning the target's
+// response status code, or 0 if it didn't respond. withAppToken adds the
+// GitHub App installation token as the request's Authorization.
+// resign replaces the signatures GitHub sent with one over body, dropping
+// them if there's no secret to sign with
+func (f *WebhookForwarder) resign(header http.Header, body []byte) {
+	header.Del("X-Hub-Signature")
+	header.Del("X-Hub-Signature-256")
+	secret := *f.secret.Load()
+	if secret == "" || !f.headerFilter.Allows("X-Hub-Signature-256") {
+		return
+	}
+	header.Set("X-Hub-Signature-256", security.GenerateSignature(body, secret))
+}
+
+func (f *WebhookForwarder) deliver(ctx context.Context, event *storage.Event, target string, withAppToken bool) (int, error) {
+	logger := f.eventLogger(event)
+	if !f.allowedHosts.Allows(target) {
+		return 0, fmt.Errorf("target host is not in the forward allowlist")
+	}
+
+	targetURL := target
+	client := f.httpClient
+	// http.NewRequest still needs a valid http URI, make a fake one for unix socket path
+	if strings.HasPrefix(target, "unix://") {
+		targetURL = "http://127.0.0.1/webhook"
+		client = f.targets.Load().socketClient
+		if client == nil {
+			// Only the default target is dialed over its socket, and it may
+			// have been replaced since the event was routed
+			return 0, fmt.Errorf("socket target %s is not the default target", target)
+		}
+	}
+
+	body := []byte(event.Payload)
+	var formatHeaders http.Header
+	if f.format == ForwardFormatCloudEvents {
+		var err error
+		body, formatHeaders, err = encodeCloudEvent(event, f.cloudEventsMode)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, targetURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("creating request: %w", err)
+	}
 
 	var headers map[string][]string
 	err = json.Unmarshal(event.Headers, &headers)
 	if err != nil {
-		webhookForwardingErrors.Inc()
-		f.logger.Error("failed to parse headers", "error", err)
-		return
+		return 0, fmt.Errorf("parsing headers: %w", err)
 	}
 
 	for name, values := range headers {
+		if !f.headerFilter.Allows(name) {
+			continue
+		}
 		for _, value := range values {
 			req.Header.Add(name, value)
 		}
 	}
+	// GitHub's connection to HubProxy isn't the connection to the target
+	removeHopByHopHeaders(req.Header)
+
+	// A payload stored with another codec is forwarded re-encoded as JSON,
+	// which GitHub's signatures no longer match
+	if f.format == ForwardFormatGitHub && event.Codec != "" && event.Codec != storage.CodecJSON {
+		f.resign(req.Header, body)
+	}
+
+	for name, values := range formatHeaders {
+		req.Header[name] = values
+	}
+
+	// Identify HubProxy rather than passing on GitHub's User-Agent
+	req.Header.Set("User-Agent", f.userAgent)
+	if event.RequestID != "" {
+		req.Header.Set(requestid.Header, event.RequestID)
+	}
+
+	if withAppToken {
+		token, err := f.appTokens.Token(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("getting GitHub App installation token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 
-	if req.Header.Get("Content-Type") != "application/json" {
-		f.logger.Warn("Content-Type header is not application/json", "Content-Type", req.Header.Get("Content-Type"))
+	if f.format == ForwardFormatGitHub && req.Header.Get("Content-Type") != "application/json" {
+		logger.Warn("Content-Type header is not application/json", "Content-Type", req.Header.Get("Content-Type"))
 	}
 	if req.Header.Get("X-Github-Event") == "" {
-		f.logger.Warn("X-Github-Event header is not set", "X-Github-Event", req.Header.Get("X-Github-Event"))
+		logger.Warn("X-Github-Event header is not set", "X-Github-Event", req.Header.Get("X-Github-Event"))
 	}
 	if req.Header.Get("X-Github-Delivery") == "" {
-		f.logger.Warn("X-Github-Delivery header is not set", "X-Github-Delivery", req.Header.Get("X-Github-Delivery"))
+		logger.Warn("X-Github-Delivery header is not set", "X-Github-Delivery", req.Header.Get("X-Github-Delivery"))
 	}
 	if req.Header.Get("X-Hub-Signature-256") == "" {
-		f.logger.Warn("X-Hub-Signature-256 header is not set", "X-Hub-Signature-256", req.Header.Get("X-Hub-Signature-256"))
+		logger.Warn("X-Hub-Signature-256 header is not set", "X-Hub-Signature-256", req.Header.Get("X-Hub-Signature-256"))
 	}
 
-	resp, err := f.httpClient.Do(req)
-	if err != nil {
-		webhookForwardingErrors.Inc()
-		f.logger.Error("failed to forward request", "targetURL", targetURL, "error", err)
-		return
+	if err := waitForwardRate(ctx, f.forwardLimiter); err != nil {
+		return 0, fmt.Errorf("waiting for the forward rate: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		webhookForwardingErrors.Inc()
-		f.logger.Error("target returned error", "status", resp.Status, "targetURL", targetURL)
-		return
+	release, err := f.hostLimiter.acquire(ctx, target)
+	if err != nil {
+		return 0, fmt.Errorf("waiting for a connection to the target: %w", err)
 	}
+	defer release()
 
-	webhookForwardedEvents.Inc()
+	// The timeout applies per request rather than through the client, so it
+	// holds for the Unix socket and tsnet clients too and doesn't count time
+	// spent waiting for a connection slot
+	reqCtx, cancel := context.WithTimeout(ctx, f.forwardTimeout)
+	defer cancel()
 
-	err = f.storage.MarkForwarded(ctx, event.ID)
+	resp, err := client.Do(req.WithContext(reqCtx))
 	if err != nil {
-		f.logger.Error("error marking event as forwarded", "error", err)
+		if ctx.Err() == nil && errors.Is(reqCtx.Err(), context.DeadlineExceeded) {
+			return 0, fmt.Errorf("target didn't respond within %s: %w", f.forwardTimeout, err)
+		}
+		return 0, fmt.Errorf("sending request: %w", err)
 	}
-}
+	defer resp.Body.Close()
 
-func (f *WebhookForwarder) ProcessEvents(ctx context.Context) error {
-	// Don't ever create a WebhookForwarder if there's no target URL
-	if f.targetURL == "" {
-		panic("target URL is not set")
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return resp.StatusCode, &retryAfterError{status: resp.Status, wait: wait}
+		}
 	}
+	if resp.StatusCode >= 400 {
+		return resp.StatusCode, fmt.Errorf("target returned %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
 
+func (f *WebhookForwarder) ProcessEvents(ctx context.Context) error {
 	f.logger.Debug("processing webhook events from database")
 
-	events, _, err := f.storage.ListEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true})
+	// Events the target's rate or Retry-After put off wait until they're due
+	events, _, err := f.storage.ListEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true, DueBy: time.Now()})
 	if err != nil {
 		return fmt.Errorf("listing events: %w", err)
 	}
+	webhookPendingEvents.Set(float64(len(events)))
 
 	if len(events) == 0 {
 		f.logger.Debug("no events to forward")
+		forwardBacklog.Set(0)
 		return nil
 	}
 
-	f.logger.Info("forwarding webhook events", "count", len(events))
+	events = f.coalescePushes(ctx, events)
+	if len(events) > 0 {
+		f.logger.Info("forwarding webhook events", "count", len(events))
+	}
 
+	var (
+		mu        sync.Mutex
+		throttled = make(map[string]bool)
+	)
+	isThrottled := func(target string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return throttled[target]
+	}
+
+	// Failed forwards are recorded on the event, so workers never return an
+	// error that would stop the others
+	var workers errgroup.Group
+	workers.SetLimit(f.concurrency)
 	for _, event := range events {
-		f.forwardEvent(ctx, event)
+		target := f.targetFor(event)
+		if isThrottled(target) {
+			continue
+		}
+		workers.Go(func() error {
+			// The target may have been throttled while waiting for a worker
+			if isThrottled(target) {
+				return nil
+			}
+			if err := f.forwardPending(ctx, event); errors.Is(err, errTargetThrottled) {
+				// The target's other events stay pending until it can take another forward
+				mu.Lock()
+				first := !throttled[target]
+				throttled[target] = true
+				mu.Unlock()
+				if first {
+					wait := f.rateLimiter.delay(target)
+					f.logger.Debug("pausing forwarding for target rate", "targetURL", target, "wait", wait)
+					time.AfterFunc(wait, f.EnqueueProcessEvents)
+				}
+			}
+			return nil
+		})
 	}
+	_ = workers.Wait()
 
+	f.updateBacklog(ctx)
 	f.metricsCollector.EnqueueGatherMetrics(ctx)
 
 	return nil
 }
 
+// forwardPending forwards an event from a sweep unless it's being delivered
+// inline or was delivered since the sweep listed it
+func (f *WebhookForwarder) forwardPending(ctx context.Context, event *storage.Event) error {
+	if !f.claim(event.ID) {
+		return nil
+	}
+	defer f.release(event.ID)
+
+	current, err := f.storage.GetEvent(ctx, event.ID)
+	if err != nil {
+		f.logger.Error("failed to reload event", "event", event.ID, "error", err)
+		return err
+	}
+	if current == nil || current.ForwardedAt != nil {
+		return nil
+	}
+
+	return f.forwardEvent(ctx, current)
+}
+
+// updateBacklog sets the forward backlog gauge to the number of events still pending
+func (f *WebhookForwarder) updateBacklog(ctx context.Context) {
+	count, err := f.storage.CountEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true})
+	if err != nil {
+		f.logger.Error("failed to count pending events", "error", err)
+		return
+	}
+	forwardBacklog.Set(float64(count))
+}
+
 func (f *WebhookForwarder) EnqueueProcessEvents() {
 	select {
 	case f.queue <- struct{}{}:
@@ -198,6 +816,12 @@ func (f *WebhookForwarder) EnqueueProcessEvents() {
 
 func (f *WebhookForwarder) StartForwarder(ctx context.Context) {
 	go func() {
+		// Events stay pending until the target is ready
+		if !f.WaitForTarget(ctx) {
+			f.logger.Debug("stopped webhook forwarder")
+			return
+		}
+
 		for {
 			select {
 			case <-ctx.Done():
@@ -211,5 +835,20 @@ func (f *WebhookForwarder) StartForwarder(ctx context.Context) {
 		}
 	}()
 
-	f.EnqueueProcessEvents()
+	if f.startupDelay <= 0 {
+		f.EnqueueProcessEvents()
+		return
+	}
+
+	f.logger.Debug("delaying first webhook forwarding run", "delay", f.startupDelay)
+	go func() {
+		timer := time.NewTimer(f.startupDelay)
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+			f.EnqueueProcessEvents()
+		}
+	}()
 }
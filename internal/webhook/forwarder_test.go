@@ -0,0 +1,1688 @@
+package webhook_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"hubproxy/internal/githubapp"
+	"hubproxy/internal/security"
+	"hubproxy/internal/storage"
+	"hubproxy/internal/storage/sql"
+	"hubproxy/internal/testutil"
+	"hubproxy/internal/webhook"
+)
+
+// storePendingEvent stores an unforwarded push event with the given ID
+func storePendingEvent(t *testing.T, store storage.Storage, id string) {
+	t.Helper()
+
+	err := store.StoreEvent(context.Background(), &storage.Event{
+		ID:         id,
+		Type:       "push",
+		Payload:    []byte(`{"ref": "refs/heads/main"}`),
+		Headers:    []byte(`{"Content-Type": ["application/json"], "X-GitHub-Event": ["push"]}`),
+		CreatedAt:  time.Now(),
+		Repository: "test/repo",
+		Sender:     "test-user",
+	})
+	require.NoError(t, err)
+}
+
+// gaugeValue returns the current value of an unlabeled gauge from the default registry
+func gaugeValue(t *testing.T, name string) float64 {
+	t.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == name {
+			require.Len(t, family.GetMetric(), 1)
+			return family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
+
+func TestForwarderAllowlist(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var received atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	tests := []struct {
+		name      string
+		allowlist []string
+		forwarded bool
+	}{
+		{
+			name:      "Allowed host",
+			allowlist: []string{"127.0.0.1"},
+			forwarded: true,
+		},
+		{
+			name:      "Disallowed host",
+			allowlist: []string{"ci.example.com"},
+			forwarded: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			received.Store(0)
+			store := testutil.NewTestDB(t)
+			storePendingEvent(t, store, "event-1")
+
+			allowlist, err := security.NewHostAllowlist(tc.allowlist)
+			require.NoError(t, err)
+
+			forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+				TargetURL:        target.URL,
+				AllowedHosts:     allowlist,
+				Storage:          store,
+				MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+				Logger:           logger,
+			})
+
+			err = forwarder.ProcessEvents(ctx)
+			require.NoError(t, err)
+
+			event, err := store.GetEvent(ctx, "event-1")
+			require.NoError(t, err)
+			require.NotNil(t, event)
+
+			if tc.forwarded {
+				assert.Equal(t, int32(1), received.Load())
+				assert.NotNil(t, event.ForwardedAt)
+			} else {
+				assert.Zero(t, received.Load(), "disallowed target should not be contacted")
+				assert.Nil(t, event.ForwardedAt)
+			}
+		})
+	}
+}
+
+func TestForwarderAllowlistRedirect(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var internalHits atomic.Int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internalHits.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer internal.Close()
+
+	var redirectTo string
+	allowed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.Redirect(w, r, redirectTo, http.StatusTemporaryRedirect)
+	}))
+	defer allowed.Close()
+	// Only the allowed server is reachable as localhost, the internal one as 127.0.0.1
+	allowedURL := strings.Replace(allowed.URL, "127.0.0.1", "localhost", 1)
+
+	allowlist, err := security.NewHostAllowlist([]string{"localhost"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		location  string
+		forwarded bool
+	}{
+		{
+			name:      "Redirect to disallowed host",
+			location:  internal.URL + "/webhook",
+			forwarded: false,
+		},
+		{
+			name:      "Redirect within allowed host",
+			location:  allowedURL + "/moved",
+			forwarded: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			redirectTo = tc.location
+			store := testutil.NewTestDB(t)
+			storePendingEvent(t, store, "event-1")
+
+			forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+				TargetURL:        allowedURL,
+				AllowedHosts:     allowlist,
+				Storage:          store,
+				MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+				Logger:           logger,
+			})
+			require.NoError(t, forwarder.ProcessEvents(ctx))
+
+			event, err := store.GetEvent(ctx, "event-1")
+			require.NoError(t, err)
+			if tc.forwarded {
+				assert.NotNil(t, event.ForwardedAt)
+			} else {
+				assert.Nil(t, event.ForwardedAt)
+			}
+			assert.Zero(t, internalHits.Load(), "the disallowed host should never be contacted")
+		})
+	}
+}
+
+func TestForwardBacklogGauge(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+
+	var healthy atomic.Bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	for _, id := range []string{"event-1", "event-2", "event-3"} {
+		storePendingEvent(t, store, id)
+	}
+
+	collector := storage.NewDBMetricsCollector(store, logger)
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		Storage:          store,
+		MetricsCollector: collector,
+		Logger:           logger,
+	})
+
+	// Target is down, so every stored event stays pending
+	err := forwarder.ProcessEvents(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, float64(3), gaugeValue(t, "hubproxy_webhook_pending_events"))
+	assert.Equal(t, float64(3), gaugeValue(t, "hubproxy_forward_backlog"))
+
+	// The run starts with the events left pending and forwards them all
+	storePendingEvent(t, store, "event-4")
+	healthy.Store(true)
+	err = forwarder.ProcessEvents(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, float64(4), gaugeValue(t, "hubproxy_webhook_pending_events"))
+	assert.Equal(t, float64(0), gaugeValue(t, "hubproxy_forward_backlog"))
+
+	err = forwarder.ProcessEvents(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, float64(0), gaugeValue(t, "hubproxy_webhook_pending_events"))
+
+	// Each run queues a metrics gather, pending until the collector runs it
+	assert.Equal(t, float64(1), gaugeValue(t, "hubproxy_metrics_gather_pending"))
+	collectorCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	collector.StartMetricsCollection(collectorCtx, 0)
+	require.Eventually(t, func() bool {
+		return gaugeValue(t, "hubproxy_metrics_gather_pending") == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestForwarderSetTargets(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+
+	var oldHits, newHits atomic.Int32
+	oldTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		oldHits.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer oldTarget.Close()
+	newTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		newHits.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer newTarget.Close()
+
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        oldTarget.URL,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+
+	storePendingEvent(t, store, "before-reload")
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+	assert.Equal(t, int32(1), oldHits.Load())
+
+	forwarder.SetTargets(newTarget.URL, nil)
+	assert.Equal(t, newTarget.URL, forwarder.TargetURL())
+
+	storePendingEvent(t, store, "after-reload")
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+	assert.Equal(t, int32(1), oldHits.Load(), "the previous target gets nothing after the swap")
+	assert.Equal(t, int32(1), newHits.Load())
+}
+
+func TestForwarderStartupJitter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+	storePendingEvent(t, store, "event-1")
+
+	firstRequest := make(chan time.Time, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case firstRequest <- time.Now():
+		default:
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	const jitter = 300 * time.Millisecond
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		StartupJitter:    jitter,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+
+	delay := forwarder.StartupDelay()
+	assert.GreaterOrEqual(t, delay, time.Duration(0))
+	assert.Less(t, delay, jitter)
+
+	start := time.Now()
+	forwarder.StartForwarder(ctx)
+
+	select {
+	case received := <-firstRequest:
+		elapsed := received.Sub(start)
+		assert.GreaterOrEqual(t, elapsed, delay, "first run should wait for the startup delay")
+		assert.Less(t, elapsed, jitter+time.Second)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for first forwarding run")
+	}
+}
+
+func TestForwarderSendsJSONForAnyCodec(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	const secret = "forward-secret"
+
+	// Spacing that msgpack doesn't preserve, so GitHub's signature only
+	// matches the payload as stored with the JSON codec
+	payload := []byte(`{"ref":  "refs/heads/main"}`)
+	headers, err := json.Marshal(map[string][]string{
+		"Content-Type":        {"application/json"},
+		"X-GitHub-Event":      {"push"},
+		"X-Hub-Signature-256": {security.GenerateSignature(payload, secret)},
+		"X-Hub-Signature":     {"sha1=0000000000000000000000000000000000000000"},
+	})
+	require.NoError(t, err)
+
+	for _, codec := range []storage.Codec{storage.JSONCodec{}, storage.MsgpackCodec{}} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			store, err := sql.New("sqlite://"+filepath.Join(t.TempDir(), "forward.db"), sql.WithCodec(codec))
+			require.NoError(t, err)
+			defer store.Close()
+			require.NoError(t, store.StoreEvent(ctx, &storage.Event{
+				ID:        "event-" + codec.Name(),
+				Type:      "push",
+				Payload:   payload,
+				Headers:   headers,
+				CreatedAt: time.Now(),
+			}))
+
+			requests := make(chan *http.Request, 1)
+			bodies := make(chan []byte, 1)
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				requests <- r
+				bodies <- body
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer target.Close()
+
+			forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+				TargetURL:        target.URL,
+				Secret:           secret,
+				Storage:          store,
+				MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+				Logger:           logger,
+			})
+			require.NoError(t, forwarder.ProcessEvents(ctx))
+
+			select {
+			case r := <-requests:
+				body := <-bodies
+				assert.JSONEq(t, `{"ref": "refs/heads/main"}`, string(body))
+				assert.True(t, security.VerifySignature(r.Header.Get("X-Hub-Signature-256"), body, secret),
+					"forwarded signature should verify against the forwarded body")
+				if codec.Name() == storage.CodecJSON {
+					assert.NotEmpty(t, r.Header.Get("X-Hub-Signature"), "JSON rows should keep GitHub's headers")
+				} else {
+					assert.Empty(t, r.Header.Get("X-Hub-Signature"), "the legacy signature can't be re-signed")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for forwarded event")
+			}
+		})
+	}
+}
+
+// counterValue returns the value of the counter with the given labels from the default registry
+func counterValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestForwardAttempts(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+
+	// The target fails every other request
+	var requests atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1)%2 == 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	for _, id := range []string{"event-1", "event-2", "event-3", "event-4"} {
+		storePendingEvent(t, store, id)
+	}
+
+	attempts := webhook.NewAttemptTracker(webhook.DefaultAttemptWindow)
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Attempts:         attempts,
+		Logger:           logger,
+	})
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+
+	assert.Equal(t, 2.0, counterValue(t, "hubproxy_forward_attempts_total", map[string]string{
+		"target": target.URL,
+		"result": webhook.AttemptResultSuccess,
+	}))
+	assert.Equal(t, 2.0, counterValue(t, "hubproxy_forward_attempts_total", map[string]string{
+		"target": target.URL,
+		"result": webhook.AttemptResultFailure,
+	}))
+
+	summaries := attempts.Summaries()
+	require.Len(t, summaries, 1)
+	summary := summaries[0]
+	assert.Equal(t, target.URL, summary.Target)
+	assert.Equal(t, 4, summary.Attempts)
+	assert.Equal(t, 2, summary.Successes)
+	assert.Equal(t, 2, summary.Failures)
+	assert.InDelta(t, 0.5, summary.SuccessRate, 0.001)
+	assert.Contains(t, summary.LastError, "502")
+	assert.NotNil(t, summary.LastErrorAt)
+}
+
+func TestAttemptTrackerWindow(t *testing.T) {
+	attempts := webhook.NewAttemptTracker(3)
+
+	attempts.Record("http://target", errors.New("boom"))
+	attempts.Record("http://target", nil)
+	attempts.Record("http://target", nil)
+	attempts.Record("http://target", nil)
+
+	// Only the last three attempts count toward the rate, but the last error is kept
+	summaries := attempts.Summaries()
+	require.Len(t, summaries, 1)
+	assert.Equal(t, 3, summaries[0].Attempts)
+	assert.Equal(t, 1.0, summaries[0].SuccessRate)
+	assert.Equal(t, "boom", summaries[0].LastError)
+}
+
+func TestForwarderMaxAge(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+
+	var received []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("X-GitHub-Delivery"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	for id, age := range map[string]time.Duration{"old-event": 2 * time.Hour, "new-event": time.Minute} {
+		receivedAt := time.Now().Add(-age)
+		err := store.StoreEvent(ctx, &storage.Event{
+			ID:         id,
+			Type:       "push",
+			Payload:    []byte(`{"ref": "refs/heads/main"}`),
+			Headers:    []byte(`{"Content-Type": ["application/json"], "X-GitHub-Delivery": ["` + id + `"]}`),
+			CreatedAt:  receivedAt,
+			ReceivedAt: receivedAt,
+		})
+		require.NoError(t, err)
+	}
+
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		MaxAge:           time.Hour,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+
+	assert.Equal(t, []string{"new-event"}, received)
+
+	old, err := store.GetEvent(ctx, "old-event")
+	require.NoError(t, err)
+	require.NotNil(t, old)
+	assert.Equal(t, storage.StatusExpired, old.Status)
+	assert.Nil(t, old.ForwardedAt)
+
+	// Expired events are no longer pending, so later runs don't pick them up
+	pending, err := store.CountEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true})
+	require.NoError(t, err)
+	assert.Zero(t, pending)
+}
+
+func TestForwarderGitHubAppToken(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+
+	var minted atomic.Int32
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		minted.Add(1)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, `{"token": "ghs_installation", "expires_at": "`+time.Now().Add(time.Hour).UTC().Format(time.RFC3339)+`"}`)
+	}))
+	defer github.Close()
+
+	var authorization []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = append(authorization, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	tokens, err := githubapp.NewTokenSource(githubapp.Options{
+		AppID:          1,
+		InstallationID: 2,
+		PrivateKey:     key,
+		APIURL:         github.URL,
+	})
+	require.NoError(t, err)
+
+	// Routed and replayed events go to other targets, which don't get the token
+	var otherAuthorization []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherAuthorization = append(otherAuthorization, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer other.Close()
+	router, err := webhook.NewRouter([]webhook.Route{{Event: "issues", Target: other.URL}})
+	require.NoError(t, err)
+
+	storePendingEvent(t, store, "event-1")
+	storePendingEvent(t, store, "event-2")
+	err = store.StoreEvent(ctx, &storage.Event{
+		ID:        "routed-event",
+		Type:      "issues",
+		Payload:   []byte(`{"action": "opened"}`),
+		Headers:   []byte(`{"Content-Type": ["application/json"], "X-GitHub-Event": ["issues"]}`),
+		CreatedAt: time.Now(),
+	})
+	require.NoError(t, err)
+
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		Router:           router,
+		AppTokens:        tokens,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+
+	assert.Equal(t, []string{"Bearer ghs_installation", "Bearer ghs_installation"}, authorization)
+	assert.Equal(t, int32(1), minted.Load(), "token is cached across forwards")
+
+	allowlist, err := security.NewHostAllowlist([]string{"127.0.0.1"})
+	require.NoError(t, err)
+	event, err := store.GetEvent(ctx, "event-1")
+	require.NoError(t, err)
+	// Even a replay to the default target is left unauthenticated
+	for _, replayTarget := range []string{other.URL, target.URL} {
+		_, err = webhook.NewReplayer(forwarder, allowlist).Replay(ctx, event, replayTarget)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, []string{"", ""}, otherAuthorization)
+	assert.Equal(t, []string{"Bearer ghs_installation", "Bearer ghs_installation", ""}, authorization)
+}
+
+func TestForwarderHeaderRegex(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+
+	var received http.Header
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	err := store.StoreEvent(ctx, &storage.Event{
+		ID:      "header-event",
+		Type:    "push",
+		Payload: []byte(`{"ref": "refs/heads/main"}`),
+		Headers: []byte(`{
+			"Content-Type": ["application/json"],
+			"X-Github-Event": ["push"],
+			"X-Github-Delivery": ["header-event"],
+			"X-Hub-Signature-256": ["sha256=abc"],
+			"X-Internal-Debug": ["1"]
+		}`),
+		CreatedAt: time.Now(),
+	})
+	require.NoError(t, err)
+
+	filter, err := webhook.NewHeaderFilter([]string{"^X-GitHub-", "^Content-Type$"}, nil)
+	require.NoError(t, err)
+
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		HeaderFilter:     filter,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+
+	require.NotNil(t, received)
+	assert.Equal(t, "push", received.Get("X-GitHub-Event"))
+	assert.Equal(t, "header-event", received.Get("X-GitHub-Delivery"))
+	assert.Equal(t, "application/json", received.Get("Content-Type"))
+	assert.Empty(t, received.Get("X-Hub-Signature-256"))
+	assert.Empty(t, received.Get("X-Internal-Debug"))
+}
+
+// Regression test: stored headers must survive a restart, since the
+// forwarder replays them rather than the original request
+func TestForwarderHeadersSurviveRestart(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dbURI := "sqlite:" + filepath.Join(t.TempDir(), "restart.db")
+
+	var received http.Header
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	headers := []byte(`{"Content-Type": ["application/json"], "X-Github-Event": ["push"], "X-Github-Delivery": ["restart-event"], "X-Hub-Signature-256": ["sha256=abc"]}`)
+	before, err := sql.New(dbURI)
+	require.NoError(t, err)
+	require.NoError(t, before.StoreEvent(ctx, &storage.Event{
+		ID:        "restart-event",
+		Type:      "push",
+		Payload:   []byte(`{"ref": "refs/heads/main"}`),
+		Headers:   headers,
+		CreatedAt: time.Now(),
+	}))
+	require.NoError(t, before.Close())
+
+	after, err := sql.New(dbURI)
+	require.NoError(t, err)
+	defer after.Close()
+
+	pending, _, err := after.ListEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true})
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.JSONEq(t, string(headers), string(pending[0].Headers))
+
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		Storage:          after,
+		MetricsCollector: storage.NewDBMetricsCollector(after, logger),
+		Logger:           logger,
+	})
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+
+	require.NotNil(t, received)
+	assert.Equal(t, "push", received.Get("X-GitHub-Event"))
+	assert.Equal(t, "restart-event", received.Get("X-GitHub-Delivery"))
+	assert.Equal(t, "sha256=abc", received.Get("X-Hub-Signature-256"))
+}
+
+func TestNewHeaderFilter(t *testing.T) {
+	filter, err := webhook.NewHeaderFilter(nil, nil)
+	require.NoError(t, err)
+	assert.True(t, filter.Allows("X-Anything"), "no patterns forwards everything")
+
+	_, err = webhook.NewHeaderFilter([]string{"^X-GitHub-", "("}, nil)
+	assert.ErrorContains(t, err, `invalid header pattern "("`)
+
+	_, err = webhook.NewHeaderFilter(nil, []string{"("})
+	assert.ErrorContains(t, err, `invalid header pattern "("`)
+
+	filter, err = webhook.NewHeaderFilter(nil, []string{"^X-Internal-"})
+	require.NoError(t, err)
+	assert.True(t, filter.Allows("X-Github-Hook-Id"), "only a deny list forwards everything else")
+	assert.False(t, filter.Allows("X-Internal-Debug"))
+
+	filter, err = webhook.NewHeaderFilter([]string{"^X-GitHub-"}, []string{"^X-GitHub-Hook-Installation-"})
+	require.NoError(t, err)
+	assert.True(t, filter.Allows("X-Github-Event"))
+	assert.False(t, filter.Allows("X-Github-Hook-Installation-Target-Id"), "deny takes precedence")
+	assert.False(t, filter.Allows("Content-Type"))
+}
+
+func TestForwarderWaitsForTargetReady(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+
+	var (
+		healthy   atomic.Bool
+		probes    atomic.Int32
+		delivered atomic.Int32
+	)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ready" {
+			probes.Add(1)
+			if !healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		delivered.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	storePendingEvent(t, store, "waiting-event")
+
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL + "/webhook",
+		ReadyURL:         target.URL + "/ready",
+		ReadyInterval:    10 * time.Millisecond,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+	forwarder.StartForwarder(ctx)
+
+	// While the target is unhealthy events stay pending
+	require.Eventually(t, func() bool { return probes.Load() >= 3 }, time.Second, 5*time.Millisecond)
+	assert.Zero(t, delivered.Load())
+	assert.ErrorContains(t, forwarder.ForwardEvent(ctx, &storage.Event{ID: "inline-event"}), "not ready")
+
+	event, err := store.GetEvent(ctx, "waiting-event")
+	require.NoError(t, err)
+	assert.Nil(t, event.ForwardedAt)
+
+	healthy.Store(true)
+	require.Eventually(t, func() bool { return delivered.Load() == 1 }, time.Second, 5*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		event, err := store.GetEvent(ctx, "waiting-event")
+		return err == nil && event.ForwardedAt != nil
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestForwarderCloudEvents(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	createdAt := time.Date(2025, 2, 6, 4, 20, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		mode     string
+		validate func(t *testing.T, header http.Header, body []byte)
+	}{
+		{
+			name: "binary",
+			mode: webhook.CloudEventsModeBinary,
+			validate: func(t *testing.T, header http.Header, body []byte) {
+				assert.Equal(t, "1.0", header.Get("ce-specversion"))
+				assert.Equal(t, "ce-event", header.Get("ce-id"))
+				assert.Equal(t, "https://github.com/test/repo", header.Get("ce-source"))
+				assert.Equal(t, "com.github.push", header.Get("ce-type"))
+				assert.Equal(t, "2025-02-06T04:20:00Z", header.Get("ce-time"))
+				assert.Equal(t, "application/json", header.Get("Content-Type"))
+				assert.Equal(t, "push", header.Get("X-GitHub-Event"), "GitHub headers are kept")
+				assert.JSONEq(t, `{"ref": "refs/heads/main"}`, string(body))
+			},
+		},
+		{
+			name: "structured",
+			mode: webhook.CloudEventsModeStructured,
+			validate: func(t *testing.T, header http.Header, body []byte) {
+				assert.Equal(t, "application/cloudevents+json", header.Get("Content-Type"))
+				assert.Empty(t, header.Get("ce-id"))
+				assert.JSONEq(t, `{
+					"specversion": "1.0",
+					"id": "ce-event",
+					"source": "https://github.com/test/repo",
+					"type": "com.github.push",
+					"time": "2025-02-06T04:20:00Z",
+					"datacontenttype": "application/json",
+					"data": {"ref": "refs/heads/main"}
+				}`, string(body))
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := testutil.NewTestDB(t)
+
+			var (
+				header http.Header
+				body   []byte
+			)
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header = r.Header.Clone()
+				body, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer target.Close()
+
+			err := store.StoreEvent(ctx, &storage.Event{
+				ID:         "ce-event",
+				Type:       "push",
+				Payload:    []byte(`{"ref": "refs/heads/main"}`),
+				Headers:    []byte(`{"Content-Type": ["application/json"], "X-Github-Event": ["push"]}`),
+				CreatedAt:  createdAt,
+				Repository: "test/repo",
+			})
+			require.NoError(t, err)
+
+			forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+				TargetURL:        target.URL,
+				Format:           webhook.ForwardFormatCloudEvents,
+				CloudEventsMode:  tc.mode,
+				Storage:          store,
+				MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+				Logger:           logger,
+			})
+			require.NoError(t, forwarder.ProcessEvents(ctx))
+
+			require.NotNil(t, header)
+			tc.validate(t, header, body)
+		})
+	}
+}
+
+func TestForwarderMaxConnsPerHost(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+
+	const limit = 2
+	var current, peak atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := current.Add(1)
+		defer current.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		MaxConnsPerHost:  limit,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		event := &storage.Event{
+			ID:        fmt.Sprintf("conns-event-%d", i),
+			Type:      "push",
+			Payload:   []byte(`{"ref": "refs/heads/main"}`),
+			Headers:   []byte(`{"Content-Type": ["application/json"]}`),
+			CreatedAt: time.Now(),
+		}
+		require.NoError(t, store.StoreEvent(ctx, event))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, forwarder.ForwardEvent(ctx, event))
+		}()
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, peak.Load(), int32(limit))
+	assert.Equal(t, int32(limit), peak.Load(), "forwards should run concurrently up to the limit")
+}
+
+func TestForwarderUserAgent(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name      string
+		userAgent string
+		expected  string
+	}{
+		{name: "default", expected: webhook.DefaultUserAgent},
+		{name: "configured", userAgent: "HubProxy/1.2.3", expected: "HubProxy/1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := testutil.NewTestDB(t)
+
+			var received string
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r.UserAgent()
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer target.Close()
+
+			err := store.StoreEvent(ctx, &storage.Event{
+				ID:      "user-agent-event",
+				Type:    "push",
+				Payload: []byte(`{"ref": "refs/heads/main"}`),
+				Headers: []byte(`{
+					"Content-Type": ["application/json"],
+					"User-Agent": ["GitHub-Hookshot/abc123"]
+				}`),
+				CreatedAt: time.Now(),
+			})
+			require.NoError(t, err)
+
+			forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+				TargetURL:        target.URL,
+				UserAgent:        tt.userAgent,
+				Storage:          store,
+				MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+				Logger:           logger,
+			})
+			require.NoError(t, forwarder.ProcessEvents(ctx))
+
+			assert.Equal(t, tt.expected, received)
+		})
+	}
+}
+
+func TestForwarderCoalescesPushes(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var (
+		mu       sync.Mutex
+		received []string
+	)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received = append(received, r.Header.Get("X-GitHub-Delivery"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	forwarded := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), received...)
+	}
+	reset := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		received = nil
+	}
+
+	storePush := func(t *testing.T, store storage.Storage, id, ref string, at time.Time) {
+		err := store.StoreEvent(ctx, &storage.Event{
+			ID:         id,
+			Type:       "push",
+			Payload:    []byte(fmt.Sprintf(`{"ref": %q}`, ref)),
+			Headers:    []byte(fmt.Sprintf(`{"Content-Type": ["application/json"], "X-Github-Delivery": [%q]}`, id)),
+			CreatedAt:  at,
+			ReceivedAt: at,
+			Repository: "test/repo",
+		})
+		require.NoError(t, err)
+	}
+
+	t.Run("rapid pushes forward only the latest", func(t *testing.T) {
+		reset()
+		store := testutil.NewTestDB(t)
+		base := time.Now().Add(-time.Minute)
+		storePush(t, store, "push-1", "refs/heads/main", base)
+		storePush(t, store, "push-2", "refs/heads/main", base.Add(time.Second))
+		storePush(t, store, "push-3", "refs/heads/main", base.Add(2*time.Second))
+		storePush(t, store, "other-ref", "refs/heads/feature", base.Add(time.Second))
+
+		forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+			TargetURL:        target.URL,
+			CoalesceWindow:   5 * time.Second,
+			Storage:          store,
+			MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+			Logger:           logger,
+		})
+		require.NoError(t, forwarder.ProcessEvents(ctx))
+
+		assert.ElementsMatch(t, []string{"push-3", "other-ref"}, forwarded())
+		for _, id := range []string{"push-1", "push-2"} {
+			event, err := store.GetEvent(ctx, id)
+			require.NoError(t, err)
+			assert.Equal(t, storage.StatusCoalesced, event.Status)
+			assert.Nil(t, event.ForwardedAt)
+		}
+
+		// Coalesced events are no longer pending
+		count, err := store.CountEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true})
+		require.NoError(t, err)
+		assert.Zero(t, count)
+	})
+
+	t.Run("latest push is held until the window passes", func(t *testing.T) {
+		reset()
+		store := testutil.NewTestDB(t)
+		storePush(t, store, "recent-push", "refs/heads/main", time.Now())
+
+		const window = 200 * time.Millisecond
+		forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+			TargetURL:        target.URL,
+			CoalesceWindow:   window,
+			Storage:          store,
+			MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+			Logger:           logger,
+		})
+		require.NoError(t, forwarder.ProcessEvents(ctx))
+		assert.Empty(t, forwarded())
+
+		time.Sleep(window)
+		require.NoError(t, forwarder.ProcessEvents(ctx))
+		assert.Equal(t, []string{"recent-push"}, forwarded())
+	})
+}
+
+func TestForwarderSampleRate(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+
+	var forwarded atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	const total = 1000
+	for i := range total {
+		storePendingEvent(t, store, fmt.Sprintf("sample-%d", i))
+	}
+
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		SampleRate:       0.1,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+
+	assert.InDelta(t, total*0.1, float64(forwarded.Load()), total*0.03)
+
+	// Everything is still stored, and nothing is left pending
+	count, err := store.CountEvents(ctx, storage.QueryOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, total, count)
+	sampledOut, err := store.CountEvents(ctx, storage.QueryOptions{Statuses: []string{storage.StatusSampledOut}})
+	require.NoError(t, err)
+	assert.Equal(t, total-int(forwarded.Load()), sampledOut)
+	pending, err := store.CountEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true})
+	require.NoError(t, err)
+	assert.Zero(t, pending)
+}
+
+func TestForwarderCountsAttempts(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var healthy atomic.Bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	store := testutil.NewTestDB(t)
+	storePendingEvent(t, store, "flaky")
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+
+	// Two failed runs, then one that succeeds
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+	healthy.Store(true)
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+
+	event, err := store.GetEvent(ctx, "flaky")
+	require.NoError(t, err)
+	require.NotNil(t, event)
+	assert.NotNil(t, event.ForwardedAt)
+	assert.Equal(t, 3, event.Attempts)
+
+	// Forwarded events aren't attempted again
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+	event, err = store.GetEvent(ctx, "flaky")
+	require.NoError(t, err)
+	assert.Equal(t, 3, event.Attempts)
+}
+
+func TestForwarderMaxRetries(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var requests atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer target.Close()
+
+	store := testutil.NewTestDB(t)
+	storePendingEvent(t, store, "doomed")
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+		MaxRetries:       2,
+	})
+
+	deadLettered := counterValue(t, "hubproxy_webhook_dead_lettered_total", nil)
+
+	// The first attempt and two retries fail
+	for range 3 {
+		require.NoError(t, forwarder.ProcessEvents(ctx))
+	}
+	event, err := store.GetEvent(ctx, "doomed")
+	require.NoError(t, err)
+	require.NotNil(t, event)
+	assert.Equal(t, storage.StatusFailed, event.Status)
+	assert.Equal(t, 3, event.Attempts)
+	assert.Nil(t, event.ForwardedAt)
+	assert.Equal(t, deadLettered+1, counterValue(t, "hubproxy_webhook_dead_lettered_total", nil))
+
+	// Failed events aren't attempted again
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+	assert.EqualValues(t, 3, requests.Load())
+
+	// Until they're requeued
+	require.NoError(t, store.UpdateEventStatus(ctx, "doomed", ""))
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+	assert.EqualValues(t, 4, requests.Load())
+}
+
+func TestForwarderRatePerTarget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var (
+		mu       sync.Mutex
+		arrivals []time.Time
+	)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrivals = append(arrivals, time.Now())
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	const (
+		events = 5
+		rate   = 10 // Forwards per second
+	)
+	store := testutil.NewTestDB(t)
+	for i := range events {
+		storePendingEvent(t, store, fmt.Sprintf("paced-%d", i))
+	}
+
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		RatePerTarget:    rate,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+	forwarder.StartForwarder(ctx)
+
+	require.Eventually(t, func() bool {
+		pending, err := store.CountEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true})
+		return err == nil && pending == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, arrivals, events, "throttled events are forwarded once, not dropped or repeated")
+
+	// Allow a little scheduling slack below the nominal interval
+	interval := time.Second / rate
+	for i := 1; i < len(arrivals); i++ {
+		assert.GreaterOrEqual(t, arrivals[i].Sub(arrivals[i-1]), interval*8/10, "forward %d came too soon after the previous one", i)
+	}
+	assert.GreaterOrEqual(t, arrivals[events-1].Sub(arrivals[0]), interval*(events-1)*9/10)
+}
+
+func TestRouter(t *testing.T) {
+	router, err := webhook.NewRouter([]webhook.Route{
+		{Event: "push", Repository: "org/infra-*", Target: "http://deploy"},
+		{Event: "push", Target: "http://ci"},
+		{Event: "issues", Target: "http://tickets"},
+		{Event: "*", Repository: "org/audited", Target: "http://audit"},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		eventType  string
+		repository string
+		target     string
+	}{
+		{name: "exact event", eventType: "issues", repository: "org/app", target: "http://tickets"},
+		{name: "first matching route wins", eventType: "push", repository: "org/infra-dns", target: "http://deploy"},
+		{name: "repository glob not matched", eventType: "push", repository: "org/app", target: "http://ci"},
+		{name: "wildcard event", eventType: "release", repository: "org/audited", target: "http://audit"},
+		{name: "unmatched event", eventType: "release", repository: "org/app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, ok := router.Target(&storage.Event{Type: tt.eventType, Repository: tt.repository})
+			assert.Equal(t, tt.target != "", ok)
+			assert.Equal(t, tt.target, target)
+		})
+	}
+
+	t.Run("no routes", func(t *testing.T) {
+		router, err := webhook.NewRouter(nil)
+		require.NoError(t, err)
+		_, ok := router.Target(&storage.Event{Type: "push"})
+		assert.False(t, ok)
+	})
+
+	t.Run("invalid routes", func(t *testing.T) {
+		_, err := webhook.NewRouter([]webhook.Route{{Target: "http://ci"}})
+		assert.ErrorContains(t, err, "event is required")
+
+		_, err = webhook.NewRouter([]webhook.Route{{Event: "push", Repository: "org/[", Target: "http://ci"}})
+		assert.ErrorContains(t, err, "invalid repository pattern")
+
+		_, err = webhook.NewRouter([]webhook.Route{{Event: "push", Target: "unix:///tmp/ci.sock"}})
+		assert.ErrorContains(t, err, "must be an http or https URL")
+	})
+}
+
+func TestForwarderRoutes(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var (
+		mu       sync.Mutex
+		received = make(map[string][]string)
+	)
+	newTarget := func(name string) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			received[name] = append(received[name], r.Header.Get("X-GitHub-Event"))
+			mu.Unlock()
+			w.WriteHeader(http.StatusOK)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	defaultTarget, ci, tickets := newTarget("default"), newTarget("ci"), newTarget("tickets")
+
+	router, err := webhook.NewRouter([]webhook.Route{
+		{Event: "push", Target: ci.URL},
+		{Event: "issues", Target: tickets.URL},
+	})
+	require.NoError(t, err)
+
+	store := testutil.NewTestDB(t)
+	for i, eventType := range []string{"push", "issues", "release"} {
+		require.NoError(t, store.StoreEvent(ctx, &storage.Event{
+			ID:        fmt.Sprintf("routed-%d", i),
+			Type:      eventType,
+			Payload:   []byte(`{}`),
+			Headers:   []byte(fmt.Sprintf(`{"Content-Type": ["application/json"], "X-Github-Event": [%q]}`, eventType)),
+			CreatedAt: time.Now(),
+		}))
+	}
+
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        defaultTarget.URL,
+		Router:           router,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string][]string{
+		"ci":      {"push"},
+		"tickets": {"issues"},
+		"default": {"release"},
+	}, received)
+}
+
+func TestForwarderTimeout(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+	defer close(release)
+
+	store := testutil.NewTestDB(t)
+	storePendingEvent(t, store, "slow")
+	attempts := webhook.NewAttemptTracker(webhook.DefaultAttemptWindow)
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		ForwardTimeout:   50 * time.Millisecond,
+		Attempts:         attempts,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+
+	errorsBefore := counterValue(t, "hubproxy_webhook_forwarding_errors_total", nil)
+	start := time.Now()
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+	assert.Less(t, time.Since(start), time.Second, "the forward should be aborted at the timeout")
+
+	assert.Equal(t, errorsBefore+1, counterValue(t, "hubproxy_webhook_forwarding_errors_total", nil))
+	stats := attempts.Summaries()
+	require.Len(t, stats, 1)
+	assert.Contains(t, stats[0].LastError, "target didn't respond within 50ms")
+
+	event, err := store.GetEvent(ctx, "slow")
+	require.NoError(t, err)
+	assert.Nil(t, event.ForwardedAt)
+}
+
+func TestForwarderConcurrency(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+
+	const limit = 4
+	var current, peak, requests atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		n := current.Add(1)
+		defer current.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	const events = 20
+	for i := range events {
+		storePendingEvent(t, store, fmt.Sprintf("concurrent-%d", i))
+	}
+
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		Concurrency:      limit,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+
+	assert.EqualValues(t, events, requests.Load())
+	assert.Equal(t, int32(limit), peak.Load(), "forwards should run concurrently up to the limit")
+
+	count, err := store.CountEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true})
+	require.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func TestForwarderForwardRate(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := testutil.NewTestDB(t)
+
+	var requests atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	const (
+		events = 6
+		rate   = 20.0
+	)
+	for i := range events {
+		storePendingEvent(t, store, fmt.Sprintf("rate-%d", i))
+	}
+
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		ForwardRate:      rate,
+		Concurrency:      events,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+
+	start := time.Now()
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+	elapsed := time.Since(start)
+
+	// The first forward uses the burst; the rest wait 1/rate each
+	assert.EqualValues(t, events, requests.Load(), "forwards should wait rather than be dropped")
+	assert.GreaterOrEqual(t, elapsed, time.Duration(float64(events-1)/rate*float64(time.Second)))
+}
+
+func TestForwarderSchedulesThrottledEvents(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	store := testutil.NewTestDB(t)
+	storePendingEvent(t, store, "first")
+	storePendingEvent(t, store, "second")
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		RatePerTarget:    0.1, // One forward every 10s
+		Concurrency:      1,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+
+	first, err := store.GetEvent(ctx, "first")
+	require.NoError(t, err)
+	assert.NotNil(t, first.ForwardedAt)
+	assert.Nil(t, first.NextAttemptAt)
+
+	second, err := store.GetEvent(ctx, "second")
+	require.NoError(t, err)
+	assert.Nil(t, second.ForwardedAt)
+	require.NotNil(t, second.NextAttemptAt, "a throttled event is due once the target's rate allows")
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), *second.NextAttemptAt, 2*time.Second)
+}
+
+func TestForwarderRetryAfter(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// newTarget returns a target answering its first request with 429 and
+	// the given Retry-After, and later ones with 200
+	newTarget := func(t *testing.T, retryAfter string) (*httptest.Server, *atomic.Int32) {
+		var requests atomic.Int32
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Add(1) == 1 {
+				w.Header().Set("Retry-After", retryAfter)
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		t.Cleanup(target.Close)
+		return target, &requests
+	}
+
+	forward := func(t *testing.T, targetURL string) (*storage.Event, *webhook.WebhookForwarder) {
+		store := testutil.NewTestDB(t)
+		storePendingEvent(t, store, "retry-after-event")
+
+		forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+			TargetURL:        targetURL,
+			MaxRetryAfter:    5 * time.Second,
+			Storage:          store,
+			MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+			Logger:           logger,
+		})
+		require.NoError(t, forwarder.ProcessEvents(ctx))
+
+		event, err := store.GetEvent(ctx, "retry-after-event")
+		require.NoError(t, err)
+		return event, forwarder
+	}
+
+	t.Run("Seconds", func(t *testing.T) {
+		target, requests := newTarget(t, "1")
+
+		start := time.Now()
+		event, _ := forward(t, target.URL)
+		assert.GreaterOrEqual(t, time.Since(start), time.Second)
+		assert.NotNil(t, event.ForwardedAt)
+		assert.Nil(t, event.NextAttemptAt)
+		assert.EqualValues(t, 2, requests.Load())
+	})
+
+	t.Run("HTTP date", func(t *testing.T) {
+		target, requests := newTarget(t, time.Now().Add(time.Second).UTC().Format(http.TimeFormat))
+
+		event, _ := forward(t, target.URL)
+		assert.NotNil(t, event.ForwardedAt)
+		assert.EqualValues(t, 2, requests.Load())
+	})
+
+	t.Run("Over the cap", func(t *testing.T) {
+		target, requests := newTarget(t, time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+
+		start := time.Now()
+		event, forwarder := forward(t, target.URL)
+		assert.Less(t, time.Since(start), time.Second)
+		assert.Nil(t, event.ForwardedAt, "event should stay pending for a later run")
+		assert.Equal(t, 1, event.Attempts)
+		assert.EqualValues(t, 1, requests.Load())
+		require.NotNil(t, event.NextAttemptAt, "the next attempt is due when the target asked")
+		assert.WithinDuration(t, time.Now().Add(time.Hour), *event.NextAttemptAt, 5*time.Second)
+
+		// Later runs leave the event alone until it's due
+		require.NoError(t, forwarder.ProcessEvents(ctx))
+		assert.EqualValues(t, 1, requests.Load())
+	})
+}
+
+func TestForwarderUnixSocketReusesConnections(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	socketPath := filepath.Join(t.TempDir(), "target.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	var requests, connections atomic.Int32
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.WriteHeader(http.StatusOK)
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				connections.Add(1)
+			}
+		},
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	const events = 50
+	store := testutil.NewTestDB(t)
+	for i := range events {
+		storePendingEvent(t, store, fmt.Sprintf("socket-%d", i))
+	}
+
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        "unix://" + socketPath,
+		Storage:          store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		Logger:           logger,
+	})
+	require.NoError(t, forwarder.ProcessEvents(ctx))
+
+	assert.EqualValues(t, events, requests.Load())
+	assert.EqualValues(t, 1, connections.Load(), "forwards should reuse the socket connection")
+}
+
+func TestForwarderTLSTarget(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var requests atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, caPEM, 0o600))
+
+	forward := func(t *testing.T, tlsOpts security.TargetTLSOptions) *storage.Event {
+		tlsConfig, err := security.NewTargetTLSConfig(tlsOpts)
+		require.NoError(t, err)
+
+		store := testutil.NewTestDB(t)
+		storePendingEvent(t, store, "tls-event")
+
+		forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+			TargetURL:        server.URL,
+			TLSConfig:        tlsConfig,
+			Storage:          store,
+			MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+			Logger:           logger,
+		})
+		require.NoError(t, forwarder.ProcessEvents(ctx))
+
+		event, err := store.GetEvent(ctx, "tls-event")
+		require.NoError(t, err)
+		return event
+	}
+
+	t.Run("Untrusted CA", func(t *testing.T) {
+		event := forward(t, security.TargetTLSOptions{})
+		assert.Nil(t, event.ForwardedAt)
+		assert.Zero(t, requests.Load())
+	})
+
+	t.Run("Trusted CA", func(t *testing.T) {
+		event := forward(t, security.TargetTLSOptions{CACertFile: caFile})
+		assert.NotNil(t, event.ForwardedAt)
+		assert.EqualValues(t, 1, requests.Load())
+	})
+
+	t.Run("Skip verify", func(t *testing.T) {
+		event := forward(t, security.TargetTLSOptions{InsecureSkipVerify: true})
+		assert.NotNil(t, event.ForwardedAt)
+		assert.EqualValues(t, 2, requests.Load())
+	})
+
+	t.Run("Client key required", func(t *testing.T) {
+		_, err := security.NewTargetTLSConfig(security.TargetTLSOptions{ClientCertFile: caFile})
+		assert.Error(t, err)
+	})
+}
@@ -1,23 +1,32 @@
 package webhook
 
 import (
+	"context"
 	"crypto/hmac"
-	"crypto/sha256"
+	"crypto/sha1" //nolint:gosec // Only for GitHub's legacy X-Hub-Signature, when allowed
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"hubproxy/internal/requestid"
 	"hubproxy/internal/security"
 	"hubproxy/internal/storage"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -28,10 +37,18 @@ var (
 		},
 	)
 
-	webhookStoredEvents = promauto.NewCounter(
+	webhookStoredEvents = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "hubproxy_webhook_stored_events_total",
-			Help: "Total number of webhook events stored",
+			Help: "Total number of webhook events stored, by event type",
+		},
+		[]string{"event_type"},
+	)
+
+	webhookDuplicateDeliveries = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "hubproxy_webhook_duplicate_deliveries_total",
+			Help: "Total number of webhooks ignored because their delivery ID was already stored",
 		},
 	)
 
@@ -41,43 +58,185 @@ var (
 			Help: "Total number of webhook requests blocked from non-GitHub IPs",
 		},
 	)
+
+	webhookSHA1Fallbacks = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "hubproxy_webhook_sha1_fallback_total",
+			Help: "Total number of webhooks verified with the legacy SHA-1 X-Hub-Signature header",
+		},
+	)
+
+	webhookOversized = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "hubproxy_webhook_oversized_total",
+			Help: "Total number of webhooks rejected for exceeding the maximum payload size",
+		},
+	)
+
+	ingestQueueDepth = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "hubproxy_ingest_queue_depth",
+			Help: "Number of received webhook requests not yet stored",
+		},
+	)
+)
+
+// DefaultMaxPayloadBytes is GitHub's own cap on webhook payloads, 25 MiB
+const DefaultMaxPayloadBytes = 25 << 20
+
+// Sources for an event's stored created_at timestamp
+const (
+	// CreatedAtSourceReceived uses the time HubProxy received the webhook
+	CreatedAtSourceReceived = "received"
+	// CreatedAtSourceEvent uses the event's own timestamp from the payload
+	// when one can be extracted, falling back to the receipt time
+	CreatedAtSourceEvent = "event"
+)
+
+// Forwarding modes, which decide the single path that delivers and marks an event forwarded
+const (
+	// ForwardModeAsync stores events and leaves delivery to the background forwarder
+	ForwardModeAsync = "async"
+	// ForwardModeSync delivers each event inline before responding, with no background retries
+	ForwardModeSync = "sync"
+	// ForwardModeHybrid delivers inline and hands failures to the background forwarder for retry
+	ForwardModeHybrid = "hybrid"
 )
 
 type Handler struct {
-	secret           string
+	secret           atomic.Pointer[string] // Swapped by SetSecret while requests are in flight
 	logger           *slog.Logger
 	ipValidator      *security.IPValidator
 	validateIP       bool
+	trustedProxies   []*net.IPNet
 	store            storage.Storage
 	metricsCollector *storage.DBMetricsCollector
+	createdAtSource  string
+	storePing        bool
+	forwarder        *WebhookForwarder
+	forwardMode      string
+	bodyReadTimeout  time.Duration
+	signatureCache   *signatureCache
+	allowSHA1        bool
+	audit            AuditSink
+	dedupeKey        string
+	dedupeWindow     time.Duration
+	maxPayloadBytes  int64
+	publisher        EventPublisher
 }
 
 type Options struct {
-	Secret           string
-	Logger           *slog.Logger
-	ValidateIP       bool
-	Store            storage.Storage
-	MetricsCollector *storage.DBMetricsCollector
+	Secret             string
+	Logger             *slog.Logger
+	ValidateIP         bool
+	GitHubMetaURL      string       // Meta API listing the webhook source ranges; defaults to security.DefaultGitHubMetaURL
+	IPCacheFile        string       // File the fetched ranges are saved to and loaded from at startup; no cache if empty
+	TrustedCIDRs       []*net.IPNet // Source ranges accepted alongside GitHub's, e.g. an egress proxy
+	TrustedProxies     []*net.IPNet // Load balancers whose X-Forwarded-For is believed when finding the client IP
+	Store              storage.Storage
+	MetricsCollector   *storage.DBMetricsCollector
+	CreatedAtSource    string // One of CreatedAtSourceReceived (default) or CreatedAtSourceEvent
+	StorePing          bool   // Store (and so forward) GitHub's ping events instead of only acknowledging them
+	Forwarder          *WebhookForwarder
+	ForwardMode        string         // One of ForwardModeAsync (default), ForwardModeSync or ForwardModeHybrid
+	BodyReadTimeout    time.Duration  // Deadline for receiving the request body, 0 for none beyond the server's ReadTimeout
+	SignatureCacheSize int            // Number of recent payload signatures to remember, 0 to disable the cache
+	Audit              AuditSink      // Records a receipt for each delivery stage; optional
+	AllowSHA1          bool           // Verify the legacy SHA-1 X-Hub-Signature header when X-Hub-Signature-256 is absent
+	DedupeKey          string         // One of DedupeKeyDelivery (default) or DedupeKeyPayload
+	DedupeWindow       time.Duration  // How far back DedupeKeyPayload looks for the same content; defaults to DefaultDedupeWindow
+	MaxPayloadBytes    int64          // Larger request bodies are rejected with 413; defaults to DefaultMaxPayloadBytes
+	Publisher          EventPublisher // Notified of each newly stored event; optional
+}
+
+// EventPublisher is notified of each event the handler stores, such as to
+// stream it to API clients. Publish must not block.
+type EventPublisher interface {
+	Publish(event *storage.Event)
 }
 
 func NewHandler(opts Options) *Handler {
 	// Update IP ranges every hour
-	ipValidator := security.NewIPValidator(1*time.Hour, false)
+	ipValidator := security.NewIPValidator(opts.Logger, opts.GitHubMetaURL, opts.IPCacheFile, 1*time.Hour, false)
+	ipValidator.AddTrustedCIDRs(opts.TrustedCIDRs)
 
-	return &Handler{
-		secret:           opts.Secret,
+	if opts.CreatedAtSource == "" {
+		opts.CreatedAtSource = CreatedAtSourceReceived
+	}
+	if opts.ForwardMode == "" {
+		opts.ForwardMode = ForwardModeAsync
+	}
+	if opts.DedupeKey == "" {
+		opts.DedupeKey = DedupeKeyDelivery
+	}
+	if opts.DedupeWindow <= 0 {
+		opts.DedupeWindow = DefaultDedupeWindow
+	}
+	if opts.MaxPayloadBytes <= 0 {
+		opts.MaxPayloadBytes = DefaultMaxPayloadBytes
+	}
+
+	h := &Handler{
 		logger:           opts.Logger,
 		ipValidator:      ipValidator,
 		validateIP:       opts.ValidateIP,
+		trustedProxies:   opts.TrustedProxies,
 		store:            opts.Store,
 		metricsCollector: opts.MetricsCollector,
+		createdAtSource:  opts.CreatedAtSource,
+		storePing:        opts.StorePing,
+		forwarder:        opts.Forwarder,
+		forwardMode:      opts.ForwardMode,
+		bodyReadTimeout:  opts.BodyReadTimeout,
+		signatureCache:   newSignatureCache(opts.SignatureCacheSize),
+		allowSHA1:        opts.AllowSHA1,
+		audit:            opts.Audit,
+		dedupeKey:        opts.DedupeKey,
+		dedupeWindow:     opts.DedupeWindow,
+		maxPayloadBytes:  opts.MaxPayloadBytes,
+		publisher:        opts.Publisher,
+	}
+	h.secret.Store(&opts.Secret)
+	return h
+}
+
+// SetSecret atomically replaces the webhook secret used to verify signatures,
+// reporting whether it differs from the previous one
+func (h *Handler) SetSecret(secret string) bool {
+	previous := h.secret.Swap(&secret)
+	return *previous != secret
+}
+
+// Secret returns the webhook secret signatures are verified with
+func (h *Handler) Secret() string {
+	return *h.secret.Load()
+}
+
+// ReloadSecretFile re-reads the webhook secret from a file and swaps it in,
+// reporting whether it changed. On error the current secret is kept.
+func (h *Handler) ReloadSecretFile(path string) (bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("reading secret file: %w", err)
+	}
+	secret := strings.TrimSpace(string(content))
+	if secret == "" {
+		return false, fmt.Errorf("secret file %s is empty", path)
 	}
+	return h.SetSecret(secret), nil
 }
 
 // VerifySignature verifies the GitHub webhook signature
 // Format: sha256=<hex-digest>
+//
+// With AllowSHA1, a request without X-Hub-Signature-256 is verified against
+// the legacy X-Hub-Signature header instead (format: sha1=<hex-digest>).
 func (h *Handler) VerifySignature(header http.Header, payload []byte) error {
+	secret := *h.secret.Load()
 	signature := header.Get("X-Hub-Signature-256")
+	if signature == "" && h.allowSHA1 && header.Get("X-Hub-Signature") != "" {
+		return h.verifySHA1Signature(header.Get("X-Hub-Signature"), payload, secret)
+	}
 	if signature == "" {
 		h.logger.Error("missing signature")
 		return fmt.Errorf("missing signature")
@@ -86,7 +245,7 @@ func (h *Handler) VerifySignature(header http.Header, payload []byte) error {
 	h.logger.Debug("verifying signature",
 		"header", signature,
 		"payload_length", len(payload),
-		"secret_length", len(h.secret))
+		"secret_length", len(secret))
 
 	if !strings.HasPrefix(signature, "sha256=") {
 		h.logger.Error("invalid signature format")
@@ -103,26 +262,44 @@ func (h *Handler) VerifySignature(header http.Header, payload []byte) error {
 	}
 
 	// Calculate expected signature
-	mac := hmac.New(sha256.New, []byte(h.secret))
-	mac.Write(payload)
-	expectedBytes := mac.Sum(nil)
-	expectedSignature := hex.EncodeToString(expectedBytes)
-
-	h.logger.Debug("comparing signatures",
-		"provided", providedSignature,
-		"expected", expectedSignature,
-		"secret", h.secret)
+	expectedBytes := h.signatureCache.expectedMAC(payload, secret)
 
+	// The expected signature isn't logged, since it's as good as the secret
+	// for forging this payload
 	if !hmac.Equal(providedBytes, expectedBytes) {
-		h.logger.Error("invalid signature",
-			"provided", providedSignature,
-			"expected", expectedSignature)
+		h.logger.Error("invalid signature", "provided", providedSignature)
 		return fmt.Errorf("invalid signature")
 	}
 
 	return nil
 }
 
+// verifySHA1Signature verifies a legacy X-Hub-Signature header
+func (h *Handler) verifySHA1Signature(signature string, payload []byte, secret string) error {
+	h.logger.Warn("verifying legacy SHA-1 signature, X-Hub-Signature-256 is missing")
+
+	if !strings.HasPrefix(signature, "sha1=") {
+		h.logger.Error("invalid SHA-1 signature format")
+		return fmt.Errorf("invalid signature format")
+	}
+
+	providedBytes, err := hex.DecodeString(strings.TrimPrefix(signature, "sha1="))
+	if err != nil {
+		h.logger.Error("invalid SHA-1 signature hex", "error", err)
+		return fmt.Errorf("invalid signature hex: %v", err)
+	}
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(payload)
+	if !hmac.Equal(providedBytes, mac.Sum(nil)) {
+		h.logger.Error("invalid SHA-1 signature")
+		return fmt.Errorf("invalid signature")
+	}
+
+	webhookSHA1Fallbacks.Inc()
+	return nil
+}
+
 // ValidateGitHubEvent validates required GitHub webhook headers
 func (h *Handler) ValidateGitHubEvent(r *http.Request) error {
 	eventType := r.Header.Get("X-GitHub-Event")
@@ -130,67 +307,142 @@ func (h *Handler) ValidateGitHubEvent(r *http.Request) error {
 		return fmt.Errorf("missing event type")
 	}
 
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		host = r.RemoteAddr
-	}
+	host := security.ClientIP(r, h.trustedProxies)
 	if !h.ipValidator.IsGitHubIP(host) {
+		logger := h.requestLogger(r)
 		if h.validateIP {
-			h.logger.Error("request from non-GitHub IP", "ip", host)
+			logger.Error("request from non-GitHub IP", "ip", host)
 			return fmt.Errorf("request from non-GitHub IP: %s", host)
 		} else {
-			h.logger.Warn("request from non-GitHub IP", "ip", host)
+			logger.Warn("request from non-GitHub IP", "ip", host)
 		}
 	}
 
 	return nil
 }
 
+// requestLogger returns the handler's logger, tagged with the request's ID
+// if it has one
+func (h *Handler) requestLogger(r *http.Request) *slog.Logger {
+	if id := requestid.FromContext(r.Context()); id != "" {
+		return h.logger.With("request_id", id)
+	}
+	return h.logger
+}
+
 // ServeHTTP handles incoming webhook requests
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Continue a trace started by a proxy in front of HubProxy, if any
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer().Start(ctx, spanReceive,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("event.type", r.Header.Get("X-GitHub-Event")),
+			attribute.String("delivery.id", r.Header.Get("X-GitHub-Delivery")),
+		))
+	defer span.End()
+	r = r.WithContext(ctx)
+	logger := h.requestLogger(r)
+
 	if r.Method != http.MethodPost {
-		h.logger.Error("validation error", "error", fmt.Sprintf("invalid method: %s", r.Method))
+		logger.Error("validation error", "error", fmt.Sprintf("invalid method: %s", r.Method))
 		http.Error(w, fmt.Sprintf("invalid method: %s", r.Method), http.StatusMethodNotAllowed)
 		return
 	}
 
 	if err := h.ValidateGitHubEvent(r); err != nil {
-		h.logger.Error("validation error", "error", err)
+		logger.Error("validation error", "error", err)
 		webhookBlockedIPs.Inc()
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	payload, err := io.ReadAll(r.Body)
+	deliveryID := r.Header.Get("X-GitHub-Delivery")
+	audit := func(stage string, err error) {
+		recordReceipt(r.Context(), h.audit, logger, Receipt{
+			DeliveryID: deliveryID,
+			EventType:  r.Header.Get("X-GitHub-Event"),
+			Stage:      stage,
+		}, err)
+	}
+
+	// Bound how long a client may take to send the body, so a slow trickle
+	// can't hold the handler for the whole server ReadTimeout
+	if h.bodyReadTimeout > 0 {
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Now().Add(h.bodyReadTimeout)); err != nil {
+			logger.Warn("unable to set body read deadline", "error", err)
+		}
+	}
+
+	// Reject oversized bodies before reading, or verifying, more than the limit
+	var payload []byte
+	var err error
+	if r.ContentLength > h.maxPayloadBytes {
+		err = &http.MaxBytesError{Limit: h.maxPayloadBytes}
+	} else {
+		payload, err = io.ReadAll(http.MaxBytesReader(w, r.Body, h.maxPayloadBytes))
+	}
+	audit(AuditStageReceived, err)
 	if err != nil {
-		h.logger.Error("error reading body", "error", err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			webhookOversized.Inc()
+			logger.Warn("webhook payload too large", "delivery", deliveryID, "limit", h.maxPayloadBytes, "ip", r.RemoteAddr)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			logger.Warn("timed out reading body", "timeout", h.bodyReadTimeout, "ip", r.RemoteAddr)
+			http.Error(w, "Timed out reading request body", http.StatusRequestTimeout)
+			return
+		}
+		logger.Error("error reading body", "error", err)
 		http.Error(w, "Error reading request body", http.StatusInternalServerError)
 		return
 	}
 	defer r.Body.Close()
 
+	ingestQueueDepth.Inc()
+	defer ingestQueueDepth.Dec()
+
 	err = h.VerifySignature(r.Header, payload)
+	audit(AuditStageVerified, err)
 	if err != nil {
-		h.logger.Error("signature verification error", "error", err)
+		logger.Error("signature verification error", "error", err)
 		webhookSignatureErrors.Inc()
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
+	// GitHub sends a ping when a webhook is created; acknowledge it without
+	// storing so it never reaches the target
+	if r.Header.Get("X-GitHub-Event") == "ping" && !h.storePing {
+		logger.Info("acknowledged ping event", "delivery", r.Header.Get("X-GitHub-Delivery"))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
 	// Convert headers to JSON
 	headerJSON, err := json.Marshal(r.Header)
 	if err != nil {
-		h.logger.Error("Error marshaling headers", "error", err, "headers", fmt.Sprintf("%v", r.Header))
+		logger.Error("Error marshaling headers", "error", err, "headers", fmt.Sprintf("%v", r.Header))
 	}
 
+	receivedAt := time.Now()
 	event := &storage.Event{
 		ID:         r.Header.Get("X-GitHub-Delivery"), // Use GitHub's delivery ID
 		Type:       r.Header.Get("X-GitHub-Event"),
 		Headers:    headerJSON,
 		Payload:    json.RawMessage(payload),
-		CreatedAt:  time.Now(),
+		CreatedAt:  receivedAt,
+		ReceivedAt: receivedAt,
 		Repository: "", // Extract from payload if needed
 		Sender:     "", // Extract from payload if needed
+
+		InstallationTargetType: r.Header.Get("X-GitHub-Hook-Installation-Target-Type"),
+		InstallationTargetID:   r.Header.Get("X-GitHub-Hook-Installation-Target-ID"),
+		RequestID:              requestid.FromContext(r.Context()),
 	}
 
 	// Extract repository and sender from payload
@@ -206,16 +458,68 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				event.Sender = login
 			}
 		}
+		if h.createdAtSource == CreatedAtSourceEvent {
+			if ts, ok := eventTimestamp(event.Type, payloadMap); ok {
+				event.CreatedAt = ts
+			}
+		}
 	}
 
-	if err := h.store.StoreEvent(r.Context(), event); err != nil {
-		h.logger.Error("error storing event", "error", err)
+	h.markRedelivery(r.Context(), event)
+
+	storeCtx, storeSpan := tracer().Start(r.Context(), spanStore)
+	inserted, err := h.store.StoreEventIfNew(storeCtx, event)
+	endSpan(storeSpan, err)
+	deliveryID = event.ID // Storage assigns an ID to events without a delivery ID
+	span.SetAttributes(attribute.String("delivery.id", deliveryID))
+	audit(AuditStageStored, err)
+	if err != nil {
+		// Push back on GitHub rather than accept an event that can't be kept
+		if errors.Is(err, storage.ErrStorageFull) {
+			logger.Warn("rejecting webhook, storage is full", "delivery", event.ID, "error", err)
+			http.Error(w, "Storage is full", http.StatusServiceUnavailable)
+			return
+		}
+		logger.Error("error storing event", "error", err)
 		// Continue even if storage fails
+	} else if !inserted {
+		// GitHub redelivered a webhook already stored, and forwarded or
+		// queued, under this delivery ID
+		webhookDuplicateDeliveries.Inc()
+		logger.Info("ignoring duplicate delivery", "delivery", event.ID, "type", event.Type)
 	} else {
-		webhookStoredEvents.Inc()
+		webhookStoredEvents.WithLabelValues(eventTypeLabel(event.Type)).Inc()
+		logger.Debug("stored event", "delivery", event.ID, "type", event.Type)
+		if h.publisher != nil {
+			h.publisher.Publish(event)
+		}
+		if event.Status != storage.StatusDuplicate {
+			h.forward(r.Context(), event)
+		}
 	}
 
 	h.metricsCollector.EnqueueGatherMetrics(r.Context())
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// forward delivers a stored event according to the forwarding mode
+func (h *Handler) forward(ctx context.Context, event *storage.Event) {
+	if h.forwarder == nil {
+		return
+	}
+
+	switch h.forwardMode {
+	case ForwardModeSync:
+		// Failures stay pending in storage and can be replayed
+		_ = h.forwarder.ForwardEvent(ctx, event)
+	case ForwardModeHybrid:
+		if err := h.forwarder.ForwardEvent(ctx, event); err != nil {
+			h.forwarder.rememberTrace(ctx, event.ID)
+			h.forwarder.EnqueueProcessEvents()
+		}
+	default:
+		h.forwarder.rememberTrace(ctx, event.ID)
+		h.forwarder.EnqueueProcessEvents()
+	}
+}
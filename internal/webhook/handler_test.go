@@ -0,0 +1,1052 @@
+package webhook_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"hubproxy/internal/requestid"
+	"hubproxy/internal/security"
+	"hubproxy/internal/storage"
+	"hubproxy/internal/testutil"
+	"hubproxy/internal/webhook"
+)
+
+const testSecret = "test-secret"
+
+// newTestHandler creates a webhook handler backed by a fresh test database
+func newTestHandler(t *testing.T, opts webhook.Options) (*webhook.Handler, storage.Storage) {
+	t.Helper()
+
+	store := testutil.NewTestDB(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	opts.Secret = testSecret
+	opts.Logger = logger
+	opts.Store = store
+	opts.MetricsCollector = storage.NewDBMetricsCollector(store, logger)
+
+	return webhook.NewHandler(opts), store
+}
+
+// postWebhook sends a signed webhook to the handler and returns the response
+func postWebhook(t *testing.T, handler http.Handler, eventType, deliveryID string, payload []byte) *http.Response {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", eventType)
+	req.Header.Set("X-GitHub-Delivery", deliveryID)
+	req.Header.Set("X-Hub-Signature-256", security.GenerateSignature(payload, testSecret))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func TestCreatedAtSource(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		eventType string
+		payload   string
+		expected  time.Time
+	}{
+		{
+			name:      "push uses head commit timestamp",
+			eventType: "push",
+			payload:   `{"ref": "refs/heads/main", "head_commit": {"timestamp": "2025-02-06T04:20:00-08:00"}}`,
+			expected:  time.Date(2025, 2, 6, 12, 20, 0, 0, time.UTC),
+		},
+		{
+			name:      "pull_request uses updated_at",
+			eventType: "pull_request",
+			payload:   `{"action": "opened", "pull_request": {"updated_at": "2025-02-06T04:20:00Z"}}`,
+			expected:  time.Date(2025, 2, 6, 4, 20, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			handler, store := newTestHandler(t, webhook.Options{CreatedAtSource: webhook.CreatedAtSourceEvent})
+
+			resp := postWebhook(t, handler, tc.eventType, "delivery-1", []byte(tc.payload))
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			event, err := store.GetEvent(ctx, "delivery-1")
+			require.NoError(t, err)
+			require.NotNil(t, event)
+
+			assert.True(t, tc.expected.Equal(event.CreatedAt), "expected %s, got %s", tc.expected, event.CreatedAt)
+			assert.WithinDuration(t, time.Now(), event.ReceivedAt, time.Minute)
+		})
+	}
+
+	t.Run("falls back to receipt time", func(t *testing.T) {
+		handler, store := newTestHandler(t, webhook.Options{CreatedAtSource: webhook.CreatedAtSourceEvent})
+
+		resp := postWebhook(t, handler, "push", "delivery-1", []byte(`{"ref": "refs/heads/main"}`))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		event, err := store.GetEvent(ctx, "delivery-1")
+		require.NoError(t, err)
+		require.NotNil(t, event)
+		assert.WithinDuration(t, time.Now(), event.CreatedAt, time.Minute)
+	})
+
+	t.Run("received source ignores payload", func(t *testing.T) {
+		handler, store := newTestHandler(t, webhook.Options{})
+
+		payload := `{"ref": "refs/heads/main", "head_commit": {"timestamp": "2025-02-06T04:20:00Z"}}`
+		resp := postWebhook(t, handler, "push", "delivery-1", []byte(payload))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		event, err := store.GetEvent(ctx, "delivery-1")
+		require.NoError(t, err)
+		require.NotNil(t, event)
+		assert.WithinDuration(t, time.Now(), event.CreatedAt, time.Minute)
+	})
+}
+
+func TestPingEvents(t *testing.T) {
+	ctx := context.Background()
+	payload := []byte(`{"zen": "Design for failure.", "hook_id": 1}`)
+
+	t.Run("acknowledged but not stored by default", func(t *testing.T) {
+		handler, store := newTestHandler(t, webhook.Options{})
+
+		resp := postWebhook(t, handler, "ping", "ping-delivery", payload)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		event, err := store.GetEvent(ctx, "ping-delivery")
+		require.NoError(t, err)
+		assert.Nil(t, event)
+
+		count, err := store.CountEvents(ctx, storage.QueryOptions{})
+		require.NoError(t, err)
+		assert.Zero(t, count)
+	})
+
+	t.Run("stored when enabled", func(t *testing.T) {
+		handler, store := newTestHandler(t, webhook.Options{StorePing: true})
+
+		resp := postWebhook(t, handler, "ping", "ping-delivery", payload)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		event, err := store.GetEvent(ctx, "ping-delivery")
+		require.NoError(t, err)
+		require.NotNil(t, event)
+		assert.Equal(t, "ping", event.Type)
+	})
+
+	t.Run("signature still required", func(t *testing.T) {
+		handler, store := newTestHandler(t, webhook.Options{})
+
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+		req.Header.Set("X-GitHub-Event", "ping")
+		req.Header.Set("X-GitHub-Delivery", "ping-unsigned")
+		req.Header.Set("X-Hub-Signature-256", security.GenerateSignature(payload, "wrong-secret"))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		count, err := store.CountEvents(ctx, storage.QueryOptions{})
+		require.NoError(t, err)
+		assert.Zero(t, count)
+	})
+}
+
+func TestForwardModes(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name        string
+		mode        string
+		failFirst   bool // The target rejects the first request
+		startWorker bool // Run the background forwarder
+		requests    int32
+		forwarded   bool
+	}{
+		{name: "async delivers from the background forwarder", mode: webhook.ForwardModeAsync, startWorker: true, requests: 1, forwarded: true},
+		{name: "sync delivers inline", mode: webhook.ForwardModeSync, requests: 1, forwarded: true},
+		{name: "sync leaves failures pending", mode: webhook.ForwardModeSync, failFirst: true, requests: 1, forwarded: false},
+		{name: "hybrid delivers inline", mode: webhook.ForwardModeHybrid, startWorker: true, requests: 1, forwarded: true},
+		{name: "hybrid retries failures in the background", mode: webhook.ForwardModeHybrid, failFirst: true, startWorker: true, requests: 2, forwarded: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			var requests, delivered atomic.Int32
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if requests.Add(1) == 1 && tc.failFirst {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				delivered.Add(1)
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer target.Close()
+
+			store := testutil.NewTestDB(t)
+			metricsCollector := storage.NewDBMetricsCollector(store, logger)
+			forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+				TargetURL:        target.URL,
+				Storage:          store,
+				MetricsCollector: metricsCollector,
+				Logger:           logger,
+			})
+			if tc.startWorker {
+				forwarder.StartForwarder(ctx)
+			}
+
+			handler := webhook.NewHandler(webhook.Options{
+				Secret:           testSecret,
+				Logger:           logger,
+				Store:            store,
+				MetricsCollector: metricsCollector,
+				Forwarder:        forwarder,
+				ForwardMode:      tc.mode,
+			})
+
+			resp := postWebhook(t, handler, "push", "delivery-"+tc.mode, []byte(`{"ref": "refs/heads/main"}`))
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			require.Eventually(t, func() bool {
+				return requests.Load() >= tc.requests
+			}, 5*time.Second, 10*time.Millisecond)
+
+			// Give any duplicate delivery a chance to show up
+			time.Sleep(100 * time.Millisecond)
+			assert.Equal(t, tc.requests, requests.Load())
+			if tc.forwarded {
+				assert.Equal(t, int32(1), delivered.Load(), "event should be delivered exactly once")
+			} else {
+				assert.Zero(t, delivered.Load())
+			}
+
+			event, err := store.GetEvent(ctx, "delivery-"+tc.mode)
+			require.NoError(t, err)
+			require.NotNil(t, event)
+			assert.Equal(t, tc.forwarded, event.ForwardedAt != nil)
+		})
+	}
+}
+
+func TestReloadSecretFile(t *testing.T) {
+	handler, _ := newTestHandler(t, webhook.Options{})
+	payload := []byte(`{"ref": "refs/heads/main"}`)
+	path := filepath.Join(t.TempDir(), "secret")
+
+	post := func(secret string) int {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", security.GenerateSignature(payload, secret))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post(testSecret))
+
+	// Reloading while requests are in flight is safe
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			post(testSecret)
+		}()
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte("rotated-secret\n"), 0o600))
+	changed, err := handler.ReloadSecretFile(path)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	wg.Wait()
+
+	assert.Equal(t, http.StatusOK, post("rotated-secret"))
+	assert.Equal(t, http.StatusUnauthorized, post(testSecret))
+
+	changed, err = handler.ReloadSecretFile(path)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// A failed reload keeps the current secret
+	require.NoError(t, os.WriteFile(path, []byte("\n"), 0o600))
+	_, err = handler.ReloadSecretFile(path)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusOK, post("rotated-secret"))
+}
+
+func TestHandlerStoresInstallationTarget(t *testing.T) {
+	ctx := context.Background()
+	handler, store := newTestHandler(t, webhook.Options{})
+
+	for i, targetID := range []string{"1001", "1002", "1001"} {
+		payload := []byte(`{"ref": "refs/heads/main"}`)
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-GitHub-Delivery", fmt.Sprintf("installation-%d", i))
+		req.Header.Set("X-GitHub-Hook-Installation-Target-Type", "integration")
+		req.Header.Set("X-GitHub-Hook-Installation-Target-ID", targetID)
+		req.Header.Set("X-Hub-Signature-256", security.GenerateSignature(payload, testSecret))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	events, total, err := store.ListEvents(ctx, storage.QueryOptions{InstallationTargetID: "1001"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, total)
+	for _, event := range events {
+		assert.Equal(t, "integration", event.InstallationTargetType)
+		assert.Equal(t, "1001", event.InstallationTargetID)
+	}
+}
+
+func TestHandlerRejectsWhenStorageFull(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store, err := storage.NewQuotaStorage(testutil.NewTestDB(t), storage.QuotaOptions{MaxEvents: 2})
+	require.NoError(t, err)
+
+	handler := webhook.NewHandler(webhook.Options{
+		Secret:           testSecret,
+		Logger:           logger,
+		Store:            store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+	})
+
+	payload := []byte(`{"ref": "refs/heads/main"}`)
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusServiceUnavailable} {
+		resp := postWebhook(t, handler, "push", fmt.Sprintf("full-%d", i), payload)
+		assert.Equal(t, expected, resp.StatusCode, "delivery %d", i)
+	}
+	assert.Equal(t, 1.0, gaugeValue(t, "hubproxy_storage_full"))
+
+	count, err := store.CountEvents(ctx, storage.QueryOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestBodyReadTimeout(t *testing.T) {
+	handler, store := newTestHandler(t, webhook.Options{BodyReadTimeout: 200 * time.Millisecond})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// Trickle the body a byte at a time so it takes far longer than the timeout
+	payload := []byte(`{"action": "opened"}`)
+	body, pw := io.Pipe()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer pw.Close()
+		for _, b := range payload {
+			select {
+			case <-done:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+			if _, err := pw.Write([]byte{b}); err != nil {
+				return
+			}
+		}
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, server.URL, body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "issues")
+	req.Header.Set("X-GitHub-Delivery", "slow-body")
+	req.Header.Set("X-Hub-Signature-256", security.GenerateSignature(payload, testSecret))
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+
+	event, err := store.GetEvent(context.Background(), "slow-body")
+	require.NoError(t, err)
+	assert.Nil(t, event)
+
+	// A body sent promptly is unaffected
+	resp = postWebhook(t, handler, "issues", "fast-body", payload)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestMaxPayloadBytes(t *testing.T) {
+	const limit = 1024
+	handler, store := newTestHandler(t, webhook.Options{MaxPayloadBytes: limit})
+
+	// Pads a JSON payload to exactly size bytes
+	payloadOf := func(size int) []byte {
+		prefix := `{"padding": "`
+		return []byte(prefix + strings.Repeat("x", size-len(prefix)-2) + `"}`)
+	}
+
+	oversized := counterValue(t, "hubproxy_webhook_oversized_total", nil)
+
+	t.Run("at the limit", func(t *testing.T) {
+		resp := postWebhook(t, handler, "issues", "at-limit", payloadOf(limit))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("over the limit", func(t *testing.T) {
+		resp := postWebhook(t, handler, "issues", "over-limit", payloadOf(limit+1))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+		event, err := store.GetEvent(context.Background(), "over-limit")
+		require.NoError(t, err)
+		assert.Nil(t, event)
+	})
+
+	t.Run("over the limit without Content-Length", func(t *testing.T) {
+		payload := payloadOf(limit + 1)
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+		req.ContentLength = -1
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", "issues")
+		req.Header.Set("X-GitHub-Delivery", "chunked-over-limit")
+		req.Header.Set("X-Hub-Signature-256", security.GenerateSignature(payload, testSecret))
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+		event, err := store.GetEvent(context.Background(), "chunked-over-limit")
+		require.NoError(t, err)
+		assert.Nil(t, event)
+	})
+
+	assert.Equal(t, oversized+2, counterValue(t, "hubproxy_webhook_oversized_total", nil))
+	count, err := store.CountEvents(context.Background(), storage.QueryOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestSignatureCache(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cached := webhook.NewHandler(webhook.Options{Secret: testSecret, Logger: logger, SignatureCacheSize: 2})
+	fresh := webhook.NewHandler(webhook.Options{Secret: testSecret, Logger: logger})
+
+	payload := []byte(`{"action": "opened"}`)
+	signatures := map[string]string{
+		"valid":         security.GenerateSignature(payload, testSecret),
+		"wrong secret":  security.GenerateSignature(payload, "other-secret"),
+		"wrong payload": security.GenerateSignature([]byte(`{}`), testSecret),
+	}
+
+	// The first verification computes the MAC and the rest reuse it, since
+	// the cache is keyed by payload and secret rather than the signature
+	hits := counterValue(t, "hubproxy_webhook_signature_cache_hits_total", nil)
+	for name, signature := range signatures {
+		header := http.Header{}
+		header.Set("X-Hub-Signature-256", signature)
+
+		want := fresh.VerifySignature(header, payload)
+		for range 2 {
+			got := cached.VerifySignature(header, payload)
+			assert.Equal(t, want == nil, got == nil, name)
+		}
+	}
+	assert.Equal(t, hits+5, counterValue(t, "hubproxy_webhook_signature_cache_hits_total", nil))
+
+	// A rotated secret doesn't reuse MACs computed with the old one
+	cached.SetSecret("rotated-secret")
+	header := http.Header{}
+	header.Set("X-Hub-Signature-256", signatures["valid"])
+	assert.Error(t, cached.VerifySignature(header, payload))
+}
+
+func BenchmarkVerifySignature(b *testing.B) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	payload := bytes.Repeat([]byte(`{"commits": [{"message": "update"}]}`), 2000)
+	header := http.Header{}
+	header.Set("X-Hub-Signature-256", security.GenerateSignature(payload, testSecret))
+
+	for _, size := range []int{0, 128} {
+		b.Run(fmt.Sprintf("cache=%d", size), func(b *testing.B) {
+			handler := webhook.NewHandler(webhook.Options{Secret: testSecret, Logger: logger, SignatureCacheSize: size})
+			b.SetBytes(int64(len(payload)))
+			for b.Loop() {
+				if err := handler.VerifySignature(header, payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSHA1SignatureFallback(t *testing.T) {
+	payload := []byte(`{"action": "opened"}`)
+	sha1Signature := func(secret string) string {
+		mac := hmac.New(sha1.New, []byte(secret))
+		mac.Write(payload)
+		return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	tests := []struct {
+		name      string
+		allowSHA1 bool
+		headers   map[string]string
+		expected  int
+		fallback  bool
+	}{
+		{
+			name:      "valid SHA-1 when allowed",
+			allowSHA1: true,
+			headers:   map[string]string{"X-Hub-Signature": sha1Signature(testSecret)},
+			expected:  http.StatusOK,
+			fallback:  true,
+		},
+		{
+			name:     "SHA-1 rejected by default",
+			headers:  map[string]string{"X-Hub-Signature": sha1Signature(testSecret)},
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:      "invalid SHA-1",
+			allowSHA1: true,
+			headers:   map[string]string{"X-Hub-Signature": sha1Signature("wrong-secret")},
+			expected:  http.StatusUnauthorized,
+		},
+		{
+			name:      "SHA-256 takes precedence",
+			allowSHA1: true,
+			headers: map[string]string{
+				"X-Hub-Signature":     sha1Signature(testSecret),
+				"X-Hub-Signature-256": security.GenerateSignature(payload, "wrong-secret"),
+			},
+			expected: http.StatusUnauthorized,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, _ := newTestHandler(t, webhook.Options{AllowSHA1: tt.allowSHA1})
+			fallbacks := counterValue(t, "hubproxy_webhook_sha1_fallback_total", nil)
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-GitHub-Event", "issues")
+			req.Header.Set("X-GitHub-Delivery", fmt.Sprintf("sha1-%d", i))
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tt.expected, rec.Code)
+
+			var expectedFallbacks float64
+			if tt.fallback {
+				expectedFallbacks = 1
+			}
+			assert.Equal(t, fallbacks+expectedFallbacks, counterValue(t, "hubproxy_webhook_sha1_fallback_total", nil))
+		})
+	}
+}
+
+func TestAuditReceipts(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := webhook.NewFileAuditSink(path)
+	require.NoError(t, err)
+
+	store := testutil.NewTestDB(t)
+	metricsCollector := storage.NewDBMetricsCollector(store, logger)
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		Storage:          store,
+		MetricsCollector: metricsCollector,
+		Audit:            sink,
+		Logger:           logger,
+	})
+	handler := webhook.NewHandler(webhook.Options{
+		Secret:           testSecret,
+		Logger:           logger,
+		Store:            store,
+		MetricsCollector: metricsCollector,
+		Forwarder:        forwarder,
+		ForwardMode:      webhook.ForwardModeSync,
+		Audit:            sink,
+	})
+
+	resp := postWebhook(t, handler, "push", "audited", []byte(`{"ref": "refs/heads/main"}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// A bad signature stops the pipeline after verification
+	payload := []byte(`{"ref": "refs/heads/main"}`)
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-GitHub-Delivery", "forged")
+	req.Header.Set("X-Hub-Signature-256", security.GenerateSignature(payload, "wrong-secret"))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	require.NoError(t, sink.Close())
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var receipts []webhook.Receipt
+	for _, line := range bytes.Split(bytes.TrimSpace(content), []byte("\n")) {
+		var receipt webhook.Receipt
+		require.NoError(t, json.Unmarshal(line, &receipt))
+		assert.False(t, receipt.Time.IsZero())
+		receipts = append(receipts, receipt)
+	}
+
+	type step struct{ delivery, stage, outcome string }
+	var steps []step
+	for _, receipt := range receipts {
+		steps = append(steps, step{receipt.DeliveryID, receipt.Stage, receipt.Outcome})
+	}
+	assert.Equal(t, []step{
+		{"audited", webhook.AuditStageReceived, webhook.AuditOutcomeOK},
+		{"audited", webhook.AuditStageVerified, webhook.AuditOutcomeOK},
+		{"audited", webhook.AuditStageStored, webhook.AuditOutcomeOK},
+		{"audited", webhook.AuditStageForwarded, webhook.AuditOutcomeOK},
+		{"forged", webhook.AuditStageReceived, webhook.AuditOutcomeOK},
+		{"forged", webhook.AuditStageVerified, webhook.AuditOutcomeFailed},
+	}, steps)
+	assert.Equal(t, target.URL, receipts[3].Target)
+	assert.Equal(t, "invalid signature", receipts[5].Error)
+}
+
+func TestRedeliveryDedupe(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	payload := []byte(`{"ref": "refs/heads/main", "after": "abc123"}`)
+
+	tests := []struct {
+		name      string
+		dedupeKey string
+		forwarded int32
+		status    string
+	}{
+		{name: "delivery ID keying forwards redeliveries", dedupeKey: webhook.DedupeKeyDelivery, forwarded: 3, status: ""},
+		{name: "payload keying dedupes redeliveries", dedupeKey: webhook.DedupeKeyPayload, forwarded: 2, status: storage.StatusDuplicate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var forwarded atomic.Int32
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwarded.Add(1)
+			}))
+			defer target.Close()
+
+			store := testutil.NewTestDB(t)
+			metricsCollector := storage.NewDBMetricsCollector(store, logger)
+			handler := webhook.NewHandler(webhook.Options{
+				Secret:           testSecret,
+				Logger:           logger,
+				Store:            store,
+				MetricsCollector: metricsCollector,
+				Forwarder: webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+					TargetURL:        target.URL,
+					Storage:          store,
+					MetricsCollector: metricsCollector,
+					Logger:           logger,
+				}),
+				ForwardMode: webhook.ForwardModeSync,
+				DedupeKey:   tt.dedupeKey,
+			})
+
+			// A manual redelivery repeats the content under a new delivery ID
+			assert.Equal(t, http.StatusOK, postWebhook(t, handler, "push", "original", payload).StatusCode)
+			assert.Equal(t, http.StatusOK, postWebhook(t, handler, "push", "redelivery", payload).StatusCode)
+			// The same content as a different event type isn't a redelivery
+			assert.Equal(t, http.StatusOK, postWebhook(t, handler, "create", "other-type", payload).StatusCode)
+
+			assert.Equal(t, tt.forwarded, forwarded.Load())
+
+			redelivery, err := store.GetEvent(ctx, "redelivery")
+			require.NoError(t, err)
+			require.NotNil(t, redelivery, "redeliveries are still stored")
+			assert.Equal(t, tt.status, redelivery.Status)
+
+			pending, err := store.CountEvents(ctx, storage.QueryOptions{OnlyNonForwarded: true})
+			require.NoError(t, err)
+			assert.Zero(t, pending, "duplicates aren't left for the background forwarder")
+		})
+	}
+}
+
+func TestDuplicateDelivery(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var forwarded atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+	}))
+	defer target.Close()
+
+	store := testutil.NewTestDB(t)
+	metricsCollector := storage.NewDBMetricsCollector(store, logger)
+	handler := webhook.NewHandler(webhook.Options{
+		Secret:           testSecret,
+		Logger:           logger,
+		Store:            store,
+		MetricsCollector: metricsCollector,
+		Forwarder: webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+			TargetURL:        target.URL,
+			Storage:          store,
+			MetricsCollector: metricsCollector,
+			Logger:           logger,
+		}),
+		ForwardMode: webhook.ForwardModeSync,
+	})
+
+	duplicates := counterValue(t, "hubproxy_webhook_duplicate_deliveries_total", nil)
+	stored := counterValue(t, "hubproxy_webhook_stored_events_total", map[string]string{"event_type": "push"})
+
+	// GitHub retrying a delivery repeats its ID
+	payload := []byte(`{"ref": "refs/heads/main"}`)
+	assert.Equal(t, http.StatusOK, postWebhook(t, handler, "push", "same-delivery", payload).StatusCode)
+	assert.Equal(t, http.StatusOK, postWebhook(t, handler, "push", "same-delivery", payload).StatusCode)
+
+	assert.Equal(t, int32(1), forwarded.Load(), "the retried delivery should not be forwarded again")
+	assert.Equal(t, duplicates+1, counterValue(t, "hubproxy_webhook_duplicate_deliveries_total", nil))
+	assert.Equal(t, stored+1, counterValue(t, "hubproxy_webhook_stored_events_total", map[string]string{"event_type": "push"}))
+
+	count, err := store.CountEvents(ctx, storage.QueryOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestEventTypeMetrics(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	store := testutil.NewTestDB(t)
+	metricsCollector := storage.NewDBMetricsCollector(store, logger)
+	handler := webhook.NewHandler(webhook.Options{
+		Secret:           testSecret,
+		Logger:           logger,
+		Store:            store,
+		MetricsCollector: metricsCollector,
+		Forwarder: webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+			TargetURL:        target.URL,
+			Storage:          store,
+			MetricsCollector: metricsCollector,
+			Logger:           logger,
+		}),
+		ForwardMode: webhook.ForwardModeSync,
+	})
+
+	counts := func(eventType string) (stored, forwarded float64) {
+		labels := map[string]string{"event_type": eventType}
+		return counterValue(t, "hubproxy_webhook_stored_events_total", labels),
+			counterValue(t, "hubproxy_webhook_forwarded_events_total", labels)
+	}
+
+	pushStored, pushForwarded := counts("push")
+	otherStored, otherForwarded := counts("other")
+
+	assert.Equal(t, http.StatusOK, postWebhook(t, handler, "push", "metrics-push", []byte(`{"ref": "refs/heads/main"}`)).StatusCode)
+	// Unknown types share one label rather than adding a series each
+	assert.Equal(t, http.StatusOK, postWebhook(t, handler, "made_up_event", "metrics-other", []byte(`{}`)).StatusCode)
+
+	stored, forwarded := counts("push")
+	assert.Equal(t, pushStored+1, stored)
+	assert.Equal(t, pushForwarded+1, forwarded)
+
+	stored, forwarded = counts("other")
+	assert.Equal(t, otherStored+1, stored)
+	assert.Equal(t, otherForwarded+1, forwarded)
+	assert.Zero(t, counterValue(t, "hubproxy_webhook_stored_events_total", map[string]string{"event_type": "made_up_event"}))
+}
+
+func TestForwardPreservesHeaders(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var received http.Header
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer target.Close()
+
+	store := testutil.NewTestDB(t)
+	metricsCollector := storage.NewDBMetricsCollector(store, logger)
+	forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+		TargetURL:        target.URL,
+		Storage:          store,
+		MetricsCollector: metricsCollector,
+		Logger:           logger,
+	})
+	handler := webhook.NewHandler(webhook.Options{
+		Secret:           testSecret,
+		Logger:           logger,
+		Store:            store,
+		MetricsCollector: metricsCollector,
+		Forwarder:        forwarder,
+		ForwardMode:      webhook.ForwardModeSync,
+	})
+
+	payload := []byte(`{"ref": "refs/heads/main"}`)
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-GitHub-Delivery", "hook-id-delivery")
+	req.Header.Set("X-Hub-Signature-256", security.GenerateSignature(payload, testSecret))
+	req.Header.Set("X-GitHub-Hook-ID", "123456")
+	req.Header.Set("X-GitHub-Hook-Installation-Target-Type", "repository")
+	req.Header.Set("X-GitHub-Hook-Installation-Target-ID", "7890")
+	req.Header.Set("X-Custom-Header", "custom")
+	req.Header.Set("Connection", "keep-alive, X-Connection-Only")
+	req.Header.Set("X-Connection-Only", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	require.NotNil(t, received)
+	assert.Equal(t, "123456", received.Get("X-GitHub-Hook-ID"))
+	assert.Equal(t, "repository", received.Get("X-GitHub-Hook-Installation-Target-Type"))
+	assert.Equal(t, "7890", received.Get("X-GitHub-Hook-Installation-Target-ID"))
+	assert.Equal(t, "custom", received.Get("X-Custom-Header"))
+	assert.Equal(t, "hook-id-delivery", received.Get("X-GitHub-Delivery"))
+	assert.NotEmpty(t, received.Get("X-Hub-Signature-256"))
+
+	// Hop-by-hop headers, and those the Connection header names, stop at HubProxy
+	assert.Empty(t, received.Get("Keep-Alive"))
+	assert.Empty(t, received.Get("X-Connection-Only"))
+}
+
+func TestTracing(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer target.Close()
+
+	spanNamed := func(t *testing.T, name string) sdktrace.ReadOnlySpan {
+		t.Helper()
+		for _, span := range recorder.Ended() {
+			if span.Name() == name {
+				return span
+			}
+		}
+		require.Failf(t, "span not recorded", "no %s span", name)
+		return nil
+	}
+	attributes := func(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+		attrs := make(map[attribute.Key]attribute.Value)
+		for _, kv := range span.Attributes() {
+			attrs[kv.Key] = kv.Value
+		}
+		return attrs
+	}
+
+	newHandler := func(t *testing.T, mode string) (*webhook.Handler, *webhook.WebhookForwarder) {
+		store := testutil.NewTestDB(t)
+		metricsCollector := storage.NewDBMetricsCollector(store, logger)
+		forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+			TargetURL:        target.URL,
+			Storage:          store,
+			MetricsCollector: metricsCollector,
+			Logger:           logger,
+		})
+		return webhook.NewHandler(webhook.Options{
+			Secret:           testSecret,
+			Logger:           logger,
+			Store:            store,
+			MetricsCollector: metricsCollector,
+			Forwarder:        forwarder,
+			ForwardMode:      mode,
+		}), forwarder
+	}
+
+	t.Run("Inline forward", func(t *testing.T) {
+		recorder.Reset()
+		handler, _ := newHandler(t, webhook.ForwardModeSync)
+
+		resp := postWebhook(t, handler, "push", "trace-sync", []byte(`{"ref": "refs/heads/main"}`))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, recorder.Ended(), 3)
+
+		receive := spanNamed(t, "webhook.receive")
+		store := spanNamed(t, "webhook.store")
+		forward := spanNamed(t, "webhook.forward")
+
+		assert.False(t, receive.Parent().IsValid(), "receive span should be the root")
+		assert.Equal(t, receive.SpanContext().SpanID(), store.Parent().SpanID())
+		assert.Equal(t, receive.SpanContext().SpanID(), forward.Parent().SpanID())
+		assert.Equal(t, receive.SpanContext().TraceID(), forward.SpanContext().TraceID())
+
+		receiveAttrs := attributes(receive)
+		assert.Equal(t, "push", receiveAttrs["event.type"].AsString())
+		assert.Equal(t, "trace-sync", receiveAttrs["delivery.id"].AsString())
+
+		forwardAttrs := attributes(forward)
+		assert.Equal(t, target.URL, forwardAttrs["forward.target"].AsString())
+		assert.Equal(t, int64(http.StatusAccepted), forwardAttrs["http.response.status_code"].AsInt64())
+	})
+
+	t.Run("Background forward links to the receipt", func(t *testing.T) {
+		recorder.Reset()
+		handler, forwarder := newHandler(t, webhook.ForwardModeAsync)
+
+		resp := postWebhook(t, handler, "push", "trace-async", []byte(`{"ref": "refs/heads/main"}`))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoError(t, forwarder.ProcessEvents(ctx))
+
+		receive := spanNamed(t, "webhook.receive")
+		forward := spanNamed(t, "webhook.forward")
+		assert.NotEqual(t, receive.SpanContext().TraceID(), forward.SpanContext().TraceID())
+		require.Len(t, forward.Links(), 1)
+		assert.Equal(t, receive.SpanContext(), forward.Links()[0].SpanContext)
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		inbound string
+		honored bool // The inbound ID is used rather than a generated one
+	}{
+		{name: "honors an inbound ID", inbound: "proxy-request-1", honored: true},
+		{name: "generates an ID", inbound: ""},
+		{name: "replaces an unprintable ID", inbound: "bad\x01id"},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+			forwardedID := make(chan string, 1)
+			target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwardedID <- r.Header.Get(requestid.Header)
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer target.Close()
+
+			store := testutil.NewTestDB(t)
+			metricsCollector := storage.NewDBMetricsCollector(store, logger)
+			forwarder := webhook.NewWebhookForwarder(webhook.WebhookForwarderOptions{
+				TargetURL:        target.URL,
+				Storage:          store,
+				MetricsCollector: metricsCollector,
+				Logger:           logger,
+			})
+			handler := requestid.Middleware(webhook.NewHandler(webhook.Options{
+				Secret:           testSecret,
+				Logger:           logger,
+				Store:            store,
+				MetricsCollector: metricsCollector,
+				Forwarder:        forwarder,
+				ForwardMode:      webhook.ForwardModeSync,
+			}))
+
+			payload := []byte(`{"ref": "refs/heads/main"}`)
+			deliveryID := fmt.Sprintf("request-id-%d", i)
+			req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-GitHub-Event", "push")
+			req.Header.Set("X-GitHub-Delivery", deliveryID)
+			req.Header.Set("X-Hub-Signature-256", security.GenerateSignature(payload, testSecret))
+			if tc.inbound != "" {
+				req.Header.Set(requestid.Header, tc.inbound)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			id := rec.Header().Get(requestid.Header)
+			require.NotEmpty(t, id)
+			if tc.honored {
+				assert.Equal(t, tc.inbound, id)
+			} else {
+				assert.NotEqual(t, tc.inbound, id)
+			}
+
+			assert.Equal(t, id, <-forwardedID, "forwarded request should carry the inbound request ID")
+			assert.Contains(t, logs.String(), `msg="stored event" request_id=`+id)
+
+			event, err := store.GetEvent(ctx, deliveryID)
+			require.NoError(t, err)
+			assert.Equal(t, id, event.RequestID)
+		})
+	}
+}
+
+func TestSecretNotLogged(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	store := testutil.NewTestDB(t)
+	handler := webhook.NewHandler(webhook.Options{
+		Secret:           testSecret,
+		Logger:           logger,
+		Store:            store,
+		MetricsCollector: storage.NewDBMetricsCollector(store, logger),
+		AllowSHA1:        true,
+	})
+
+	payload := []byte(`{"ref": "refs/heads/main"}`)
+	resp := postWebhook(t, handler, "push", "secret-valid", payload)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Failed verifications log the most detail
+	forged := []byte(`{"ref": "refs/heads/forged"}`)
+	header := http.Header{}
+	header.Set("X-Hub-Signature-256", security.GenerateSignature(forged, "wrong-secret"))
+	assert.Error(t, handler.VerifySignature(header, forged))
+	header = http.Header{}
+	header.Set("X-Hub-Signature", "sha1=0000")
+	assert.Error(t, handler.VerifySignature(header, forged))
+
+	require.NotEmpty(t, logs.String())
+	assert.NotContains(t, logs.String(), testSecret)
+	assert.NotContains(t, logs.String(), strings.TrimPrefix(security.GenerateSignature(forged, testSecret), "sha256="),
+		"the expected signature would let anyone reading the logs forge the payload")
+}
@@ -0,0 +1,98 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// hopByHopHeaders describe a single connection rather than the webhook
+// (RFC 7230 section 6.1), so they're never forwarded
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HeaderFilter decides which stored headers are forwarded to the target.
+// A nil HeaderFilter forwards every header.
+type HeaderFilter struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// NewHeaderFilter compiles patterns into a HeaderFilter that forwards headers
+// whose name matches any allow pattern, or every header when there are none,
+// unless the name matches a deny pattern. Matching ignores case, since stored
+// header names are canonicalized (X-Github-Event rather than X-GitHub-Event).
+// It returns nil when no patterns are given.
+func NewHeaderFilter(allow, deny []string) (*HeaderFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	filter := &HeaderFilter{}
+	var err error
+	if filter.allow, err = compileHeaderPatterns(allow); err != nil {
+		return nil, err
+	}
+	if filter.deny, err = compileHeaderPatterns(deny); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func compileHeaderPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid header pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Allows reports whether a header should be forwarded
+func (f *HeaderFilter) Allows(name string) bool {
+	if f == nil {
+		return true
+	}
+	if matchesAny(f.deny, name) {
+		return false
+	}
+	return len(f.allow) == 0 || matchesAny(f.allow, name)
+}
+
+func matchesAny(patterns []*regexp.Regexp, name string) bool {
+	for _, re := range patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeHopByHopHeaders deletes the hop-by-hop headers from h, including any
+// listed in its Connection header
+func removeHopByHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,69 @@
+package webhook
+
+import (
+	"context"
+	"net/url"
+	"sync"
+)
+
+// hostLimiter caps the number of concurrent forwards to each target host, so
+// several targets sharing a host can't overwhelm it together. A nil
+// hostLimiter doesn't limit anything.
+type hostLimiter struct {
+	limit int
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// newHostLimiter returns a limiter allowing limit concurrent forwards per
+// host, or nil if limit isn't positive
+func newHostLimiter(limit int) *hostLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &hostLimiter{
+		limit: limit,
+		slots: make(map[string]chan struct{}),
+	}
+}
+
+// acquire waits for a free slot for the target's host, returning a function
+// that releases it. It returns ctx's error if ctx is done first.
+func (l *hostLimiter) acquire(ctx context.Context, target string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	slots := l.hostSlots(limiterHost(target))
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *hostLimiter) hostSlots(host string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	slots, ok := l.slots[host]
+	if !ok {
+		slots = make(chan struct{}, l.limit)
+		l.slots[host] = slots
+	}
+	return slots
+}
+
+// limiterHost returns the key a target is limited under: the host and port
+// for HTTP targets, or the socket path for unix:// targets
+func limiterHost(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	if u.Scheme == "unix" {
+		return u.Host + u.Path
+	}
+	return u.Host
+}
@@ -0,0 +1,143 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+var webhookForwardThrottled = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "hubproxy_webhook_forward_throttled_total",
+		Help: "Total number of forwards postponed because the target's forward rate was reached or the target asked to retry later",
+	},
+)
+
+var webhookForwardRateLimited = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "hubproxy_webhook_forward_rate_limited_total",
+		Help: "Total number of forwards that waited for the overall forward rate",
+	},
+)
+
+// errTargetThrottled is returned by ForwardEvent when the target's forward
+// rate has been reached; the event stays pending
+var errTargetThrottled = errors.New("target forward rate reached")
+
+// targetRateLimiter paces forwards to each target with a token bucket, so a
+// target never sees more than its rate however many events are pending. A nil
+// targetRateLimiter doesn't limit anything.
+type targetRateLimiter struct {
+	limit    rate.Limit
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// newTargetRateLimiter returns a limiter allowing perSecond forwards per
+// second to each target, or nil if perSecond isn't positive
+func newTargetRateLimiter(perSecond float64) *targetRateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &targetRateLimiter{
+		limit:    rate.Limit(perSecond),
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// allow takes a token for a forward to target if one is available
+func (l *targetRateLimiter) allow(target string) bool {
+	if l == nil {
+		return true
+	}
+	return l.limiter(target).Allow()
+}
+
+// delay returns how long until a forward to target will be allowed
+func (l *targetRateLimiter) delay(target string) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	reservation := l.limiter(target).Reserve()
+	defer reservation.Cancel()
+	return reservation.Delay()
+}
+
+func (l *targetRateLimiter) limiter(target string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limiter, ok := l.limiters[target]
+	if !ok {
+		// A burst of one keeps forwards evenly spaced
+		limiter = rate.NewLimiter(l.limit, 1)
+		l.limiters[target] = limiter
+	}
+	return limiter
+}
+
+// newForwardLimiter returns a token bucket allowing perSecond forwards per
+// second across all targets, with bursts of up to burst, or nil if perSecond
+// isn't positive
+func newForwardLimiter(perSecond float64, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// waitForwardRate blocks until limiter allows another forward or ctx is done.
+// A nil limiter never waits.
+func waitForwardRate(ctx context.Context, limiter *rate.Limiter) error {
+	if limiter == nil || limiter.Allow() {
+		return nil
+	}
+	webhookForwardRateLimited.Inc()
+	return limiter.Wait(ctx)
+}
+
+// DefaultMaxRetryAfter is the longest Retry-After waited out when no cap is
+// configured
+const DefaultMaxRetryAfter = 10 * time.Second
+
+// retryAfterError is returned by deliver when the target responded 429 with
+// a Retry-After header
+type retryAfterError struct {
+	status string
+	wait   time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("target returned %s, retry after %s", e.status, e.wait)
+}
+
+// parseRetryAfter parses a Retry-After header in either its delay-seconds or
+// HTTP-date form. Dates in the past mean no wait.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(date.Sub(now), 0), true
+}
@@ -0,0 +1,57 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"hubproxy/internal/security"
+	"hubproxy/internal/storage"
+)
+
+// Errors returned by Replayer.Replay for targets it won't deliver to
+var (
+	ErrInvalidReplayTarget    = errors.New("replay target must be an http or https URL")
+	ErrReplayTargetNotAllowed = errors.New("replay target host is not allowed")
+)
+
+// Replayer re-delivers stored events to a target chosen at replay time, such
+// as a developer's machine, through the forwarder's delivery path. Since the
+// target comes from an API caller, only hosts on its allowlist are accepted.
+// A nil Replayer allows no targets.
+type Replayer struct {
+	forwarder    *WebhookForwarder
+	allowedHosts *security.HostAllowlist
+}
+
+// NewReplayer creates a Replayer delivering through forwarder to hosts on
+// allowedHosts. It returns nil, disabling replays to a target, when there's
+// no forwarder or the allowlist is empty.
+func NewReplayer(forwarder *WebhookForwarder, allowedHosts *security.HostAllowlist) *Replayer {
+	if forwarder == nil || allowedHosts.Empty() {
+		return nil
+	}
+	return &Replayer{forwarder: forwarder, allowedHosts: allowedHosts}
+}
+
+// Replay delivers an event to target without recording the delivery on the
+// stored event or authenticating it with the forwarder's GitHub App token.
+// It returns the target's response status code, or 0 if it didn't respond;
+// a status of 400 or above is also returned as an error.
+func (r *Replayer) Replay(ctx context.Context, event *storage.Event, target string) (int, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return 0, ErrInvalidReplayTarget
+	}
+	if r == nil {
+		return 0, fmt.Errorf("%w: replaying to a target is disabled, set --replay-allowed-hosts", ErrReplayTargetNotAllowed)
+	}
+	if !r.allowedHosts.Allows(target) {
+		return 0, fmt.Errorf("%w: %s", ErrReplayTargetNotAllowed, u.Hostname())
+	}
+
+	r.forwarder.logger.Info("replaying event to target", "event", event.ID, "targetURL", target)
+	// The target is the caller's choice, so it never gets the app token
+	return r.forwarder.deliver(ctx, event, target, false)
+}
@@ -0,0 +1,81 @@
+package webhook
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+
+	"hubproxy/internal/storage"
+)
+
+// Route sends events of a type, optionally limited to matching repositories,
+// to a target other than the default one
+type Route struct {
+	Event      string `mapstructure:"event"`      // X-GitHub-Event value, or * for every type
+	Repository string `mapstructure:"repository"` // Repository full name glob such as org/*; empty matches every repository
+	Target     string `mapstructure:"target"`     // URL events matching the route are forwarded to
+}
+
+// matches reports whether the route applies to an event
+func (r Route) matches(event *storage.Event) bool {
+	if r.Event != "*" && r.Event != event.Type {
+		return false
+	}
+	if r.Repository == "" {
+		return true
+	}
+	// Patterns are validated by NewRouter
+	matched, _ := path.Match(r.Repository, event.Repository)
+	return matched
+}
+
+// Router picks the target of each event from the first route it matches. A
+// nil Router matches nothing.
+type Router struct {
+	routes []Route
+}
+
+// NewRouter validates routes and returns a Router trying them in order, or
+// nil if there are none
+func NewRouter(routes []Route) (*Router, error) {
+	if len(routes) == 0 {
+		return nil, nil
+	}
+
+	for i, route := range routes {
+		if route.Event == "" {
+			return nil, fmt.Errorf("route %d: event is required, use * to match every type", i+1)
+		}
+		if _, err := path.Match(route.Repository, ""); err != nil {
+			return nil, fmt.Errorf("route %d: invalid repository pattern %q: %w", i+1, route.Repository, err)
+		}
+		// Unix socket targets need their own client, so only the default target may use one
+		u, err := url.Parse(route.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("route %d: target must be an http or https URL, got %q", i+1, route.Target)
+		}
+	}
+	return &Router{routes: routes}, nil
+}
+
+// Target returns the target of the first route matching event, and false if
+// no route matches so the default target applies
+func (r *Router) Target(event *storage.Event) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	for _, route := range r.routes {
+		if route.matches(event) {
+			return route.Target, true
+		}
+	}
+	return "", false
+}
+
+// Len returns the number of routes
+func (r *Router) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.routes)
+}
@@ -0,0 +1,29 @@
+package webhook
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var webhookSampledOutEvents = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "hubproxy_webhook_sampled_out_events_total",
+		Help: "Total number of webhook events stored but not forwarded because they fell outside the forward sample rate",
+	},
+)
+
+// sampled reports whether an event falls inside the forward sample rate. The
+// decision is derived from the event ID, so retries and inline and
+// background delivery all agree on it.
+func (f *WebhookForwarder) sampled(id string) bool {
+	if f.sampleRate >= 1 {
+		return true
+	}
+
+	sum := sha256.Sum256([]byte(id))
+	return float64(binary.BigEndian.Uint64(sum[:8]))/math.MaxUint64 < f.sampleRate
+}
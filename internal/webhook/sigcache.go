@@ -0,0 +1,98 @@
+package webhook
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var webhookSignatureCacheHits = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "hubproxy_webhook_signature_cache_hits_total",
+		Help: "Total number of signature verifications answered from the signature cache",
+	},
+)
+
+// signatureKey identifies a payload signed with a secret without keeping
+// either of them
+type signatureKey struct {
+	payload [sha256.Size]byte
+	secret  [sha256.Size]byte
+}
+
+// signatureCache remembers the expected HMAC of recently verified payloads,
+// so duplicate deliveries and replays with pass-through signatures don't
+// recompute it. Least recently used entries are evicted once it's full. A nil
+// signatureCache computes every HMAC.
+type signatureCache struct {
+	size    int
+	mu      sync.Mutex
+	order   *list.List // Of *signatureEntry, most recently used first
+	entries map[signatureKey]*list.Element
+}
+
+type signatureEntry struct {
+	key signatureKey
+	mac []byte
+}
+
+// newSignatureCache returns a cache holding up to size entries, or nil if
+// size isn't positive
+func newSignatureCache(size int) *signatureCache {
+	if size <= 0 {
+		return nil
+	}
+	return &signatureCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[signatureKey]*list.Element, size),
+	}
+}
+
+// expectedMAC returns the HMAC-SHA256 of payload with secret, from the cache
+// when it's been computed recently
+func (c *signatureCache) expectedMAC(payload []byte, secret string) []byte {
+	if c == nil {
+		return computeMAC(payload, secret)
+	}
+
+	key := signatureKey{
+		payload: sha256.Sum256(payload),
+		secret:  sha256.Sum256([]byte(secret)),
+	}
+
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		mac := element.Value.(*signatureEntry).mac
+		c.mu.Unlock()
+		webhookSignatureCacheHits.Inc()
+		return mac
+	}
+	c.mu.Unlock()
+
+	mac := computeMAC(payload, secret)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.order.PushFront(&signatureEntry{key: key, mac: mac})
+		if c.order.Len() > c.size {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*signatureEntry).key)
+		}
+	}
+	return mac
+}
+
+// computeMAC returns the HMAC-SHA256 of payload with secret
+func computeMAC(payload []byte, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,48 @@
+package webhook
+
+import "time"
+
+// eventTimestampFields maps event types to the payload path holding the time
+// the event actually happened on GitHub
+var eventTimestampFields = map[string][]string{
+	"push":                        {"head_commit", "timestamp"},
+	"pull_request":                {"pull_request", "updated_at"},
+	"pull_request_review":         {"review", "submitted_at"},
+	"pull_request_review_comment": {"comment", "updated_at"},
+	"issues":                      {"issue", "updated_at"},
+	"issue_comment":               {"comment", "updated_at"},
+	"release":                     {"release", "published_at"},
+	"workflow_run":                {"workflow_run", "updated_at"},
+	"workflow_job":                {"workflow_job", "started_at"},
+	"check_run":                   {"check_run", "started_at"},
+	"check_suite":                 {"check_suite", "updated_at"},
+}
+
+// eventTimestamp extracts the event's occurrence time from its payload. It
+// returns false if the event type is unknown or the field is missing or invalid.
+func eventTimestamp(eventType string, payload map[string]interface{}) (time.Time, bool) {
+	path, ok := eventTimestampFields[eventType]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	var value interface{} = payload
+	for _, key := range path {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return time.Time{}, false
+		}
+		value = obj[key]
+	}
+
+	str, ok := value.(string)
+	if !ok || str == "" {
+		return time.Time{}, false
+	}
+
+	ts, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts, true
+}
@@ -0,0 +1,51 @@
+package webhook
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer returns the tracer from the global tracer provider, which is a
+// no-op unless tracing is set up. It's looked up on each use so a provider
+// installed later, such as by a test, takes effect.
+func tracer() trace.Tracer {
+	return otel.Tracer("hubproxy/internal/webhook")
+}
+
+// Span names
+const (
+	spanReceive = "webhook.receive"
+	spanStore   = "webhook.store"
+	spanForward = "webhook.forward"
+)
+
+// endSpan records err, if any, on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// rememberTrace keeps the trace an event was received in, so the forward
+// span started by a later sweep can link back to it. Nothing is kept when
+// the event wasn't traced.
+func (f *WebhookForwarder) rememberTrace(ctx context.Context, eventID string) {
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		f.traces.Store(eventID, spanContext)
+	}
+}
+
+// receivedTrace returns the links to the trace an event was received in, if
+// it was remembered
+func (f *WebhookForwarder) receivedTrace(eventID string) []trace.Link {
+	spanContext, ok := f.traces.LoadAndDelete(eventID)
+	if !ok {
+		return nil
+	}
+	return []trace.Link{{SpanContext: spanContext.(trace.SpanContext)}}
+}
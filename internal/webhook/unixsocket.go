@@ -0,0 +1,35 @@
+package webhook
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Connection pooling for Unix socket targets. Every request goes to the same
+// socket, so the per-host idle limit is the whole pool.
+const (
+	socketMaxIdleConns    = 64
+	socketIdleConnTimeout = 90 * time.Second
+	socketDialTimeout     = 5 * time.Second
+)
+
+// newUnixSocketClient returns a client sending every request to the Unix
+// socket at socketPath, whatever the request URL's host. Connections are kept
+// for reuse rather than redialed per request, and a target that accepts a
+// request but doesn't respond within timeout fails it.
+func newUnixSocketClient(socketPath string, timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: socketDialTimeout}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+			MaxIdleConns:          socketMaxIdleConns,
+			MaxIdleConnsPerHost:   socketMaxIdleConns,
+			IdleConnTimeout:       socketIdleConnTimeout,
+			ResponseHeaderTimeout: timeout,
+		},
+	}
+}